@@ -97,6 +97,11 @@ func NewConfig(ctx *cli.Context, log log.Logger) (*node.Config, error) {
 			ListenAddr: ctx.GlobalString(flags.MetricsAddrFlag.Name),
 			ListenPort: ctx.GlobalInt(flags.MetricsPortFlag.Name),
 		},
+		Dashboard: node.DashboardConfig{
+			Enabled:    ctx.GlobalBool(flags.DashboardEnabledFlag.Name),
+			ListenAddr: ctx.GlobalString(flags.DashboardAddrFlag.Name),
+			ListenPort: ctx.GlobalInt(flags.DashboardPortFlag.Name),
+		},
 		Pprof: oppprof.CLIConfig{
 			Enabled:    ctx.GlobalBool(flags.PprofEnabledFlag.Name),
 			ListenAddr: ctx.GlobalString(flags.PprofAddrFlag.Name),
@@ -105,6 +110,8 @@ func NewConfig(ctx *cli.Context, log log.Logger) (*node.Config, error) {
 		P2P: p2pConfig,
 		// 	P2PSigner:           p2pSignerSetup,
 		L1EpochPollInterval: ctx.GlobalDuration(flags.L1EpochPollIntervalFlag.Name),
+		KZGBackend:          ctx.GlobalString(flags.KZGBackend.Name),
+		KZGTrustedSetup:     ctx.GlobalString(flags.KZGTrustedSetup.Name),
 		// 	Heartbeat: node.HeartbeatConfig{
 		// 		Enabled: ctx.GlobalBool(flags.HeartbeatEnabledFlag.Name),
 		// 		Moniker: ctx.GlobalString(flags.HeartbeatMonikerFlag.Name),
@@ -133,12 +140,13 @@ func NewMinerConfig(ctx *cli.Context, client *ethclient.Client, l1Contract commo
 		return nil, err
 	}
 	cctx := context.Background()
-	randomChecks, err := readUintFromContract(cctx, client, l1Contract, "randomChecks")
+	contract := eth.NewStorageContract(l1Contract, client)
+	randomChecks, err := contract.RandomChecks(cctx)
 	if err != nil {
 		return nil, err
 	}
 	minerConfig.RandomChecks = randomChecks
-	nonceLimit, err := readUintFromContract(cctx, client, l1Contract, "nonceLimit")
+	nonceLimit, err := contract.NonceLimit(cctx)
 	if err != nil {
 		return nil, err
 	}
@@ -164,17 +172,17 @@ func NewMinerConfig(ctx *cli.Context, client *ethclient.Client, l1Contract commo
 	}
 	minerConfig.DcfFactor = dcf
 
-	startTime, err := readUintFromContract(cctx, client, l1Contract, "startTime")
+	startTime, err := contract.StartTime(cctx)
 	if err != nil {
 		return nil, err
 	}
 	minerConfig.StartTime = startTime
-	shardEntryBits, err := readUintFromContract(cctx, client, l1Contract, "shardEntryBits")
+	shardEntryBits, err := contract.ShardEntryBits(cctx)
 	if err != nil {
 		return nil, err
 	}
 	minerConfig.ShardEntry = 1 << shardEntryBits
-	treasuryShare, err := readUintFromContract(cctx, client, l1Contract, "treasuryShare")
+	treasuryShare, err := contract.TreasuryShare(cctx)
 	if err != nil {
 		return nil, err
 	}
@@ -242,25 +250,42 @@ func NewStorageConfig(ctx *cli.Context, client *ethclient.Client) (*storage.Stor
 		log.Error("Failed to load storage config from contract", "error", err)
 		return nil, err
 	}
+	shardMiners, err := storage.ParseShardMiners(ctx.GlobalStringSlice(flags.StorageShardMiners.Name))
+	if err != nil {
+		return nil, err
+	}
+	storageCfg.ShardMiners = shardMiners
 	storageCfg.Filenames = ctx.GlobalStringSlice(flags.StorageFiles.Name)
+	if ctx.GlobalIsSet(flags.StorageDiskMap.Name) {
+		diskMap, err := storage.LoadDiskMap(ctx.GlobalString(flags.StorageDiskMap.Name))
+		if err != nil {
+			return nil, err
+		}
+		storageCfg.Filenames = appendDiskMapFiles(storageCfg.Filenames, diskMap, ctx.GlobalString(flags.DataDir.Name))
+	}
+	storageCfg.VerifyOnOpen = ctx.GlobalBool(flags.StorageVerifyOnOpen.Name)
+	storageCfg.Mmap = ctx.GlobalBool(flags.StorageMmap.Name)
 	return storageCfg, nil
 }
 
 func NewL1EndpointConfig(ctx *cli.Context) (*eth.L1EndpointConfig, *ethclient.Client, error) {
-	l1NodeAddr := ctx.GlobalString(flags.L1NodeAddr.Name)
-	client, err := ethclient.DialContext(context.Background(), l1NodeAddr)
+	l1NodeAddrs := eth.SplitURLs(ctx.GlobalString(flags.L1NodeAddr.Name))
+	client, l1NodeAddr, err := eth.DialAvailable(context.Background(), l1NodeAddrs)
 	if err != nil {
-		log.Error("Failed to connect to the L1 RPC", "error", err, "l1Rpc", l1NodeAddr)
+		log.Error("Failed to connect to the L1 RPC", "error", err, "l1Rpc", l1NodeAddrs)
 		return nil, nil, err
 	}
 	return &eth.L1EndpointConfig{
 		L1ChainID:                    ctx.GlobalUint64(flags.L1ChainId.Name),
 		L1NodeAddr:                   l1NodeAddr,
+		L1NodeAddrs:                  l1NodeAddrs,
 		L1BeaconURL:                  ctx.GlobalString(flags.L1BeaconAddr.Name),
 		L1BeaconBasedTime:            ctx.GlobalUint64(flags.L1BeaconBasedTime.Name),
 		L1BeaconBasedSlot:            ctx.GlobalUint64(flags.L1BeaconBasedSlot.Name),
 		L1BeaconSlotTime:             ctx.GlobalUint64(flags.L1BeaconSlotTime.Name),
 		L1MinDurationForBlobsRequest: ctx.GlobalUint64(flags.L1MinDurationForBlobsRequest.Name),
+		L1MetaCacheSize:              ctx.GlobalInt(flags.L1MetaCacheSize.Name),
+		L1MetaBatchSize:              ctx.GlobalInt(flags.L1MetaBatchSize.Name),
 	}, client, nil
 }
 
@@ -0,0 +1,250 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
+)
+
+func TestCreateDataFileForce(t *testing.T) {
+	datadir := t.TempDir()
+	cfg := &storage.StorageConfig{
+		Miner:             common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"),
+		KvSize:            4096,
+		ChunkSize:         4096,
+		KvEntriesPerShard: 16,
+	}
+	shards := []uint64{0, 1, 2, 3, 4, 5}
+	files, err := createDataFile(cfg, shards, datadir, nil, ethstorage.ENCODE_KECCAK_256, false, ethstorage.AllocFull)
+	if err != nil {
+		t.Fatalf("createDataFile() error: %v", err)
+	}
+
+	// write some data to shard 1, and simulate an init interrupted before the header of shard 2 is written
+	data := bytes.Repeat([]byte{0xab}, int(cfg.ChunkSize))
+	df, err := ethstorage.OpenDataFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := df.Write(cfg.KvEntriesPerShard+3, data); err != nil {
+		t.Fatal(err)
+	}
+	df.Close()
+	if err := os.Truncate(files[2], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := createDataFile(cfg, shards, datadir, nil, ethstorage.ENCODE_KECCAK_256, false, ethstorage.AllocFull); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("expected ErrFileExists without force, got %v", err)
+	}
+	rerun, err := createDataFile(cfg, shards, datadir, nil, ethstorage.ENCODE_KECCAK_256, true, ethstorage.AllocFull)
+	if err != nil {
+		t.Fatalf("createDataFile() with force error: %v", err)
+	}
+	for i, file := range rerun {
+		if file != files[i] {
+			t.Fatalf("expected file %s, got %s", files[i], file)
+		}
+		df, err := ethstorage.OpenDataFile(file)
+		if err != nil {
+			t.Fatalf("open data file %s failed: %v", file, err)
+		}
+		if df.KvIdxStart() != shards[i]*cfg.KvEntriesPerShard || df.Miner() != cfg.Miner {
+			t.Errorf("unexpected header of %s: kvIdxStart %d, miner %s", file, df.KvIdxStart(), df.Miner())
+		}
+		df.Close()
+	}
+	df, err = ethstorage.OpenDataFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	got, err := df.Read(cfg.KvEntriesPerShard+3, int(cfg.ChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data of the reused file is lost")
+	}
+
+	// a file of another config is not reused
+	other := *cfg
+	other.Miner = common.HexToAddress("0x0000000000000000000000000000000000000b01")
+	if _, err := createDataFile(&other, shards, datadir, nil, ethstorage.ENCODE_KECCAK_256, true, ethstorage.AllocFull); err == nil {
+		t.Fatal("expected the data files of another miner to be refused")
+	}
+}
+
+func TestCreateDataFileForceKeepsUnreadableFile(t *testing.T) {
+	cfg := &storage.StorageConfig{
+		Miner:             common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"),
+		KvSize:            4096,
+		ChunkSize:         4096,
+		KvEntriesPerShard: 16,
+	}
+	tests := []struct {
+		name   string
+		offset int64
+		value  uint64
+	}{
+		{"bad version", 8, ethstorage.VERSION + 1},
+		{"corrupt header", 0, 0xdeadbeef},
+	}
+	for _, tt := range tests {
+		datadir := t.TempDir()
+		files, err := createDataFile(cfg, []uint64{0}, datadir, nil, ethstorage.ENCODE_KECCAK_256, false, ethstorage.AllocFull)
+		if err != nil {
+			t.Fatalf("createDataFile() error: %v", err)
+		}
+		f, err := os.OpenFile(files[0], os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt(binary.BigEndian.AppendUint64(nil, tt.value), tt.offset); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		before, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := createDataFile(cfg, []uint64{0}, datadir, nil, ethstorage.ENCODE_KECCAK_256, true, ethstorage.AllocFull); err == nil {
+			t.Fatalf("%s: expected createDataFile() with force to fail", tt.name)
+		}
+		after, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Fatalf("%s: data file is overwritten", tt.name)
+		}
+	}
+}
+
+func TestCreateDataFileChunkSizeZero(t *testing.T) {
+	cfg := &storage.StorageConfig{KvSize: 4096, KvEntriesPerShard: 16}
+	if _, err := createDataFile(cfg, []uint64{0}, t.TempDir(), nil, ethstorage.NO_ENCODE, false, ethstorage.AllocFull); !errors.Is(err, ErrChunkSizeZero) {
+		t.Fatalf("expected ErrChunkSizeZero, got %v", err)
+	}
+}
+
+func TestCreateDataFileDiskMap(t *testing.T) {
+	var (
+		datadir = t.TempDir()
+		disk0   = t.TempDir()
+		disk1   = filepath.Join(t.TempDir(), "shards")
+		mapFile = filepath.Join(datadir, "disk_map.json")
+		cfg     = &storage.StorageConfig{
+			Miner:             common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"),
+			KvSize:            4096,
+			ChunkSize:         4096,
+			KvEntriesPerShard: 16,
+		}
+	)
+	if err := os.WriteFile(mapFile, []byte(`{"0": "`+disk0+`", "1": "`+disk1+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diskMap, err := storage.LoadDiskMap(mapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := createDataFile(cfg, []uint64{0, 1, 2}, datadir, diskMap, ethstorage.ENCODE_KECCAK_256, false, ethstorage.AllocFull)
+	if err != nil {
+		t.Fatalf("createDataFile() error: %v", err)
+	}
+	expected := []string{
+		filepath.Join(disk0, "shard-0.dat"),
+		filepath.Join(disk1, "shard-1.dat"),
+		filepath.Join(datadir, "shard-2.dat"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected files %v, got %v", expected, files)
+	}
+
+	// the node opens the data files of the mapped shards besides the listed ones
+	opened := appendDiskMapFiles(expected[2:], diskMap, datadir)
+	if !reflect.DeepEqual(opened, []string{expected[2], expected[0], expected[1]}) {
+		t.Fatalf("unexpected data files to open %v", opened)
+	}
+	for i, file := range expected[:2] {
+		shardIdx := uint64(i)
+		df, err := ethstorage.OpenDataFile(file)
+		if err != nil {
+			t.Fatalf("open data file %s failed: %v", file, err)
+		}
+		data := bytes.Repeat([]byte{byte(0xa0 + i)}, int(cfg.ChunkSize))
+		chunkIdx := shardIdx*cfg.KvEntriesPerShard + 5
+		if err := df.Write(chunkIdx, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := df.Read(chunkIdx, int(cfg.ChunkSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if df.KvIdxStart() != shardIdx*cfg.KvEntriesPerShard || !bytes.Equal(got, data) {
+			t.Errorf("unexpected data file of shard %d: kvIdxStart %d", shardIdx, df.KvIdxStart())
+		}
+		df.Close()
+	}
+
+	if err := os.WriteFile(mapFile, []byte(`{"0": ""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadDiskMap(mapFile); err == nil {
+		t.Fatal("expected the disk map with an empty directory to be refused")
+	}
+}
+
+// mockContract serves the uint fields of the storage contract by their getter selectors.
+type mockContract map[string]uint64
+
+func (c mockContract) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	for name, v := range c {
+		if bytes.Equal(msg.Data, crypto.Keccak256([]byte(name + "()"))[0:4]) {
+			return common.BigToHash(new(big.Int).SetUint64(v)).Bytes(), nil
+		}
+	}
+	return nil, errors.New("execution reverted")
+}
+
+func TestDetectShardLen(t *testing.T) {
+	const kvEntries = 1024
+	tests := []struct {
+		lastKvIdx uint64
+		want      int
+	}{
+		{0, 1},
+		{1, 1},
+		{kvEntries, 1},
+		{2*kvEntries + 1, 3},
+		{3 * kvEntries, 3},
+	}
+	for _, tt := range tests {
+		got, err := detectShardLen(context.Background(), mockContract{"lastKvIdx": tt.lastKvIdx}, common.Address{}, kvEntries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("lastKvIdx %d: expected shard length %d, got %d", tt.lastKvIdx, tt.want, got)
+		}
+	}
+	if _, err := detectShardLen(context.Background(), mockContract{}, common.Address{}, kvEntries); err == nil {
+		t.Fatal("expected the error of the contract call")
+	}
+}
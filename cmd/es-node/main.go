@@ -17,13 +17,15 @@ import (
 
 	oppprof "github.com/ethereum-optimism/optimism/op-service/pprof"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
 	"github.com/ethstorage/go-ethstorage/ethstorage/flags"
 	eslog "github.com/ethstorage/go-ethstorage/ethstorage/log"
 	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
 	"github.com/ethstorage/go-ethstorage/ethstorage/node"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
 	"github.com/urfave/cli"
 )
 
@@ -75,11 +77,11 @@ func main() {
 			Name:      "init",
 			Aliases:   []string{"i"},
 			Usage:     `Init storage node by creating a data file for each shard. Type 'es-node init --help' for more information.`,
-			UsageText: `You can specify shard_len (the number of shards) or shard_index (the index of specified shard, and you can specify more than one) to mine. If both appears, shard_index takes precedence. `,
+			UsageText: `You can specify shard_len (the number of shards) or shard_index (the index of specified shard, and you can specify more than one) to mine. If both appears, shard_index takes precedence. If neither is specified, shard_len is the number of shards holding the blobs stored in the contract. `,
 			Flags: []cli.Flag{
 				cli.Uint64Flag{
 					Name:  shardLenFlagName,
-					Usage: "Number of shards to mine. Will create one data file per shard.",
+					Usage: "Number of shards to mine. Will create one data file per shard. Detected from the contract if not specified.",
 				},
 				cli.IntFlag{
 					Name:  encodingTypeFlagName,
@@ -90,13 +92,48 @@ func main() {
 					Name:  shardIndexFlagName,
 					Usage: "Indexes of shards to mine. Will create one data file per shard.",
 				},
+				cli.BoolFlag{
+					Name:  forceFlagName,
+					Usage: "Reuse the existing data files matching the shards instead of failing, so an interrupted init can be re-run.",
+				},
+				cli.BoolFlag{
+					Name:  sparseFlagName,
+					Usage: "Create the data files without allocating their disk space, which suits the lazy empty fill of the sync. Same as --alloc sparse.",
+				},
+				cli.StringFlag{
+					Name: allocFlagName,
+					Usage: "How the disk space of the data files is allocated: 'full' allocates it up front, 'sparse' sizes the files " +
+						"without allocating the space, 'none' lets the files grow as they are written, for the filesystems " +
+						"supporting neither preallocation nor sparse files.",
+					Value: string(ethstorage.AllocFull),
+				},
 				flags.DataDir,
+				flags.StorageDiskMap,
 				flags.L1NodeAddr,
 				flags.StorageL1Contract,
 				flags.StorageMiner,
+				flags.StorageShardMiners,
 			},
 			Action: EsNodeInit,
 		},
+		{
+			Name:      "plan-shards",
+			Usage:     `Suggest the shards to serve within a disk budget. Type 'es-node plan-shards --help' for more information.`,
+			UsageText: `The shards advertised by the peers are read from a JSON file in the format of the static peers, i.e. [{"shards": [{"Contract": "0x...", "ShardIds": [0, 1]}]}, ...]. The shards served by the fewest peers are suggested first.`,
+			Flags: []cli.Flag{
+				cli.Uint64Flag{
+					Name:  availableFlagName,
+					Usage: "Disk space in bytes available for the data files.",
+				},
+				cli.StringFlag{
+					Name:  peersFlagName,
+					Usage: "JSON file of the shards advertised by the peers. All the shards are unserved if not specified.",
+				},
+				flags.L1NodeAddr,
+				flags.StorageL1Contract,
+			},
+			Action: EsNodePlanShards,
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -157,7 +194,7 @@ func EsNodeMain(ctx *cli.Context) error {
 	end := ctx.GlobalUint64(flags.TestSimpleSyncEndFlag.Name)
 	if end > start {
 		log.Info("Start force sync", "start", start, "end", end)
-		n.RequestL2Range(context.Background(), start, end)
+		n.RequestL2Range(context.Background(), cfg.Storage.L1Contract, start, end)
 	}
 
 	interruptChannel := make(chan os.Signal, 1)
@@ -188,6 +225,12 @@ func EsNodeInit(ctx *cli.Context) error {
 	}
 
 	datadir := readRequiredFlag(ctx, flags.DataDir.Name)
+	lock, err := node.LockDataDir(datadir, log)
+	if err != nil {
+		log.Error("Failed to lock datadir", "error", err)
+		return err
+	}
+	defer lock.Release()
 	encodingType := ethstorage.ENCODE_BLOB_POSEIDON
 	miner := "0x"
 	if ctx.IsSet(encodingTypeFlagName) {
@@ -197,7 +240,19 @@ func EsNodeInit(ctx *cli.Context) error {
 			return fmt.Errorf("encoding_type must be an integer between 0 and 3")
 		}
 	}
-	if encodingType != ethstorage.NO_ENCODE {
+	alloc, err := ethstorage.ParseAllocStrategy(ctx.String(allocFlagName))
+	if err != nil {
+		return err
+	}
+	if ctx.Bool(sparseFlagName) && !ctx.IsSet(allocFlagName) {
+		alloc = ethstorage.AllocSparse
+	}
+	shardMiners, err := storage.ParseShardMiners(ctx.StringSlice(flags.StorageShardMiners.Name))
+	if err != nil {
+		return err
+	}
+	// the miner may be omitted if all the shards have their own miners, which is checked with the shard list
+	if encodingType != ethstorage.NO_ENCODE && (ctx.IsSet(flags.StorageMiner.Name) || len(shardMiners) == 0) {
 		miner = readRequiredFlag(ctx, flags.StorageMiner.Name)
 		if !common.IsHexAddress(miner) {
 			return fmt.Errorf("invalid miner address %s", miner)
@@ -207,15 +262,11 @@ func EsNodeInit(ctx *cli.Context) error {
 	log.Info("Read flag", "name", shardIndexFlagName, "value", shardIndexes)
 	shardLen := 0
 	if len(shardIndexes) == 0 {
-		shards := ctx.Int(shardLenFlagName)
-		log.Info("Read flag", "name", shardLenFlagName, "value", shards)
-		if shards == 0 {
-			return fmt.Errorf("shard_len or shard_index must be specified")
-		}
-		shardLen = shards
+		shardLen = ctx.Int(shardLenFlagName)
+		log.Info("Read flag", "name", shardLenFlagName, "value", shardLen)
 	}
 	cctx := context.Background()
-	client, err := ethclient.DialContext(cctx, l1Rpc)
+	client, _, err := eth.DialAvailable(cctx, eth.SplitURLs(l1Rpc))
 	if err != nil {
 		log.Error("Failed to connect to the Ethereum client", "error", err, "l1Rpc", l1Rpc)
 		return err
@@ -228,6 +279,7 @@ func EsNodeInit(ctx *cli.Context) error {
 		log.Error("Failed to load storage config", "error", err)
 		return err
 	}
+	storageCfg.ShardMiners = shardMiners
 	log.Info("Storage config loaded", "storageCfg", storageCfg)
 	var shardIdxList []uint64
 	if len(shardIndexes) > 0 {
@@ -247,6 +299,18 @@ func EsNodeInit(ctx *cli.Context) error {
 			shardIdxList = append(shardIdxList, shard)
 		}
 	} else {
+		required, err := detectShardLen(cctx, client, l1Contract, storageCfg.KvEntriesPerShard)
+		if err != nil {
+			log.Error("Failed to get the number of shards from contract", "error", err)
+			return err
+		}
+		if shardLen == 0 {
+			shardLen = required
+			log.Info("Shard length detected from contract", "shardLen", shardLen)
+		} else if shardLen < required {
+			log.Warn("Fewer shards than the blobs stored in the contract span, the data will be incomplete",
+				"shardLen", shardLen, "required", required)
+		}
 		// get shard indexes of length shardLen from contract
 		shardList, err := getShardList(cctx, client, l1Contract, shardLen)
 		if err != nil {
@@ -258,7 +322,20 @@ func EsNodeInit(ctx *cli.Context) error {
 		}
 		shardIdxList = shardList
 	}
-	files, err := createDataFile(storageCfg, shardIdxList, datadir, encodingType)
+	if encodingType != ethstorage.NO_ENCODE {
+		for _, shardIdx := range shardIdxList {
+			if storageCfg.MinerOf(shardIdx) == (common.Address{}) {
+				return fmt.Errorf("miner of shard %d is not specified", shardIdx)
+			}
+		}
+	}
+	var diskMap storage.DiskMap
+	if ctx.IsSet(flags.StorageDiskMap.Name) {
+		if diskMap, err = storage.LoadDiskMap(ctx.String(flags.StorageDiskMap.Name)); err != nil {
+			return err
+		}
+	}
+	files, err := createDataFile(storageCfg, shardIdxList, datadir, diskMap, encodingType, ctx.Bool(forceFlagName), alloc)
 	if err != nil {
 		log.Error("Failed to create data file", "error", err)
 		return err
@@ -270,3 +347,64 @@ func EsNodeInit(ctx *cli.Context) error {
 	}
 	return nil
 }
+
+func EsNodePlanShards(ctx *cli.Context) error {
+	logCfg := eslog.ReadCLIConfig(ctx)
+	if err := logCfg.Check(); err != nil {
+		log.Error("Unable to create the log config", "error", err)
+		return err
+	}
+	log := eslog.NewLogger(logCfg)
+	l1Rpc := readRequiredFlag(ctx, flags.L1NodeAddr.Name)
+	contract := readRequiredFlag(ctx, flags.StorageL1Contract.Name)
+	if !common.IsHexAddress(contract) {
+		return fmt.Errorf("invalid contract address %s", contract)
+	}
+	if !ctx.IsSet(availableFlagName) {
+		return fmt.Errorf("flag %s is required", availableFlagName)
+	}
+	available := ctx.Uint64(availableFlagName)
+	var (
+		peers [][]*protocol.ContractShards
+		err   error
+	)
+	if file := ctx.String(peersFlagName); file != "" {
+		if peers, err = readPeerShards(file); err != nil {
+			log.Error("Failed to read the peer shards", "file", file, "error", err)
+			return err
+		}
+	}
+
+	cctx := context.Background()
+	client, _, err := eth.DialAvailable(cctx, eth.SplitURLs(l1Rpc))
+	if err != nil {
+		log.Error("Failed to connect to the Ethereum client", "error", err, "l1Rpc", l1Rpc)
+		return err
+	}
+	defer client.Close()
+
+	l1Contract := common.HexToAddress(contract)
+	storageCfg, err := initStorageConfig(cctx, client, l1Contract, common.Address{})
+	if err != nil {
+		log.Error("Failed to load storage config", "error", err)
+		return err
+	}
+	shardCount, err := detectShardLen(cctx, client, l1Contract, storageCfg.KvEntriesPerShard)
+	if err != nil {
+		log.Error("Failed to get the number of shards from contract", "error", err)
+		return err
+	}
+	plan := protocol.PlanShards(l1Contract, uint64(shardCount), storageCfg.KvSize, storageCfg.KvEntriesPerShard, available, peers)
+	if len(plan) == 0 {
+		log.Warn("No shard fits the available space", "available", available, "shardSize", storageCfg.KvSize*storageCfg.KvEntriesPerShard)
+		return nil
+	}
+	var args []string
+	for _, s := range plan {
+		log.Info("Shard suggested", "shard", s.ShardId, "providers", s.Providers)
+		args = append(args, fmt.Sprintf("--%s %d", shardIndexFlagName, s.ShardId))
+	}
+	log.Info("Shards planned", "shards", len(plan), "total", shardCount, "peers", len(peers))
+	fmt.Println(strings.Join(args, " "))
+	return nil
+}
@@ -5,11 +5,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
@@ -18,37 +21,64 @@ import (
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
 	es "github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
 	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
 	"github.com/urfave/cli"
 )
 
 const (
-	fileName             = "shard-%d.dat"
 	shardLenFlagName     = "shard_len"
 	shardIndexFlagName   = "shard_index"
 	encodingTypeFlagName = "encoding_type"
+	forceFlagName        = "force"
+	sparseFlagName       = "sparse"
+	allocFlagName        = "alloc"
+	availableFlagName    = "available"
+	peersFlagName        = "peers"
+
+	// createDataFileWorkers bounds the data files created at a time.
+	createDataFileWorkers = 4
+)
+
+var (
+	// ErrFileExists is returned by createDataFile if a data file exists and is not reused.
+	ErrFileExists = errors.New("data file already exists")
+	// ErrChunkSizeZero is returned by createDataFile if the chunk size of the config is 0.
+	ErrChunkSizeZero = errors.New("chunk size should not be 0")
 )
 
-func initStorageConfig(ctx context.Context, client *ethclient.Client, l1Contract, miner common.Address) (*storage.StorageConfig, error) {
-	maxKvSizeBits, err := readUintFromContract(ctx, client, l1Contract, "maxKvSizeBits")
+func initStorageConfig(ctx context.Context, client ethereum.ContractCaller, l1Contract, miner common.Address) (*storage.StorageConfig, error) {
+	contract := eth.NewStorageContract(l1Contract, client)
+	maxKvSizeBits, err := contract.MaxKvSizeBits(ctx)
 	if err != nil {
 		return nil, err
 	}
 	chunkSizeBits := maxKvSizeBits
-	shardEntryBits, err := readUintFromContract(ctx, client, l1Contract, "shardEntryBits")
+	shardEntryBits, err := contract.ShardEntryBits(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &storage.StorageConfig{
+	log.Info("Read storage layout from contract", "maxKvSizeBits", maxKvSizeBits, "shardEntryBits", shardEntryBits)
+	// shifting by 64 or more bits would silently wrap to 0
+	if maxKvSizeBits >= 64 || shardEntryBits >= 64 {
+		return nil, fmt.Errorf("invalid storage layout from contract: maxKvSizeBits %d, shardEntryBits %d", maxKvSizeBits, shardEntryBits)
+	}
+	cfg := &storage.StorageConfig{
 		L1Contract:        l1Contract,
 		Miner:             miner,
 		KvSize:            1 << maxKvSizeBits,
 		ChunkSize:         1 << chunkSizeBits,
 		KvEntriesPerShard: 1 << shardEntryBits,
-	}, nil
+	}
+	if err := cfg.Check(); err != nil {
+		return nil, fmt.Errorf("invalid storage layout from contract: %w", err)
+	}
+	return cfg, nil
 }
 
-func readSlotFromContract(ctx context.Context, client *ethclient.Client, l1Contract common.Address, fieldName string) ([]byte, error) {
+func readSlotFromContract(ctx context.Context, client ethereum.ContractCaller, l1Contract common.Address, fieldName string) ([]byte, error) {
 	h := crypto.Keccak256Hash([]byte(fieldName + "()"))
 	msg := ethereum.CallMsg{
 		To:   &l1Contract,
@@ -61,24 +91,41 @@ func readSlotFromContract(ctx context.Context, client *ethclient.Client, l1Contr
 	return bs, nil
 }
 
-func readUintFromContract(ctx context.Context, client *ethclient.Client, l1Contract common.Address, fieldName string) (uint64, error) {
+func readBigIntFromContract(ctx context.Context, client *ethclient.Client, l1Contract common.Address, fieldName string) (*big.Int, error) {
 	bs, err := readSlotFromContract(ctx, client, l1Contract, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	value := new(big.Int).SetBytes(bs)
+	log.Info("Read big int from contract", "field", fieldName, "value", value)
+	return new(big.Int).SetBytes(bs), nil
+}
+
+// detectShardLen returns the number of shards holding the blobs stored in the contract so far, which is
+// at least 1.
+func detectShardLen(ctx context.Context, client ethereum.ContractCaller, l1Contract common.Address, kvEntriesPerShard uint64) (int, error) {
+	lastKvIdx, err := eth.NewStorageContract(l1Contract, client).LastKvIdx(ctx)
 	if err != nil {
 		return 0, err
 	}
-	value := new(big.Int).SetBytes(bs).Uint64()
-	log.Info("Read uint from contract", "field", fieldName, "value", value)
-	return value, nil
+	return max(1, int((lastKvIdx+kvEntriesPerShard-1)/kvEntriesPerShard)), nil
 }
 
-func readBigIntFromContract(ctx context.Context, client *ethclient.Client, l1Contract common.Address, fieldName string) (*big.Int, error) {
-	bs, err := readSlotFromContract(ctx, client, l1Contract, fieldName)
+// readPeerShards reads the shards advertised by the peers from a JSON file of static peers.
+func readPeerShards(file string) ([][]*protocol.ContractShards, error) {
+	b, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	value := new(big.Int).SetBytes(bs)
-	log.Info("Read big int from contract", "field", fieldName, "value", value)
-	return new(big.Int).SetBytes(bs), nil
+	var peers []p2p.StaticPeer
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, err
+	}
+	shards := make([][]*protocol.ContractShards, 0, len(peers))
+	for _, p := range peers {
+		shards = append(shards, p.Shards)
+	}
+	return shards, nil
 }
 
 func getShardList(ctx context.Context, client *ethclient.Client, contract common.Address, shardLen int) ([]uint64, error) {
@@ -142,41 +189,115 @@ func getDifficulty(ctx context.Context, client *ethclient.Client, contract commo
 	return res[1].(*big.Int), nil
 }
 
-func createDataFile(cfg *storage.StorageConfig, shardIdxList []uint64, datadir string, encodingType int) ([]string, error) {
-	log.Info("Creating data files", "shardIdxList", shardIdxList, "dataDir", datadir)
+// createDataFile creates the data files of the shards in parallel, as the fallocate of a large shard takes
+// a while. With force, an existing data file is reused if its header matches the config, so an interrupted
+// init can be re-run; a file without a valid header, whose creation did not complete, is created again.
+// The disk space of the data files is allocated by the alloc strategy, see es.AllocStrategy.
+// The data file of a shard is placed in its directory of the disk map, or in the datadir if not mapped.
+func createDataFile(cfg *storage.StorageConfig, shardIdxList []uint64, datadir string, diskMap storage.DiskMap, encodingType int,
+	force bool, alloc es.AllocStrategy) ([]string, error) {
+	log.Info("Creating data files", "shardIdxList", shardIdxList, "dataDir", datadir, "diskMap", diskMap, "force", force, "alloc", alloc)
 	if _, err := os.Stat(datadir); os.IsNotExist(err) {
 		if err := os.Mkdir(datadir, 0755); err != nil {
 			log.Error("Creating data directory", "error", err)
 			return nil, err
 		}
 	}
-	var files []string
-	for _, shardIdx := range shardIdxList {
-		dataFile := filepath.Join(datadir, fmt.Sprintf(fileName, shardIdx))
-		if _, err := os.Stat(dataFile); err == nil {
+	if cfg.ChunkSize == 0 {
+		return nil, ErrChunkSizeZero
+	}
+	if cfg.KvSize%cfg.ChunkSize != 0 {
+		return nil, fmt.Errorf("max kv size %% chunk size should be 0")
+	}
+
+	var (
+		files = make([]string, len(shardIdxList))
+		errs  = make([]error, len(shardIdxList))
+		sem   = make(chan struct{}, createDataFileWorkers)
+		wg    sync.WaitGroup
+	)
+	for i, shardIdx := range shardIdxList {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, shardIdx uint64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			files[i], errs[i] = createShardFile(cfg, shardIdx, diskMap.DataFile(datadir, shardIdx), encodingType, force, alloc)
+		}(i, shardIdx)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func createShardFile(cfg *storage.StorageConfig, shardIdx uint64, dataFile string, encodingType int, force bool, alloc es.AllocStrategy) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dataFile), 0755); err != nil {
+		log.Error("Creating data directory", "error", err)
+		return "", err
+	}
+	chunkPerKv := cfg.KvSize / cfg.ChunkSize
+	startChunkId := shardIdx * cfg.KvEntriesPerShard * chunkPerKv
+	chunkIdxLen := chunkPerKv * cfg.KvEntriesPerShard
+	miner := cfg.MinerOf(shardIdx)
+	if _, err := os.Stat(dataFile); err == nil {
+		if !force {
 			log.Error("Creating data file", "error", "file already exists, will not overwrite", "file", dataFile)
-			return nil, err
+			return "", fmt.Errorf("%w: %s", ErrFileExists, dataFile)
 		}
-		if cfg.ChunkSize == 0 {
-			return nil, fmt.Errorf("chunk size should not be 0")
+		df, err := es.OpenDataFile(dataFile)
+		if err == nil {
+			defer df.Close()
+			if df.KvIdxStart() != shardIdx*cfg.KvEntriesPerShard || df.KvIdxEnd() != (shardIdx+1)*cfg.KvEntriesPerShard ||
+				df.MaxKvSize() != cfg.KvSize || df.ChunkSize() != cfg.ChunkSize ||
+				df.EncodeType() != uint64(encodingType) || df.Miner() != miner {
+				return "", fmt.Errorf("data file %s does not match the config of shard %d", dataFile, shardIdx)
+			}
+			log.Info("Data file reused", "shard", shardIdx, "file", dataFile, "miner", df.Miner())
+			return dataFile, nil
 		}
-		if cfg.KvSize%cfg.ChunkSize != 0 {
-			return nil, fmt.Errorf("max kv size %% chunk size should be 0")
+		// only a file whose creation was interrupted before its header was written is recreated,
+		// any other error may come from a valid data file which must not be overwritten
+		if !errors.Is(err, es.ErrIncompleteHeader) {
+			log.Error("Opening existing data file", "file", dataFile, "error", err)
+			return "", err
 		}
-		chunkPerKv := cfg.KvSize / cfg.ChunkSize
-		startChunkId := shardIdx * cfg.KvEntriesPerShard * chunkPerKv
-		chunkIdxLen := chunkPerKv * cfg.KvEntriesPerShard
-		log.Info("Creating data file", "chunkIdxStart", startChunkId, "chunkIdxLen", chunkIdxLen, "chunkSize", cfg.ChunkSize, "miner", cfg.Miner, "encodeType", encodingType)
+		log.Warn("Recreating incomplete data file", "file", dataFile, "error", err)
+	}
+	log.Info("Creating data file", "chunkIdxStart", startChunkId, "chunkIdxLen", chunkIdxLen, "chunkSize", cfg.ChunkSize, "miner", miner, "encodeType", encodingType, "alloc", alloc)
 
-		df, err := es.Create(dataFile, startChunkId, chunkPerKv*cfg.KvEntriesPerShard, 0, cfg.KvSize, uint64(encodingType), cfg.Miner, cfg.ChunkSize)
-		if err != nil {
-			log.Error("Creating data file", "error", err)
-			return nil, err
+	df, err := es.CreateWithStrategy(dataFile, alloc, startChunkId, chunkIdxLen, 0, cfg.KvSize, uint64(encodingType), miner, cfg.ChunkSize)
+	if err != nil {
+		log.Error("Creating data file", "error", err)
+		return "", err
+	}
+	defer df.Close()
+	log.Info("Data file created", "shard", shardIdx, "file", dataFile, "kvIdxStart", df.KvIdxStart(), "kvIdxEnd", df.KvIdxEnd(), "miner", df.Miner())
+	return dataFile, nil
+}
+
+// appendDiskMapFiles appends the data files of the shards in the disk map to the files, skipping the ones
+// already listed.
+func appendDiskMapFiles(files []string, diskMap storage.DiskMap, datadir string) []string {
+	listed := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		listed[filepath.Clean(f)] = struct{}{}
+	}
+	shards := make([]uint64, 0, len(diskMap))
+	for shardIdx := range diskMap {
+		shards = append(shards, shardIdx)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	for _, shardIdx := range shards {
+		f := diskMap.DataFile(datadir, shardIdx)
+		if _, ok := listed[f]; !ok {
+			files = append(files, f)
 		}
-		log.Info("Data file created", "shard", shardIdx, "file", dataFile, "kvIdxStart", df.KvIdxStart(), "kvIdxEnd", df.KvIdxEnd(), "miner", df.Miner())
-		files = append(files, dataFile)
 	}
-	return files, nil
+	return files
 }
 
 func sortBigIntSlice(slice []*big.Int) []int {
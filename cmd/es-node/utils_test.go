@@ -64,7 +64,7 @@ func TestCreateDataFile(t *testing.T) {
 			if err != nil {
 				t.Fatalf("getShardList() error: %v ", err)
 			}
-			files, err := createDataFile(tt.args.cfg, shardList, ".", ethstorage.ENCODE_BLOB_POSEIDON)
+			files, err := createDataFile(tt.args.cfg, shardList, ".", nil, ethstorage.ENCODE_BLOB_POSEIDON, false, ethstorage.AllocFull)
 			if err != nil {
 				t.Fatalf("createDataFile() error: %v ", err)
 			}
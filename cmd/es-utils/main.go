@@ -5,23 +5,35 @@ package main
 
 import (
 	"bufio"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/ethstorage/go-ethstorage/cmd/es-utils/utils"
 	es "github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol/selftest"
+	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
+	"github.com/holiman/uint256"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var (
@@ -30,6 +42,8 @@ var (
 	miner      *string
 	dumpFolder *string
 	filenames  *[]string
+	diskMap    *string
+	refFiles   *[]string
 
 	verbosity *int
 
@@ -46,6 +60,7 @@ var (
 	commitString *string
 	encodeType   *uint64
 	readEncoded  *bool
+	verifyOnOpen *bool
 
 	sampleIdx *uint64
 
@@ -55,6 +70,21 @@ var (
 	contractAddr *string
 	chainId      *string
 	privateKeys  *[]string
+	keystoreFile *string
+	password     *string
+	passwordFile *string
+	gasTipCap    *string
+	gasLimit     *uint64
+	signerURL    *string
+	signerAddr   *string
+	metricsAddr  *string
+	blobFeeCap   *string
+	nonceGapTTL  *time.Duration
+	nodeRPC      *string
+	output       *string
+	decodeOutput *bool
+	kvCount      *uint64
+	e2eTimeout   *time.Duration
 )
 
 var CreateCmd = &cobra.Command{
@@ -111,6 +141,44 @@ var BlobWriteCmd = &cobra.Command{
 	Run:   runWriteBlob,
 }
 
+var ShardVerifyCmd = &cobra.Command{
+	Use:   "shard_verify",
+	Short: "Verify the KVs of a data shard against a reference data shard",
+	Run:   runShardVerify,
+}
+
+var ContractVerifyCmd = &cobra.Command{
+	Use:   "contract_verify",
+	Short: "Verify the KVs of data shards against the data hashes stored in the contract",
+	Run:   runContractVerify,
+}
+
+var ChecksumBackfillCmd = &cobra.Command{
+	Use:   "checksum_backfill",
+	Short: "Compute the chunk checksums of data files created without them",
+	Run:   runChecksumBackfill,
+}
+
+var CompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Free the disk space of the KVs filled with empty at the tail of data files, beyond the last KV index of the contract",
+	Long:  "Free the disk space of the KVs filled with empty at the tail of data files, beyond the last KV index of the contract. The blocks of the KVs are deallocated by punching holes, so the size of the data files is unchanged while the disk usage shrinks. Punching holes is only supported on Linux.",
+	Run:   runCompact,
+}
+
+var BlobDownloadCmd = &cobra.Command{
+	Use:   "blob_download",
+	Short: "Download the blobs of a KV range from an es-node and verify them against the contract commits",
+	Run:   runBlobDownload,
+}
+
+var E2ECmd = &cobra.Command{
+	Use:   "e2e",
+	Short: "Generate blobs, sync them between two in-process nodes and verify every blob synced",
+	Long:  "Generate blobs, sync them between two in-process nodes and verify every blob synced. kv_size and chunk_size default to the blob size of 131072 here.",
+	Run:   runE2E,
+}
+
 var BlobUploadCmd = &cobra.Command{
 	Use:   "blob_upload",
 	Short: "Upload blobs",
@@ -120,8 +188,23 @@ var BlobUploadCmd = &cobra.Command{
 func init() {
 	kvLen = CreateCmd.Flags().Uint64("kv_len", 0, "kv idx len to create")
 	chunkLen = CreateCmd.Flags().Uint64("chunk_len", 0, "Chunks idx len to create")
+	refFiles = ShardVerifyCmd.Flags().StringArray("ref_filename", []string{}, "Data filename of the reference shard")
+	keystoreFile = BlobUploadCmd.Flags().String("keystore", "", "go-ethereum keystore file of the key to upload the blobs, which cannot be used with private_key")
+	password = BlobUploadCmd.Flags().String("password", "", "Password of the keystore, prompted for on the terminal if neither password nor password_file is given")
+	passwordFile = BlobUploadCmd.Flags().String("password_file", "", "File with the password of the keystore")
+	gasTipCap = BlobUploadCmd.Flags().String("max_priority_fee_per_gas", "200000000", "Max priority fee per gas of the blob transactions, the suggested gas price if empty")
+	gasLimit = BlobUploadCmd.Flags().Uint64("gas_limit", 210000, "Gas limit of the blob transactions")
+	blobFeeCap = BlobUploadCmd.Flags().String("max_fee_per_blob_gas", "300000000", "Max fee per blob gas of the blob transactions, estimated from the latest block if empty")
+	nodeRPC = BlobDownloadCmd.Flags().String("node_rpc", "http://127.0.0.1:9545", "RPC URL of the es-node to download the blobs from")
+	output = BlobDownloadCmd.Flags().String("output", "", "File to reassemble the downloaded blobs into, in the order of the KVs")
+	decodeOutput = BlobDownloadCmd.Flags().Bool("decode", false, "Strip the padding byte of each 32 bytes when reassembling, for the data uploaded with encoding")
+	kvCount = E2ECmd.Flags().Uint64("kv_count", 12, "Number of KVs with data in the shard, the rest are synced as empty blobs")
+	e2eTimeout = E2ECmd.Flags().Duration("timeout", time.Minute, "Time to wait for the sync to finish")
+	nonceGapTTL = BlobUploadCmd.Flags().Duration("nonce_gap_timeout", utils.DefaultNonceGapTimeout, "Time a nonce gap left by a dropped blob transaction may last before the transaction is resubmitted with bumped fees")
+	metricsAddr = BlobUploadCmd.Flags().String("metrics.addr", "", "Address to serve the upload metrics on, e.g. 127.0.0.1:7301; the receipts are only awaited if set")
 
 	filenames = rootCmd.PersistentFlags().StringArray("filename", []string{}, "Data filename")
+	diskMap = rootCmd.PersistentFlags().String("disk_map", "", "JSON file mapping the shard indexes to the directories of their data files, to find the data file of shard_idx if no filename is given")
 	dumpFolder = rootCmd.PersistentFlags().String("dump_folder", "", "Data dump folder")
 	miner = rootCmd.PersistentFlags().String("miner", "", "miner address")
 	verbosity = rootCmd.PersistentFlags().Int("verbosity", 3, "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail")
@@ -133,12 +216,13 @@ func init() {
 	readStart = rootCmd.PersistentFlags().Uint64("read_start", 0, "Start index for KV reading")
 	readEnd = rootCmd.PersistentFlags().Uint64("read_end", 1, "End index for KV reading")
 	kvEntries = rootCmd.PersistentFlags().Uint64("kv_entries", 0, "Number of KV entries in the shard")
-	encodeType = rootCmd.PersistentFlags().Uint64("encode_type", 0, "Encode Type, 0=no, 1=simple, 2=ethash")
+	encodeType = rootCmd.PersistentFlags().Uint64("encode_type", 0, "Encode Type, 0=no, 1=keccak256, 2=ethash, 3=blob poseidon")
 	chunkSize = rootCmd.PersistentFlags().Uint64("chunk_size", 4096, "Chunk size to encode/decode")
 
 	readLen = rootCmd.PersistentFlags().Uint64("readlen", 0, "Bytes to read (only for unmasked read)")
 	commitString = rootCmd.PersistentFlags().String("commit", "", "encode key")
 	readEncoded = rootCmd.PersistentFlags().Bool("read_encoded", false, "Read encoded KV data")
+	verifyOnOpen = rootCmd.PersistentFlags().Bool("verify_on_open", false, "Check a sample of the KVs against their commits when opening data files")
 
 	sampleIdx = rootCmd.PersistentFlags().Uint64("sample_idx", 0, "Sample idx to read")
 
@@ -149,7 +233,9 @@ func init() {
 	contractAddr = rootCmd.PersistentFlags().String("contract_addr", "0xc443DA12Ec34b2677F9a2755f3738879bEBe0db7", "L1 EthStorage contract address")
 	chainId = rootCmd.PersistentFlags().String("chain_id", "3151908", "L1 Chain Id")
 
-	privateKeys = rootCmd.PersistentFlags().StringArray("private_key", []string{}, "Private keys to upload the blobs")
+	privateKeys = rootCmd.PersistentFlags().StringArray("private_key", []string{}, "Private keys to upload the blobs, which are kept in the shell history, see keystore of blob_upload")
+	signerURL = rootCmd.PersistentFlags().String("signer_url", "", "Endpoint of a remote signer to upload the blobs, used with signer_address")
+	signerAddr = rootCmd.PersistentFlags().String("signer_address", "", "Address the remote signer uploads the blobs from")
 }
 
 func setupLogger() {
@@ -321,24 +407,223 @@ func runMetaRead(cmd *cobra.Command, args []string) {
 }
 
 func initDataShard() *es.DataShard {
-	ds := es.NewDataShard(*shardIdx, *kvSize, *kvEntries, *chunkSize)
-	for _, filename := range *filenames {
-		var err error
-		var df *es.DataFile
-		df, err = es.OpenDataFile(filename)
+	files := *filenames
+	if len(files) == 0 && *diskMap != "" {
+		m, err := storage.LoadDiskMap(*diskMap)
 		if err != nil {
-			log.Crit("Open failed", "error", err)
+			log.Crit("Load disk map failed", "error", err)
 		}
-		err = ds.AddDataFile(df)
+		files = []string{m.DataFile(".", *shardIdx)}
+	}
+	ds, err := openDataShard(files)
+	if err != nil {
+		log.Crit("Open failed", "error", err)
+	}
+	return ds
+}
+
+// openDataShard opens the data files of the shard, and leaves to the command whether to exit on an error.
+func openDataShard(files []string) (*es.DataShard, error) {
+	ds := es.NewDataShard(*shardIdx, *kvSize, *kvEntries, *chunkSize)
+	for _, filename := range files {
+		df, err := es.OpenDataFile(filename)
 		if err != nil {
-			log.Crit("Open failed", "error", err)
+			return nil, fmt.Errorf("open data file %s: %w", filename, err)
+		}
+		if *verifyOnOpen {
+			if err := verifyDataFile(filename, df); err != nil {
+				return nil, err
+			}
+		}
+		if err := ds.AddDataFile(df); err != nil {
+			return nil, fmt.Errorf("add data file %s: %w", filename, err)
 		}
 	}
 
 	if !ds.IsComplete() {
 		log.Warn("Shard is not completed")
 	}
-	return ds
+	return ds, nil
+}
+
+func runShardVerify(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	if len(*refFiles) == 0 {
+		log.Crit("Must provide reference filenames")
+	}
+	ds := initDataShard()
+	ref, err := openDataShard(*refFiles)
+	if err != nil {
+		log.Crit("Open reference failed", "error", err)
+	}
+	defer ds.Close()
+	defer ref.Close()
+
+	// verify the whole shard unless a KV range is given
+	start, end := *shardIdx**kvEntries, (*shardIdx+1)**kvEntries
+	if cmd.Flags().Changed("read_start") {
+		start = *readStart
+	}
+	if cmd.Flags().Changed("read_end") {
+		end = *readEnd
+	}
+	log.Info("Verifying shard", "shardIdx", *shardIdx, "start", start, "end", end)
+
+	mismatches, err := utils.VerifyShard(ds, ref, *kvSize, start, end)
+	for _, m := range mismatches {
+		log.Error("KV mismatch", "kvIdx", m.KvIdx, "reason", m.Reason)
+	}
+	if err != nil {
+		log.Crit("Verify failed", "error", err)
+	}
+	if len(mismatches) > 0 {
+		log.Crit("Shard does not match the reference", "mismatches", len(mismatches))
+	}
+	log.Info("Shard matches the reference", "kvs", end-start)
+}
+
+// runContractVerify verifies the shards of the data files, which may be of different shards, and exits
+// non-zero if any KV does not match the contract.
+func runContractVerify(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	if len(*filenames) == 0 {
+		log.Crit("Must provide data filenames")
+	}
+	if *kvEntries == 0 {
+		log.Crit("Must provide kv_entries")
+	}
+	client, err := eth.Dial(*rpcURL, common.HexToAddress(*contractAddr), log.Root())
+	if err != nil {
+		log.Crit("Failed to connect to the L1 RPC", "error", err)
+	}
+	defer client.Close()
+
+	shards := make(map[uint64][]string)
+	for _, filename := range *filenames {
+		df, err := es.OpenDataFile(filename)
+		if err != nil {
+			log.Crit("Open failed", "file", filename, "error", err)
+		}
+		shard := df.KvIdxStart() / *kvEntries
+		df.Close()
+		shards[shard] = append(shards[shard], filename)
+	}
+	shardIds := make([]uint64, 0, len(shards))
+	for shard := range shards {
+		shardIds = append(shardIds, shard)
+	}
+	slices.Sort(shardIds)
+
+	failed := 0
+	for _, shard := range shardIds {
+		*shardIdx = shard
+		ds, err := openDataShard(shards[shard])
+		if err != nil {
+			log.Crit("Open failed", "shard", shard, "error", err)
+		}
+		start, end := shard**kvEntries, (shard+1)**kvEntries
+		mismatches, err := utils.VerifyAgainstContract(ds, client, *kvSize, start, end)
+		ds.Close()
+		for _, m := range mismatches {
+			log.Error("KV mismatch", "kvIdx", m.KvIdx, "reason", m.Reason)
+		}
+		if err != nil {
+			log.Crit("Verify failed", "shard", shard, "error", err)
+		}
+		if len(mismatches) > 0 {
+			failed++
+			log.Error("Shard verification FAILED", "shard", shard, "kvs", end-start, "mismatches", len(mismatches))
+		} else {
+			log.Info("Shard verification passed", "shard", shard, "kvs", end-start)
+		}
+	}
+	if failed > 0 {
+		log.Crit("Shards do not match the contract", "failed", failed, "shards", len(shardIds))
+	}
+	log.Info("All shards match the contract", "shards", len(shardIds))
+}
+
+// runCompact punches the tail of the data files filled with empty beyond the finalized last kv index of the
+// contract. The node must be stopped, as the metas of the files are cleared.
+func runCompact(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	if len(*filenames) == 0 {
+		log.Crit("Must provide filenames")
+	}
+	if *kvEntries == 0 {
+		log.Crit("Must provide kv_entries")
+	}
+	client, err := eth.Dial(*rpcURL, common.HexToAddress(*contractAddr), log.Root())
+	if err != nil {
+		log.Crit("Failed to connect to the L1 RPC", "error", err)
+	}
+	defer client.Close()
+
+	shardManager := es.NewShardManager(common.HexToAddress(*contractAddr), *kvSize, *kvEntries, *chunkSize)
+	defer shardManager.Close()
+	dfs := make([]*es.DataFile, 0, len(*filenames))
+	for _, filename := range *filenames {
+		df, err := es.OpenDataFile(filename)
+		if err != nil {
+			log.Crit("Open data file failed", "file", filename, "error", err)
+		}
+		if err := shardManager.AddDataFileAndShard(df); err != nil {
+			log.Crit("Add data file failed", "file", filename, "error", err)
+		}
+		dfs = append(dfs, df)
+	}
+	sm := es.NewStorageManager(shardManager, client)
+	if err := sm.Reset(rpc.FinalizedBlockNumber.Int64()); err != nil {
+		log.Crit("Query the last kv index failed", "error", err)
+	}
+	for i, df := range dfs {
+		if err := sm.Compact(df); err != nil {
+			log.Crit("Compact failed", "file", (*filenames)[i], "error", err)
+		}
+		log.Info("Data file compacted", "file", (*filenames)[i], "lastKvIdx", sm.LastKvIndex())
+	}
+}
+
+// verifyDataFile logs the corrupted kvs of the data file, which are left to be repaired by the sync, and
+// only returns the errors failing the verification itself.
+func verifyDataFile(filename string, df *es.DataFile) error {
+	err := es.VerifyDataFile(df)
+	var verifyErr *es.DataFileVerifyError
+	if errors.As(err, &verifyErr) {
+		for _, kvIdx := range verifyErr.KvIndices {
+			log.Error("Corrupted kv in data file", "file", filename, "kvIdx", kvIdx)
+		}
+	} else if err != nil {
+		return fmt.Errorf("verify data file %s: %w", filename, err)
+	} else {
+		log.Info("Verified data file", "file", filename)
+	}
+	return nil
+}
+
+// runChecksumBackfill migrates the data files to store the checksums of their chunks. The node must be
+// stopped, as the files are extended.
+func runChecksumBackfill(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	if len(*filenames) == 0 {
+		log.Crit("Must provide filenames")
+	}
+	for _, filename := range *filenames {
+		df, err := es.OpenDataFile(filename)
+		if err != nil {
+			log.Crit("Open data file failed", "file", filename, "error", err)
+		}
+		err = es.BackfillChecksums(df)
+		df.Close()
+		if err != nil {
+			log.Crit("Backfill checksums failed", "file", filename, "error", err)
+		}
+		log.Info("Checksums backfilled", "file", filename)
+	}
 }
 
 func runShardWrite(cmd *cobra.Command, args []string) {
@@ -472,48 +757,222 @@ func genRandomCanonicalScalar() [32]byte {
 	return res
 }
 
+// runBlobDownload downloads the blobs from read_start to read_end (exclusive) to dump_folder, and reassembles
+// them into the output file if all of them are downloaded.
+func runBlobDownload(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	if *dumpFolder == "" {
+		log.Crit("Must provide dump_folder")
+	}
+	client, err := rpc.Dial(*nodeRPC)
+	if err != nil {
+		log.Crit("Connect to es-node failed", "rpc", *nodeRPC, "error", err)
+	}
+	defer client.Close()
+
+	files, err := utils.DownloadBlobs(context.Background(), utils.NewRPCBlobFetcher(client), common.HexToAddress(*contractAddr),
+		*readStart, *readEnd, *dumpFolder)
+	if err != nil {
+		log.Crit("Download blobs failed", "downloaded", len(files), "error", err)
+	}
+	log.Info("Blobs downloaded", "count", len(files), "folder", *dumpFolder)
+	if *output == "" {
+		return
+	}
+	var data []byte
+	for _, file := range files {
+		blob, err := os.ReadFile(file)
+		if err != nil {
+			log.Crit("Read blob failed", "file", file, "error", err)
+		}
+		if *decodeOutput {
+			blob = utils.DecodeBlob(blob)
+		}
+		data = append(data, blob...)
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		log.Crit("Write output failed", "file", *output, "error", err)
+	}
+	log.Info("Blobs reassembled", "file", *output, "bytes", len(data))
+}
+
+func runE2E(cmd *cobra.Command, args []string) {
+	setupLogger()
+
+	cfg := &selftest.Config{
+		KvSize:     *kvSize,
+		ChunkSize:  *chunkSize,
+		KvEntries:  *kvEntries,
+		KvCount:    *kvCount,
+		EncodeType: *encodeType,
+		Timeout:    *e2eTimeout,
+	}
+	if !cmd.Flags().Changed("kv_size") {
+		cfg.KvSize = 1 << 17
+	}
+	if !cmd.Flags().Changed("chunk_size") {
+		cfg.ChunkSize = 1 << 17
+	}
+	if cfg.KvEntries == 0 {
+		cfg.KvEntries = 16
+	}
+	res, err := selftest.Run(context.Background(), cfg, log.New("module", "e2e"))
+	if err != nil {
+		log.Crit("E2E failed", "error", err)
+	}
+	log.Info("E2E passed", "blobs", res.Blobs, "entries", cfg.KvEntries, "generate", res.Generate, "sync", res.Sync,
+		"verify", res.Verify)
+}
+
 func runUploadBlobs(cmd *cobra.Command, args []string) {
 	setupLogger()
 
+	chainID, ok := new(big.Int).SetString(*chainId, 0)
+	if !ok {
+		log.Crit("Invalid chain id", "chainId", *chainId)
+	}
+	var maxFeePerBlobGas *uint256.Int
+	if *blobFeeCap != "" {
+		var err error
+		if maxFeePerBlobGas, err = utils.DecodeUint256String(*blobFeeCap); err != nil {
+			log.Crit("Invalid max fee per blob gas", "value", *blobFeeCap, "error", err)
+		}
+	}
+	var maxPriorityFeePerGas *uint256.Int
+	if *gasTipCap != "" {
+		var err error
+		if maxPriorityFeePerGas, err = utils.DecodeUint256String(*gasTipCap); err != nil {
+			log.Crit("Invalid max priority fee per gas", "value", *gasTipCap, "error", err)
+		}
+	}
+	client, err := ethclient.Dial(*rpcURL)
+	if err != nil {
+		log.Crit("Connect to L1 failed", "rpc", *rpcURL, "error", err)
+	}
+	defer client.Close()
+
+	var m utils.UploadMetricer = utils.NoopUploadMetrics
+	if *metricsAddr != "" {
+		um := utils.NewUploadMetrics()
+		go func() {
+			if err := um.Serve(context.Background(), *metricsAddr); err != nil {
+				log.Error("Serve upload metrics failed", "addr", *metricsAddr, "error", err)
+			}
+		}()
+		m = um
+		log.Info("Serving upload metrics", "addr", *metricsAddr)
+	}
+
+	signers := make([]utils.Signer, 0, len(*privateKeys)+2)
+	if *keystoreFile != "" {
+		if len(*privateKeys) > 0 {
+			log.Crit("Cannot use private_key with keystore")
+		}
+		pass, err := readPassword()
+		if err != nil {
+			log.Crit("Read keystore password failed", "error", err)
+		}
+		signer, err := utils.NewKeystoreSigner(*keystoreFile, pass)
+		if err != nil {
+			log.Crit("Load keystore failed", "error", err)
+		}
+		signers = append(signers, signer)
+	}
+	for _, privateKey := range *privateKeys {
+		signer, err := utils.NewKeySigner(privateKey)
+		if err != nil {
+			log.Crit("Invalid private key", "error", err)
+		}
+		signers = append(signers, signer)
+	}
+	if *signerURL != "" {
+		signer, err := utils.NewRemoteSigner(*signerURL, common.HexToAddress(*signerAddr))
+		if err != nil {
+			log.Crit("Connect to remote signer failed", "url", *signerURL, "error", err)
+		}
+		signers = append(signers, signer)
+	}
+
 	wg := new(sync.WaitGroup)
-	wg.Add(len(*privateKeys))
+	wg.Add(len(signers))
 
-	for i, privateKey := range *privateKeys {
-		go func(idx int, priv string) {
+	for i, signer := range signers {
+		go func(idx int, signer utils.Signer) {
+			defer wg.Done()
+			ctx := context.Background()
 			files := genBlobAndDump(idx)
 
+			uploader, err := utils.NewBlobUploader(ctx, client, signer, chainID, *nonceGapTTL)
+			if err != nil {
+				log.Error("Failed to create blob uploader", "signer", signer.Address(), "error", err)
+				return
+			}
+			sentAt := make(map[uint64]time.Time)
 			for j, file := range files {
 				selector := "0x4581a920"
 				byteArray := make([]byte, 32)
 				binary.LittleEndian.PutUint64(byteArray, uint64(j))
 				firstParam := hex.EncodeToString(byteArray)
 				otherParams := "00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000020000"
-				calldata := selector + firstParam + otherParams
-
-				utils.SendBlobTx(
-					*rpcURL,
-					common.HexToAddress(*contractAddr),
-					priv,
-					file,
-					false,
-					-1,
-					"0x0",
-					210000,
-					"",
-					"200000000",
-					"300000000",
-					*chainId, // TODO: @Qiang everytime devnet update, we may need to update it
-					calldata,
-				)
+				calldata := common.FromHex(selector + firstParam + otherParams)
+
+				sent := time.Now()
+				tx, err := uploader.Send(ctx, common.HexToAddress(*contractAddr), utils.ConvertToBlobs(file), new(big.Int),
+					*gasLimit, nil, maxPriorityFeePerGas, maxFeePerBlobGas, calldata)
+				if err != nil {
+					log.Error("Failed to upload blob", "file", j, "error", err)
+					continue
+				}
+				m.RecordBatchSubmitted()
+				sentAt[tx.Nonce()] = sent
+				// a dropped transaction stalls all the transactions sent after it
+				if _, err := uploader.CheckNonceGap(ctx); err != nil {
+					log.Error("Failed to check nonce gap", "file", j, "error", err)
+				}
 			}
-
-			wg.Done()
-		}(i, privateKey)
+			if err := uploader.WaitSent(ctx); err != nil {
+				log.Error("Failed to wait for the blob transactions", "signer", signer.Address(), "error", err)
+				return
+			}
+			if *metricsAddr == "" {
+				return
+			}
+			for nonce, sent := range sentAt {
+				tx := uploader.Transaction(nonce)
+				if _, err := utils.ConfirmBlobTx(ctx, client, tx, sent, m); err != nil {
+					log.Error("Failed to confirm blob", "nonce", nonce, "tx", tx.Hash(), "error", err)
+				}
+			}
+		}(i, signer)
 	}
 
 	wg.Wait()
 }
 
+// readPassword returns the password of the keystore from password_file or password, or prompts for it on the
+// terminal, so it is kept out of the shell history by default.
+func readPassword() (string, error) {
+	if *passwordFile != "" {
+		b, err := os.ReadFile(*passwordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if *password != "" {
+		return *password, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("must provide password or password_file")
+	}
+	fmt.Fprint(os.Stderr, "Keystore password: ")
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(b), err
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "es-utils",
@@ -530,7 +989,13 @@ func init() {
 	rootCmd.AddCommand(MetaReadCmd)
 	rootCmd.AddCommand(BlobWriteCmd)
 	rootCmd.AddCommand(BlobUploadCmd)
+	rootCmd.AddCommand(BlobDownloadCmd)
 	rootCmd.AddCommand(KVReadCmd)
+	rootCmd.AddCommand(ShardVerifyCmd)
+	rootCmd.AddCommand(ContractVerifyCmd)
+	rootCmd.AddCommand(ChecksumBackfillCmd)
+	rootCmd.AddCommand(CompactCmd)
+	rootCmd.AddCommand(E2ECmd)
 }
 
 func main() {
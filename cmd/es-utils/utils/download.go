@@ -0,0 +1,103 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// BlobFetcher fetches the decoded blob of a kv together with the commit of the blob in the contract.
+type BlobFetcher interface {
+	FetchBlob(ctx context.Context, contract common.Address, kvIdx uint64) ([]byte, common.Hash, error)
+}
+
+// rpcBlob mirrors the result of es_getBlobByIndex.
+type rpcBlob struct {
+	KvIndex    uint64        `json:"kvIndex"`
+	Commit     common.Hash   `json:"commit"`
+	EncodeType uint64        `json:"encodeType"`
+	Data       hexutil.Bytes `json:"data"`
+}
+
+type rpcBlobFetcher struct {
+	client *rpc.Client
+}
+
+// NewRPCBlobFetcher fetches the blobs with the es_getBlobByIndex RPC of an es-node.
+func NewRPCBlobFetcher(client *rpc.Client) BlobFetcher {
+	return &rpcBlobFetcher{client: client}
+}
+
+func (f *rpcBlobFetcher) FetchBlob(ctx context.Context, contract common.Address, kvIdx uint64) ([]byte, common.Hash, error) {
+	var res rpcBlob
+	if err := f.client.CallContext(ctx, &res, "es_getBlobByIndex", contract, kvIdx); err != nil {
+		return nil, common.Hash{}, err
+	}
+	return res.Data, res.Commit, nil
+}
+
+// DownloadBlobs fetches the blobs of the kvs from start to end (exclusive), checks the versioned hash of each
+// blob against its commit in the contract, and writes the blobs matching their commits to dir, named by
+// kvIdx. The written files are returned in the order of the kvs, and the kvs failed are reported in the error.
+func DownloadBlobs(ctx context.Context, f BlobFetcher, contract common.Address, start, end uint64, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var (
+		files  []string
+		failed []uint64
+	)
+	for kvIdx := start; kvIdx < end; kvIdx++ {
+		blob, commit, err := f.FetchBlob(ctx, contract, kvIdx)
+		if err != nil {
+			log.Error("Fetch blob failed", "kvIdx", kvIdx, "error", err)
+			failed = append(failed, kvIdx)
+			continue
+		}
+		if err := verifyBlob(blob, commit); err != nil {
+			log.Error("Blob does not match its commit", "kvIdx", kvIdx, "error", err)
+			failed = append(failed, kvIdx)
+			continue
+		}
+		file := filepath.Join(dir, fmt.Sprintf("%d.blob", kvIdx))
+		if err := os.WriteFile(file, blob, 0644); err != nil {
+			return files, err
+		}
+		log.Info("Blob downloaded", "kvIdx", kvIdx, "file", file)
+		files = append(files, file)
+	}
+	if len(failed) > 0 {
+		return files, fmt.Errorf("%d of %d blobs failed: %v", len(failed), end-start, failed)
+	}
+	return files, nil
+}
+
+// verifyBlob checks the versioned hash of the blob against the commit, of which only the first
+// HashSizeInContract bytes are kept by the contract.
+func verifyBlob(data []byte, commit common.Hash) error {
+	if len(data) != len(kzg4844.Blob{}) {
+		return fmt.Errorf("invalid blob size %d", len(data))
+	}
+	var blob kzg4844.Blob
+	copy(blob[:], data)
+	commitment, err := kzg4844.BlobToCommitment(blob)
+	if err != nil {
+		return err
+	}
+	hash := kZGToVersionedHash(commitment)
+	if !bytes.Equal(hash[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]) {
+		return fmt.Errorf("versioned hash %s, commit %s", hash, commit)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type mockBlob struct {
+	data   []byte
+	commit common.Hash
+}
+
+// mockBlobSource serves the blobs of the kvs like a node.
+type mockBlobSource map[uint64]mockBlob
+
+func (s mockBlobSource) FetchBlob(ctx context.Context, contract common.Address, kvIdx uint64) ([]byte, common.Hash, error) {
+	b, ok := s[kvIdx]
+	if !ok {
+		return nil, common.Hash{}, ethereum.NotFound
+	}
+	return b.data, b.commit, nil
+}
+
+func TestDownloadBlobs(t *testing.T) {
+	data := generateSequentialBytes(t, 3*126976)
+	blobs := EncodeBlobs(data)
+	_, _, hashes, err := ComputeBlobs(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := mockBlobSource{}
+	for i, blob := range blobs {
+		source[uint64(10+i)] = mockBlob{blob[:], hashes[i]}
+	}
+
+	dir := t.TempDir()
+	files, err := DownloadBlobs(context.Background(), source, common.Address{}, 10, 13, dir)
+	if err != nil {
+		t.Fatalf("DownloadBlobs() error: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %d", len(files))
+	}
+	var downloaded []byte
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		downloaded = append(downloaded, DecodeBlob(b)...)
+	}
+	if !bytes.Equal(downloaded[:len(data)], data) {
+		t.Fatal("downloaded data does not match the uploaded data")
+	}
+
+	// a blob not matching its commit and a missing blob are reported, and the rest are still written
+	tampered := blobs[1]
+	tampered[1] ^= 0xff
+	source[11] = mockBlob{tampered[:], hashes[1]}
+	files, err = DownloadBlobs(context.Background(), source, common.Address{}, 10, 14, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "[11 13]") {
+		t.Fatalf("expected kvs 11 and 13 to fail, got %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+}
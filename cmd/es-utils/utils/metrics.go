@@ -0,0 +1,106 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	ophttp "github.com/ethereum-optimism/optimism/op-service/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const uploadMetricsNamespace = "es_utils_upload"
+
+// UploadMetricer records the outcome of the blob transactions sent to upload data.
+type UploadMetricer interface {
+	RecordBatchSubmitted()
+	RecordBatchReverted()
+	RecordGasUsed(gas uint64)
+	RecordConfirmation(d time.Duration)
+}
+
+type noopUploadMetrics struct{}
+
+func (noopUploadMetrics) RecordBatchSubmitted()              {}
+func (noopUploadMetrics) RecordBatchReverted()               {}
+func (noopUploadMetrics) RecordGasUsed(gas uint64)           {}
+func (noopUploadMetrics) RecordConfirmation(d time.Duration) {}
+
+// NoopUploadMetrics discards the upload metrics.
+var NoopUploadMetrics UploadMetricer = noopUploadMetrics{}
+
+// UploadMetrics keeps the upload metrics in a Prometheus registry.
+type UploadMetrics struct {
+	BatchesSubmitted prometheus.Counter
+	BatchesReverted  prometheus.Counter
+	GasUsed          prometheus.Counter
+	Confirmation     prometheus.Histogram
+
+	registry *prometheus.Registry
+}
+
+func NewUploadMetrics() *UploadMetrics {
+	registry := prometheus.NewRegistry()
+	m := &UploadMetrics{
+		BatchesSubmitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: uploadMetricsNamespace,
+			Name:      "batches_submitted_total",
+			Help:      "Number of blob transactions submitted",
+		}),
+		BatchesReverted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: uploadMetricsNamespace,
+			Name:      "batches_reverted_total",
+			Help:      "Number of blob transactions reverted",
+		}),
+		GasUsed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: uploadMetricsNamespace,
+			Name:      "gas_used_total",
+			Help:      "Gas used by the blob transactions according to their receipts",
+		}),
+		Confirmation: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: uploadMetricsNamespace,
+			Name:      "confirmation_seconds",
+			Help:      "Time from sending a blob transaction to its successful receipt",
+			Buckets:   []float64{6, 12, 24, 36, 60, 120, 300, 600},
+		}),
+		registry: registry,
+	}
+	registry.MustRegister(m.BatchesSubmitted, m.BatchesReverted, m.GasUsed, m.Confirmation)
+	return m
+}
+
+func (m *UploadMetrics) RecordBatchSubmitted() {
+	m.BatchesSubmitted.Inc()
+}
+
+func (m *UploadMetrics) RecordBatchReverted() {
+	m.BatchesReverted.Inc()
+}
+
+func (m *UploadMetrics) RecordGasUsed(gas uint64) {
+	m.GasUsed.Add(float64(gas))
+}
+
+func (m *UploadMetrics) RecordConfirmation(d time.Duration) {
+	m.Confirmation.Observe(d.Seconds())
+}
+
+// Handler returns the http handler exposing the metrics in the Prometheus text format.
+func (m *UploadMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves the metrics on addr until the context is cancelled.
+func (m *UploadMetrics) Serve(ctx context.Context, addr string) error {
+	server := ophttp.NewHttpServer(m.Handler())
+	server.Addr = addr
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return server.ListenAndServe()
+}
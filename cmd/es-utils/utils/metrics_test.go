@@ -0,0 +1,78 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// mockReceipts serves the simulated receipts of the blob transactions.
+type mockReceipts map[common.Hash]*types.Receipt
+
+func (r mockReceipts) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	if receipt, ok := r[txHash]; ok {
+		return receipt, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (r mockReceipts) CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error) {
+	return nil, nil
+}
+
+func TestUploadMetrics(t *testing.T) {
+	receipts := mockReceipts{}
+	var txs []*types.Transaction
+	for i, r := range []struct {
+		status  uint64
+		gasUsed uint64
+	}{
+		{types.ReceiptStatusSuccessful, 100000},
+		{types.ReceiptStatusFailed, 50000},
+		{types.ReceiptStatusSuccessful, 200000},
+	} {
+		tx := types.NewTx(&types.BlobTx{Nonce: uint64(i)})
+		receipts[tx.Hash()] = &types.Receipt{Status: r.status, GasUsed: r.gasUsed, TxHash: tx.Hash()}
+		txs = append(txs, tx)
+	}
+
+	m := NewUploadMetrics()
+	for i, tx := range txs {
+		m.RecordBatchSubmitted()
+		_, err := ConfirmBlobTx(context.Background(), receipts, tx, time.Now().Add(-12*time.Second), m)
+		if reverted := i == 1; reverted != errors.Is(err, ErrBlobTxReverted) {
+			t.Fatalf("tx %d: unexpected error %v", i, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"es_utils_upload_batches_submitted_total 3",
+		"es_utils_upload_batches_reverted_total 1",
+		"es_utils_upload_gas_used_total 350000",
+		"es_utils_upload_confirmation_seconds_count 2",
+		`es_utils_upload_confirmation_seconds_bucket{le="6"} 0`,
+		`es_utils_upload_confirmation_seconds_bucket{le="24"} 2`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/holiman/uint256"
+)
+
+const (
+	// DefaultNonceGapTimeout is how long a nonce gap may last before the missing transaction is resubmitted.
+	DefaultNonceGapTimeout = time.Minute
+	// nonceGapFeeBump is the percentage the fees of a resubmitted transaction are raised by, as the blob pool
+	// only replaces a blob transaction whose fees are at least doubled.
+	nonceGapFeeBump = 100
+	// nonceGapPollInterval is the interval the pending nonce is polled at by WaitSent.
+	nonceGapPollInterval = time.Second
+)
+
+// BlobUploader sends the blob transactions of a signer with consecutive nonces without waiting for their
+// inclusion. A transaction silently dropped from the pool leaves a gap in the nonces, which stalls all the
+// transactions sent after it. After each transaction sent, CheckNonceGap confirms the pending nonce of the
+// account advanced past it, and a gap lasting over the timeout is filled by resubmitting the missing
+// transaction with bumped fees.
+type BlobUploader struct {
+	client  blobTxBackend
+	signer  Signer
+	chainId *big.Int
+	timeout time.Duration
+
+	next     uint64                        // nonce of the next transaction to send
+	sent     map[uint64]*types.Transaction // the last transaction sent of each nonce
+	gapNonce uint64                        // the pending nonce when the gap was detected
+	gapSince time.Time                     // zero if there is no gap
+}
+
+// NewBlobUploader creates a BlobUploader sending the transactions from the pending nonce of the signer.
+func NewBlobUploader(ctx context.Context, client blobTxBackend, signer Signer, chainId *big.Int, timeout time.Duration) (*BlobUploader, error) {
+	nonce, err := client.PendingNonceAt(ctx, signer.Address())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	return &BlobUploader{
+		client:  client,
+		signer:  signer,
+		chainId: chainId,
+		timeout: timeout,
+		next:    nonce,
+		sent:    make(map[uint64]*types.Transaction),
+	}, nil
+}
+
+// Send sends a blob transaction with the next nonce of the uploader; the nil prices are filled in like SendBlobTx.
+func (u *BlobUploader) Send(ctx context.Context, to common.Address, blobs []kzg4844.Blob, val *big.Int, gasLimit uint64,
+	gasPrice256, priorityGasPrice256, maxFeePerDataGas256 *uint256.Int, calldataBytes []byte) (*types.Transaction, error) {
+	tx, err := signBlobTx(ctx, u.client, u.signer, u.chainId, to, blobs, int64(u.next), val, gasLimit, gasPrice256,
+		priorityGasPrice256, maxFeePerDataGas256, calldataBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.client.SendTransaction(ctx, tx); err != nil {
+		return nil, fmt.Errorf("unable to send transaction: %w", err)
+	}
+	u.sent[u.next] = tx
+	u.next++
+	log.Info("Transaction submitted.", "nonce", tx.Nonce(), "hash", tx.Hash(), "blobs", len(blobs))
+	return tx, nil
+}
+
+// Transaction returns the last transaction sent with the nonce, which is the resubmitted one if the
+// transaction was dropped, or nil if no transaction of the nonce is sent.
+func (u *BlobUploader) Transaction(nonce uint64) *types.Transaction {
+	return u.sent[nonce]
+}
+
+// CheckNonceGap checks the pending nonce of the account against the transactions sent, and resubmits the
+// transaction of the pending nonce with bumped fees if it has been missing for over the timeout. It returns
+// true once the pending nonce is past all the transactions sent.
+func (u *BlobUploader) CheckNonceGap(ctx context.Context) (bool, error) {
+	pending, err := u.client.PendingNonceAt(ctx, u.signer.Address())
+	if err != nil {
+		return false, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	if pending >= u.next {
+		u.gapSince = time.Time{}
+		return true, nil
+	}
+	if u.gapSince.IsZero() || u.gapNonce != pending {
+		u.gapNonce, u.gapSince = pending, time.Now()
+		log.Warn("Detected nonce gap", "account", u.signer.Address(), "pendingNonce", pending, "expectedNonce", u.next)
+	}
+	if time.Since(u.gapSince) < u.timeout {
+		return false, nil
+	}
+	tx, ok := u.sent[pending]
+	if !ok {
+		return false, fmt.Errorf("nonce gap at %d of a transaction not sent by the uploader", pending)
+	}
+	bumped, err := u.bumpFees(tx)
+	if err != nil {
+		return false, err
+	}
+	if err := u.client.SendTransaction(ctx, bumped); err != nil {
+		return false, fmt.Errorf("unable to resubmit transaction: %w", err)
+	}
+	u.sent[pending] = bumped
+	u.gapSince = time.Now()
+	log.Warn("Resubmitted the missing transaction of the nonce gap", "nonce", pending, "hash", bumped.Hash(),
+		"droppedHash", tx.Hash(), "gasFeeCap", bumped.GasFeeCap(), "blobFeeCap", bumped.BlobGasFeeCap())
+	return false, nil
+}
+
+// WaitSent checks the nonce gap periodically until the pending nonce is past all the transactions sent.
+func (u *BlobUploader) WaitSent(ctx context.Context) error {
+	ticker := time.NewTicker(nonceGapPollInterval)
+	defer ticker.Stop()
+	for {
+		done, err := u.CheckNonceGap(ctx)
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// bumpFees signs a copy of the blob transaction with the fees raised by nonceGapFeeBump percent.
+func (u *BlobUploader) bumpFees(tx *types.Transaction) (*types.Transaction, error) {
+	bump := func(v *big.Int) *uint256.Int {
+		bumped := new(big.Int).Mul(v, big.NewInt(100+nonceGapFeeBump))
+		return uint256.MustFromBig(bumped.Div(bumped, big.NewInt(100)))
+	}
+	bumped, err := u.signer.SignTx(types.NewTx(&types.BlobTx{
+		ChainID:    uint256.MustFromBig(u.chainId),
+		Nonce:      tx.Nonce(),
+		GasTipCap:  bump(tx.GasTipCap()),
+		GasFeeCap:  bump(tx.GasFeeCap()),
+		Gas:        tx.Gas(),
+		To:         *tx.To(),
+		Value:      uint256.MustFromBig(tx.Value()),
+		Data:       tx.Data(),
+		BlobFeeCap: bump(tx.BlobGasFeeCap()),
+		BlobHashes: tx.BlobHashes(),
+		Sidecar:    tx.BlobTxSidecar(),
+	}), u.chainId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	return bumped, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+)
+
+// droppingBackend keeps the transactions sent in a pool, except the drop-th one which is silently dropped,
+// and reports the pending nonce of the account up to the first nonce missing from the pool.
+type droppingBackend struct {
+	*mockBlobTxBackend
+	drop  int
+	sends int
+	pool  map[uint64]*types.Transaction
+}
+
+func (b *droppingBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sends++
+	b.sent = append(b.sent, tx)
+	if b.sends != b.drop {
+		b.pool[tx.Nonce()] = tx
+	}
+	return nil
+}
+
+func (b *droppingBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	nonce := b.nonce
+	for b.pool[nonce] != nil {
+		nonce++
+	}
+	return nonce, nil
+}
+
+func TestBlobUploaderNonceGap(t *testing.T) {
+	key, err := NewKeySigner("8da4ef21b864d2cc526dbdb2a120bd2874c36c9d0a1fb7f8c63d7f7a8b41de8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		ctx     = context.Background()
+		backend = &droppingBackend{
+			mockBlobTxBackend: &mockBlobTxBackend{upfront: big.NewInt(0), nonce: 7},
+			drop:              2,
+			pool:              make(map[uint64]*types.Transaction),
+		}
+		chainID = big.NewInt(3151908)
+		to      = common.HexToAddress("0x0000000000000000000000000000000003330001")
+	)
+	// a zero timeout resubmits the missing transaction as soon as the gap is detected
+	uploader, err := NewBlobUploader(ctx, backend, key, chainID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := uploader.Send(ctx, to, EncodeBlobs([]byte{byte(i)}), new(big.Int), 210000, uint256.NewInt(100),
+			uint256.NewInt(2), uint256.NewInt(300), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dropped := uploader.Transaction(8)
+	if dropped == nil || backend.pool[8] != nil {
+		t.Fatalf("the transaction of the second batch should be dropped")
+	}
+
+	if err := uploader.WaitSent(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 4 {
+		t.Fatalf("expected the dropped transaction resubmitted once, got %d transactions sent", len(backend.sent))
+	}
+	resubmitted := backend.sent[3]
+	if resubmitted.Nonce() != 8 || backend.pool[8] != resubmitted || uploader.Transaction(8) != resubmitted {
+		t.Fatalf("expected the transaction of nonce 8 resubmitted, got nonce %d", resubmitted.Nonce())
+	}
+	if resubmitted.GasFeeCap().Cmp(dropped.GasFeeCap()) <= 0 || resubmitted.GasTipCap().Cmp(dropped.GasTipCap()) <= 0 ||
+		resubmitted.BlobGasFeeCap().Cmp(dropped.BlobGasFeeCap()) <= 0 {
+		t.Fatalf("expected the fees of the resubmitted transaction bumped")
+	}
+	if resubmitted.Hash() == dropped.Hash() || resubmitted.BlobHashes()[0] != dropped.BlobHashes()[0] {
+		t.Fatalf("expected the resubmitted transaction to carry the same blob with new fees")
+	}
+	if nonce, _ := backend.PendingNonceAt(ctx, key.Address()); nonce != 10 {
+		t.Fatalf("expected pending nonce 10 after the gap is filled, got %d", nonce)
+	}
+}
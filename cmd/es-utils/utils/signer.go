@@ -0,0 +1,111 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethstorage/go-ethstorage/ethstorage/signer"
+)
+
+// remoteSignTimeout bounds a signing request to the remote signer.
+const remoteSignTimeout = 30 * time.Second
+
+// Signer signs the transactions sent by SendBlobTx, so the key may be kept out of the process.
+type Signer interface {
+	// Address returns the account signing the transactions.
+	Address() common.Address
+	// SignTx returns the transaction signed for the chain.
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+type keySigner struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+}
+
+// NewKeySigner signs the transactions with the private key in hex, which is parsed once here.
+func NewKeySigner(prv string) (Signer, error) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(prv, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: private key: %v", ErrInvalidParam, err)
+	}
+	return &keySigner{key: key, addr: crypto.PubkeyToAddress(key.PublicKey)}, nil
+}
+
+// NewKeystoreSigner signs the transactions with the key decrypted from the go-ethereum keystore file with the
+// password, so the key is not passed on the command line.
+func NewKeystoreSigner(path, password string) (Signer, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	key, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt keystore %s: %w", path, err)
+	}
+	return &keySigner{key: key.PrivateKey, addr: key.Address}, nil
+}
+
+func (s *keySigner) Address() common.Address {
+	return s.addr
+}
+
+func (s *keySigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.NewCancunSigner(chainID), s.key)
+}
+
+type remoteSigner struct {
+	client *signer.SignerClient
+	addr   common.Address
+}
+
+// NewRemoteSigner signs the transactions of the address with the account_signTransaction RPC of a remote
+// signer like clef.
+func NewRemoteSigner(endpoint string, address common.Address) (Signer, error) {
+	client, err := signer.NewSignerClient(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the signer client: %w", err)
+	}
+	return &remoteSigner{client: client, addr: address}, nil
+}
+
+func (s *remoteSigner) Address() common.Address {
+	return s.addr
+}
+
+// SignTx only sends the fields of the transaction to the remote signer, so the signature it returns is
+// applied to the transaction here, which keeps the blob sidecar.
+func (s *remoteSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSignTimeout)
+	defer cancel()
+	signed, err := s.client.SignTransaction(ctx, chainID, s.addr, tx)
+	if err != nil {
+		return nil, err
+	}
+	v, r, sv := signed.RawSignatureValues()
+	sig := make([]byte, crypto.SignatureLength)
+	r.FillBytes(sig[0:32])
+	sv.FillBytes(sig[32:64])
+	sig[64] = byte(v.Uint64())
+	txSigner := types.NewCancunSigner(chainID)
+	res, err := tx.WithSignature(txSigner, sig)
+	if err != nil {
+		return nil, err
+	}
+	if from, err := types.Sender(txSigner, res); err != nil || from != s.addr {
+		return nil, fmt.Errorf("remote signer signed for %s, expected %s: %v", from, s.addr, err)
+	}
+	return res, nil
+}
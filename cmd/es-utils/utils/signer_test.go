@@ -0,0 +1,164 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// mockSigner records the transactions to sign and signs them with a local key.
+type mockSigner struct {
+	Signer
+	unsigned []*types.Transaction
+	chainIDs []*big.Int
+}
+
+func (s *mockSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	s.unsigned = append(s.unsigned, tx)
+	s.chainIDs = append(s.chainIDs, chainID)
+	return s.Signer.SignTx(tx, chainID)
+}
+
+// mockBlobTxBackend serves the calls of sendBlobTx like an L1 node including the sent transactions at once.
+type mockBlobTxBackend struct {
+	upfront      *big.Int
+	nonce        uint64
+	nonceAccount common.Address
+	sent         []*types.Transaction
+}
+
+func (b *mockBlobTxBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return nil, ethereum.NotFound
+}
+
+func (b *mockBlobTxBackend) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return common.BigToHash(b.upfront).Bytes(), nil
+}
+
+func (b *mockBlobTxBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	b.nonceAccount = account
+	return b.nonce, nil
+}
+
+func (b *mockBlobTxBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return nil, ethereum.NotFound
+}
+
+func (b *mockBlobTxBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.sent = append(b.sent, tx)
+	return nil
+}
+
+func (b *mockBlobTxBackend) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	for _, tx := range b.sent {
+		if tx.Hash() == hash {
+			return tx, false, nil
+		}
+	}
+	return nil, false, ethereum.NotFound
+}
+
+func TestSendBlobTxSigner(t *testing.T) {
+	key, err := NewKeySigner("8da4ef21b864d2cc526dbdb2a120bd2874c36c9d0a1fb7f8c63d7f7a8b41de8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		signer   = &mockSigner{Signer: key}
+		backend  = &mockBlobTxBackend{upfront: big.NewInt(1000), nonce: 7}
+		chainID  = big.NewInt(3151908)
+		to       = common.HexToAddress("0x0000000000000000000000000000000003330001")
+		calldata = []byte{0x45, 0x81, 0xa9, 0x20}
+	)
+	tx, err := sendBlobTx(context.Background(), backend, signer, chainID, to, EncodeBlobs([]byte("blob")), -1,
+		big.NewInt(10), 210000, uint256.NewInt(100), uint256.NewInt(2), uint256.NewInt(300), calldata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.nonceAccount != key.Address() {
+		t.Fatalf("nonce queried for %s, expected the signer %s", backend.nonceAccount, key.Address())
+	}
+	if len(signer.unsigned) != 1 || signer.chainIDs[0].Cmp(chainID) != 0 {
+		t.Fatalf("expected one transaction signed for chain %s, got %d %v", chainID, len(signer.unsigned), signer.chainIDs)
+	}
+	unsigned := signer.unsigned[0]
+	if v, r, s := unsigned.RawSignatureValues(); v.Sign() != 0 || r.Sign() != 0 || s.Sign() != 0 {
+		t.Fatalf("transaction passed to the signer should be unsigned")
+	}
+	// the value is raised to the upfront payment
+	if unsigned.Type() != types.BlobTxType || unsigned.Nonce() != 7 || *unsigned.To() != to ||
+		unsigned.Value().Cmp(backend.upfront) != 0 || unsigned.Gas() != 210000 ||
+		unsigned.GasFeeCap().Uint64() != 100 || unsigned.GasTipCap().Uint64() != 2 ||
+		unsigned.BlobGasFeeCap().Uint64() != 300 || !bytes.Equal(unsigned.Data(), calldata) ||
+		len(unsigned.BlobHashes()) != 1 || unsigned.BlobTxSidecar() == nil {
+		t.Fatalf("unexpected transaction passed to the signer: %+v", unsigned)
+	}
+
+	if len(backend.sent) != 1 || backend.sent[0].Hash() != tx.Hash() {
+		t.Fatalf("the signed transaction should be broadcast")
+	}
+	from, err := types.Sender(types.NewCancunSigner(chainID), backend.sent[0])
+	if err != nil || from != key.Address() {
+		t.Fatalf("broadcast transaction signed by %s, expected %s: %v", from, key.Address(), err)
+	}
+	if backend.sent[0].BlobTxSidecar() == nil {
+		t.Fatalf("broadcast transaction should carry the blobs")
+	}
+}
+
+// TestWaitTxIncludedDropped tests the wait for a transaction dropped from the pool ends with
+// ErrBlobTxNotIncluded after the timeout instead of polling forever.
+func TestWaitTxIncludedDropped(t *testing.T) {
+	backend := &mockBlobTxBackend{}
+	dropped := types.NewTx(&types.BlobTx{Nonce: 3})
+	start := time.Now()
+	if _, err := waitTxIncluded(context.Background(), backend, dropped, 100*time.Millisecond); !errors.Is(err, ErrBlobTxNotIncluded) {
+		t.Fatalf("expected ErrBlobTxNotIncluded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > sentTxPollInterval {
+		t.Fatalf("wait should end at the timeout, took %s", elapsed)
+	}
+
+	// the transaction included is returned at once
+	backend.sent = append(backend.sent, dropped)
+	if tx, err := waitTxIncluded(context.Background(), backend, dropped, 100*time.Millisecond); err != nil || tx.Hash() != dropped.Hash() {
+		t.Fatalf("expected the transaction included, got %v", err)
+	}
+}
+
+func TestNewKeystoreSigner(t *testing.T) {
+	key, err := crypto.HexToECDSA("8da4ef21b864d2cc526dbdb2a120bd2874c36c9d0a1fb7f8c63d7f7a8b41de8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := keystore.NewKeyStore(t.TempDir(), keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.ImportECDSA(key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewKeystoreSigner(account.URL.Path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Address() != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("signer address %s, expected %s", signer.Address(), crypto.PubkeyToAddress(key.PublicKey))
+	}
+	if _, err := NewKeystoreSigner(account.URL.Path, "wrong"); err == nil {
+		t.Fatal("expected an error decrypting with a wrong password")
+	}
+}
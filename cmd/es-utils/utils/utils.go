@@ -13,9 +13,9 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/misc/eip4844"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/kzg4844"
@@ -32,10 +32,34 @@ var (
 	log = esLog.NewLogger(esLog.DefaultCLIConfig())
 )
 
+var (
+	// ErrInvalidParam is returned by SendBlobTx if a param of the transaction cannot be parsed.
+	ErrInvalidParam = errors.New("invalid param")
+	// ErrGasPriceTooHigh is returned by SendBlobTx if the suggested gas price overflows uint256.
+	ErrGasPriceTooHigh = errors.New("gas price is too high")
+	// ErrBlobTxNotIncluded is returned by SendBlobTx if the transaction sent is still pending or unknown to the
+	// client after the wait, e.g. as it is dropped from the pool or replaced.
+	ErrBlobTxNotIncluded = errors.New("blob transaction not included")
+	// ErrBlobTxReverted is returned by ConfirmBlobTx if the receipt of the blob transaction is failed.
+	ErrBlobTxReverted = errors.New("blob transaction reverted")
+)
+
+const (
+	// sentTxTimeout bounds the wait of SendBlobTx for the transaction sent to leave the pool.
+	sentTxTimeout = 5 * time.Minute
+	// sentTxPollInterval is the first interval the transaction sent is polled at, doubled after each poll
+	// up to sentTxMaxPollInterval.
+	sentTxPollInterval    = time.Second
+	sentTxMaxPollInterval = 16 * time.Second
+)
+
+// SendBlobTx sends a blob transaction with the data signed by the signer and waits until it is no longer
+// pending, or fails with ErrBlobTxNotIncluded if it is not included in time. The params are parsed before
+// connecting the client, so an invalid param fails with ErrInvalidParam.
 func SendBlobTx(
 	addr string,
 	to common.Address,
-	prv string,
+	signer Signer,
 	data []byte,
 	needEncoding bool,
 	nonce int64,
@@ -46,142 +70,229 @@ func SendBlobTx(
 	maxFeePerDataGas string,
 	chainID string,
 	calldata string,
-) *types.Transaction {
-	chainId, _ := new(big.Int).SetString(chainID, 0)
+) (*types.Transaction, error) {
+	chainId, ok := new(big.Int).SetString(chainID, 0)
+	if !ok {
+		return nil, fmt.Errorf("%w: chain id %q", ErrInvalidParam, chainID)
+	}
+	val, ok := new(big.Int).SetString(value, 0)
+	if !ok {
+		return nil, fmt.Errorf("%w: value %q", ErrInvalidParam, value)
+	}
+	var (
+		gasPrice256 *uint256.Int
+		err         error
+	)
+	if gasPrice != "" {
+		gasPrice256, err = DecodeUint256String(gasPrice)
+		if err != nil {
+			return nil, fmt.Errorf("%w: gas price: %v", ErrInvalidParam, err)
+		}
+	}
+	var priorityGasPrice256 *uint256.Int
+	if priorityGasPrice != "" {
+		priorityGasPrice256, err = DecodeUint256String(priorityGasPrice)
+		if err != nil {
+			return nil, fmt.Errorf("%w: priority gas price: %v", ErrInvalidParam, err)
+		}
+	}
+	var maxFeePerDataGas256 *uint256.Int
+	if maxFeePerDataGas != "" {
+		maxFeePerDataGas256, err = DecodeUint256String(maxFeePerDataGas)
+		if err != nil {
+			return nil, fmt.Errorf("%w: max_fee_per_data_gas: %v", ErrInvalidParam, err)
+		}
+	}
+	calldataBytes, err := common.ParseHexOrString(calldata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: calldata: %v", ErrInvalidParam, err)
+	}
+
+	var blobs []kzg4844.Blob
+	if needEncoding {
+		blobs = EncodeBlobs(data)
+	} else {
+		blobs = ConvertToBlobs(data)
+	}
 
 	ctx := context.Background()
 	client, err := ethclient.DialContext(ctx, addr)
 	if err != nil {
-		log.Crit("Failed to connect to the Ethereum client", "error", err)
+		return nil, fmt.Errorf("failed to connect to the Ethereum client: %w", err)
 	}
+	defer client.Close()
+	return sendBlobTx(ctx, client, signer, chainId, to, blobs, nonce, val, gasLimit, gasPrice256, priorityGasPrice256,
+		maxFeePerDataGas256, calldataBytes)
+}
 
-	h := crypto.Keccak256Hash([]byte(`upfrontPayment()`))
-	callMsg := ethereum.CallMsg{
-		To:   &to,
-		Data: h[:],
+// blobTxBackend is the part of the L1 client used to send a blob transaction.
+type blobTxBackend interface {
+	headerReader
+	CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error)
+}
+
+// sendBlobTx fills in the params of the blob transaction left unset, i.e. nonce -1 and the nil prices, from the
+// client, and sends the transaction signed by the signer.
+func sendBlobTx(ctx context.Context, client blobTxBackend, signer Signer, chainId *big.Int, to common.Address,
+	blobs []kzg4844.Blob, nonce int64, val *big.Int, gasLimit uint64, gasPrice256, priorityGasPrice256,
+	maxFeePerDataGas256 *uint256.Int, calldataBytes []byte) (*types.Transaction, error) {
+	tx, err := signBlobTx(ctx, client, signer, chainId, to, blobs, nonce, val, gasLimit, gasPrice256, priorityGasPrice256,
+		maxFeePerDataGas256, calldataBytes)
+	if err != nil {
+		return nil, err
 	}
-	bs, err := client.CallContract(context.Background(), callMsg, new(big.Int).SetInt64(-2))
+	err = client.SendTransaction(ctx, tx)
 	if err != nil {
-		log.Crit("Failed to get upfront fee", "error", err)
+		return nil, fmt.Errorf("unable to send transaction: %w", err)
 	}
 
-	uint256Type, _ := abi.NewType("uint256", "", nil)
-	res, err := abi.Arguments{{Type: uint256Type}}.UnpackValues(bs)
+	tx, err = waitTxIncluded(ctx, client, tx, sentTxTimeout)
 	if err != nil {
-		log.Crit("Failed to unpack values", "error", err)
+		return nil, err
 	}
 
-	val, success := new(big.Int).SetString(value, 0)
-	if !success {
-		log.Crit("Invalid value param")
-	}
+	log.Info("Transaction submitted.", "nonce", tx.Nonce(), "hash", tx.Hash(), "blobs", len(blobs))
+	return tx, nil
+}
 
-	if res[0].(*big.Int).Cmp(val) == 1 {
-		val = res[0].(*big.Int)
+// signBlobTx fills in the params of the blob transaction left unset like sendBlobTx, and returns the
+// transaction signed by the signer without sending it.
+func signBlobTx(ctx context.Context, client blobTxBackend, signer Signer, chainId *big.Int, to common.Address,
+	blobs []kzg4844.Blob, nonce int64, val *big.Int, gasLimit uint64, gasPrice256, priorityGasPrice256,
+	maxFeePerDataGas256 *uint256.Int, calldataBytes []byte) (*types.Transaction, error) {
+	upfront, err := eth.NewStorageContract(to, client).UpfrontPayment(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upfront fee: %w", err)
+	}
+	if upfront.Cmp(val) == 1 {
+		val = upfront
 	}
-
 	value256, overflow := uint256.FromBig(val)
 	if overflow {
-		log.Crit("Invalid value param", "error", err)
-	}
-
-	key, err := crypto.HexToECDSA(prv)
-	if err != nil {
-		log.Crit("Invalid private key", "error", err)
+		return nil, fmt.Errorf("%w: value %s overflows uint256", ErrInvalidParam, val)
 	}
 
 	if nonce == -1 {
-		pendingNonce, err := client.PendingNonceAt(ctx, crypto.PubkeyToAddress(key.PublicKey))
+		pendingNonce, err := client.PendingNonceAt(ctx, signer.Address())
 		if err != nil {
-			log.Crit("Error getting nonce", "error", err)
+			return nil, fmt.Errorf("failed to get nonce: %w", err)
 		}
 		nonce = int64(pendingNonce)
 	}
 	log.Info("SendBlobTx", "nonce", nonce)
 
-	var gasPrice256 *uint256.Int
-	if gasPrice == "" {
+	if gasPrice256 == nil {
 		val, err := client.SuggestGasPrice(ctx)
 		if err != nil {
-			log.Crit("Error getting suggested gas price", "error", err)
+			return nil, fmt.Errorf("failed to get suggested gas price: %w", err)
 		}
 		var nok bool
 		gasPrice256, nok = uint256.FromBig(val)
 		if nok {
-			log.Crit("Gas price is too high!", "value", val.String())
+			return nil, fmt.Errorf("%w: %s", ErrGasPriceTooHigh, val)
 		}
 		log.Info("SendBlobTx", "gasPriceSuggested", gasPrice256)
-	} else {
-		gasPrice256, err = DecodeUint256String(gasPrice)
-		if err != nil {
-			log.Crit("Invalid gas price", "error", err)
-		}
 	}
-
-	priorityGasPrice256 := gasPrice256
-	if priorityGasPrice != "" {
-		priorityGasPrice256, err = DecodeUint256String(priorityGasPrice)
+	if priorityGasPrice256 == nil {
+		priorityGasPrice256 = gasPrice256
+	}
+	if maxFeePerDataGas256 == nil {
+		maxFeePerDataGas256, err = estimateBlobFeeCap(ctx, client)
 		if err != nil {
-			log.Crit("Invalid priority gas price", "error", err)
+			return nil, err
 		}
+		log.Info("SendBlobTx", "maxFeePerDataGasEstimated", maxFeePerDataGas256)
 	}
 
-	maxFeePerDataGas256, err := DecodeUint256String(maxFeePerDataGas)
+	blobtx, err := newBlobTx(chainId, uint64(nonce), priorityGasPrice256, gasPrice256, gasLimit, to, value256,
+		calldataBytes, maxFeePerDataGas256, blobs)
 	if err != nil {
-		log.Crit("Invalid max_fee_per_data_gas", "error", err)
+		return nil, err
 	}
-	var blobs []kzg4844.Blob
-	if needEncoding {
-		blobs = EncodeBlobs(data)
-	} else {
-		blobs = ConvertToBlobs(data)
-	}
-	commitments, proofs, versionedHashes, err := ComputeBlobs(blobs)
+	tx, err := signer.SignTx(types.NewTx(blobtx), chainId)
 	if err != nil {
-		log.Crit("Failed to compute commitments", "error", err)
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
 	}
+	return tx, nil
+}
 
-	calldataBytes, err := common.ParseHexOrString(calldata)
-	if err != nil {
-		log.Crit("Failed to parse calldata", "error", err)
+// waitTxIncluded polls the transaction sent with a growing interval until it is no longer pending, and
+// returns ErrBlobTxNotIncluded if it is still pending or unknown once the timeout is over.
+func waitTxIncluded(ctx context.Context, client blobTxBackend, tx *types.Transaction, timeout time.Duration) (*types.Transaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	interval := sentTxPollInterval
+	for {
+		txn, isPending, err := client.TransactionByHash(ctx, tx.Hash())
+		if err == nil && !isPending {
+			return txn, nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			if err == nil {
+				err = errors.New("pending")
+			}
+			return nil, fmt.Errorf("%w: %s after %s: %v", ErrBlobTxNotIncluded, tx.Hash(), timeout, err)
+		}
+		interval = min(interval*2, sentTxMaxPollInterval)
 	}
-	sideCar := &types.BlobTxSidecar{
-		Blobs:       blobs,
-		Commitments: commitments,
-		Proofs:      proofs,
+}
+
+// newBlobTx builds a blob transaction carrying the blobs in its sidecar, with the versioned hashes of
+// the blob commitments.
+func newBlobTx(chainId *big.Int, nonce uint64, gasTipCap, gasFeeCap *uint256.Int, gas uint64, to common.Address,
+	value *uint256.Int, data []byte, blobFeeCap *uint256.Int, blobs []kzg4844.Blob) (*types.BlobTx, error) {
+	commitments, proofs, versionedHashes, err := ComputeBlobs(blobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute commitments: %w", err)
 	}
-	blobtx := &types.BlobTx{
+	return &types.BlobTx{
 		ChainID:    uint256.MustFromBig(chainId),
-		Nonce:      uint64(nonce),
-		GasTipCap:  priorityGasPrice256,
-		GasFeeCap:  gasPrice256,
-		Gas:        gasLimit,
+		Nonce:      nonce,
+		GasTipCap:  gasTipCap,
+		GasFeeCap:  gasFeeCap,
+		Gas:        gas,
 		To:         to,
-		Value:      value256,
-		Data:       calldataBytes,
-		BlobFeeCap: maxFeePerDataGas256,
+		Value:      value,
+		Data:       data,
+		BlobFeeCap: blobFeeCap,
 		BlobHashes: versionedHashes,
-		Sidecar:    sideCar,
-	}
-	tx := types.MustSignNewTx(key, types.NewCancunSigner(chainId), blobtx)
-	err = client.SendTransaction(context.Background(), tx)
+		Sidecar: &types.BlobTxSidecar{
+			Blobs:       blobs,
+			Commitments: commitments,
+			Proofs:      proofs,
+		},
+	}, nil
+}
+
+// blobFeeCapMultiplier is the headroom of the estimated blob fee cap over the blob base fee of the latest
+// block, so the transaction stays includable while the blob base fee rises by up to 12.5% per block.
+const blobFeeCapMultiplier = 2
+
+type headerReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// estimateBlobFeeCap estimates the max fee per blob gas from the excess blob gas of the latest header.
+func estimateBlobFeeCap(ctx context.Context, client headerReader) (*uint256.Int, error) {
+	header, err := client.HeaderByNumber(ctx, nil)
 	if err != nil {
-		log.Crit("Unable to send transaction", "error", err)
+		return nil, fmt.Errorf("failed to get latest header: %w", err)
 	}
-
-	for {
-		// receipt, err = client.TransactionReceipt(context.Background(), txWithBlobs.Transaction.Hash())
-		txn, isPending, err := client.TransactionByHash(context.Background(), tx.Hash())
-		if err != nil || isPending {
-			time.Sleep(1 * time.Second)
-		} else {
-			tx = txn
-			break
-		}
+	if header.ExcessBlobGas == nil {
+		return nil, errors.New("latest header has no excess blob gas, is Cancun activated?")
 	}
-
-	log.Info("Transaction submitted.", "nonce", nonce, "hash", tx.Hash(), "blobs", len(blobs))
-	return tx
+	fee := new(big.Int).Mul(eip4844.CalcBlobFee(*header.ExcessBlobGas), big.NewInt(blobFeeCapMultiplier))
+	feeCap, overflow := uint256.FromBig(fee)
+	if overflow {
+		return nil, fmt.Errorf("%w: %s", ErrGasPriceTooHigh, fee)
+	}
+	return feeCap, nil
 }
 
 func ConvertToBlobs(data []byte) []kzg4844.Blob {
@@ -284,21 +395,40 @@ func DecodeUint256String(hexOrDecimal string) (*uint256.Int, error) {
 	return val256, nil
 }
 
+// ConfirmBlobTx waits for the receipt of the blob transaction sent at sent, and records the gas used and
+// the time to confirmation, or the revert, to the metrics.
+func ConfirmBlobTx(ctx context.Context, b bind.DeployBackend, tx *types.Transaction, sent time.Time, m UploadMetricer) (*types.Receipt, error) {
+	receipt, err := bind.WaitMined(ctx, b, tx)
+	if err != nil {
+		return nil, err
+	}
+	m.RecordGasUsed(receipt.GasUsed)
+	if receipt.Status == types.ReceiptStatusFailed {
+		m.RecordBatchReverted()
+		return nil, ErrBlobTxReverted
+	}
+	m.RecordConfirmation(time.Since(sent))
+	return receipt, nil
+}
+
 // upload blobs and call putBlobs(bytes32[] memory keys)
-// and returns the kv indexes and the data hashes
+// and returns the kv indexes and the data hashes.
+// The max fee per blob gas is estimated from the latest block if empty, like SendBlobTx.
 func UploadBlobs(
 	pc *eth.PollingClient,
-	rpc, private, chainID string,
+	rpc string,
+	signer Signer,
+	chainID string,
 	contractAddr common.Address,
 	data []byte,
 	needEncoding bool,
-	value string) ([]uint64, []common.Hash, error) {
-	key, err := crypto.HexToECDSA(private)
-	if err != nil {
-		log.Error("Invalid private key", "err", err)
-		return nil, nil, err
+	value string,
+	gasLimit uint64,
+	maxFeePerBlobGas string,
+	m UploadMetricer) ([]uint64, []common.Hash, error) {
+	if m == nil {
+		m = NoopUploadMetrics
 	}
-	signer := crypto.PubkeyToAddress(key.PublicKey)
 	var keys []common.Hash
 
 	var blobs []kzg4844.Blob
@@ -308,40 +438,41 @@ func UploadBlobs(
 		blobs = ConvertToBlobs(data)
 	}
 	for i, blob := range blobs {
-		keys = append(keys, genKey(signer, i, blob[:]))
+		keys = append(keys, genKey(signer.Address(), i, blob[:]))
 	}
-	bytes32Array, _ := abi.NewType("bytes32[]", "", nil)
-	dataField, _ := abi.Arguments{{Type: bytes32Array}}.Pack(keys)
-	h := crypto.Keccak256Hash([]byte("putBlobs(bytes32[])"))
-	calldata := "0x" + common.Bytes2Hex(append(h[0:4], dataField...))
-	tx := SendBlobTx(
+	putBlobs, err := eth.NewStorageContract(contractAddr, pc).PackPutBlobs(keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to pack putBlobs: %w", err)
+	}
+	calldata := "0x" + common.Bytes2Hex(putBlobs)
+	sent := time.Now()
+	tx, err := SendBlobTx(
 		rpc,
 		contractAddr,
-		private,
+		signer,
 		data,
 		needEncoding,
 		-1,
 		value,
-		5000000,
+		gasLimit,
 		"",
 		"",
-		"300000000",
+		maxFeePerBlobGas,
 		chainID,
 		calldata,
 	)
+	if err != nil {
+		log.Error("Failed to send blob transaction", "err", err)
+		return nil, nil, err
+	}
 	log.Info("SendBlobTx done.", "txHash", tx.Hash())
+	m.RecordBatchSubmitted()
 	resultCh := make(chan *types.Receipt, 1)
 	errorCh := make(chan error, 1)
-	revert := fmt.Errorf("revert")
 	go func() {
-		receipt, err := bind.WaitMined(context.Background(), pc.Client, tx)
+		receipt, err := ConfirmBlobTx(context.Background(), pc.Client, tx, sent, m)
 		if err != nil {
-			log.Error("Get transaction receipt err", "error", err)
 			errorCh <- err
-		}
-		if receipt.Status == 0 {
-			log.Error("Blob transaction reverted")
-			errorCh <- revert
 			return
 		}
 		log.Info("Blob transaction confirmed successfully", "txHash", tx.Hash())
@@ -364,7 +495,7 @@ func UploadBlobs(
 		return kvIndexes, dataHashs, nil
 	case err := <-errorCh:
 		log.Error("Get transaction receipt err", "error", err)
-		if err == revert {
+		if errors.Is(err, ErrBlobTxReverted) {
 			return nil, nil, err
 		}
 	case <-time.After(5 * time.Second):
@@ -392,10 +523,11 @@ func getKvInfo(pc *eth.PollingClient, contractAddr common.Address, blobLen int)
 		return nil, nil, errors.New("invalid params lens")
 	}
 	var hashes []common.Hash
+	blobLog := esLog.NewBlobLogger(log, contractAddr, 0)
 	for i := 0; i < len(metas); i++ {
 		var dhash common.Hash
 		copy(dhash[:], metas[i][32-ethstorage.HashSizeInContract:32])
-		log.Info("Get data hash", "kvIndex", kvIndices[i], "hash", dhash.Hex())
+		blobLog.WithBlob(kvIndices[i]).Info("Get data hash", "hash", dhash.Hex())
 		hashes = append(hashes, dhash)
 	}
 	return kvIndices, hashes, nil
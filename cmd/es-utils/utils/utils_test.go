@@ -5,8 +5,19 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"math/big"
 	"os"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/misc/eip4844"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
 )
 
 func TestEncodeDecodeBlob(t *testing.T) {
@@ -50,3 +61,88 @@ func readTxt(t *testing.T, n int) []byte {
 	}
 	return data[:n]
 }
+
+func TestSendBlobTxInvalidParam(t *testing.T) {
+	if _, err := NewKeySigner("0xzz"); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("expected ErrInvalidParam for the private key, got %v", err)
+	}
+	signer, err := NewKeySigner("8da4ef21b864d2cc526dbdb2a120bd2874c36c9d0a1fb7f8c63d7f7a8b41de8f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name               string
+		value, gas, maxFee string
+		chainID, calldata  string
+	}{
+		{"value", "ten", "", "300000000", "3151908", "0x"},
+		{"gas price", "0x0", "abc", "300000000", "3151908", "0x"},
+		{"max fee per data gas", "0x0", "", "xyz", "3151908", "0x"},
+		{"chain id", "0x0", "", "300000000", "", "0x"},
+		{"calldata", "0x0", "", "300000000", "3151908", "0xzz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the params are checked before connecting, so the unreachable endpoint is never dialed
+			_, err := SendBlobTx("http://127.0.0.1:1", common.Address{}, signer, []byte{1}, true, -1, tt.value,
+				21000, tt.gas, "", tt.maxFee, tt.chainID, tt.calldata)
+			if !errors.Is(err, ErrInvalidParam) {
+				t.Fatalf("expected ErrInvalidParam, got %v", err)
+			}
+		})
+	}
+}
+
+type mockHeaderReader struct {
+	header *types.Header
+}
+
+func (r *mockHeaderReader) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return r.header, nil
+}
+
+func TestNewBlobTx(t *testing.T) {
+	excessBlobGas := uint64(10 * params.BlobTxTargetBlobGasPerBlock)
+	feeCap, err := estimateBlobFeeCap(context.Background(), &mockHeaderReader{&types.Header{ExcessBlobGas: &excessBlobGas}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := new(big.Int).Mul(eip4844.CalcBlobFee(excessBlobGas), big.NewInt(blobFeeCapMultiplier)); feeCap.ToBig().Cmp(want) != 0 {
+		t.Fatalf("blob fee cap %s, want %s", feeCap, want)
+	}
+	if _, err := estimateBlobFeeCap(context.Background(), &mockHeaderReader{&types.Header{}}); err == nil {
+		t.Fatal("expected an error for a header before Cancun")
+	}
+
+	blobs := EncodeBlobs(generateSequentialBytes(t, 40*4096))
+	if len(blobs) != 2 {
+		t.Fatalf("expected 2 blobs, got %d", len(blobs))
+	}
+	to := common.HexToAddress("0x0000000000000000000000000000000003330001")
+	blobTx, err := newBlobTx(big.NewInt(3151908), 7, uint256.NewInt(1), uint256.NewInt(2), 21000, to,
+		uint256.NewInt(0), []byte{0x01}, feeCap, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := crypto.GenerateKey()
+	tx := types.MustSignNewTx(key, types.NewCancunSigner(big.NewInt(3151908)), blobTx)
+	if tx.Type() != types.BlobTxType || tx.BlobGasFeeCap().Cmp(feeCap.ToBig()) != 0 {
+		t.Fatalf("unexpected tx type %d or blob fee cap %s", tx.Type(), tx.BlobGasFeeCap())
+	}
+	sidecar := tx.BlobTxSidecar()
+	if sidecar == nil || len(sidecar.Commitments) != len(blobs) || len(sidecar.Proofs) != len(blobs) {
+		t.Fatal("sidecar commitments or proofs missing")
+	}
+	hashes := tx.BlobHashes()
+	if len(hashes) != len(blobs) {
+		t.Fatalf("expected %d blob hashes, got %d", len(blobs), len(hashes))
+	}
+	for i, h := range hashes {
+		if h != kZGToVersionedHash(sidecar.Commitments[i]) {
+			t.Errorf("blob hash %d does not match the versioned hash of the commitment", i)
+		}
+		if err := kzg4844.VerifyBlobProof(sidecar.Blobs[i], sidecar.Commitments[i], sidecar.Proofs[i]); err != nil {
+			t.Errorf("invalid proof of blob %d: %v", i, err)
+		}
+	}
+}
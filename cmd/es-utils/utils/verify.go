@@ -0,0 +1,129 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// metaBatchSize is the number of KV metas read from the contract in a call.
+const metaBatchSize = 64
+
+// the first bit after the data hash in the meta is set once a blob (including an empty one) is filled
+const blobFillingMask = byte(0b10000000)
+
+// KvMismatch describes a KV of a synced shard that does not match the reference shard.
+type KvMismatch struct {
+	KvIdx  uint64
+	Reason string
+}
+
+// VerifyShard compares the KVs in [start, end) of a synced shard against a trusted reference shard.
+// Blobs are compared after decoding, so the two shards may use different miners and encode types.
+// Every KV must be filled, have the same commit as the reference, and decode to the same data;
+// for an empty slot the decoded data must be all zero, which is checked when reading it.
+func VerifyShard(synced, ref *ethstorage.DataShard, kvSize, start, end uint64) ([]KvMismatch, error) {
+	var mismatches []KvMismatch
+	for idx := start; idx < end; idx++ {
+		meta, err := synced.ReadMeta(idx)
+		if err != nil {
+			return mismatches, fmt.Errorf("read meta of kv %d failed: %w", idx, err)
+		}
+		refMeta, err := ref.ReadMeta(idx)
+		if err != nil {
+			return mismatches, fmt.Errorf("read reference meta of kv %d failed: %w", idx, err)
+		}
+		if meta[ethstorage.HashSizeInContract]&blobFillingMask == 0 {
+			mismatches = append(mismatches, KvMismatch{idx, "not filled"})
+			continue
+		}
+		if !bytes.Equal(meta[:ethstorage.HashSizeInContract], refMeta[:ethstorage.HashSizeInContract]) {
+			mismatches = append(mismatches, KvMismatch{idx, fmt.Sprintf("commit mismatch: %x, reference %x",
+				meta[:ethstorage.HashSizeInContract], refMeta[:ethstorage.HashSizeInContract])})
+			continue
+		}
+		data, _, err := synced.ReadWithMeta(idx, int(kvSize))
+		if err != nil {
+			mismatches = append(mismatches, KvMismatch{idx, fmt.Sprintf("read failed: %v", err)})
+			continue
+		}
+		refData, _, err := ref.ReadWithMeta(idx, int(kvSize))
+		if err != nil {
+			return mismatches, fmt.Errorf("read reference kv %d failed: %w", idx, err)
+		}
+		if !bytes.Equal(data, refData) {
+			mismatches = append(mismatches, KvMismatch{idx, "data mismatch"})
+		}
+	}
+	return mismatches, nil
+}
+
+// KvMetaReader reads the metas of the KVs from the storage contract, implemented by eth.PollingClient.
+type KvMetaReader interface {
+	GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error)
+}
+
+// VerifyAgainstContract checks the KVs in [start, end) of a shard against the data hashes stored in the
+// contract. Every KV must be filled with the hash in the contract, and the versioned hash recomputed from
+// the decoded blob must match it; a KV empty in the contract must be empty locally.
+func VerifyAgainstContract(ds *ethstorage.DataShard, contract KvMetaReader, kvSize, start, end uint64) ([]KvMismatch, error) {
+	if kvSize != uint64(len(kzg4844.Blob{})) {
+		return nil, fmt.Errorf("kv size %d is not the blob size", kvSize)
+	}
+	var mismatches []KvMismatch
+	for first := start; first < end; first += metaBatchSize {
+		kvIndices := make([]uint64, 0, metaBatchSize)
+		for idx := first; idx < min(first+metaBatchSize, end); idx++ {
+			kvIndices = append(kvIndices, idx)
+		}
+		metas, err := contract.GetKvMetas(kvIndices, rpc.LatestBlockNumber.Int64())
+		if err != nil {
+			return mismatches, fmt.Errorf("read metas of kv %d to %d from contract failed: %w", first, first+uint64(len(kvIndices)), err)
+		}
+		for i, idx := range kvIndices {
+			if m := verifyKvAgainstMeta(ds, idx, metas[i], kvSize); m != nil {
+				mismatches = append(mismatches, *m)
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+func verifyKvAgainstMeta(ds *ethstorage.DataShard, idx uint64, contractMeta [32]byte, kvSize uint64) *KvMismatch {
+	hash := contractMeta[32-ethstorage.HashSizeInContract:]
+	meta, err := ds.ReadMeta(idx)
+	if err != nil {
+		return &KvMismatch{idx, fmt.Sprintf("read meta failed: %v", err)}
+	}
+	if meta[ethstorage.HashSizeInContract]&blobFillingMask == 0 {
+		return &KvMismatch{idx, "not filled"}
+	}
+	if !bytes.Equal(meta[:ethstorage.HashSizeInContract], hash) {
+		return &KvMismatch{idx, fmt.Sprintf("hash mismatch: %x, contract %x", meta[:ethstorage.HashSizeInContract], hash)}
+	}
+	// the empty data is checked when reading it, as it has no versioned hash
+	data, _, err := ds.ReadWithMeta(idx, int(kvSize))
+	if err != nil {
+		return &KvMismatch{idx, fmt.Sprintf("read failed: %v", err)}
+	}
+	if bytes.Equal(hash, ethstorage.EmptyBlobCommit) {
+		return nil
+	}
+	var blob kzg4844.Blob
+	copy(blob[:], data)
+	_, _, versionedHashes, err := ComputeBlobs([]kzg4844.Blob{blob})
+	if err != nil {
+		return &KvMismatch{idx, fmt.Sprintf("compute versioned hash failed: %v", err)}
+	}
+	if !bytes.Equal(versionedHashes[0][:ethstorage.HashSizeInContract], hash) {
+		return &KvMismatch{idx, fmt.Sprintf("versioned hash mismatch: %x, contract %x",
+			versionedHashes[0][:ethstorage.HashSizeInContract], hash)}
+	}
+	return nil
+}
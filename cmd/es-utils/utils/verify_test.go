@@ -0,0 +1,128 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+const (
+	verifyKvSize    = uint64(131072)
+	verifyKvEntries = uint64(4)
+)
+
+func newVerifyShard(t *testing.T, name string, encodeType uint64, miner common.Address) *ethstorage.DataShard {
+	df, err := ethstorage.Create(filepath.Join(t.TempDir(), name), 0, verifyKvEntries, 0, verifyKvSize, encodeType, miner, verifyKvSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := ethstorage.NewDataShard(0, verifyKvSize, verifyKvEntries, verifyKvSize)
+	if err := ds.AddDataFile(df); err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+// writeFilled writes the blob with the filling bit set in the meta like the storage manager does.
+func writeFilled(t *testing.T, ds *ethstorage.DataShard, kvIdx uint64, data []byte) {
+	commit := common.Hash{}
+	if len(data) > 0 {
+		blobs := EncodeBlobs(data)
+		_, _, hashes, err := ComputeBlobs(blobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(commit[:ethstorage.HashSizeInContract], hashes[0][:ethstorage.HashSizeInContract])
+		data = blobs[0][:]
+	}
+	commit[ethstorage.HashSizeInContract] |= blobFillingMask
+	if err := ds.Write(kvIdx, data, commit); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyShard(t *testing.T) {
+	synced := newVerifyShard(t, "synced.dat", ethstorage.NO_ENCODE, common.Address{})
+	ref := newVerifyShard(t, "ref.dat", ethstorage.ENCODE_KECCAK_256, common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"))
+	defer synced.Close()
+	defer ref.Close()
+
+	blob := generateSequentialBytes(t, 1024)
+	// kv 0: same blob, kv 1: empty filled, kv 2: different blob, kv 3: not filled in the synced shard
+	for _, ds := range []*ethstorage.DataShard{synced, ref} {
+		writeFilled(t, ds, 0, blob)
+		writeFilled(t, ds, 1, nil)
+	}
+	writeFilled(t, synced, 2, blob[:512])
+	writeFilled(t, ref, 2, blob)
+	writeFilled(t, ref, 3, blob)
+
+	mismatches, err := VerifyShard(synced, ref, verifyKvSize, 0, verifyKvEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 2 || mismatches[0].KvIdx != 2 || mismatches[1].KvIdx != 3 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+
+	mismatches, err = VerifyShard(synced, ref, verifyKvSize, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+}
+
+// mockKvMetas serves the metas of a contract with the data hashes at the end of the metas.
+type mockKvMetas map[uint64]common.Hash
+
+func (m mockKvMetas) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas := make([][32]byte, len(kvIndices))
+	for i, idx := range kvIndices {
+		hash := m[idx]
+		copy(metas[i][32-ethstorage.HashSizeInContract:], hash[:ethstorage.HashSizeInContract])
+	}
+	return metas, nil
+}
+
+func TestVerifyAgainstContract(t *testing.T) {
+	ds := newVerifyShard(t, "local.dat", ethstorage.ENCODE_KECCAK_256, common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"))
+	defer ds.Close()
+
+	blob := generateSequentialBytes(t, 1024)
+	_, _, hashes, err := ComputeBlobs(EncodeBlobs(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, otherHashes, err := ComputeBlobs(EncodeBlobs(blob[:512]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kv 0: same blob, kv 1: empty, kv 2: another blob in the contract, kv 3: not filled locally
+	writeFilled(t, ds, 0, blob)
+	writeFilled(t, ds, 1, nil)
+	writeFilled(t, ds, 2, blob)
+	contract := mockKvMetas{0: hashes[0], 2: otherHashes[0], 3: hashes[0]}
+
+	mismatches, err := VerifyAgainstContract(ds, contract, verifyKvSize, 0, verifyKvEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 2 || mismatches[0].KvIdx != 2 || mismatches[1].KvIdx != 3 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+
+	mismatches, err = VerifyAgainstContract(ds, contract, verifyKvSize, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("unexpected mismatches %v", mismatches)
+	}
+}
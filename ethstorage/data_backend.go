@@ -0,0 +1,145 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Backend is the storage a data file is kept in, which is a local file by default.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+	// Truncate changes the size of the storage, with the bytes beyond the old size read as zeros.
+	Truncate(size int64) error
+	Size() (int64, error)
+	// Sync commits the written data to the stable storage.
+	Sync() error
+	Close() error
+	// Name identifies the storage in the logs and errors, e.g. the path of a file.
+	Name() string
+}
+
+// holePuncher is implemented by the backends able to free the storage of a range, which is then read as
+// zeros without changing the size.
+type holePuncher interface {
+	PunchHole(off, size int64) error
+}
+
+// fileBackend keeps the data file in a local file, which can be mapped in memory.
+type fileBackend struct {
+	*os.File
+}
+
+func (b *fileBackend) Size() (int64, error) {
+	fi, err := b.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// MemBackend keeps the data file in memory, e.g. for the tests.
+type MemBackend struct {
+	name string
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemBackend(name string) *MemBackend {
+	return &MemBackend{name: name}
+}
+
+func (b *MemBackend) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *MemBackend) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(b.data)) {
+		b.resize(end)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+func (b *MemBackend) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resize(size)
+	return nil
+}
+
+// resize grows the data with zeros or cuts it. The caller must hold b.mu.
+func (b *MemBackend) resize(size int64) {
+	if size <= int64(len(b.data)) {
+		b.data = b.data[:size]
+		return
+	}
+	data := make([]byte, size)
+	copy(data, b.data)
+	b.data = data
+}
+
+func (b *MemBackend) PunchHole(off, size int64) error {
+	if off < 0 || size < 0 {
+		return errors.New("negative range")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if off < int64(len(b.data)) {
+		clear(b.data[off:min(off+size, int64(len(b.data)))])
+	}
+	return nil
+}
+
+func (b *MemBackend) Size() (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return int64(len(b.data)), nil
+}
+
+func (b *MemBackend) Sync() error  { return nil }
+func (b *MemBackend) Close() error { return nil }
+func (b *MemBackend) Name() string { return b.name }
+
+// errBackendNotImplemented is returned by the backends not supported yet.
+var errBackendNotImplemented = errors.New("backend not implemented")
+
+// S3Backend is a placeholder for keeping the data file in an S3 object, which is not supported yet.
+// Such a backend is expected to cache the written ranges and upload them on Sync.
+type S3Backend struct {
+	Bucket string
+	Key    string
+}
+
+func (b *S3Backend) ReadAt(p []byte, off int64) (int, error)  { return 0, errBackendNotImplemented }
+func (b *S3Backend) WriteAt(p []byte, off int64) (int, error) { return 0, errBackendNotImplemented }
+func (b *S3Backend) Truncate(size int64) error                { return errBackendNotImplemented }
+func (b *S3Backend) Size() (int64, error)                     { return 0, errBackendNotImplemented }
+func (b *S3Backend) Sync() error                              { return errBackendNotImplemented }
+func (b *S3Backend) Close() error                             { return nil }
+func (b *S3Backend) Name() string                             { return fmt.Sprintf("s3://%s/%s", b.Bucket, b.Key) }
@@ -0,0 +1,17 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build linux
+
+package ethstorage
+
+import "golang.org/x/sys/unix"
+
+// PunchHole deallocates the blocks of the range, keeping the size of the file. An empty range is a no-op,
+// which fallocate rejects.
+func (b *fileBackend) PunchHole(off, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	return unix.Fallocate(int(b.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
+}
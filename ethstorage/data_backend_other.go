@@ -0,0 +1,15 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build !linux
+
+package ethstorage
+
+import "errors"
+
+var errPunchHoleUnsupported = errors.New("punching holes is unsupported on this platform")
+
+// PunchHole fails as the blocks of a file cannot be deallocated on the platform.
+func (b *fileBackend) PunchHole(off, size int64) error {
+	return errPunchHoleUnsupported
+}
@@ -6,11 +6,15 @@ package ethstorage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/detailyang/go-fallocate"
+	"github.com/edsrzf/mmap-go"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 )
 
 const (
@@ -22,14 +26,22 @@ const (
 
 	// keccak256(b'Web3Q Large Storage')[0:8]
 	MAGIC   = uint64(0xcf20bd770c22b2e1)
-	VERSION = uint64(1)
+	VERSION = uint64(2) // 2 adds the chunk checksums, which the nodes of version 1 would not keep updated
 
 	HEADER_SIZE = 4096
 )
 
+// statusPunched is set in the status of the header once the tail of the data file is punched by Compact,
+// in which case the header keeps the first kv punched.
+const statusPunched = uint64(1) << 0
+
+// ErrIncompleteHeader is returned when opening a data file whose header is truncated or not written yet,
+// e.g. its creation was interrupted, as the header is written after the file is allocated.
+var ErrIncompleteHeader = errors.New("incomplete data file header")
+
 // A DataFile represents a local file for a consecutive chunks
 type DataFile struct {
-	file          *os.File
+	backend       Backend
 	chunkIdxStart uint64
 	chunkIdxLen   uint64
 	encodeType    uint64
@@ -37,6 +49,15 @@ type DataFile struct {
 	chunkSize     uint64
 	metaSize      uint64         // per KV meta size (like commit)
 	miner         common.Address // storage provider key
+	punched       bool           // the tail of the file is punched by Compact, see isPunched
+	punchedFrom   uint64         // kvs from it are punched, and read as empty until written with a blob
+	mapped        mmap.MMap      // read-only mapping of the file serving the reads, nil if reads use ReadAt
+	checksums     bool           // the checksum of each chunk is stored after the metas
+	zeroChunkSum  uint32         // CRC32C of a chunk of zeros, see checksum
+	reencoding    bool           // the kvs are being re-encoded for reencodeMiner, see ReEncodeShard
+	reencodeMiner common.Address // miner the kvs are being re-encoded for
+	reencodeNext  uint64         // kvs before it are re-encoded for reencodeMiner
+	growing       bool           // created with AllocNone, so the bytes beyond the end of the file are zeros
 }
 
 type DataFileHeader struct {
@@ -50,6 +71,9 @@ type DataFileHeader struct {
 	metaSize      uint64
 	miner         common.Address
 	status        uint64
+	punchedFrom   uint64
+	reencodeMiner common.Address
+	reencodeNext  uint64
 }
 
 // Mask the data in place.  Padding zeros to userData if the len of userData is smaller than that of maskData,
@@ -74,31 +98,99 @@ func UnmaskDataInPlace(userData []byte, maskData []byte) []byte {
 	return maskData[:len(userData)]
 }
 
+// AllocStrategy decides how the disk space of a data file is allocated when it is created.
+type AllocStrategy string
+
+const (
+	// AllocFull allocates the disk space of the whole data file up front with fallocate.
+	AllocFull AllocStrategy = "full"
+	// AllocSparse sizes the data file without allocating its disk space, which is taken as the kvs are
+	// written. The filesystem needs to support sparse files, or the space is allocated anyway.
+	AllocSparse AllocStrategy = "sparse"
+	// AllocNone only writes the header, and the data file grows as it is written, which suits the
+	// filesystems failing to preallocate or truncate a large file, e.g. some network filesystems. As the
+	// metas are kept after the chunks, the first meta written extends the file over the chunks not written.
+	AllocNone AllocStrategy = "none"
+)
+
+// statusGrowing is set in the status of the header if the data file is created with AllocNone, in which
+// case the bytes beyond the end of the file are the ones not written yet, and read as zeros.
+const statusGrowing = uint64(1) << 3
+
+// ParseAllocStrategy parses the name of an AllocStrategy, where an empty name means AllocFull.
+func ParseAllocStrategy(name string) (AllocStrategy, error) {
+	switch a := AllocStrategy(name); a {
+	case "":
+		return AllocFull, nil
+	case AllocFull, AllocSparse, AllocNone:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown alloc strategy %q", name)
+}
+
 func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64) (*DataFile, error) {
-	if chunkSize > maxKvSize {
-		return nil, fmt.Errorf("chunkSize must be smaller than maxKvSize")
+	return CreateWithStrategy(filename, AllocFull, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType, miner, chunkSize)
+}
+
+// CreateSparse creates a data file like Create, but without allocating the disk space of the chunks, so
+// the space is taken as the kvs are written.
+func CreateSparse(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64) (*DataFile, error) {
+	return CreateWithStrategy(filename, AllocSparse, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType, miner, chunkSize)
+}
+
+// CreateWithStrategy creates a data file like Create, with its disk space allocated by the strategy.
+func CreateWithStrategy(filename string, strategy AllocStrategy, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64,
+	miner common.Address, chunkSize uint64) (*DataFile, error) {
+	if err := checkDataFileParams(chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, chunkSize); err != nil {
+		return nil, err
 	}
-	if (chunkIdxLen*chunkSize)%maxKvSize != 0 {
-		return nil, fmt.Errorf("chunkSize * chunkIdxLen must be multiple of maxKvSize")
+	strategy, err := ParseAllocStrategy(string(strategy))
+	if err != nil {
+		return nil, err
 	}
-	if (chunkIdxStart*chunkSize)%maxKvSize != 0 {
-		return nil, fmt.Errorf("chunkSize * chunkIdxStart must be multiple of maxKvSize")
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
 	}
-	if !isPow2n(chunkSize) || !isPow2n(maxKvSize) {
-		return nil, fmt.Errorf("chunkSize and maxKvSize must be 2^n")
+	backend := &fileBackend{file}
+	switch strategy {
+	case AllocFull:
+		// actual initialization is done when synchronize
+		if err := fallocate.Fallocate(file, int64((chunkSize+32+checksumSize)*chunkIdxLen), int64(HEADER_SIZE)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	case AllocNone:
+		if err := backend.Truncate(HEADER_SIZE); err != nil {
+			file.Close()
+			return nil, err
+		}
+		df, err := newDataFile(backend, chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, miner, chunkSize, true)
+		if err != nil {
+			file.Close()
+		}
+		return df, err
 	}
+	return CreateWithBackend(backend, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType, miner, chunkSize)
+}
 
-	file, err := os.Create(filename)
-	if err != nil {
+// CreateWithBackend creates a data file in the backend, which is sized to hold all the chunks, metas and checksums.
+func CreateWithBackend(backend Backend, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64) (*DataFile, error) {
+	if err := checkDataFileParams(chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, chunkSize); err != nil {
 		return nil, err
 	}
-	// actual initialization is done when synchronize
-	err = fallocate.Fallocate(file, int64((chunkSize+32)*chunkIdxLen), int64(HEADER_SIZE))
-	if err != nil {
+	if err := backend.Truncate(int64(HEADER_SIZE + (chunkSize+32+checksumSize)*chunkIdxLen)); err != nil {
 		return nil, err
 	}
+	return newDataFile(backend, chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, miner, chunkSize, false)
+}
+
+// newDataFile writes the header of a new data file to the backend, growing tells whether the file is
+// created with AllocNone.
+func newDataFile(backend Backend, chunkIdxStart, chunkIdxLen, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64,
+	growing bool) (*DataFile, error) {
 	dataFile := &DataFile{
-		file:          file,
+		backend:       backend,
 		chunkIdxStart: chunkIdxStart,
 		chunkIdxLen:   chunkIdxLen,
 		encodeType:    encodeType,
@@ -106,22 +198,108 @@ func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encod
 		miner:         miner,
 		chunkSize:     chunkSize,
 		metaSize:      32,
+		checksums:     true,
+		zeroChunkSum:  zeroChunkChecksum(chunkSize),
+		growing:       growing,
+	}
+	if err := dataFile.writeHeader(); err != nil {
+		return nil, err
 	}
-	dataFile.writeHeader()
 	return dataFile, nil
 }
 
+func checkDataFileParams(chunkIdxStart, chunkIdxLen, maxKvSize, encodeType, chunkSize uint64) error {
+	if chunkSize > maxKvSize {
+		return fmt.Errorf("chunkSize must be smaller than maxKvSize")
+	}
+	if (chunkIdxLen*chunkSize)%maxKvSize != 0 {
+		return fmt.Errorf("chunkSize * chunkIdxLen must be multiple of maxKvSize")
+	}
+	if (chunkIdxStart*chunkSize)%maxKvSize != 0 {
+		return fmt.Errorf("chunkSize * chunkIdxStart must be multiple of maxKvSize")
+	}
+	if !isPow2n(chunkSize) || !isPow2n(maxKvSize) {
+		return fmt.Errorf("chunkSize and maxKvSize must be 2^n")
+	}
+	if !IsValidEncodeType(encodeType) {
+		return fmt.Errorf("unknown encode type %d", encodeType)
+	}
+	return nil
+}
+
 func OpenDataFile(filename string) (*DataFile, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
 	if err != nil {
 		return nil, err
 	}
+	return OpenDataFileWithBackend(&fileBackend{file})
+}
+
+// OpenDataFileWithBackend opens the data file created in the backend.
+func OpenDataFileWithBackend(backend Backend) (*DataFile, error) {
 	dataFile := &DataFile{
-		file: file,
+		backend: backend,
 	}
 	return dataFile, dataFile.readHeader()
 }
 
+// OpenMmapDataFile opens the data file like OpenDataFile, and maps it in memory to serve the reads
+// without a syscall per read. The writes still go through WriteAt, which the shared mapping sees.
+// If the file cannot be mapped, e.g. mmap is not supported on the platform, the reads use ReadAt.
+func OpenMmapDataFile(filename string) (*DataFile, error) {
+	df, err := OpenDataFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := df.mmap(); err != nil {
+		log.Warn("Failed to map data file, reading with ReadAt", "file", filename, "err", err)
+	}
+	return df, nil
+}
+
+// mmap maps the file in memory, which is only supported by the file backend.
+func (df *DataFile) mmap() error {
+	fb, ok := df.backend.(*fileBackend)
+	if !ok {
+		return fmt.Errorf("backend %s cannot be mapped", df.backend.Name())
+	}
+	mapped, err := mmap.Map(fb.File, mmap.RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	df.mapped = mapped
+	return nil
+}
+
+// unmap flushes the mapping and unmaps it, so the reads use ReadAt.
+func (df *DataFile) unmap() error {
+	if df.mapped == nil {
+		return nil
+	}
+	if err := df.mapped.Flush(); err != nil {
+		return err
+	}
+	if err := df.mapped.Unmap(); err != nil {
+		return err
+	}
+	df.mapped = nil
+	return nil
+}
+
+// readAt reads len(b) bytes at the offset of the file, from the mapping if the file is mapped. The bytes
+// beyond the end of a file created with AllocNone, which grows as it is written, are read as zeros.
+func (df *DataFile) readAt(b []byte, off int64) (int, error) {
+	if df.mapped == nil || off < 0 || off+int64(len(b)) > int64(len(df.mapped)) {
+		n, err := df.backend.ReadAt(b, off)
+		if err == io.EOF && df.growing && off >= 0 {
+			clear(b[n:])
+			return len(b), nil
+		}
+		return n, err
+	}
+	return copy(b, df.mapped[off:]), nil
+}
+
 func (df *DataFile) Contains(chunkIdx uint64) bool {
 	return chunkIdx >= df.chunkIdxStart && chunkIdx < df.ChunkIdxEnd()
 }
@@ -150,6 +328,18 @@ func (df *DataFile) Miner() common.Address {
 	return df.miner
 }
 
+func (df *DataFile) EncodeType() uint64 {
+	return df.encodeType
+}
+
+func (df *DataFile) MaxKvSize() uint64 {
+	return df.maxKvSize
+}
+
+func (df *DataFile) ChunkSize() uint64 {
+	return df.chunkSize
+}
+
 // Read raw chunk data from the storage file.
 func (df *DataFile) Read(chunkIdx uint64, len int) ([]byte, error) {
 	if !df.Contains(chunkIdx) {
@@ -159,7 +349,26 @@ func (df *DataFile) Read(chunkIdx uint64, len int) ([]byte, error) {
 		return nil, fmt.Errorf("read too large")
 	}
 	md := make([]byte, len)
-	n, err := df.file.ReadAt(md, HEADER_SIZE+int64(chunkIdx-df.chunkIdxStart)*int64(df.chunkSize))
+	n, err := df.readAt(md, HEADER_SIZE+int64(chunkIdx-df.chunkIdxStart)*int64(df.chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	if n != len {
+		return nil, fmt.Errorf("not full read")
+	}
+	return md, nil
+}
+
+// readRange read len bytes of raw chunk data starting at off within the chunk.
+func (df *DataFile) readRange(chunkIdx uint64, off, len int) ([]byte, error) {
+	if !df.Contains(chunkIdx) {
+		return nil, fmt.Errorf("chunk not found")
+	}
+	if off+len > int(df.chunkSize) {
+		return nil, fmt.Errorf("read too large")
+	}
+	md := make([]byte, len)
+	n, err := df.readAt(md, HEADER_SIZE+int64(chunkIdx-df.chunkIdxStart)*int64(df.chunkSize)+int64(off))
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +385,7 @@ func (df *DataFile) ReadSample(sampleIdx uint64) (common.Hash, error) {
 	}
 
 	md := make([]byte, 32)
-	n, err := df.file.ReadAt(md, HEADER_SIZE+int64(sampleIdx*32)-int64(df.chunkIdxStart*df.chunkSize))
+	n, err := df.readAt(md, HEADER_SIZE+int64(sampleIdx*32)-int64(df.chunkIdxStart*df.chunkSize))
 	if err != nil {
 		return common.Hash{}, err
 	}
@@ -196,7 +405,44 @@ func (df *DataFile) Write(chunkIdx uint64, b []byte) error {
 		return fmt.Errorf("write data too large")
 	}
 
-	_, err := df.file.WriteAt(b, HEADER_SIZE+int64(chunkIdx-df.chunkIdxStart)*int64(df.chunkSize))
+	if _, err := df.backend.WriteAt(b, HEADER_SIZE+int64(chunkIdx-df.chunkIdxStart)*int64(df.chunkSize)); err != nil {
+		return err
+	}
+	if !df.checksums {
+		return nil
+	}
+	if len(b) < int(df.chunkSize) {
+		// the checksum covers the whole chunk including the bytes not overwritten
+		chunk, err := df.Read(chunkIdx, int(df.chunkSize))
+		if err != nil {
+			return err
+		}
+		b = chunk
+	}
+	return df.writeChecksums(chunkIdx, b)
+}
+
+// writeKvs writes the encoded chunks and the metas of adjacent KVs starting at kvIdx,
+// with a single WriteAt for the chunks and another one for the metas.
+func (df *DataFile) writeKvs(kvIdx uint64, chunks []byte, metas []byte) error {
+	kvs := uint64(len(metas)) / df.metaSize
+	if kvs == 0 || !df.ContainsKv(kvIdx) || !df.ContainsKv(kvIdx+kvs-1) {
+		return fmt.Errorf("kv not found")
+	}
+	if uint64(len(chunks)) != kvs*df.maxKvSize {
+		return fmt.Errorf("chunks do not match the metas")
+	}
+
+	chunkIdx := kvIdx * df.maxKvSize / df.chunkSize
+	if _, err := df.backend.WriteAt(chunks, HEADER_SIZE+int64(chunkIdx-df.chunkIdxStart)*int64(df.chunkSize)); err != nil {
+		return err
+	}
+	if df.checksums {
+		if err := df.writeChecksums(chunkIdx, chunks); err != nil {
+			return err
+		}
+	}
+	_, err := df.backend.WriteAt(metas, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdx-df.KvIdxStart())*df.metaSize))
 	return err
 }
 
@@ -207,7 +453,14 @@ func (df *DataFile) ReadMeta(kvIdx uint64) ([]byte, error) {
 	}
 
 	b := make([]byte, df.metaSize)
-	_, err := df.file.ReadAt(b, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdx-df.KvIdxStart())*df.metaSize))
+	_, err := df.readAt(b, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdx-df.KvIdxStart())*df.metaSize))
+	return b, err
+}
+
+// readMetas reads the metadata of all the kvs of the file.
+func (df *DataFile) readMetas() ([]byte, error) {
+	b := make([]byte, (df.KvIdxEnd()-df.KvIdxStart())*df.metaSize)
+	_, err := df.readAt(b, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize))
 	return b, err
 }
 
@@ -221,10 +474,63 @@ func (df *DataFile) WriteMeta(kvIdx uint64, b []byte) error {
 		return fmt.Errorf("write meta too large")
 	}
 
-	_, err := df.file.WriteAt(b, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdx-df.KvIdxStart())*df.metaSize))
+	_, err := df.backend.WriteAt(b, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdx-df.KvIdxStart())*df.metaSize))
 	return err
 }
 
+// punch frees the disk space of the chunks of the kvs from kvIdxStart to kvIdxEnd, which then read as zeros.
+// The metas and checksums of the kvs are cleared and the punched tail is kept in the header, so the kvs
+// read as empty and are not filled with empty again, and the layout of the file is kept for the kvs to be
+// written once the last kv index grows.
+func (df *DataFile) punch(kvIdxStart, kvIdxEnd uint64) error {
+	if kvIdxStart >= kvIdxEnd || !df.ContainsKv(kvIdxStart) || !df.ContainsKv(kvIdxEnd-1) {
+		return fmt.Errorf("kvs [%d, %d) out of the file", kvIdxStart, kvIdxEnd)
+	}
+	hp, ok := df.backend.(holePuncher)
+	if !ok {
+		return fmt.Errorf("backend %s cannot punch holes", df.backend.Name())
+	}
+
+	chunkIdx := kvIdxStart * df.maxKvSize / df.chunkSize
+	chunks := (kvIdxEnd - kvIdxStart) * df.maxKvSize / df.chunkSize
+	off := HEADER_SIZE + int64((chunkIdx-df.chunkIdxStart)*df.chunkSize)
+	// an empty punch fails if holes cannot be punched on the platform, before anything is cleared
+	if err := hp.PunchHole(off, 0); err != nil {
+		return err
+	}
+
+	// the metas are cleared first, so the kvs read as empty even if the punch is interrupted
+	metas := make([]byte, (kvIdxEnd-kvIdxStart)*df.metaSize)
+	if _, err := df.backend.WriteAt(metas, int64(HEADER_SIZE+df.chunkIdxLen*df.chunkSize+(kvIdxStart-df.KvIdxStart())*df.metaSize)); err != nil {
+		return err
+	}
+	if df.checksums {
+		// the punched chunks read as zeros, whose checksum is zero
+		if _, err := df.backend.WriteAt(make([]byte, chunks*checksumSize), df.checksumOffset(chunkIdx)); err != nil {
+			return err
+		}
+	}
+	if err := df.backend.Sync(); err != nil {
+		return err
+	}
+	if err := hp.PunchHole(off, int64(chunks*df.chunkSize)); err != nil {
+		return err
+	}
+	if !df.punched || kvIdxStart < df.punchedFrom {
+		df.punched, df.punchedFrom = true, kvIdxStart
+		if err := df.writeHeader(); err != nil {
+			return err
+		}
+	}
+	return df.backend.Sync()
+}
+
+// isPunched returns whether the kv is in the tail punched by Compact, whose kvs are not filled with empty
+// again while their metas are empty, to keep their space free.
+func (df *DataFile) isPunched(kvIdx uint64) bool {
+	return df.punched && kvIdx >= df.punchedFrom && df.ContainsKv(kvIdx)
+}
+
 func (df *DataFile) writeHeader() error {
 	header := DataFileHeader{
 		magic:         MAGIC,
@@ -237,6 +543,21 @@ func (df *DataFile) writeHeader() error {
 		metaSize:      df.metaSize,
 		miner:         df.miner,
 		status:        0,
+		punchedFrom:   df.punchedFrom,
+		reencodeMiner: df.reencodeMiner,
+		reencodeNext:  df.reencodeNext,
+	}
+	if df.punched {
+		header.status |= statusPunched
+	}
+	if df.checksums {
+		header.status |= statusChecksums
+	}
+	if df.reencoding {
+		header.status |= statusReencoding
+	}
+	if df.growing {
+		header.status |= statusGrowing
 	}
 
 	buf := new(bytes.Buffer)
@@ -274,7 +595,16 @@ func (df *DataFile) writeHeader() error {
 	if err := binary.Write(buf, binary.BigEndian, header.status); err != nil {
 		return err
 	}
-	if _, err := df.file.WriteAt(buf.Bytes(), 0); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, header.punchedFrom); err != nil {
+		return err
+	}
+	if _, err := buf.Write(header.reencodeMiner[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, header.reencodeNext); err != nil {
+		return err
+	}
+	if _, err := df.backend.WriteAt(buf.Bytes(), 0); err != nil {
 		return err
 	}
 	return nil
@@ -284,13 +614,13 @@ func (df *DataFile) readHeader() error {
 	header := DataFileHeader{}
 
 	b := make([]byte, HEADER_SIZE)
-	n, err := df.file.ReadAt(b, 0)
+	n, err := df.backend.ReadAt(b, 0)
+	if err == io.EOF || err == nil && n != int(HEADER_SIZE) {
+		return fmt.Errorf("%w: %d bytes read", ErrIncompleteHeader, n)
+	}
 	if err != nil {
 		return err
 	}
-	if n != int(HEADER_SIZE) {
-		return fmt.Errorf("not full header read")
-	}
 
 	buf := bytes.NewBuffer(b)
 	if err := binary.Read(buf, binary.BigEndian, &header.magic); err != nil {
@@ -327,15 +657,31 @@ func (df *DataFile) readHeader() error {
 	if err := binary.Read(buf, binary.BigEndian, &header.status); err != nil {
 		return err
 	}
+	if header.status&(statusPunched|statusReencoding) != 0 {
+		if err := binary.Read(buf, binary.BigEndian, &header.punchedFrom); err != nil {
+			return err
+		}
+	}
+	if header.status&statusReencoding != 0 {
+		if _, err := buf.Read(header.reencodeMiner[:]); err != nil {
+			return err
+		}
+		if err := binary.Read(buf, binary.BigEndian, &header.reencodeNext); err != nil {
+			return err
+		}
+	}
 
 	// Sanity check
+	if header.magic == 0 {
+		return fmt.Errorf("%w: no magic", ErrIncompleteHeader)
+	}
 	if header.magic != MAGIC {
 		return fmt.Errorf("magic error")
 	}
 	if header.version > VERSION {
 		return fmt.Errorf("unsupported version")
 	}
-	if header.encodeType > ENCODE_END {
+	if !IsValidEncodeType(header.encodeType) {
 		return fmt.Errorf("unknown mask type")
 	}
 
@@ -346,14 +692,29 @@ func (df *DataFile) readHeader() error {
 	df.chunkSize = header.chunkSize
 	df.metaSize = header.metaSize
 	df.miner = header.miner
+	if header.status&statusPunched != 0 {
+		df.punched = true
+		df.punchedFrom = header.punchedFrom
+	}
+	df.checksums = header.status&statusChecksums != 0
+	df.zeroChunkSum = zeroChunkChecksum(df.chunkSize)
+	df.growing = header.status&statusGrowing != 0
+	if header.status&statusReencoding != 0 {
+		df.reencoding = true
+		df.reencodeMiner = header.reencodeMiner
+		df.reencodeNext = header.reencodeNext
+	}
 
 	return nil
 }
 
 func (df *DataFile) Close() error {
-	if df.file != nil {
-		if err := df.file.Close(); err != nil {
-			return fmt.Errorf("close data file %s error: %w", df.file.Name(), err)
+	if err := df.unmap(); err != nil {
+		return fmt.Errorf("unmap data file %s error: %w", df.backend.Name(), err)
+	}
+	if df.backend != nil {
+		if err := df.backend.Close(); err != nil {
+			return fmt.Errorf("close data file %s error: %w", df.backend.Name(), err)
 		}
 	}
 	return nil
@@ -0,0 +1,141 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// statusChecksums is set in the status of the header if the data file stores the checksums of its chunks.
+	statusChecksums = uint64(1) << 1
+	// checksumSize is the size of the checksum of a chunk, which are stored right after the metas.
+	checksumSize = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChunkCorrupt is matched by the errors returned for a chunk whose data does not match its checksum.
+var ErrChunkCorrupt = errors.New("chunk corrupt")
+
+// ChunkCorruptError is returned when reading a chunk whose data on disk does not match the checksum
+// written with it, so the KV should be synced again.
+type ChunkCorruptError struct {
+	Filename string
+	KvIdx    uint64
+	ChunkIdx uint64
+}
+
+func (e *ChunkCorruptError) Error() string {
+	return fmt.Sprintf("chunk %d of kv %d in %s is corrupt", e.ChunkIdx, e.KvIdx, e.Filename)
+}
+
+func (e *ChunkCorruptError) Is(target error) bool {
+	return target == ErrChunkCorrupt
+}
+
+// checksumOffset returns the offset of the checksum of the chunk, the checksums are placed after the
+// region reserved for the metas.
+func (df *DataFile) checksumOffset(chunkIdx uint64) int64 {
+	return int64(HEADER_SIZE + (df.chunkSize+32)*df.chunkIdxLen + (chunkIdx-df.chunkIdxStart)*checksumSize)
+}
+
+// checksum returns the checksum of the full chunk, which is its CRC32C xored with the one of a chunk of
+// zeros. So the checksum of a chunk of zeros is zero, and a chunk never written or punched matches the
+// zeros read for its checksum, while every other chunk is checked against the checksum written with it.
+func (df *DataFile) checksum(chunk []byte) uint32 {
+	return crc32.Checksum(chunk, castagnoli) ^ df.zeroChunkSum
+}
+
+// zeroChunkChecksum returns the CRC32C of a chunk of zeros of the chunk size.
+func zeroChunkChecksum(chunkSize uint64) uint32 {
+	return crc32.Checksum(make([]byte, chunkSize), castagnoli)
+}
+
+// writeChecksums writes the checksums of the adjacent full chunks starting at chunkIdx.
+func (df *DataFile) writeChecksums(chunkIdx uint64, chunks []byte) error {
+	n := uint64(len(chunks)) / df.chunkSize
+	sums := make([]byte, n*checksumSize)
+	for i := uint64(0); i < n; i++ {
+		binary.BigEndian.PutUint32(sums[i*checksumSize:], df.checksum(chunks[i*df.chunkSize:(i+1)*df.chunkSize]))
+	}
+	_, err := df.backend.WriteAt(sums, df.checksumOffset(chunkIdx))
+	return err
+}
+
+// verifyChunk checks the full chunk read from the file against its checksum.
+func (df *DataFile) verifyChunk(chunkIdx uint64, chunk []byte) error {
+	b := make([]byte, checksumSize)
+	if _, err := df.readAt(b, df.checksumOffset(chunkIdx)); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(b) == df.checksum(chunk) {
+		return nil
+	}
+	return &ChunkCorruptError{
+		Filename: df.backend.Name(),
+		KvIdx:    chunkIdx * df.chunkSize / df.maxKvSize,
+		ChunkIdx: chunkIdx,
+	}
+}
+
+// readVerified reads the chunk data like Read, and checks the full chunk against its checksum if the
+// file stores the checksums. A *ChunkCorruptError is returned if the chunk is corrupt.
+func (df *DataFile) readVerified(chunkIdx uint64, len int) ([]byte, error) {
+	if !df.checksums || len > int(df.chunkSize) {
+		return df.Read(chunkIdx, len)
+	}
+	chunk, err := df.Read(chunkIdx, int(df.chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	if err := df.verifyChunk(chunkIdx, chunk); err != nil {
+		return nil, err
+	}
+	return chunk[:len], nil
+}
+
+// BackfillChecksums migrates a data file created without checksums: the file is extended with the region
+// of the checksums, which are computed for all the chunks from the data on disk. The header is only marked
+// after all the checksums are written, so an interrupted migration can be run again.
+func BackfillChecksums(df *DataFile) error {
+	if df.checksums {
+		return nil
+	}
+	mapped := df.mapped != nil
+	if err := df.unmap(); err != nil {
+		return err
+	}
+	if err := df.backend.Truncate(df.checksumOffset(df.ChunkIdxEnd())); err != nil {
+		return err
+	}
+	chunksPerKv := df.maxKvSize / df.chunkSize
+	chunks := make([]byte, df.maxKvSize)
+	for kvIdx := df.KvIdxStart(); kvIdx < df.KvIdxEnd(); kvIdx++ {
+		chunkIdx := kvIdx * chunksPerKv
+		if _, err := df.backend.ReadAt(chunks, HEADER_SIZE+int64((chunkIdx-df.chunkIdxStart)*df.chunkSize)); err != nil {
+			return fmt.Errorf("read kv %d failed: %w", kvIdx, err)
+		}
+		if err := df.writeChecksums(chunkIdx, chunks); err != nil {
+			return fmt.Errorf("write checksums of kv %d failed: %w", kvIdx, err)
+		}
+	}
+	if err := df.backend.Sync(); err != nil {
+		return err
+	}
+	df.checksums = true
+	if err := df.writeHeader(); err != nil {
+		return err
+	}
+	if err := df.backend.Sync(); err != nil {
+		return err
+	}
+	if mapped {
+		return df.mmap()
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDataFile_ChunkCorrupt(t *testing.T) {
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330007")
+	sm, files := createEthStorage(contract, []uint64{0}, 131072, 131072, kvEntries, miner, ENCODE_KECCAK_256)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	for kvIdx := uint64(0); kvIdx < 4; kvIdx++ {
+		blob, hash := createBlob(kvIdx)
+		if _, err := sm.TryWrite(kvIdx, blob, prepareCommit(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for kvIdx := uint64(0); kvIdx < 4; kvIdx++ {
+		if _, _, err := sm.TryReadEncoded(kvIdx, 131072); err != nil {
+			t.Fatalf("read intact kv %d failed: %v", kvIdx, err)
+		}
+	}
+
+	// flip a byte of kv 2 on disk
+	df := sm.ShardMap()[0].GetStorageFile(0)
+	b, err := df.readRange(2, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := df.backend.WriteAt([]byte{b[0] ^ 0xff}, HEADER_SIZE+2*int64(df.chunkSize)+100); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = sm.TryReadEncoded(2, 131072)
+	if !errors.Is(err, ErrChunkCorrupt) {
+		t.Fatalf("expected ErrChunkCorrupt, got %v", err)
+	}
+	var corruptErr *ChunkCorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.KvIdx != 2 || corruptErr.ChunkIdx != 2 {
+		t.Fatalf("expected corrupt kv 2, got %v", err)
+	}
+	if _, _, err := sm.TryReadEncoded(3, 131072); err != nil {
+		t.Fatalf("read intact kv 3 failed: %v", err)
+	}
+
+	// a zeroed checksum is not taken as a chunk without checksum
+	if _, err := df.backend.WriteAt(make([]byte, checksumSize), df.checksumOffset(3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.TryReadEncoded(3, 131072); !errors.Is(err, ErrChunkCorrupt) {
+		t.Fatalf("expected ErrChunkCorrupt of kv 3 with a zeroed checksum, got %v", err)
+	}
+	// a chunk never written reads as zeros matching its zero checksum
+	if _, err := df.readVerified(5, int(df.chunkSize)); err != nil {
+		t.Fatalf("read chunk never written failed: %v", err)
+	}
+}
+
+func TestDataFile_BackfillChecksums(t *testing.T) {
+	const (
+		chunkSize = 4096
+		kvSize    = 2 * chunkSize
+		kvs       = 8
+	)
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	backend := NewMemBackend("legacy")
+	df, err := CreateWithBackend(backend, 0, kvs*2, 0, kvSize, NO_ENCODE, miner, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// turn it into a data file created before the checksums
+	df.checksums = false
+	if err := df.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Truncate(HEADER_SIZE + (chunkSize+32)*kvs*2); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{0x5a}, 3*kvSize)
+	meta := make([]byte, 32)
+	meta[HashSizeInContract] = blobFillingMask
+	if err := df.writeKvs(1, data, bytes.Repeat(meta, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BackfillChecksums(df); err != nil {
+		t.Fatalf("BackfillChecksums() error: %v", err)
+	}
+	df, err = OpenDataFileWithBackend(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !df.checksums {
+		t.Fatal("checksums are not enabled in the header")
+	}
+	for chunkIdx := uint64(0); chunkIdx < kvs*2; chunkIdx++ {
+		if _, err := df.readVerified(chunkIdx, chunkSize); err != nil {
+			t.Fatalf("read chunk %d failed: %v", chunkIdx, err)
+		}
+	}
+
+	// the second chunk of kv 3 is corrupt
+	if _, err := backend.WriteAt([]byte{0}, HEADER_SIZE+7*chunkSize+10); err != nil {
+		t.Fatal(err)
+	}
+	_, err = df.readVerified(7, chunkSize)
+	var corruptErr *ChunkCorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.KvIdx != 3 || corruptErr.ChunkIdx != 7 {
+		t.Fatalf("expected corrupt chunk 7 of kv 3, got %v", err)
+	}
+}
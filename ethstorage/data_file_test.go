@@ -0,0 +1,329 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"crypto/rand"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	testChunkSize = uint64(4096)
+	testKvSize    = uint64(4096 * 4)
+	testKvs       = uint64(64)
+)
+
+// createTestDataFile creates a data file with random chunks and metas.
+func createTestDataFile(t testing.TB) string {
+	filename := filepath.Join(t.TempDir(), "data.dat")
+	chunks := testKvs * testKvSize / testChunkSize
+	df, err := Create(filename, 0, chunks, 0, testKvSize, ENCODE_BLOB_POSEIDON, common.Address{}, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	b := make([]byte, testChunkSize)
+	for chunkIdx := uint64(0); chunkIdx < chunks; chunkIdx++ {
+		rand.Read(b)
+		if err := df.Write(chunkIdx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := make([]byte, 32)
+	for kvIdx := uint64(0); kvIdx < testKvs; kvIdx++ {
+		rand.Read(meta)
+		if err := df.WriteMeta(kvIdx, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filename
+}
+
+func TestDataFile_MmapReads(t *testing.T) {
+	filename := createTestDataFile(t)
+	df, err := OpenDataFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	mdf, err := OpenMmapDataFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdf.Close()
+	if mdf.mapped == nil {
+		t.Skip("mmap is not supported")
+	}
+
+	compare := func() {
+		for chunkIdx := uint64(0); chunkIdx < df.chunkIdxLen; chunkIdx++ {
+			b, err := df.Read(chunkIdx, int(testChunkSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mb, err := mdf.Read(chunkIdx, int(testChunkSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, mb) {
+				t.Fatalf("chunk %d mismatch", chunkIdx)
+			}
+			b, _ = df.readRange(chunkIdx, 100, 200)
+			mb, _ = mdf.readRange(chunkIdx, 100, 200)
+			if !bytes.Equal(b, mb) {
+				t.Fatalf("range of chunk %d mismatch", chunkIdx)
+			}
+		}
+		for kvIdx := uint64(0); kvIdx < testKvs; kvIdx++ {
+			m, err := df.ReadMeta(kvIdx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mm, err := mdf.ReadMeta(kvIdx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(m, mm) {
+				t.Fatalf("meta %d mismatch", kvIdx)
+			}
+		}
+		sampleIdx := uint64(12345)
+		s, err := df.ReadSample(sampleIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms, err := mdf.ReadSample(sampleIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != ms {
+			t.Fatalf("sample %d mismatch", sampleIdx)
+		}
+	}
+	compare()
+
+	// the writes through WriteAt are seen by the mapping
+	b := make([]byte, testChunkSize)
+	rand.Read(b)
+	if err := mdf.Write(3, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdf.WriteMeta(5, common.HexToHash("0x1234").Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if mb, _ := mdf.Read(3, int(testChunkSize)); !bytes.Equal(mb, b) {
+		t.Fatalf("written chunk is not read from the mapping")
+	}
+	compare()
+}
+
+func benchmarkDataFileRead(b *testing.B, open func(string) (*DataFile, error)) {
+	df, err := open(createTestDataFile(b))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer df.Close()
+	chunks := int(df.chunkIdxLen)
+	b.SetBytes(int64(testChunkSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := df.Read(uint64(mrand.Intn(chunks)), int(testChunkSize)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDataFile_ReadAt(b *testing.B) { benchmarkDataFileRead(b, OpenDataFile) }
+func BenchmarkDataFile_Mmap(b *testing.B)   { benchmarkDataFileRead(b, OpenMmapDataFile) }
+
+func TestDataFile_Backends(t *testing.T) {
+	backends := map[string]func() Backend{
+		"file": func() Backend {
+			file, err := os.Create(filepath.Join(t.TempDir(), "backend.dat"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &fileBackend{file}
+		},
+		"memory": func() Backend { return NewMemBackend("backend") },
+	}
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	encoded := make(map[string][][]byte)
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend()
+			df, err := CreateWithBackend(backend, 0, kvEntries, 0, 131072, ENCODE_KECCAK_256, miner, 131072)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sm := NewShardManager(common.HexToAddress("0x0000000000000000000000000000000003330007"), 131072, kvEntries, 131072)
+			if err := sm.AddDataFileAndShard(df); err != nil {
+				t.Fatal(err)
+			}
+			for kvIdx := uint64(0); kvIdx < 4; kvIdx++ {
+				blob, hash := createBlob(kvIdx)
+				enc, ok, err := sm.TryEncodeKV(kvIdx, blob, hash)
+				if !ok || err != nil {
+					t.Fatalf("TryEncodeKV failed: %v", err)
+				}
+				if _, err := sm.TryWrite(kvIdx, blob, hash); err != nil {
+					t.Fatal(err)
+				}
+				stored, _, err := sm.TryReadEncoded(kvIdx, len(blob))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(stored, enc) {
+					t.Fatalf("kv %d: stored blob differs from TryEncodeKV output", kvIdx)
+				}
+				decoded, _, err := sm.TryRead(kvIdx, len(blob), hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded, blob) {
+					t.Fatalf("kv %d: decoded blob differs from the raw blob", kvIdx)
+				}
+				encoded[name] = append(encoded[name], stored)
+			}
+			// an empty kv reads as zeros
+			if b, err := df.Read(5, 32); err != nil || !bytes.Equal(b, make([]byte, 32)) {
+				t.Fatalf("expected zeros of an empty kv, got %x, %v", b, err)
+			}
+
+			// the data file is reopened from the header in the backend
+			reopened, err := OpenDataFileWithBackend(backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.KvIdxEnd() != kvEntries || reopened.Miner() != miner || reopened.EncodeType() != ENCODE_KECCAK_256 {
+				t.Fatalf("unexpected header of the reopened data file")
+			}
+			sm.Close()
+		})
+	}
+	for i := range encoded["file"] {
+		if !bytes.Equal(encoded["file"][i], encoded["memory"][i]) {
+			t.Fatalf("kv %d is stored differently by the backends", i)
+		}
+	}
+}
+
+// TestDataFile_AllocStrategies tests the data files created without allocating their disk space: the kvs
+// written are read back after reopening the file, the kvs not written are read as zeros, and the disk
+// space grows only with the kvs written.
+func TestDataFile_AllocStrategies(t *testing.T) {
+	const kvSize = uint64(131072)
+	var (
+		miner    = common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+		fullSize = int64(HEADER_SIZE + (kvSize+32+checksumSize)*kvEntries)
+	)
+	diskUsage := func(filename string) (int64, int64) {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size(), fi.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+	for _, strategy := range []AllocStrategy{AllocSparse, AllocNone} {
+		t.Run(string(strategy), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "data.dat")
+			df, err := CreateWithStrategy(filename, strategy, 0, kvEntries, 0, kvSize, ENCODE_KECCAK_256, miner, kvSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, used := diskUsage(filename)
+			if used >= int64(kvSize) {
+				t.Fatalf("expected no disk space allocated for the kvs, got %d bytes", used)
+			}
+			if strategy == AllocNone && size != HEADER_SIZE {
+				t.Fatalf("expected only the header written, got a file of %d bytes", size)
+			}
+			if strategy == AllocSparse && size != fullSize {
+				t.Fatalf("expected a file of %d bytes, got %d", fullSize, size)
+			}
+
+			// the kvs are beyond the end of the file created with AllocNone
+			for _, kvIdx := range []uint64{0, kvEntries - 1} {
+				if b, err := df.Read(kvIdx, 32); err != nil || !bytes.Equal(b, make([]byte, 32)) {
+					t.Fatalf("expected zeros of the kv %d not written, got %x, %v", kvIdx, b, err)
+				}
+				if meta, err := df.ReadMeta(kvIdx); err != nil || !bytes.Equal(meta, make([]byte, 32)) {
+					t.Fatalf("expected an empty meta of the kv %d not written, got %x, %v", kvIdx, meta, err)
+				}
+			}
+
+			sm := NewShardManager(common.HexToAddress("0x0000000000000000000000000000000003330007"), kvSize, kvEntries, kvSize)
+			if err := sm.AddDataFileAndShard(df); err != nil {
+				t.Fatal(err)
+			}
+			written := []uint64{1, 2}
+			for _, kvIdx := range written {
+				blob, hash := createBlob(kvIdx)
+				if _, err := sm.TryWrite(kvIdx, blob, hash); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sm.Close()
+			if _, grown := diskUsage(filename); grown < used+int64(len(written))*int64(kvSize) || grown >= fullSize/2 {
+				t.Fatalf("expected the disk space to grow by the %d kvs written, got %d bytes from %d", len(written), grown, used)
+			}
+
+			reopened, err := OpenDataFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sm = NewShardManager(common.HexToAddress("0x0000000000000000000000000000000003330007"), kvSize, kvEntries, kvSize)
+			if err := sm.AddDataFileAndShard(reopened); err != nil {
+				t.Fatal(err)
+			}
+			defer sm.Close()
+			for _, kvIdx := range written {
+				blob, hash := createBlob(kvIdx)
+				decoded, _, err := sm.TryRead(kvIdx, len(blob), hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded, blob) {
+					t.Fatalf("kv %d: read blob differs from the one written", kvIdx)
+				}
+			}
+			if b, err := reopened.Read(0, 32); err != nil || !bytes.Equal(b, make([]byte, 32)) {
+				t.Fatalf("expected zeros of the kv not written, got %x, %v", b, err)
+			}
+		})
+	}
+	if _, err := CreateWithStrategy(filepath.Join(t.TempDir(), "data.dat"), "lazy", 0, kvEntries, 0, kvSize, ENCODE_KECCAK_256, miner, kvSize); err == nil {
+		t.Fatalf("expected the error of an unknown alloc strategy")
+	}
+}
+
+// TestDataFile_TruncatedNotGrowing tests the bytes beyond the end of a data file not created with AllocNone,
+// e.g. truncated by accident, are an error instead of zeros.
+func TestDataFile_TruncatedNotGrowing(t *testing.T) {
+	const kvSize = uint64(131072)
+	filename := filepath.Join(t.TempDir(), "data.dat")
+	df, err := CreateSparse(filename, 0, kvEntries, 0, kvSize, ENCODE_KECCAK_256, common.Address{}, kvSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	df.Close()
+	if err := os.Truncate(filename, HEADER_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := OpenDataFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer truncated.Close()
+	if _, err := truncated.Read(0, 32); err == nil {
+		t.Fatal("expected an error reading beyond the end of the truncated data file")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// dataFileVerifySamples is the max number of filled KVs decoded and checked by VerifyDataFile.
+const dataFileVerifySamples = 64
+
+// DataFileVerifyError lists the KVs of a data file whose data does not match the commit in their metas.
+type DataFileVerifyError struct {
+	Filename  string
+	KvIndices []uint64
+}
+
+func (e *DataFileVerifyError) Error() string {
+	return fmt.Sprintf("data file %s has %d corrupted kvs: %v", e.Filename, len(e.KvIndices), e.KvIndices)
+}
+
+// VerifyDataFile walks the metas of the data file and, for up to dataFileVerifySamples filled KVs
+// spread evenly over the file, decodes the data and checks it against the commit stored in the meta.
+// KVs which are not filled yet are skipped. A *DataFileVerifyError is returned if any sample mismatches.
+func VerifyDataFile(df *DataFile) error {
+	filled := make([]uint64, 0)
+	for kvIdx := df.KvIdxStart(); kvIdx < df.KvIdxEnd(); kvIdx++ {
+		meta, err := df.ReadMeta(kvIdx)
+		if err != nil {
+			return fmt.Errorf("read meta of kv %d failed: %w", kvIdx, err)
+		}
+		if meta[HashSizeInContract]&blobFillingMask != 0 {
+			filled = append(filled, kvIdx)
+		}
+	}
+
+	step := 1
+	if len(filled) > dataFileVerifySamples {
+		step = len(filled) / dataFileVerifySamples
+	}
+	var corrupted []uint64
+	for i := 0; i < len(filled); i += step {
+		ok, err := df.verifyKv(filled[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			corrupted = append(corrupted, filled[i])
+		}
+	}
+	if len(corrupted) > 0 {
+		return &DataFileVerifyError{Filename: df.backend.Name(), KvIndices: corrupted}
+	}
+	return nil
+}
+
+// verifyKv decodes the kv with the commit in its meta and checks the data matches the commit.
+func (df *DataFile) verifyKv(kvIdx uint64) (bool, error) {
+	meta, err := df.ReadMeta(kvIdx)
+	if err != nil {
+		return false, err
+	}
+	commit := common.BytesToHash(meta)
+	chunksPerKv := df.maxKvSize / df.chunkSize
+	data := make([]byte, 0, df.maxKvSize)
+	for i := uint64(0); i < chunksPerKv; i++ {
+		chunkIdx := kvIdx*chunksPerKv + i
+		cdata, err := df.Read(chunkIdx, int(df.chunkSize))
+		if err != nil {
+			return false, fmt.Errorf("read chunk %d failed: %w", chunkIdx, err)
+		}
+		encodeKey := calcEncodeKey(commit, chunkIdx, df.miner)
+		data = append(data, decodeChunk(df.chunkSize, cdata, df.encodeType, encodeKey)...)
+	}
+	return checkCommit(commit, data) == nil, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestVerifyDataFile(t *testing.T) {
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330006")
+	sm, files := createEthStorage(contract, []uint64{0}, 131072, 131072, kvEntries, miner, ENCODE_KECCAK_256)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	// kv 0 to 3 hold blobs, kv 4 is an empty blob and the rest are not filled
+	for kvIdx := uint64(0); kvIdx < 4; kvIdx++ {
+		blob, hash := createBlob(kvIdx)
+		if _, err := sm.TryWrite(kvIdx, blob, prepareCommit(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sm.TryWrite(4, nil, prepareCommit(common.Hash{})); err != nil {
+		t.Fatal(err)
+	}
+
+	df := sm.ShardMap()[0].GetStorageFile(0)
+	if err := VerifyDataFile(df); err != nil {
+		t.Fatalf("intact data file should verify: %v", err)
+	}
+
+	// flip a byte in the middle of the chunk of kv 2 and in the empty kv 4
+	for _, kvIdx := range []uint64{2, 4} {
+		b, err := df.readRange(kvIdx, 100, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := df.backend.WriteAt([]byte{b[0] ^ 0xff}, HEADER_SIZE+int64(kvIdx*df.chunkSize)+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := VerifyDataFile(df)
+	var verifyErr *DataFileVerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("expected DataFileVerifyError, got %v", err)
+	}
+	if !reflect.DeepEqual(verifyErr.KvIndices, []uint64{2, 4}) {
+		t.Fatalf("expected corrupted kvs [2 4], got %v", verifyErr.KvIndices)
+	}
+}
@@ -5,8 +5,10 @@ package ethstorage
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/big"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -26,6 +28,13 @@ type DataShard struct {
 	kvEntries   uint64
 	dataFiles   []*DataFile
 	chunkSize   uint64
+
+	// present holds the KVs written since the data files are added, and those with a meta set in the files,
+	// so a KV it does not hold is known to be zero, both its data and meta, without reading the files
+	present *kvFilter
+
+	// mu is taken by the ShardManager so that a KV is never read while its chunks are half written
+	mu sync.RWMutex
 }
 
 func NewDataShard(shardIdx uint64, kvSize uint64, kvEntries uint64, chunkSize uint64) *DataShard {
@@ -33,27 +42,42 @@ func NewDataShard(shardIdx uint64, kvSize uint64, kvEntries uint64, chunkSize ui
 		panic("kvSize must be CHUNK_SIZE at the moment")
 	}
 
-	return &DataShard{shardIdx: shardIdx, kvSize: kvSize, chunksPerKv: kvSize / chunkSize, kvEntries: kvEntries, chunkSize: chunkSize}
+	return &DataShard{shardIdx: shardIdx, kvSize: kvSize, chunksPerKv: kvSize / chunkSize, kvEntries: kvEntries, chunkSize: chunkSize,
+		present: newKvFilter(kvEntries)}
 }
 
 func (ds *DataShard) AddDataFile(df *DataFile) error {
+	if df.maxKvSize != ds.kvSize {
+		return fmt.Errorf("mismatched data file max kv size %d of shard kv size %d", df.maxKvSize, ds.kvSize)
+	}
 	if len(ds.dataFiles) != 0 {
 		// Perform sanity check
-		if ds.dataFiles[0].miner != df.miner {
+		if ds.dataFiles[0].targetMiner() != df.targetMiner() {
 			return fmt.Errorf("mismatched data file SP")
 		}
 		if ds.dataFiles[0].encodeType != df.encodeType {
 			return fmt.Errorf("mismatched data file encode type")
 		}
-		if ds.dataFiles[0].maxKvSize != df.maxKvSize {
-			return fmt.Errorf("mismatched data file max kv size")
-		}
 		// TODO: May check if not overlapped?
 	}
+	metas, err := df.readMetas()
+	if err != nil {
+		return fmt.Errorf("read metas of data file failed: %w", err)
+	}
+	for i := uint64(0); i < uint64(len(metas))/df.metaSize; i++ {
+		if !bytes.Equal(metas[i*df.metaSize:(i+1)*df.metaSize], make([]byte, df.metaSize)) {
+			ds.present.add(df.KvIdxStart() + i)
+		}
+	}
 	ds.dataFiles = append(ds.dataFiles, df)
 	return nil
 }
 
+// mayContain reports whether the KV may be written; if not, the KV is neither synced nor filled.
+func (ds *DataShard) mayContain(kvIdx uint64) bool {
+	return ds.present.mayContain(kvIdx)
+}
+
 // Returns whether the shard has all data files to cover all entries
 func (ds *DataShard) IsComplete() bool {
 	chunkIdx := ds.StartChunkIdx()
@@ -102,6 +126,11 @@ func (ds *DataShard) StartChunkIdx() uint64 {
 	return ds.shardIdx * ds.chunksPerKv * ds.kvEntries
 }
 
+// ContainsChunk reports whether the chunk, counted in the chunks of the kv size of the shard, is in the shard.
+func (ds *DataShard) ContainsChunk(chunkIdx uint64) bool {
+	return chunkIdx >= ds.StartChunkIdx() && chunkIdx < ds.StartChunkIdx()+ds.chunksPerKv*ds.kvEntries
+}
+
 func (ds *DataShard) GetStorageFile(chunkIdx uint64) *DataFile {
 	for _, df := range ds.dataFiles {
 		if df.Contains(chunkIdx) {
@@ -126,6 +155,30 @@ func (ds *DataShard) ReadChunk(kvIdx uint64, chunkIdx uint64, commit common.Hash
 	})
 }
 
+// ReadChunks reads and decodes only the chunks of the kv at chunkIdxs, keyed by their indexes in the kv, so
+// a read of a few chunks does not decode the whole blob. The commit of a blob covers its whole data, so
+// unlike Read, the chunks are not checked against it.
+func (ds *DataShard) ReadChunks(kvIdx uint64, chunkIdxs []uint64, commit common.Hash) (map[uint64][]byte, error) {
+	// a kv never written holds no encoded empty blob to decode, but it is still read as an empty blob
+	empty := !ds.mayContain(kvIdx) && ds.Contains(kvIdx) && ds.GetStorageFile(kvIdx*ds.chunksPerKv) != nil
+	chunks := make(map[uint64][]byte, len(chunkIdxs))
+	for _, chunkIdx := range chunkIdxs {
+		if _, ok := chunks[chunkIdx]; ok {
+			continue
+		}
+		if empty && chunkIdx < ds.chunksPerKv {
+			chunks[chunkIdx] = make([]byte, ds.chunkSize)
+			continue
+		}
+		b, err := ds.ReadChunk(kvIdx, chunkIdx, commit)
+		if err != nil {
+			return nil, err
+		}
+		chunks[chunkIdx] = b
+	}
+	return chunks, nil
+}
+
 // readChunkWith read the encoded chunk from storage with a decoder.
 func (ds *DataShard) readChunkWith(kvIdx uint64, chunkIdx uint64, decoder func([]byte, uint64) []byte) ([]byte, error) {
 	if !ds.Contains(kvIdx) {
@@ -145,14 +198,39 @@ func (ds *DataShard) readChunkWith(kvIdx uint64, chunkIdx uint64, decoder func([
 
 // ReadEncoded read the encoded data from storage and return it.
 func (ds *DataShard) ReadEncoded(kvIdx uint64, readLen int) ([]byte, error) {
-	return ds.readWith(kvIdx, readLen, func(cdata []byte, chunkIdx uint64) []byte {
+	return ds.ReadEncodedCtx(context.Background(), kvIdx, readLen)
+}
+
+// ReadEncodedCtx reads the encoded data like ReadEncoded, and stops with ctx.Err() between the chunks
+// once the context is done.
+func (ds *DataShard) ReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, error) {
+	if !ds.mayContain(kvIdx) && ds.Contains(kvIdx) && ds.GetStorageFile(kvIdx*ds.chunksPerKv) != nil &&
+		readLen >= 0 && readLen <= int(ds.kvSize) {
+		return make([]byte, readLen), nil
+	}
+	return ds.readWith(ctx, kvIdx, readLen, func(cdata []byte, chunkIdx uint64) []byte {
 		return cdata
 	})
 }
 
 // Read the encoded data from storage and decode it.
 func (ds *DataShard) Read(kvIdx uint64, readLen int, commit common.Hash) ([]byte, error) {
-	bs, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
+	return ds.ReadCtx(context.Background(), kvIdx, readLen, commit)
+}
+
+// ReadCtx reads and decodes the data like Read, and stops with ctx.Err() between the chunks once the
+// context is done.
+func (ds *DataShard) ReadCtx(ctx context.Context, kvIdx uint64, readLen int, commit common.Hash) ([]byte, error) {
+	// a kv never written holds no encoded empty blob to decode, but it is still read as an empty blob
+	if !ds.mayContain(kvIdx) && ds.Contains(kvIdx) && ds.GetStorageFile(kvIdx*ds.chunksPerKv) != nil &&
+		readLen >= 0 && readLen <= int(ds.kvSize) {
+		bs := make([]byte, ds.kvSize)
+		if err := checkCommit(commit, bs); err != nil {
+			return nil, err
+		}
+		return bs[0:readLen], nil
+	}
+	bs, err := ds.readWith(ctx, kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
 		encodeKey := calcEncodeKey(commit, chunkIdx, ds.dataFiles[0].miner)
 		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
 	})
@@ -172,7 +250,7 @@ func (ds *DataShard) ReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, er
 	if err != nil {
 		return nil, nil, err
 	}
-	bs, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
+	bs, err := ds.readWith(context.Background(), kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
 		encodeKey := calcEncodeKey(common.BytesToHash(commit), chunkIdx, ds.dataFiles[0].miner)
 		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
 	})
@@ -186,8 +264,39 @@ func (ds *DataShard) ReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, er
 	return bs[0:readLen], commit, nil
 }
 
-// readWith read the encoded data from storage with a decoder.
-func (ds *DataShard) readWith(kvIdx uint64, readLen int, decoder func([]byte, uint64) []byte) ([]byte, error) {
+// ReadEncodedRange read readLen bytes of the encoded data starting at off, only the chunks covering the range are read.
+func (ds *DataShard) ReadEncodedRange(kvIdx uint64, off, readLen int) ([]byte, error) {
+	if !ds.Contains(kvIdx) {
+		return nil, fmt.Errorf("kv not found")
+	}
+	if off < 0 || readLen < 0 || off+readLen > int(ds.kvSize) {
+		return nil, fmt.Errorf("read range [%d, %d) exceeds kv size %d", off, off+readLen, ds.kvSize)
+	}
+	data := make([]byte, 0, readLen)
+	for readLen > 0 {
+		chunkIdx := kvIdx*ds.chunksPerKv + uint64(off)/ds.chunkSize
+		chunkOff := off % int(ds.chunkSize)
+		chunkReadLen := int(ds.chunkSize) - chunkOff
+		if chunkReadLen > readLen {
+			chunkReadLen = readLen
+		}
+		df := ds.GetStorageFile(chunkIdx)
+		if df == nil {
+			return nil, fmt.Errorf("chunk not found: the shard is not completed?")
+		}
+		cdata, err := df.readRange(chunkIdx, chunkOff, chunkReadLen)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, cdata...)
+		off += chunkReadLen
+		readLen -= chunkReadLen
+	}
+	return data, nil
+}
+
+// readWith read the encoded data from storage with a decoder, checking the context before each chunk.
+func (ds *DataShard) readWith(ctx context.Context, kvIdx uint64, readLen int, decoder func([]byte, uint64) []byte) ([]byte, error) {
 	if !ds.Contains(kvIdx) {
 		return nil, fmt.Errorf("kv not found")
 	}
@@ -199,6 +308,9 @@ func (ds *DataShard) readWith(kvIdx uint64, readLen int, decoder func([]byte, ui
 		if readLen == 0 {
 			break
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
 		chunkReadLen := readLen
 		if chunkReadLen > int(ds.chunkSize) {
@@ -293,6 +405,8 @@ func IsValidEncodeType(encodeType uint64) bool {
 		return true
 	case ENCODE_ETHASH:
 		return true
+	case ENCODE_BLOB_POSEIDON:
+		return true
 	default:
 		return false
 	}
@@ -386,6 +500,32 @@ func (ds *DataShard) WriteWith(kvIdx uint64, b []byte, commit common.Hash, encod
 	return ds.WriteMeta(kvIdx, commit[:])
 }
 
+// writeBatch encodes the values of adjacent KVs stored in df and writes them with a WriteAt for
+// all the chunks and another one for all the metas, instead of one WriteAt per chunk and meta.
+func (ds *DataShard) writeBatch(df *DataFile, entries []WriteEntry) error {
+	chunks := make([]byte, 0, uint64(len(entries))*ds.kvSize)
+	metas := make([]byte, 0, uint64(len(entries))*df.metaSize)
+	for _, e := range entries {
+		cb := make([]byte, ds.kvSize)
+		copy(cb, e.Data)
+		for i := uint64(0); i < ds.chunksPerKv; i++ {
+			chunkIdx := e.KvIdx*ds.chunksPerKv + i
+			encodeKey := calcEncodeKey(e.Commit, chunkIdx, ds.Miner())
+			chunks = append(chunks, encodeChunk(ds.chunkSize, cb[i*ds.chunkSize:(i+1)*ds.chunkSize], ds.EncodeType(), encodeKey)...)
+		}
+		meta := make([]byte, df.metaSize)
+		copy(meta, e.Commit[:])
+		metas = append(metas, meta...)
+	}
+	if err := df.writeKvs(entries[0].KvIdx, chunks, metas); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ds.present.add(e.KvIdx)
+	}
+	return nil
+}
+
 // Write a value of the KV to the store.  The value will be encoded with kvIdx and SP address.
 func (ds *DataShard) Write(kvIdx uint64, b []byte, commit common.Hash) error {
 	return ds.WriteWith(kvIdx, b, commit, func(cdata []byte, chunkIdx uint64) []byte {
@@ -398,7 +538,7 @@ func (ds *DataShard) Write(kvIdx uint64, b []byte, commit common.Hash) error {
 func (ds *DataShard) readChunk(chunkIdx uint64, readLen int) ([]byte, error) {
 	for _, df := range ds.dataFiles {
 		if df.Contains(chunkIdx) {
-			return df.Read(chunkIdx, readLen)
+			return df.readVerified(chunkIdx, readLen)
 		}
 	}
 	return nil, fmt.Errorf("chunk not found: the shard is not completed?")
@@ -416,7 +556,11 @@ func (ds *DataShard) writeChunk(chunkIdx uint64, b []byte) error {
 func (ds *DataShard) WriteMeta(kvIdx uint64, b []byte) error {
 	for _, df := range ds.dataFiles {
 		if df.ContainsKv(kvIdx) {
-			return df.WriteMeta(kvIdx, b)
+			if err := df.WriteMeta(kvIdx, b); err != nil {
+				return err
+			}
+			ds.present.add(kvIdx)
+			return nil
 		}
 	}
 	return fmt.Errorf("kv not found: the shard is not completed?")
@@ -425,6 +569,9 @@ func (ds *DataShard) WriteMeta(kvIdx uint64, b []byte) error {
 func (ds *DataShard) ReadMeta(kvIdx uint64) ([]byte, error) {
 	for _, df := range ds.dataFiles {
 		if df.ContainsKv(kvIdx) {
+			if !ds.mayContain(kvIdx) {
+				return make([]byte, df.metaSize), nil
+			}
 			return df.ReadMeta(kvIdx)
 		}
 	}
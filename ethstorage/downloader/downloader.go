@@ -43,7 +43,7 @@ type Downloader struct {
 
 	// latestHead and finalizedHead are shared among multiple threads and thus locks must be required when being accessed
 	// others are only accessed by the downloader thread so it is safe to access them in DL thread without locks
-	l1Source                   *eth.PollingClient
+	l1Source                   eth.L1Reader
 	l1Beacon                   *eth.BeaconClient
 	db                         ethdb.Database
 	sm                         *ethstorage.StorageManager
@@ -79,7 +79,7 @@ type blockBlobs struct {
 }
 
 func NewDownloader(
-	l1Source *eth.PollingClient,
+	l1Source eth.L1Reader,
 	l1Beacon *eth.BeaconClient,
 	db ethdb.Database,
 	sm *ethstorage.StorageManager,
@@ -1,11 +1,14 @@
 package eth
 
 type L1EndpointConfig struct {
-	L1ChainID                    uint64 // L1 Chain ID
-	L1NodeAddr                   string // Address of L1 User JSON-RPC endpoint to use (eth namespace required)
-	L1BeaconURL                  string // L1 beacon chain endpoint
-	L1BeaconBasedTime            uint64 // a pair of timestamp and slot number in the past time
-	L1BeaconBasedSlot            uint64 // a pair of timestamp and slot number in the past time
-	L1BeaconSlotTime             uint64 // slot duration
-	L1MinDurationForBlobsRequest uint64 // Min duration for blobs sidecars request
+	L1ChainID                    uint64   // L1 Chain ID
+	L1NodeAddr                   string   // Address of L1 User JSON-RPC endpoint to use (eth namespace required)
+	L1NodeAddrs                  []string // Addresses of all the L1 endpoints given, the others are used when L1NodeAddr fails
+	L1BeaconURL                  string   // L1 beacon chain endpoint
+	L1BeaconBasedTime            uint64   // a pair of timestamp and slot number in the past time
+	L1BeaconBasedSlot            uint64   // a pair of timestamp and slot number in the past time
+	L1BeaconSlotTime             uint64   // slot duration
+	L1MinDurationForBlobsRequest uint64   // Min duration for blobs sidecars request
+	L1MetaCacheSize              int      // Number of kv metas read from the contract kept in memory
+	L1MetaBatchSize              int      // Max number of kv metas read from the contract in one call
 }
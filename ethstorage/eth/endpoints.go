@@ -0,0 +1,56 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package eth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const endpointProbeTimeout = 10 * time.Second
+
+// SplitURLs splits a comma-separated list of RPC URLs, dropping the empty and duplicated ones.
+func SplitURLs(raw string) []string {
+	urls := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, url := range strings.Split(raw, ",") {
+		url = strings.TrimSpace(url)
+		if _, ok := seen[url]; ok || url == "" {
+			continue
+		}
+		seen[url] = struct{}{}
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// DialAvailable connects to the first of the URLs which answers a chain id request.
+func DialAvailable(ctx context.Context, urls []string) (*ethclient.Client, string, error) {
+	var errs []error
+	for _, url := range urls {
+		client, err := ethclient.DialContext(ctx, url)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+			continue
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, endpointProbeTimeout)
+		_, err = client.ChainID(probeCtx)
+		cancel()
+		if err != nil {
+			client.Close()
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+			continue
+		}
+		return client, url, nil
+	}
+	if len(errs) == 0 {
+		return nil, "", errors.New("no L1 endpoint is given")
+	}
+	return nil, "", fmt.Errorf("all the L1 endpoints are unreachable: %w", errors.Join(errs...))
+}
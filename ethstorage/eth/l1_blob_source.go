@@ -0,0 +1,72 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package eth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// kvHashSize is the size of the blob hash kept in the metas of the storage contract.
+const kvHashSize = 24
+
+// L1BlobSource downloads the blob of a kv from the beacon node, at the slot of the block with the latest
+// PutBlob event of the kv. The beacon node only keeps the blobs for a limited period, so the blobs put long
+// ago may not be found.
+type L1BlobSource struct {
+	l1         L1Reader
+	beacon     *BeaconClient
+	startBlock uint64 // block to search the PutBlob events from
+}
+
+func NewL1BlobSource(l1 L1Reader, beacon *BeaconClient, startBlock uint64) *L1BlobSource {
+	return &L1BlobSource{
+		l1:         l1,
+		beacon:     beacon,
+		startBlock: startBlock,
+	}
+}
+
+func (s *L1BlobSource) BlobByKvIndex(ctx context.Context, contract common.Address, kvIdx uint64, commit common.Hash) ([]byte, error) {
+	query := ethereum.FilterQuery{
+		Addresses: []common.Address{contract},
+		Topics: [][]common.Hash{
+			{crypto.Keccak256Hash([]byte(PutBlobEvent))},
+			{common.BigToHash(new(big.Int).SetUint64(kvIdx))},
+		},
+		FromBlock: new(big.Int).SetUint64(s.startBlock),
+	}
+	logs, err := s.l1.FilterLogs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	// the kv may be put more than once, so the latest event with the commit is taken
+	for i := len(logs) - 1; i >= 0; i-- {
+		event := logs[i]
+		if len(event.Topics) < 4 || !bytes.Equal(event.Topics[3][:kvHashSize], commit[:kvHashSize]) {
+			continue
+		}
+		header, err := s.l1.HeaderByHash(ctx, event.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		slot := s.beacon.Timestamp2Slot(header.Time)
+		blobs, err := s.beacon.DownloadBlobs(slot)
+		if err != nil {
+			return nil, err
+		}
+		blob, ok := blobs[event.Topics[3]]
+		if !ok {
+			return nil, fmt.Errorf("blob %s of kv %d not found in slot %d", event.Topics[3], kvIdx, slot)
+		}
+		return blob.Data, nil
+	}
+	return nil, fmt.Errorf("no PutBlob event of kv %d with commit %s", kvIdx, common.Bytes2Hex(commit[:kvHashSize]))
+}
@@ -26,8 +26,17 @@ const (
 )
 
 var httpRegex = regexp.MustCompile("^http(s)?://")
+
 var ErrSubscriberClosed = errors.New("subscriber closed")
 
+// L1Reader reads the headers and the logs of L1, served by a PollingClient, or by several for failover.
+type L1Reader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+	FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error)
+}
+
 type PollingClient struct {
 	*ethclient.Client
 	isHTTP     bool
@@ -0,0 +1,124 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package eth
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// StorageContractABI is the ABI of the methods of the EthStorage contract called by the node and the tools.
+const StorageContractABI = `[
+	{"type":"function","name":"maxKvSizeBits","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"shardEntryBits","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"upfrontPayment","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"randomChecks","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"nonceLimit","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"startTime","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"treasuryShare","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint256"}]},
+	{"type":"function","name":"lastKvIdx","stateMutability":"view","inputs":[],"outputs":[{"name":"","type":"uint40"}]},
+	{"type":"function","name":"putBlobs","stateMutability":"payable","inputs":[{"name":"keys","type":"bytes32[]"}],"outputs":[]}
+]`
+
+var storageContractABI = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(StorageContractABI))
+	if err != nil {
+		panic(fmt.Sprintf("invalid storage contract ABI: %v", err))
+	}
+	return parsed
+}()
+
+// StorageContract calls the EthStorage contract with the methods packed and unpacked by its ABI. The view
+// methods are called at the latest block.
+type StorageContract struct {
+	address common.Address
+	caller  ethereum.ContractCaller
+}
+
+// NewStorageContract creates a StorageContract calling the contract at the address through the caller.
+func NewStorageContract(address common.Address, caller ethereum.ContractCaller) *StorageContract {
+	return &StorageContract{address: address, caller: caller}
+}
+
+// MaxKvSizeBits returns the log2 of the max KV size of the contract.
+func (c *StorageContract) MaxKvSizeBits(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "maxKvSizeBits")
+}
+
+// ShardEntryBits returns the log2 of the number of KV entries in a shard.
+func (c *StorageContract) ShardEntryBits(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "shardEntryBits")
+}
+
+// RandomChecks returns the number of the random samples checked in a mining proof.
+func (c *StorageContract) RandomChecks(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "randomChecks")
+}
+
+// NonceLimit returns the max nonce of a mining proof in a block.
+func (c *StorageContract) NonceLimit(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "nonceLimit")
+}
+
+// StartTime returns the timestamp the storage of the contract started at.
+func (c *StorageContract) StartTime(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "startTime")
+}
+
+// TreasuryShare returns the share of the mining reward paid to the treasury, in basis points.
+func (c *StorageContract) TreasuryShare(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "treasuryShare")
+}
+
+// LastKvIdx returns the number of KVs stored in the contract so far.
+func (c *StorageContract) LastKvIdx(ctx context.Context) (uint64, error) {
+	return c.callUint64(ctx, "lastKvIdx")
+}
+
+// UpfrontPayment returns the payment required to put a blob.
+func (c *StorageContract) UpfrontPayment(ctx context.Context) (*big.Int, error) {
+	var out *big.Int
+	if err := c.call(ctx, "upfrontPayment", &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PackPutBlobs returns the calldata of putBlobs with the keys of the blobs, which is sent in the blob
+// transaction carrying the blobs.
+func (c *StorageContract) PackPutBlobs(keys []common.Hash) ([]byte, error) {
+	return storageContractABI.Pack("putBlobs", keys)
+}
+
+func (c *StorageContract) callUint64(ctx context.Context, method string) (uint64, error) {
+	var out *big.Int
+	if err := c.call(ctx, method, &out); err != nil {
+		return 0, err
+	}
+	if !out.IsUint64() {
+		return 0, fmt.Errorf("%s from contract overflows uint64: %s", method, out)
+	}
+	return out.Uint64(), nil
+}
+
+func (c *StorageContract) call(ctx context.Context, method string, out interface{}) error {
+	data, err := storageContractABI.Pack(method)
+	if err != nil {
+		return err
+	}
+	bs, err := c.caller.CallContract(ctx, ethereum.CallMsg{To: &c.address, Data: data}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to call %s of contract: %w", method, err)
+	}
+	if err := storageContractABI.UnpackIntoInterface(out, method, bs); err != nil {
+		return fmt.Errorf("failed to unpack %s from contract: %w", method, err)
+	}
+	return nil
+}
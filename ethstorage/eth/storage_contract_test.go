@@ -0,0 +1,140 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package eth
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// stubStorageContract assembles the runtime code of a contract returning the uint values of the view
+// methods by their selectors in the ABI, accepting putBlobs and reverting any other call.
+func stubStorageContract(values map[string]uint64) []byte {
+	var code []byte
+	op := func(ops ...vm.OpCode) {
+		for _, o := range ops {
+			code = append(code, byte(o))
+		}
+	}
+	// selector = calldata[0:4]
+	op(vm.PUSH1, 0, vm.CALLDATALOAD, vm.PUSH1, 0xe0, vm.SHR)
+	var jumps []int
+	methods := []string{"putBlobs"}
+	for name := range values {
+		methods = append(methods, name)
+	}
+	for _, name := range methods {
+		op(vm.DUP1, vm.PUSH4)
+		code = append(code, storageContractABI.Methods[name].ID...)
+		op(vm.EQ, vm.PUSH1)
+		jumps = append(jumps, len(code))
+		op(0, vm.JUMPI)
+	}
+	op(vm.PUSH1, 0, vm.DUP1, vm.REVERT)
+	for i, name := range methods {
+		code[jumps[i]] = byte(len(code))
+		if name == "putBlobs" {
+			op(vm.JUMPDEST, vm.STOP)
+			continue
+		}
+		// return values[name] as a uint256
+		op(vm.JUMPDEST, vm.PUSH1, vm.OpCode(values[name]), vm.PUSH1, 0, vm.MSTORE, vm.PUSH1, 32, vm.PUSH1, 0, vm.RETURN)
+	}
+	return code
+}
+
+func TestStorageContract(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		key, _  = crypto.HexToECDSA("8da4ef21b864d2cc526dbdb2a120bd2874c36c9d0a1fb7f8c63d7f7a8b41de8f")
+		from    = crypto.PubkeyToAddress(key.PublicKey)
+		address = common.HexToAddress("0x0000000000000000000000000000000003330001")
+		values  = map[string]uint64{"maxKvSizeBits": 17, "shardEntryBits": 10, "upfrontPayment": 100, "randomChecks": 2,
+			"nonceLimit": 200, "startTime": 150, "treasuryShare": 100, "lastKvIdx": 42}
+		balance = new(big.Int).Mul(big.NewInt(1e18), big.NewInt(100))
+		backend = backends.NewSimulatedBackend(core.GenesisAlloc{
+			address: {Code: stubStorageContract(values), Balance: new(big.Int)},
+			from:    {Balance: balance},
+		}, 10_000_000)
+		contract = NewStorageContract(address, backend)
+	)
+	defer backend.Close()
+
+	if v, err := contract.MaxKvSizeBits(ctx); err != nil || v != values["maxKvSizeBits"] {
+		t.Fatalf("expected maxKvSizeBits %d, got %d, err %v", values["maxKvSizeBits"], v, err)
+	}
+	if v, err := contract.ShardEntryBits(ctx); err != nil || v != values["shardEntryBits"] {
+		t.Fatalf("expected shardEntryBits %d, got %d, err %v", values["shardEntryBits"], v, err)
+	}
+	if v, err := contract.UpfrontPayment(ctx); err != nil || v.Uint64() != values["upfrontPayment"] {
+		t.Fatalf("expected upfrontPayment %d, got %v, err %v", values["upfrontPayment"], v, err)
+	}
+	for name, get := range map[string]func(context.Context) (uint64, error){
+		"randomChecks":  contract.RandomChecks,
+		"nonceLimit":    contract.NonceLimit,
+		"startTime":     contract.StartTime,
+		"treasuryShare": contract.TreasuryShare,
+		"lastKvIdx":     contract.LastKvIdx,
+	} {
+		if v, err := get(ctx); err != nil || v != values[name] {
+			t.Fatalf("expected %s %d, got %d, err %v", name, values[name], v, err)
+		}
+	}
+	if _, err := NewStorageContract(from, backend).MaxKvSizeBits(ctx); err == nil {
+		t.Fatal("expected the error of calling an account without code")
+	}
+
+	keys := []common.Hash{{1}, {2}, {3}}
+	calldata, err := contract.PackPutBlobs(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(calldata[:4], crypto.Keccak256([]byte("putBlobs(bytes32[])"))[:4]) {
+		t.Fatalf("unexpected putBlobs selector %x", calldata[:4])
+	}
+	args, err := storageContractABI.Methods["putBlobs"].Inputs.Unpack(calldata[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked := args[0].([][32]byte); len(unpacked) != len(keys) || common.Hash(unpacked[2]) != keys[2] {
+		t.Fatalf("unexpected keys unpacked %x", unpacked)
+	}
+	head, err := backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := types.LatestSignerForChainID(big.NewInt(1337))
+	tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+		ChainID:   big.NewInt(1337),
+		Nonce:     0,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: new(big.Int).Mul(head.BaseFee, big.NewInt(2)),
+		Gas:       100000,
+		To:        &address,
+		Data:      calldata,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+	receipt, err := backend.TransactionReceipt(ctx, tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("putBlobs reverted by the stub contract")
+	}
+}
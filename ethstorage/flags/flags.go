@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/ethstorage/go-ethstorage/ethstorage"
 	eslog "github.com/ethstorage/go-ethstorage/ethstorage/log"
 	"github.com/ethstorage/go-ethstorage/ethstorage/miner"
 	"github.com/ethstorage/go-ethstorage/ethstorage/signer"
@@ -43,7 +44,7 @@ var (
 	}
 	L1NodeAddr = cli.StringFlag{
 		Name:   "l1.rpc",
-		Usage:  "Address of L1 User JSON-RPC endpoint to use (eth namespace required)",
+		Usage:  "Address of L1 User JSON-RPC endpoint to use (eth namespace required), or a comma-separated list of addresses to fail over",
 		EnvVar: prefixEnvVar("L1_ETH_RPC"),
 	}
 	L1BeaconAddr = cli.StringFlag{
@@ -76,6 +77,18 @@ var (
 		Value:  4096 * 32 * 12, // ~18 days, define in CL p2p spec: https://github.com/ethereum/consensus-specs/pull/3047
 		EnvVar: prefixEnvVar("L1_BEACON_MIN_DURATION_BLOBS_REQUEST"),
 	}
+	L1MetaCacheSize = cli.IntFlag{
+		Name:   "l1.meta-cache-size",
+		Usage:  "Number of blob metadatas read from the storage contract kept in memory",
+		Value:  ethstorage.DefaultMetaLRUSize,
+		EnvVar: prefixEnvVar("L1_META_CACHE_SIZE"),
+	}
+	L1MetaBatchSize = cli.IntFlag{
+		Name:   "l1.meta-batch-size",
+		Usage:  "Max number of blob metadatas read from the storage contract in one RPC call",
+		Value:  ethstorage.DefaultMetaBatchSize,
+		EnvVar: prefixEnvVar("L1_META_BATCH_SIZE"),
+	}
 	L2ChainId = cli.Uint64Flag{
 		Name:   "l2.chain_id",
 		Usage:  "Chain id of L2 chain endpoint to use",
@@ -99,6 +112,23 @@ var (
 		Value:  7300,
 		EnvVar: prefixEnvVar("METRICS_PORT"),
 	}
+	DashboardEnabledFlag = cli.BoolFlag{
+		Name:   "dashboard.enabled",
+		Usage:  "Enable the web dashboard of the p2p sync progress",
+		EnvVar: prefixEnvVar("DASHBOARD_ENABLED"),
+	}
+	DashboardAddrFlag = cli.StringFlag{
+		Name:   "dashboard.addr",
+		Usage:  "Dashboard listening address",
+		Value:  "127.0.0.1",
+		EnvVar: prefixEnvVar("DASHBOARD_ADDR"),
+	}
+	DashboardPortFlag = cli.IntFlag{
+		Name:   "dashboard.port",
+		Usage:  "Dashboard listening port",
+		Value:  9696,
+		EnvVar: prefixEnvVar("DASHBOARD_PORT"),
+	}
 	PprofEnabledFlag = cli.BoolFlag{
 		Name:   "pprof.enabled",
 		Usage:  "Enable the pprof server",
@@ -140,11 +170,31 @@ var (
 		Usage:  "File paths where the data are stored",
 		EnvVar: prefixEnvVar("STORAGE_FILES"),
 	}
+	StorageDiskMap = cli.StringFlag{
+		Name:   "storage.disk-map",
+		Usage:  "JSON file mapping the shard indexes to the directories of their data files, e.g. {\"0\": \"/mnt/disk0\"}, whose data files are opened besides storage.files",
+		EnvVar: prefixEnvVar("STORAGE_DISK_MAP"),
+	}
+	StorageVerifyOnOpen = cli.BoolFlag{
+		Name:   "storage.verify-on-open",
+		Usage:  "Decode a sample of the stored blobs of each data file on startup and check them against their commits",
+		EnvVar: prefixEnvVar("STORAGE_VERIFY_ON_OPEN"),
+	}
+	StorageMmap = cli.BoolFlag{
+		Name:   "storage.mmap",
+		Usage:  "Map the data files in memory to serve the reads, falling back to ReadAt where mmap is unavailable",
+		EnvVar: prefixEnvVar("STORAGE_MMAP"),
+	}
 	StorageMiner = cli.StringFlag{
 		Name:   "storage.miner",
 		Usage:  "Miner's address to encode data and receive mining rewards",
 		EnvVar: prefixEnvVar("STORAGE_MINER"),
 	}
+	StorageShardMiners = cli.StringSliceFlag{
+		Name:   "storage.shard-miners",
+		Usage:  "Miners of the shards encoded for another address than storage.miner, in the form of shardIdx:address",
+		EnvVar: prefixEnvVar("STORAGE_SHARD_MINERS"),
+	}
 	StorageL1Contract = cli.StringFlag{
 		Name:   "storage.l1contract",
 		Usage:  "Storage contract address on l1",
@@ -195,6 +245,17 @@ var (
 		EnvVar: prefixEnvVar("RPC_ESCALL_URL"),
 		Value:  "http://127.0.0.1:8545",
 	}
+	KZGBackend = cli.StringFlag{
+		Name:   "kzg.backend",
+		Usage:  "KZG library for blob commitments and proofs: gokzg (pure Go) or ckzg (cgo, requires a binary built with CGO_ENABLED=1 and '-tags ckzg')",
+		EnvVar: prefixEnvVar("KZG_BACKEND"),
+		Value:  "gokzg",
+	}
+	KZGTrustedSetup = cli.StringFlag{
+		Name:   "kzg.trusted-setup",
+		Usage:  "Path of a KZG trusted setup JSON file with the g1_lagrange and g2_monomial points, the setup embedded in go-ethereum is used if empty. Only supported by the gokzg backend",
+		EnvVar: prefixEnvVar("KZG_TRUSTED_SETUP"),
+	}
 )
 
 // Not use 'Required' field in order to avoid unnecessary check when use 'init' subcommand
@@ -211,15 +272,24 @@ var requiredFlags = []cli.Flag{
 
 var optionalFlags = []cli.Flag{
 	StorageMiner,
+	StorageShardMiners,
+	StorageDiskMap,
+	StorageVerifyOnOpen,
+	StorageMmap,
 	Network,
 	RollupConfig,
 	L1ChainId,
 	L1BeaconSlotTime,
 	L1MinDurationForBlobsRequest,
+	L1MetaCacheSize,
+	L1MetaBatchSize,
 	L2ChainId,
 	MetricsEnabledFlag,
 	MetricsAddrFlag,
 	MetricsPortFlag,
+	DashboardEnabledFlag,
+	DashboardAddrFlag,
+	DashboardPortFlag,
 	PprofEnabledFlag,
 	PprofAddrFlag,
 	PprofPortFlag,
@@ -233,6 +303,8 @@ var optionalFlags = []cli.Flag{
 	RPCListenAddr,
 	RPCListenPort,
 	RPCESCallURL,
+	KZGBackend,
+	KZGTrustedSetup,
 }
 
 // Flags contains the list of configuration options available to the binary.
@@ -248,6 +320,10 @@ func init() {
 
 func CheckRequired(ctx *cli.Context) error {
 	for _, f := range requiredFlags {
+		// the data files may all be found by the disk map
+		if f.GetName() == StorageFiles.Name && ctx.GlobalIsSet(StorageDiskMap.Name) {
+			continue
+		}
 		if !ctx.GlobalIsSet(f.GetName()) {
 			return fmt.Errorf("flag %s is required", f.GetName())
 		}
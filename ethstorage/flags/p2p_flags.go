@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/ethstorage/go-ethstorage/ethstorage/p2p"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
 	"github.com/urfave/cli"
 )
 
@@ -184,6 +185,217 @@ var (
 		Value:    8000, // The upper limit of devnet-11 geth node
 		EnvVar:   p2pEnv("META_BATCH_SIZE"),
 	}
+	PeerJoinRate = cli.Float64Flag{
+		Name: "p2p.sync.peer-join-rate",
+		Usage: "Max number of newly connected peers per second that start serving sync requests. Peers beyond the rate " +
+			"are queued instead of dropped. 0 means unlimited.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("PEER_JOIN_RATE"),
+	}
+	SyncMaxConcurrentRequests = cli.IntFlag{
+		Name:     "p2p.sync.max-concurrent-requests",
+		Usage:    "Max number of sync requests in flight. 0 means one request per idle peer.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_CONCURRENT_REQUESTS"),
+	}
+	SyncMaxConcurrentWrites = cli.IntFlag{
+		Name:     "p2p.sync.max-concurrent-writes",
+		Usage:    "Max number of synced blob batches written to the data files concurrently. 0 means unlimited.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_CONCURRENT_WRITES"),
+	}
+	SyncMaxWriteQueue = cli.IntFlag{
+		Name:     "p2p.sync.max-write-queue",
+		Usage:    "Max number of synced blob batches waiting to be written before new sync requests are paused. 0 means unlimited.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_WRITE_QUEUE"),
+	}
+	SyncHealBacklogThreshold = cli.IntFlag{
+		Name: "p2p.sync.heal-backlog-threshold",
+		Usage: "Number of blobs waiting to be healed in a shard above which the blobs are requested before new ranges " +
+			"of the shard. 0 means disabled.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_HEAL_BACKLOG_THRESHOLD"),
+	}
+	SyncMetaRefreshInterval = cli.DurationFlag{
+		Name: "p2p.sync.meta-refresh-interval",
+		Usage: "Interval to re-read the blob metadatas from the storage contract at the finalized L1 block during " +
+			"the sync, so the blobs changed by an L1 reorg are synced again. 0 means disabled.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_META_REFRESH_INTERVAL"),
+	}
+	SyncRequestTimeout = cli.DurationFlag{
+		Name: "p2p.sync.request-timeout",
+		Usage: "Max time of a sync request to a peer, after which the request is cancelled and the blobs are " +
+			"requested from another peer. 0 means only the stream timeouts apply.",
+		Required: false,
+		Value:    protocol.DefaultRequestTimeout,
+		EnvVar:   p2pEnv("SYNC_REQUEST_TIMEOUT"),
+	}
+	SyncStallTimeout = cli.DurationFlag{
+		Name: "p2p.sync.stall-timeout",
+		Usage: "Max time a range being synced from a peer may not advance, after which the request is cancelled and " +
+			"the range is requested from another peer. 0 means disabled.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_STALL_TIMEOUT"),
+	}
+	SyncSkipFilled = cli.BoolFlag{
+		Name: "p2p.sync.skip-filled",
+		Usage: "Skip the blobs already filled in the local storage with the commit in the contract instead of requesting " +
+			"them from the peers again, e.g. when resuming the sync of a partially synced shard. The blobs filled with " +
+			"another commit are healed.",
+		Required: false,
+		EnvVar:   p2pEnv("SYNC_SKIP_FILLED"),
+	}
+	SyncMinRangeSize = cli.Uint64Flag{
+		Name:     "p2p.sync.min-range-size",
+		Usage:    "Min number of blobs in a range requested from a peer, when the range is sized by the throughput of the peer.",
+		Required: false,
+		Value:    1,
+		EnvVar:   p2pEnv("SYNC_MIN_RANGE_SIZE"),
+	}
+	SyncMaxRangeSize = cli.Uint64Flag{
+		Name: "p2p.sync.max-range-size",
+		Usage: "Max number of blobs in a range requested from a peer. The ranges are sized by the throughput of each peer " +
+			"within the min and max range size, so the slow peers get smaller ranges. 0 means a fixed range size.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_RANGE_SIZE"),
+	}
+	SyncMaxPeersPerShard = cli.IntFlag{
+		Name: "p2p.sync.max-peers-per-shard",
+		Usage: "Max number of peers kept for a shard, the peers of the shards over the limit are evicted in favor " +
+			"of the peers serving the shards with fewer providers. 0 means no limit.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_MAX_PEERS_PER_SHARD"),
+	}
+	SyncReconnectAttempts = cli.IntFlag{
+		Name: "p2p.sync.reconnect-attempts",
+		Usage: "Max number of dials to reconnect a disconnected peer serving the shards being synced, with an " +
+			"exponential backoff between the dials. 0 means the peers are not reconnected.",
+		Required: false,
+		Value:    5,
+		EnvVar:   p2pEnv("SYNC_RECONNECT_ATTEMPTS"),
+	}
+	SyncReconnectBackoff = cli.DurationFlag{
+		Name:     "p2p.sync.reconnect-backoff",
+		Usage:    "Delay before the first dial to reconnect a peer, which doubles with each dial.",
+		Required: false,
+		Value:    protocol.DefaultReconnectBackoff,
+		EnvVar:   p2pEnv("SYNC_RECONNECT_BACKOFF"),
+	}
+	SyncReconnectMaxBackoff = cli.DurationFlag{
+		Name:     "p2p.sync.reconnect-max-backoff",
+		Usage:    "Max delay between the dials to reconnect a peer.",
+		Required: false,
+		Value:    protocol.DefaultReconnectMaxBackoff,
+		EnvVar:   p2pEnv("SYNC_RECONNECT_MAX_BACKOFF"),
+	}
+	SyncEmptyFill = cli.StringFlag{
+		Name: "p2p.sync.empty-fill",
+		Usage: "How the kvs beyond the last kv index are filled, 'eager' to fill them with empty blobs, or 'lazy' " +
+			"to leave them unwritten until their blobs arrive, which saves the disk space of the data files created " +
+			"with es-node init --sparse. The shards cannot be mined before their kvs are filled eagerly.",
+		Required: false,
+		Value:    string(protocol.EmptyFillEager),
+		EnvVar:   p2pEnv("SYNC_EMPTY_FILL"),
+	}
+	SyncL1HealTimeout = cli.DurationFlag{
+		Name: "p2p.sync.l1-heal-timeout",
+		Usage: "Time a blob stays in the heal task before it is downloaded from the L1 beacon node set by l1.beacon, " +
+			"in case no peer has it. 0 disables the healing from L1.",
+		Required: false,
+		Value:    0,
+		EnvVar:   p2pEnv("SYNC_L1_HEAL_TIMEOUT"),
+	}
+	ServerRequestRate = cli.Float64Flag{
+		Name:     "p2p.server.request-rate",
+		Usage:    "Max number of sync requests per second the node serves to all peers.",
+		Required: false,
+		Value:    protocol.DefaultGlobalServerRequestRate,
+		EnvVar:   p2pEnv("SERVER_REQUEST_RATE"),
+	}
+	ServerRequestBurst = cli.IntFlag{
+		Name:     "p2p.server.request-burst",
+		Usage:    "Max number of sync requests the node serves to all peers in a burst.",
+		Required: false,
+		Value:    protocol.DefaultGlobalServerRequestBurst,
+		EnvVar:   p2pEnv("SERVER_REQUEST_BURST"),
+	}
+	ServerBytesRate = cli.Float64Flag{
+		Name: "p2p.server.bytes-rate",
+		Usage: "Max number of bytes per second the node writes to the sync streams of all peers, e.g. to keep " +
+			"the upload bandwidth for other use. 0 means unlimited.",
+		Required: false,
+		Value:    protocol.DefaultGlobalServerBytesRate,
+		EnvVar:   p2pEnv("SERVER_BYTES_RATE"),
+	}
+	ServerBytesBurst = cli.IntFlag{
+		Name:     "p2p.server.bytes-burst",
+		Usage:    "Max number of bytes the node writes to the sync streams of all peers in a burst.",
+		Required: false,
+		Value:    protocol.DefaultGlobalServerBytesBurst,
+		EnvVar:   p2pEnv("SERVER_BYTES_BURST"),
+	}
+	ServerPeerRequestRate = cli.Float64Flag{
+		Name: "p2p.server.peer-request-rate",
+		Usage: "Max number of sync requests per second the node serves to a single peer. A peer exceeding it " +
+			"is asked to slow down.",
+		Required: false,
+		Value:    protocol.DefaultPeerServerRequestRate,
+		EnvVar:   p2pEnv("SERVER_PEER_REQUEST_RATE"),
+	}
+	ServerPeerRequestBurst = cli.IntFlag{
+		Name:     "p2p.server.peer-request-burst",
+		Usage:    "Max number of sync requests the node serves to a single peer in a burst.",
+		Required: false,
+		Value:    protocol.DefaultPeerServerRequestBurst,
+		EnvVar:   p2pEnv("SERVER_PEER_REQUEST_BURST"),
+	}
+	ServerPeerMaxStreams = cli.IntFlag{
+		Name:     "p2p.server.peer-max-streams",
+		Usage:    "Max number of sync requests of a single peer served concurrently. 0 means unlimited.",
+		Required: false,
+		Value:    protocol.DefaultMaxPeerServerStreams,
+		EnvVar:   p2pEnv("SERVER_PEER_MAX_STREAMS"),
+	}
+	ServerPeerBytesRate = cli.Float64Flag{
+		Name:     "p2p.server.peer-bytes-rate",
+		Usage:    "Max number of blob bytes per second the node serves to a single peer. 0 means unlimited.",
+		Required: false,
+		Value:    protocol.DefaultPeerServerBytesRate,
+		EnvVar:   p2pEnv("SERVER_PEER_BYTES_RATE"),
+	}
+	ServerPeerBytesBurst = cli.IntFlag{
+		Name:     "p2p.server.peer-bytes-burst",
+		Usage:    "Max number of blob bytes the node serves to a single peer in a burst.",
+		Required: false,
+		Value:    protocol.DefaultPeerServerBytesBurst,
+		EnvVar:   p2pEnv("SERVER_PEER_BYTES_BURST"),
+	}
+	ServerBlobCacheSize = cli.Int64Flag{
+		Name:     "p2p.server.blob-cache-size",
+		Usage:    "Max number of bytes of the recently served blobs the node keeps in memory. 0 disables the cache.",
+		Required: false,
+		Value:    protocol.DefaultServerBlobCacheSize,
+		EnvVar:   p2pEnv("SERVER_BLOB_CACHE_SIZE"),
+	}
+	ServerMaxResponseSize = cli.Uint64Flag{
+		Name: "p2p.server.max-response-size",
+		Usage: "Max number of blob bytes the node replies to a single request, at most the default. The smaller one of it " +
+			"and the size accepted by the requesting peer is used.",
+		Required: false,
+		Value:    protocol.DefaultMaxServerResponseSize,
+		EnvVar:   p2pEnv("SERVER_MAX_RESPONSE_SIZE"),
+	}
 	PeersLo = cli.UintFlag{
 		Name:     "p2p.peers.lo",
 		Usage:    "Low-tide peer count. The node actively searches for new peer connections if below this amount.",
@@ -193,14 +405,14 @@ var (
 	}
 	PeersHi = cli.UintFlag{
 		Name:     "p2p.peers.hi",
-		Usage:    "High-tide peer count. The node starts pruning peer connections slowly after reaching this number.",
+		Usage:    "High-tide peer count. The node starts pruning peer connections slowly after reaching this number. It is also the max number of peers the sync client accepts (maxPeers).",
 		Required: false,
 		Value:    70,
 		EnvVar:   p2pEnv("PEERS_HI"),
 	}
 	PeersGrace = cli.DurationFlag{
 		Name:     "p2p.peers.grace",
-		Usage:    "Grace period to keep a newly connected peer around, if it is not misbehaving.",
+		Usage:    "Grace period to keep a newly connected peer around before the connection manager may prune it, if it is not misbehaving.",
 		Required: false,
 		Value:    30 * time.Second,
 		EnvVar:   p2pEnv("PEERS_GRACE"),
@@ -349,6 +561,34 @@ var p2pFlags = []cli.Flag{
 	SyncConcurrency,
 	FillEmptyConcurrency,
 	MetaDownloadBatchSize,
+	PeerJoinRate,
+	SyncMaxConcurrentRequests,
+	SyncMaxConcurrentWrites,
+	SyncMaxWriteQueue,
+	SyncHealBacklogThreshold,
+	SyncMetaRefreshInterval,
+	SyncRequestTimeout,
+	SyncStallTimeout,
+	SyncSkipFilled,
+	SyncMinRangeSize,
+	SyncMaxRangeSize,
+	SyncMaxPeersPerShard,
+	SyncReconnectAttempts,
+	SyncReconnectBackoff,
+	SyncReconnectMaxBackoff,
+	SyncEmptyFill,
+	SyncL1HealTimeout,
+	ServerRequestRate,
+	ServerRequestBurst,
+	ServerBytesRate,
+	ServerBytesBurst,
+	ServerPeerRequestRate,
+	ServerPeerRequestBurst,
+	ServerPeerMaxStreams,
+	ServerPeerBytesRate,
+	ServerPeerBytesBurst,
+	ServerBlobCacheSize,
+	ServerMaxResponseSize,
 	PeersLo,
 	PeersHi,
 	PeersGrace,
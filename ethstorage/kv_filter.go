@@ -0,0 +1,51 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+const (
+	kvFilterBitsPerKv = 10 // about 1% false positives with all the kvs of the shard added
+	kvFilterHashes    = 7
+)
+
+// kvFilter is a bloom filter of kv indices. It never reports an added kv as absent, so a kv it
+// reports as absent is known to be absent without looking it up; a kv reported as present may not be.
+type kvFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+}
+
+func newKvFilter(kvEntries uint64) *kvFilter {
+	m := max(kvEntries*kvFilterBitsPerKv, 64)
+	return &kvFilter{bits: make([]uint64, (m+63)/64), m: m}
+}
+
+func (f *kvFilter) add(kvIdx uint64) {
+	h1, h2 := kvFilterHash(kvIdx)
+	for i := uint64(0); i < kvFilterHashes; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *kvFilter) mayContain(kvIdx uint64) bool {
+	h1, h2 := kvFilterHash(kvIdx)
+	for i := uint64(0); i < kvFilterHashes; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// kvFilterHash derives the two hashes of the kv index combined into the probe positions,
+// using the splitmix64 finalizer with two different seeds.
+func kvFilterHash(kvIdx uint64) (uint64, uint64) {
+	mix := func(z uint64) uint64 {
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		return z ^ (z >> 31)
+	}
+	return mix(kvIdx + 0x9e3779b97f4a7c15), mix(kvIdx+0x3c6ef372fe94f82a) | 1
+}
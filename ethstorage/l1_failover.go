@@ -0,0 +1,208 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+)
+
+// DefaultL1EndpointCooldown is how long an L1 endpoint failing with a connection error is skipped.
+const DefaultL1EndpointCooldown = 30 * time.Second
+
+var ErrL1EndpointsDown = errors.New("all the L1 endpoints are down")
+
+type l1Endpoint struct {
+	name      string
+	source    Il1Source
+	downSince time.Time // zero if the endpoint is healthy
+}
+
+// FailoverL1Source is an Il1Source over several L1 endpoints. Requests go to the endpoints in order, so the
+// first healthy one serves them. An endpoint failing with a connection error is marked down and the request
+// is retried on the next one; the endpoint is tried again once the cooldown has passed. Errors returned by
+// the contract call itself are returned as is, as the other endpoints would fail the same way.
+type FailoverL1Source struct {
+	endpoints []*l1Endpoint
+	cooldown  time.Duration
+	lg        log.Logger
+
+	mu sync.Mutex
+}
+
+func NewFailoverL1Source(names []string, sources []Il1Source, cooldown time.Duration, lg log.Logger) (*FailoverL1Source, error) {
+	if len(sources) == 0 || len(names) != len(sources) {
+		return nil, fmt.Errorf("invalid L1 endpoints: %d names, %d sources", len(names), len(sources))
+	}
+	endpoints := make([]*l1Endpoint, len(sources))
+	for i, source := range sources {
+		endpoints[i] = &l1Endpoint{name: names[i], source: source}
+	}
+	return &FailoverL1Source{
+		endpoints: endpoints,
+		cooldown:  cooldown,
+		lg:        lg,
+	}, nil
+}
+
+func (f *FailoverL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	var metas [][32]byte
+	err := f.call(func(source Il1Source) (err error) {
+		metas, err = source.GetKvMetas(kvIndices, blockNumber)
+		return err
+	})
+	return metas, err
+}
+
+func (f *FailoverL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	var lastKvIdx uint64
+	err := f.call(func(source Il1Source) (err error) {
+		lastKvIdx, err = source.GetStorageLastBlobIdx(blockNumber)
+		return err
+	})
+	return lastKvIdx, err
+}
+
+// L1Reader is an Il1Source which also reads the headers and the logs of L1, e.g. eth.PollingClient.
+type L1Reader interface {
+	Il1Source
+	eth.L1Reader
+}
+
+// FailoverL1Reader is a FailoverL1Source over L1Readers, so the reads of the headers and the logs fail over
+// to the next endpoint as well.
+type FailoverL1Reader struct {
+	*FailoverL1Source
+}
+
+func NewFailoverL1Reader(names []string, sources []L1Reader, cooldown time.Duration, lg log.Logger) (*FailoverL1Reader, error) {
+	l1Sources := make([]Il1Source, len(sources))
+	for i, source := range sources {
+		l1Sources[i] = source
+	}
+	f, err := NewFailoverL1Source(names, l1Sources, cooldown, lg)
+	if err != nil {
+		return nil, err
+	}
+	return &FailoverL1Reader{f}, nil
+}
+
+func (f *FailoverL1Reader) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	var header *types.Header
+	err := f.call(func(source Il1Source) (err error) {
+		header, err = source.(L1Reader).HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, err
+}
+
+func (f *FailoverL1Reader) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	var header *types.Header
+	err := f.call(func(source Il1Source) (err error) {
+		header, err = source.(L1Reader).HeaderByHash(ctx, hash)
+		return err
+	})
+	return header, err
+}
+
+func (f *FailoverL1Reader) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	err := f.call(func(source Il1Source) (err error) {
+		logs, err = source.(L1Reader).FilterLogs(ctx, q)
+		return err
+	})
+	return logs, err
+}
+
+func (f *FailoverL1Reader) FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error) {
+	var logs []types.Log
+	err := f.call(func(source Il1Source) (err error) {
+		logs, err = source.(L1Reader).FilterLogsByBlockRange(start, end, eventSig)
+		return err
+	})
+	return logs, err
+}
+
+// Healthy returns the names of the endpoints which are not marked down.
+func (f *FailoverL1Source) Healthy() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.endpoints))
+	for _, ep := range f.endpoints {
+		if ep.downSince.IsZero() {
+			names = append(names, ep.name)
+		}
+	}
+	return names
+}
+
+func (f *FailoverL1Source) call(fn func(source Il1Source) error) error {
+	var errs []error
+	for _, ep := range f.available() {
+		err := fn(ep.source)
+		if err != nil && isConnectionError(err) {
+			f.markDown(ep, err)
+			errs = append(errs, fmt.Errorf("%s: %w", ep.name, err))
+			continue
+		}
+		f.markUp(ep)
+		return err
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("%w: all in cooldown", ErrL1EndpointsDown)
+	}
+	return fmt.Errorf("%w: %w", ErrL1EndpointsDown, errors.Join(errs...))
+}
+
+// available returns the endpoints in order, skipping those marked down within the cooldown.
+func (f *FailoverL1Source) available() []*l1Endpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	endpoints := make([]*l1Endpoint, 0, len(f.endpoints))
+	for _, ep := range f.endpoints {
+		if ep.downSince.IsZero() || time.Since(ep.downSince) >= f.cooldown {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+func (f *FailoverL1Source) markDown(ep *l1Endpoint, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ep.downSince.IsZero() {
+		f.lg.Warn("L1 endpoint is down", "endpoint", ep.name, "err", err)
+	}
+	ep.downSince = time.Now()
+}
+
+func (f *FailoverL1Source) markUp(ep *l1Endpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !ep.downSince.IsZero() {
+		f.lg.Info("L1 endpoint is up again", "endpoint", ep.name)
+		ep.downSince = time.Time{}
+	}
+}
+
+// isConnectionError reports whether the error comes from reaching the endpoint rather than from
+// the call, which the endpoint reports as a JSON-RPC error with a code, or as a header not found.
+func isConnectionError(err error) bool {
+	if errors.Is(err, ethereum.NotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var rpcErr rpc.Error
+	return !errors.As(err, &rpcErr)
+}
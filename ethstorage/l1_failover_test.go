@@ -0,0 +1,142 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type downL1Source struct {
+	calls int
+	err   error
+}
+
+func (l1 *downL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	l1.calls++
+	return nil, l1.err
+}
+
+func (l1 *downL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	l1.calls++
+	return 0, l1.err
+}
+
+// revertError is an error reported by a reachable endpoint.
+type revertError struct{}
+
+func (revertError) Error() string  { return "execution reverted" }
+func (revertError) ErrorCode() int { return 3 }
+
+func TestFailoverL1Source(t *testing.T) {
+	first := &downL1Source{err: errors.New("connection refused")}
+	second := &countingL1Source{metas: map[uint64][32]byte{0: {1}, 1: {2}}}
+	f, err := NewFailoverL1Source([]string{"first", "second"}, []Il1Source{first, second}, time.Hour, testLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		metas, err := f.GetKvMetas([]uint64{0, 1}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metas[1] != second.metas[1] {
+			t.Fatalf("unexpected metas %v", metas)
+		}
+		lastKvIdx, err := f.GetStorageLastBlobIdx(100)
+		if err != nil || lastKvIdx != 2 {
+			t.Fatalf("unexpected last kv index %d, err %v", lastKvIdx, err)
+		}
+	}
+	// the first endpoint is skipped during its cooldown
+	if first.calls != 1 || second.calls != 3 {
+		t.Fatalf("expected 1 call to the first endpoint and 3 to the second, got %d and %d", first.calls, second.calls)
+	}
+	if healthy := f.Healthy(); len(healthy) != 1 || healthy[0] != "second" {
+		t.Fatalf("unexpected healthy endpoints %v", healthy)
+	}
+
+	// the first endpoint is tried again after the cooldown
+	f.cooldown = 0
+	first.err = revertError{}
+	if _, err := f.GetKvMetas([]uint64{0}, 100); !errors.Is(err, revertError{}) {
+		t.Fatalf("call errors should be returned without failing over, got %v", err)
+	}
+	if first.calls != 2 || second.calls != 3 || len(f.Healthy()) != 2 {
+		t.Fatalf("the first endpoint should be up again")
+	}
+
+	// all the endpoints are down
+	first.err = errors.New("connection refused")
+	f2, _ := NewFailoverL1Source([]string{"first", "second"}, []Il1Source{first, &downL1Source{err: errors.New("i/o timeout")}}, time.Hour, testLog)
+	if _, err := f2.GetStorageLastBlobIdx(100); !errors.Is(err, ErrL1EndpointsDown) {
+		t.Fatalf("expected ErrL1EndpointsDown, got %v", err)
+	}
+	if _, err := f2.GetStorageLastBlobIdx(100); !errors.Is(err, ErrL1EndpointsDown) {
+		t.Fatalf("expected ErrL1EndpointsDown during the cooldown, got %v", err)
+	}
+}
+
+// headerL1Reader is an L1Reader serving the headers, its logs are an error.
+type headerL1Reader struct {
+	downL1Source
+	headers map[uint64]*types.Header
+}
+
+func (r *headerL1Reader) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	r.calls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	if header, ok := r.headers[number.Uint64()]; ok {
+		return header, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (r *headerL1Reader) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	r.calls++
+	return nil, r.err
+}
+
+func (r *headerL1Reader) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	r.calls++
+	return nil, r.err
+}
+
+func (r *headerL1Reader) FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error) {
+	r.calls++
+	return nil, r.err
+}
+
+func TestFailoverL1Reader(t *testing.T) {
+	first := &headerL1Reader{downL1Source: downL1Source{err: errors.New("connection refused")}}
+	second := &headerL1Reader{headers: map[uint64]*types.Header{100: {Number: big.NewInt(100)}}}
+	f, err := NewFailoverL1Reader([]string{"first", "second"}, []L1Reader{first, second}, time.Hour, testLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := f.HeaderByNumber(context.Background(), big.NewInt(100))
+	if err != nil || header.Number.Uint64() != 100 {
+		t.Fatalf("unexpected header %v, err %v", header, err)
+	}
+	if first.calls != 1 || second.calls != 1 {
+		t.Fatalf("expected the header read from the second endpoint, got %d and %d calls", first.calls, second.calls)
+	}
+	// a header not found is returned without marking the endpoint down
+	if _, err := f.HeaderByNumber(context.Background(), big.NewInt(101)); !errors.Is(err, ethereum.NotFound) {
+		t.Fatalf("expected ethereum.NotFound, got %v", err)
+	}
+	if healthy := f.Healthy(); len(healthy) != 1 || healthy[0] != "second" {
+		t.Fatalf("unexpected healthy endpoints %v", healthy)
+	}
+}
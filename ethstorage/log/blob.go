@@ -0,0 +1,67 @@
+package log
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// The keys of the fields tagging the log records of a blob.
+const (
+	ContractKey = "contract"
+	ShardKey    = "shardId"
+	KvIdxKey    = "kvIdx"
+)
+
+// BlobLogger is a logger tagging its records with the contract, shardId and kvIdx of the blob it is scoped
+// to, so the records of a blob from its generation through the upload, sync and verification can be found
+// with a single grep of the same fields.
+type BlobLogger struct {
+	log.Logger
+	base      log.Logger
+	contract  common.Address
+	kvEntries uint64 // kvs in a shard of the contract, 0 means the shardId is not derived from the kvIdx
+	shardId   *uint64
+	kvIdx     *uint64
+}
+
+// NewBlobLogger creates a BlobLogger of the contract on top of the logger. The shardId of a blob is derived
+// from its kvIdx with kvEntries, where 0 leaves the shardId out unless it is set by WithShard.
+func NewBlobLogger(l log.Logger, contract common.Address, kvEntries uint64) *BlobLogger {
+	bl := &BlobLogger{base: l, contract: contract, kvEntries: kvEntries}
+	bl.Logger = bl.scoped()
+	return bl
+}
+
+// WithShard returns a logger scoped to the shard, which tags its records with the shardId.
+func (l *BlobLogger) WithShard(shardId uint64) *BlobLogger {
+	bl := *l
+	bl.shardId, bl.kvIdx = &shardId, nil
+	bl.Logger = bl.scoped()
+	return &bl
+}
+
+// WithBlob returns a logger scoped to the blob at kvIdx, which tags its records with the kvIdx and the
+// shardId of the blob.
+func (l *BlobLogger) WithBlob(kvIdx uint64) *BlobLogger {
+	bl := *l
+	bl.kvIdx = &kvIdx
+	if l.kvEntries > 0 {
+		shardId := kvIdx / l.kvEntries
+		bl.shardId = &shardId
+	}
+	bl.Logger = bl.scoped()
+	return &bl
+}
+
+// scoped creates the logger of the base one with the fields set, so a field set again replaces the former
+// value instead of being repeated in the records.
+func (l *BlobLogger) scoped() log.Logger {
+	ctx := []interface{}{ContractKey, l.contract}
+	if l.shardId != nil {
+		ctx = append(ctx, ShardKey, *l.shardId)
+	}
+	if l.kvIdx != nil {
+		ctx = append(ctx, KvIdxKey, *l.kvIdx)
+	}
+	return l.base.New(ctx...)
+}
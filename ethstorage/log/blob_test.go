@@ -0,0 +1,63 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+func TestBlobLogger(t *testing.T) {
+	var records []*log.Record
+	base := log.New()
+	base.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330001")
+	fields := func(r *log.Record) map[string]interface{} {
+		m := make(map[string]interface{})
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if _, ok := m[r.Ctx[i].(string)]; ok {
+				t.Fatalf("field %v repeated in %v", r.Ctx[i], r.Ctx)
+			}
+			m[r.Ctx[i].(string)] = r.Ctx[i+1]
+		}
+		return m
+	}
+
+	bl := NewBlobLogger(base, contract, 16)
+	bl.Info("shard synced")
+	bl.WithBlob(35).Info("blob synced", "commit", "0x01")
+	bl.WithBlob(35).WithBlob(3).Warn("blob verified")
+	bl.WithShard(1).Info("shard filled")
+	NewBlobLogger(base, contract, 0).WithBlob(35).Info("blob uploaded")
+
+	tests := []struct {
+		msg    string
+		fields map[string]interface{}
+	}{
+		{"shard synced", map[string]interface{}{ContractKey: contract}},
+		{"blob synced", map[string]interface{}{ContractKey: contract, ShardKey: uint64(2), KvIdxKey: uint64(35), "commit": "0x01"}},
+		{"blob verified", map[string]interface{}{ContractKey: contract, ShardKey: uint64(0), KvIdxKey: uint64(3)}},
+		{"shard filled", map[string]interface{}{ContractKey: contract, ShardKey: uint64(1)}},
+		{"blob uploaded", map[string]interface{}{ContractKey: contract, KvIdxKey: uint64(35)}},
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("expected %d records, got %d", len(tests), len(records))
+	}
+	for i, tt := range tests {
+		if records[i].Msg != tt.msg {
+			t.Fatalf("expected record %q, got %q", tt.msg, records[i].Msg)
+		}
+		got := fields(records[i])
+		if len(got) != len(tt.fields) {
+			t.Fatalf("record %q: expected fields %v, got %v", tt.msg, tt.fields, got)
+		}
+		for k, v := range tt.fields {
+			if got[k] != v {
+				t.Fatalf("record %q: expected %s=%v, got %v", tt.msg, k, v, got[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var (
+	metaCachePrefix    = []byte("kvMetaCache-")
+	metaCacheRangeKey  = []byte("kvMetaCacheRange")
+	metaCacheEntrySize = 8 + 32
+)
+
+type MetaCacheMetrics interface {
+	RecordMetaCache(hits, misses uint64)
+}
+
+// metaInvalidator is implemented by the Il1Source wrappers which need to be told about the kv
+// entries changed by the blobs downloaded from L1.
+type metaInvalidator interface {
+	InvalidateMetas(kvIndices []uint64, fromL1, toL1 int64)
+}
+
+// MetaCache is an Il1Source which keeps the kv metas read from the contract in the local database,
+// keyed by kv index together with the L1 block number they were read at.
+//
+// A cached meta read at block B is returned for a request at block N if B == N, or if B <= N <= coveredL1
+// and B >= validFromL1, where (validFromL1, coveredL1] is the continuous range of L1 blocks whose
+// blob updates have been reported via InvalidateMetas.
+type MetaCache struct {
+	Il1Source
+	db      ethdb.KeyValueStore
+	metrics MetaCacheMetrics
+	lg      log.Logger
+
+	mu          sync.Mutex
+	validFromL1 int64
+	coveredL1   int64
+}
+
+func NewMetaCache(l1Source Il1Source, db ethdb.KeyValueStore, m MetaCacheMetrics, lg log.Logger) *MetaCache {
+	c := &MetaCache{
+		Il1Source: l1Source,
+		db:        db,
+		metrics:   m,
+		lg:        lg,
+	}
+	if bs, err := db.Get(metaCacheRangeKey); err == nil && len(bs) == 16 {
+		c.validFromL1 = int64(binary.BigEndian.Uint64(bs[:8]))
+		c.coveredL1 = int64(binary.BigEndian.Uint64(bs[8:]))
+	}
+	return c
+}
+
+func metaCacheKey(kvIdx uint64) []byte {
+	key := make([]byte, len(metaCachePrefix)+8)
+	copy(key, metaCachePrefix)
+	binary.BigEndian.PutUint64(key[len(metaCachePrefix):], kvIdx)
+	return key
+}
+
+// GetKvMetas returns the metas from the cache when possible and only asks the underlying source for the rest.
+// Requests for a block tag (e.g. latest) instead of a block number bypass the cache.
+func (c *MetaCache) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	if blockNumber < 0 {
+		return c.Il1Source.GetKvMetas(kvIndices, blockNumber)
+	}
+
+	c.mu.Lock()
+	validFromL1, coveredL1 := c.validFromL1, c.coveredL1
+	c.mu.Unlock()
+
+	metas := make([][32]byte, len(kvIndices))
+	missed := make([]int, 0)
+	for i, idx := range kvIndices {
+		bs, err := c.db.Get(metaCacheKey(idx))
+		if err != nil || len(bs) != metaCacheEntrySize {
+			missed = append(missed, i)
+			continue
+		}
+		readAt := int64(binary.BigEndian.Uint64(bs[:8]))
+		if readAt == blockNumber || (readAt >= validFromL1 && readAt <= blockNumber && blockNumber <= coveredL1) {
+			copy(metas[i][:], bs[8:])
+			continue
+		}
+		missed = append(missed, i)
+	}
+	c.metrics.RecordMetaCache(uint64(len(kvIndices)-len(missed)), uint64(len(missed)))
+	if len(missed) == 0 {
+		return metas, nil
+	}
+
+	missedIndices := make([]uint64, len(missed))
+	for i, pos := range missed {
+		missedIndices[i] = kvIndices[pos]
+	}
+	fetched, err := c.Il1Source.GetKvMetas(missedIndices, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, pos := range missed {
+		metas[pos] = fetched[i]
+	}
+	// Entries may have been invalidated while the request was in flight, in which case
+	// the fetched metas could be stale for the blocks after blockNumber.
+	if blockNumber < c.coveredL1 {
+		return metas, nil
+	}
+	batch := c.db.NewBatch()
+	for i := range missed {
+		entry := make([]byte, metaCacheEntrySize)
+		binary.BigEndian.PutUint64(entry[:8], uint64(blockNumber))
+		copy(entry[8:], fetched[i][:])
+		batch.Put(metaCacheKey(missedIndices[i]), entry)
+	}
+	if err := batch.Write(); err != nil {
+		c.lg.Warn("Failed to write metas to cache", "err", err)
+	}
+	return metas, nil
+}
+
+// InvalidateMetas drops the cached metas of the kv entries updated in L1 blocks (fromL1, toL1] and extends the
+// range of blocks the remaining entries stay valid for. If there is a gap after the last reported range, updates
+// may have been missed, so all entries read before fromL1 are treated as stale.
+func (c *MetaCache) InvalidateMetas(kvIndices []uint64, fromL1, toL1 int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch := c.db.NewBatch()
+	for _, idx := range kvIndices {
+		batch.Delete(metaCacheKey(idx))
+	}
+	if fromL1 > c.coveredL1 {
+		c.validFromL1 = fromL1
+	}
+	if toL1 > c.coveredL1 {
+		c.coveredL1 = toL1
+	}
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs[:8], uint64(c.validFromL1))
+	binary.BigEndian.PutUint64(bs[8:], uint64(c.coveredL1))
+	batch.Put(metaCacheRangeKey, bs)
+	if err := batch.Write(); err != nil {
+		c.lg.Warn("Failed to invalidate cached metas", "err", err)
+	}
+}
+
+// PurgeMetas drops the cached metas of the kvs.
+func (c *MetaCache) PurgeMetas(kvIndices []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	batch := c.db.NewBatch()
+	for _, idx := range kvIndices {
+		batch.Delete(metaCacheKey(idx))
+	}
+	if err := batch.Write(); err != nil {
+		c.lg.Warn("Failed to purge cached metas", "err", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+type countingL1Source struct {
+	metas     map[uint64][32]byte
+	requested int
+	calls     int
+}
+
+func (l1 *countingL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	l1.requested += len(kvIndices)
+	l1.calls++
+	metas := make([][32]byte, len(kvIndices))
+	for i, idx := range kvIndices {
+		metas[i] = l1.metas[idx]
+	}
+	return metas, nil
+}
+
+func (l1 *countingL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	return uint64(len(l1.metas)), nil
+}
+
+type metaCacheCounter struct {
+	hits, misses uint64
+}
+
+func (m *metaCacheCounter) RecordMetaCache(hits, misses uint64) {
+	m.hits += hits
+	m.misses += misses
+}
+
+func TestMetaCache_GetKvMetas(t *testing.T) {
+	l1 := &countingL1Source{metas: map[uint64][32]byte{0: {1}, 1: {2}, 2: {3}}}
+	counter := &metaCacheCounter{}
+	db := rawdb.NewMemoryDatabase()
+	cache := NewMetaCache(l1, db, counter, testLog)
+	indices := []uint64{0, 1, 2}
+
+	// first read at block 100 goes to L1
+	if _, err := cache.GetKvMetas(indices, 100); err != nil {
+		t.Fatal(err)
+	}
+	if l1.requested != 3 || counter.misses != 3 {
+		t.Fatalf("expected 3 L1 reads, got %d", l1.requested)
+	}
+
+	// same block is served from the cache
+	metas, err := cache.GetKvMetas(indices, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1.requested != 3 || counter.hits != 3 || metas[1] != l1.metas[1] {
+		t.Fatalf("expected cache hits, L1 reads %d, hits %d", l1.requested, counter.hits)
+	}
+
+	// a newer block is unknown until its updates are reported
+	cache.GetKvMetas([]uint64{0}, 110)
+	if l1.requested != 4 {
+		t.Fatalf("expected meta of newer block read from L1, L1 reads %d", l1.requested)
+	}
+
+	// kv 1 changed in (100, 120], so only kv 1 is read again
+	l1.metas[1] = [32]byte{4}
+	cache.InvalidateMetas([]uint64{1}, 100, 120)
+	metas, err = cache.GetKvMetas(indices, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1.requested != 5 || metas[1] != l1.metas[1] {
+		t.Fatalf("expected only invalidated meta read from L1, L1 reads %d", l1.requested)
+	}
+
+	// the valid range survives a restart
+	cache = NewMetaCache(l1, db, counter, testLog)
+	cache.GetKvMetas(indices, 120)
+	if l1.requested != 5 {
+		t.Fatalf("expected cache hits after reload, L1 reads %d", l1.requested)
+	}
+
+	// a gap in the reported ranges makes all earlier entries stale
+	cache.InvalidateMetas(nil, 150, 160)
+	cache.GetKvMetas(indices, 160)
+	if l1.requested != 8 {
+		t.Fatalf("expected all metas read from L1 after a gap, L1 reads %d", l1.requested)
+	}
+}
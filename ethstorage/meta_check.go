@@ -0,0 +1,67 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// metaCheckBatchSize is the number of kvs whose metas are read from L1 in one call by CheckMetaConsistency.
+const metaCheckBatchSize = 256
+
+// CheckMetaConsistency compares the metas in the data files of the shard manager with the metas in the
+// contract at blockNumber, and returns the indices of the kvs whose filled data does not match the contract:
+// the commit differs, or the kv is beyond the last kv index but holds data. The kvs not filled yet are skipped,
+// as they are left to the sync.
+func CheckMetaConsistency(sm *ShardManager, l1 Il1Source, blockNumber int64) ([]uint64, error) {
+	lastKvIdx, err := l1.GetStorageLastBlobIdx(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	shards := sm.ShardIds()
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+
+	mismatched := make([]uint64, 0)
+	emptyHash := make([]byte, HashSizeInContract)
+	for _, sid := range shards {
+		from, limit := sm.KvEntries()*sid, sm.KvEntries()*(sid+1)
+		for start := from; start < limit; start += metaCheckBatchSize {
+			end := min(start+metaCheckBatchSize, limit)
+			kvIndices := make([]uint64, 0, end-start)
+			for i := start; i < min(end, lastKvIdx); i++ {
+				kvIndices = append(kvIndices, i)
+			}
+			var metas [][32]byte
+			if len(kvIndices) > 0 {
+				if metas, err = l1.GetKvMetas(kvIndices, blockNumber); err != nil {
+					return nil, err
+				}
+				if len(metas) != len(kvIndices) {
+					return nil, fmt.Errorf("expected %d metas, got %d", len(kvIndices), len(metas))
+				}
+			}
+
+			for kvIdx := start; kvIdx < end; kvIdx++ {
+				local, found, err := sm.TryReadMeta(kvIdx)
+				if err != nil {
+					return nil, fmt.Errorf("read meta of kv %d failed: %w", kvIdx, err)
+				}
+				if !found || local[HashSizeInContract]&blobFillingMask == 0 {
+					continue
+				}
+				// the contract keeps no blob beyond the last kv index, so those kvs can only be filled with empty
+				expected := emptyHash
+				if kvIdx < lastKvIdx {
+					expected = metas[kvIdx-start][32-HashSizeInContract:]
+				}
+				if !bytes.Equal(local[0:HashSizeInContract], expected) {
+					mismatched = append(mismatched, kvIdx)
+				}
+			}
+		}
+	}
+	return mismatched, nil
+}
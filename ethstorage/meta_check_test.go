@@ -0,0 +1,74 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCheckMetaConsistency(t *testing.T) {
+	metafile, err := createMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func(file *os.File) {
+		file.Close()
+		os.Remove(file.Name())
+	}(metafile)
+	l1 := newMockL1Source(6, metafileName)
+
+	shardManager, files := createEthStorage(contractAddress, []uint64{0},
+		131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	sm := NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+
+	// kvs 0 ~ 5 are in the contract, of which kv 3 is not synced yet, and the others are filled with empty
+	for idx := uint64(0); idx < 6; idx++ {
+		blob, hash := createBlob(idx)
+		metafile.WriteAt(generateMetadata(idx, 131072, hash[:]).Bytes(), int64(idx*32))
+		if idx == 3 {
+			continue
+		}
+		if _, err := shardManager.TryWrite(idx, blob, prepareCommit(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := sm.CommitEmptyBlobs(6, kvEntries-1); err != nil {
+		t.Fatal(err)
+	}
+	mismatched, err := CheckMetaConsistency(shardManager, l1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatched) != 0 {
+		t.Fatalf("expected no mismatched kvs, got %v", mismatched)
+	}
+
+	// kv 2 holds the blob of another commit, and kv 12 beyond the last kv index holds data
+	for _, idx := range []uint64{2, 12} {
+		blob, hash := createBlob(idx + 100)
+		if _, err := shardManager.TryWrite(idx, blob, prepareCommit(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mismatched, err = CheckMetaConsistency(shardManager, l1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mismatched, []uint64{2, 12}) {
+		t.Fatalf("expected kvs [2 12] mismatched, got %v", mismatched)
+	}
+}
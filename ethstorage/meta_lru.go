@@ -0,0 +1,169 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+const (
+	DefaultMetaLRUSize   = 1 << 16
+	DefaultMetaBatchSize = 8000
+)
+
+// metaPurger is implemented by the Il1Source wrappers which need to drop the kv metas found
+// changed by a reorg, as the metas cached for a block number are no longer valid then.
+type metaPurger interface {
+	PurgeMetas(kvIndices []uint64)
+}
+
+type metaLRUKey struct {
+	kvIdx       uint64
+	blockNumber int64
+}
+
+// metaCall is a fetch of a kv meta in flight, which the requests for the same kv and block wait for.
+type metaCall struct {
+	done chan struct{}
+	meta [32]byte
+	err  error
+}
+
+// MetaLRU is an Il1Source which keeps the recently read kv metas in memory, keyed by kv index and the L1
+// block number they were read at. The missed kvs of a request are sorted, so adjacent kvs go together, and
+// fetched from the underlying source in batches of at most maxBatch kvs. A kv already being fetched for
+// another request is waited for instead of fetched again.
+type MetaLRU struct {
+	Il1Source
+	maxBatch int
+
+	mu       sync.Mutex
+	cache    *simplelru.LRU[metaLRUKey, [32]byte]
+	inflight map[metaLRUKey]*metaCall
+}
+
+func NewMetaLRU(l1Source Il1Source, size, maxBatch int) (*MetaLRU, error) {
+	if maxBatch <= 0 {
+		return nil, fmt.Errorf("invalid meta batch size %d", maxBatch)
+	}
+	cache, err := simplelru.NewLRU[metaLRUKey, [32]byte](size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MetaLRU{
+		Il1Source: l1Source,
+		maxBatch:  maxBatch,
+		cache:     cache,
+		inflight:  make(map[metaLRUKey]*metaCall),
+	}, nil
+}
+
+// GetKvMetas returns the cached metas and fetches the rest in batches. Requests for a block tag
+// (e.g. latest) instead of a block number bypass the cache.
+func (c *MetaLRU) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	if blockNumber < 0 {
+		return c.Il1Source.GetKvMetas(kvIndices, blockNumber)
+	}
+
+	metas := make([][32]byte, len(kvIndices))
+	calls := make([]*metaCall, len(kvIndices))
+	owned := make(map[uint64]*metaCall)
+	c.mu.Lock()
+	for i, idx := range kvIndices {
+		key := metaLRUKey{idx, blockNumber}
+		if meta, ok := c.cache.Get(key); ok {
+			metas[i] = meta
+			continue
+		}
+		call, ok := c.inflight[key]
+		if !ok {
+			call = &metaCall{done: make(chan struct{})}
+			c.inflight[key] = call
+			owned[idx] = call
+		}
+		calls[i] = call
+	}
+	c.mu.Unlock()
+
+	if len(owned) > 0 {
+		c.fetch(owned, blockNumber)
+	}
+	for i, call := range calls {
+		if call == nil {
+			continue
+		}
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		metas[i] = call.meta
+	}
+	return metas, nil
+}
+
+// fetch reads the metas of the calls from the underlying source and completes the calls.
+func (c *MetaLRU) fetch(calls map[uint64]*metaCall, blockNumber int64) {
+	missed := make([]uint64, 0, len(calls))
+	for idx := range calls {
+		missed = append(missed, idx)
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i] < missed[j] })
+
+	var err error
+	for from := 0; from < len(missed); from += c.maxBatch {
+		batch := missed[from:min(from+c.maxBatch, len(missed))]
+		var fetched [][32]byte
+		if err == nil {
+			fetched, err = c.Il1Source.GetKvMetas(batch, blockNumber)
+			if err == nil && len(fetched) != len(batch) {
+				err = fmt.Errorf("expected %d metas, got %d", len(batch), len(fetched))
+			}
+		}
+
+		c.mu.Lock()
+		for i, idx := range batch {
+			key := metaLRUKey{idx, blockNumber}
+			call := calls[idx]
+			if err != nil {
+				call.err = err
+			} else {
+				call.meta = fetched[i]
+				c.cache.Add(key, call.meta)
+			}
+			delete(c.inflight, key)
+			close(call.done)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// InvalidateMetas passes the updated kv entries to the underlying source. The metas cached here are
+// read at a given block number, so they stay valid for that block.
+func (c *MetaLRU) InvalidateMetas(kvIndices []uint64, fromL1, toL1 int64) {
+	if inv, ok := c.Il1Source.(metaInvalidator); ok {
+		inv.InvalidateMetas(kvIndices, fromL1, toL1)
+	}
+}
+
+// PurgeMetas drops the cached metas of the kvs read at any block, and those of the underlying source.
+func (c *MetaLRU) PurgeMetas(kvIndices []uint64) {
+	purged := make(map[uint64]struct{}, len(kvIndices))
+	for _, idx := range kvIndices {
+		purged[idx] = struct{}{}
+	}
+	c.mu.Lock()
+	for _, key := range c.cache.Keys() {
+		if _, ok := purged[key.kvIdx]; ok {
+			c.cache.Remove(key)
+		}
+	}
+	c.mu.Unlock()
+	if p, ok := c.Il1Source.(metaPurger); ok {
+		p.PurgeMetas(kvIndices)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMetaLRU_GetKvMetas(t *testing.T) {
+	l1 := &countingL1Source{metas: make(map[uint64][32]byte)}
+	for i := uint64(0); i < 64; i++ {
+		l1.metas[i] = [32]byte{byte(i + 1)}
+	}
+	cache, err := NewMetaLRU(l1, 1024, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the kvs are requested out of order, and fetched in sorted batches of 16
+	indices := rand.Perm(64)
+	kvIndices := make([]uint64, len(indices))
+	for i, idx := range indices {
+		kvIndices[i] = uint64(idx)
+	}
+	metas, err := cache.GetKvMetas(kvIndices, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, idx := range kvIndices {
+		if metas[i] != l1.metas[idx] {
+			t.Fatalf("meta of kv %d mismatch", idx)
+		}
+	}
+	if l1.calls != 4 || l1.requested != 64 {
+		t.Fatalf("expected 4 L1 calls for 64 kvs, got %d calls for %d kvs", l1.calls, l1.requested)
+	}
+
+	// reading the kvs one by one at the same block is served from the cache
+	for idx := uint64(0); idx < 64; idx++ {
+		if _, err := cache.GetKvMetas([]uint64{idx}, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l1.calls != 4 {
+		t.Fatalf("expected no more L1 calls, got %d", l1.calls)
+	}
+
+	// the metas of another block are not shared
+	if _, err := cache.GetKvMetas(kvIndices[:8], 101); err != nil {
+		t.Fatal(err)
+	}
+	if l1.calls != 5 || l1.requested != 72 {
+		t.Fatalf("expected 1 L1 call for block 101, got %d calls", l1.calls-4)
+	}
+
+	// purged kvs are fetched again at all blocks
+	cache.PurgeMetas([]uint64{5, 63})
+	if _, err := cache.GetKvMetas(kvIndices, 100); err != nil {
+		t.Fatal(err)
+	}
+	if l1.calls != 6 || l1.requested != 74 {
+		t.Fatalf("expected 1 L1 call for the 2 purged kvs, got %d calls for %d kvs", l1.calls-5, l1.requested-72)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -31,6 +32,7 @@ const (
 type Metricer interface {
 	SetLastKVIndexAndMaxShardId(lastL1Block, lastKVIndex uint64, maxShardId uint64)
 	SetMiningInfo(shardId uint64, difficulty, minedTime, blockMined uint64, miner common.Address, gasFee, reward uint64)
+	RecordMetaCache(hits, misses uint64)
 
 	ClientGetBlobsByRangeEvent(peerID string, resultCode byte, duration time.Duration)
 	ClientGetBlobsByListEvent(peerID string, resultCode byte, duration time.Duration)
@@ -38,6 +40,9 @@ type Metricer interface {
 	ClientOnBlobsByRange(peerID string, reqCount, getBlobCount, insertedCount uint64, duration time.Duration)
 	ClientOnBlobsByList(peerID string, reqCount, getBlobCount, insertedCount uint64, duration time.Duration)
 	ClientRecordTimeUsed(method string) func()
+	ClientRecordShardSync(contract common.Address, shardId uint64, reqCount, insertedCount, bytes uint64, duration time.Duration)
+	ClientSetShardHealCount(contract common.Address, shardId uint64, count int)
+	ClientSetWriteQueueDepth(depth int)
 	IncDropPeerCount()
 	IncPeerCount()
 	DecPeerCount()
@@ -70,6 +75,7 @@ type Metrics struct {
 	LastMinerSubmissionTime *prometheus.GaugeVec
 	MiningReward            *prometheus.GaugeVec
 	GasFee                  *prometheus.GaugeVec
+	MetaCacheTotal          *prometheus.CounterVec
 
 	// P2P Metrics
 	PeerScores        *prometheus.GaugeVec
@@ -85,6 +91,13 @@ type Metrics struct {
 	SyncClientPerfCallTotal           *prometheus.CounterVec
 	SyncClientPerfCallDurationSeconds *prometheus.HistogramVec
 
+	SyncClientShardBlobsRequestedTotal    *prometheus.CounterVec
+	SyncClientShardBlobsWrittenTotal      *prometheus.CounterVec
+	SyncClientShardBytesReceivedTotal     *prometheus.CounterVec
+	SyncClientShardRequestDurationSeconds *prometheus.HistogramVec
+	SyncClientShardHealCount              *prometheus.GaugeVec
+	SyncClientWriteQueueDepth             prometheus.Gauge
+
 	PeerCount      prometheus.Gauge
 	DropPeerCount  prometheus.Counter
 	BandwidthTotal *prometheus.GaugeVec
@@ -212,6 +225,15 @@ func NewMetrics(procName string) *Metrics {
 			"block_mined",
 		}),
 
+		MetaCacheTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: ContractMetrics,
+			Name:      "meta_cache_total",
+			Help:      "Number of kv metas looked up in the local meta cache",
+		}, []string{
+			"result",
+		}),
+
 		SyncClientRequestsTotal: factory.NewCounterVec(prometheus.CounterOpts{
 			Namespace: ns,
 			Subsystem: SyncClientSubsystem,
@@ -294,6 +316,64 @@ func NewMetrics(procName string) *Metrics {
 			"method",
 		}),
 
+		SyncClientShardBlobsRequestedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "shard_blobs_requested_total",
+			Help:      "Number of blobs requested from peers per shard",
+		}, []string{
+			"contract",
+			"shard_id",
+		}),
+
+		SyncClientShardBlobsWrittenTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "shard_blobs_written_total",
+			Help:      "Number of synced blobs written to the storage per shard",
+		}, []string{
+			"contract",
+			"shard_id",
+		}),
+
+		SyncClientShardBytesReceivedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "shard_bytes_received_total",
+			Help:      "Bytes of blobs received from peers per shard",
+		}, []string{
+			"contract",
+			"shard_id",
+		}),
+
+		SyncClientShardRequestDurationSeconds: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "shard_request_duration_seconds",
+			Buckets:   []float64{},
+			Help:      "Duration of handling the blobs responses per shard",
+		}, []string{
+			"contract",
+			"shard_id",
+		}),
+
+		SyncClientShardHealCount: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "shard_heal_count",
+			Help:      "Number of blobs waiting to be healed per shard",
+		}, []string{
+			"contract",
+			"shard_id",
+		}),
+
+		SyncClientWriteQueueDepth: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: SyncClientSubsystem,
+			Name:      "write_queue_depth",
+			Help:      "Number of synced blob batches waiting to be written",
+		}),
+
 		PeerCount: factory.NewGauge(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: SyncClientSubsystem,
@@ -441,13 +521,18 @@ func (m *Metrics) Document() []metrics.DocumentedMetric {
 	return m.factory.Document()
 }
 
+// Handler returns the http handler exposing the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		m.registry, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}),
+	)
+}
+
 // Serve starts the metrics server on the given hostname and port.
 // The server will be closed when the passed-in context is cancelled.
 func (m *Metrics) Serve(ctx context.Context, hostname string, port int) error {
 	addr := net.JoinHostPort(hostname, strconv.Itoa(port))
-	server := ophttp.NewHttpServer(promhttp.InstrumentMetricHandler(
-		m.registry, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}),
-	))
+	server := ophttp.NewHttpServer(m.Handler())
 	server.Addr = addr
 	go func() {
 		<-ctx.Done()
@@ -477,6 +562,11 @@ func (m *Metrics) SetMiningInfo(shardId uint64, difficulty, minedTime, blockMine
 	m.lastSubmissionTimes[shardId] = minedTime
 }
 
+func (m *Metrics) RecordMetaCache(hits, misses uint64) {
+	m.MetaCacheTotal.WithLabelValues("hit").Add(float64(hits))
+	m.MetaCacheTotal.WithLabelValues("miss").Add(float64(misses))
+}
+
 func (m *Metrics) RecordGossipEvent(evType int32) {
 	m.GossipEventsTotal.WithLabelValues(pb.TraceEvent_Type_name[evType]).Inc()
 }
@@ -547,6 +637,24 @@ func (m *Metrics) ClientRecordTimeUsed(method string) func() {
 	}
 }
 
+// ClientRecordShardSync records a blobs response handled for the shard: the blobs requested,
+// the blobs written to the storage and the bytes received.
+func (m *Metrics) ClientRecordShardSync(contract common.Address, shardId uint64, reqCount, insertedCount, bytes uint64, duration time.Duration) {
+	labels := []string{contract.Hex(), strconv.FormatUint(shardId, 10)}
+	m.SyncClientShardBlobsRequestedTotal.WithLabelValues(labels...).Add(float64(reqCount))
+	m.SyncClientShardBlobsWrittenTotal.WithLabelValues(labels...).Add(float64(insertedCount))
+	m.SyncClientShardBytesReceivedTotal.WithLabelValues(labels...).Add(float64(bytes))
+	m.SyncClientShardRequestDurationSeconds.WithLabelValues(labels...).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ClientSetShardHealCount(contract common.Address, shardId uint64, count int) {
+	m.SyncClientShardHealCount.WithLabelValues(contract.Hex(), strconv.FormatUint(shardId, 10)).Set(float64(count))
+}
+
+func (m *Metrics) ClientSetWriteQueueDepth(depth int) {
+	m.SyncClientWriteQueueDepth.Set(float64(depth))
+}
+
 func (m *Metrics) IncDropPeerCount() {
 	m.DropPeerCount.Inc()
 }
@@ -662,6 +770,15 @@ func (n *noopMetricer) ClientRecordTimeUsed(method string) func() {
 	return func() {}
 }
 
+func (n *noopMetricer) ClientRecordShardSync(contract common.Address, shardId uint64, reqCount, insertedCount, bytes uint64, duration time.Duration) {
+}
+
+func (n *noopMetricer) ClientSetShardHealCount(contract common.Address, shardId uint64, count int) {
+}
+
+func (n *noopMetricer) ClientSetWriteQueueDepth(depth int) {
+}
+
 func (n *noopMetricer) IncDropPeerCount() {
 }
 
@@ -684,6 +801,9 @@ func (n *noopMetricer) ServerRecordTimeUsed(method string) func() {
 	return func() {}
 }
 
+func (m *noopMetricer) RecordMetaCache(hits, misses uint64) {
+}
+
 func (m *noopMetricer) RecordGossipEvent(evType int32) {
 }
 
@@ -23,6 +23,7 @@ const (
 	ZKProverModeFlagName     = "miner.zk-prover-mode"
 	ThreadsPerShardFlagName  = "miner.threads-per-shard"
 	MinimumProfitFlagName    = "miner.min-profit"
+	ProofCacheSizeFlagName   = "miner.proof-cache-size"
 )
 
 func CLIFlags(envPrefix string) []cli.Flag {
@@ -75,6 +76,12 @@ func CLIFlags(envPrefix string) []cli.Flag {
 			Value:  DefaultConfig.ThreadsPerShard,
 			EnvVar: rollup.PrefixEnvVar(envPrefix, "THREADS_PER_SHARD"),
 		},
+		cli.Uint64Flag{
+			Name:   ProofCacheSizeFlagName,
+			Usage:  "Number of KZG proofs cached for samples proved again, 0 to bypass the cache",
+			Value:  DefaultConfig.ProofCacheSize,
+			EnvVar: rollup.PrefixEnvVar(envPrefix, "PROOF_CACHE_SIZE"),
+		},
 	}
 	return flag
 }
@@ -88,6 +95,7 @@ type CLIConfig struct {
 	ZKWorkingDir     string
 	ZKProverMode     uint64
 	ThreadsPerShard  uint64
+	ProofCacheSize   uint64
 }
 
 func (c CLIConfig) Check() error {
@@ -117,6 +125,7 @@ func (c CLIConfig) ToMinerConfig() (Config, error) {
 	cfg.ZKeyFileName = c.ZKeyFileName
 	cfg.ZKProverMode = c.ZKProverMode
 	cfg.ThreadsPerShard = c.ThreadsPerShard
+	cfg.ProofCacheSize = c.ProofCacheSize
 	return cfg, nil
 }
 
@@ -130,6 +139,7 @@ func ReadCLIConfig(ctx *cli.Context) CLIConfig {
 		ZKWorkingDir:     ctx.GlobalString(ZKWorkingDirFlagName),
 		ZKProverMode:     ctx.GlobalUint64(ZKProverModeFlagName),
 		ThreadsPerShard:  ctx.GlobalUint64(ThreadsPerShardFlagName),
+		ProofCacheSize:   ctx.GlobalUint64(ProofCacheSizeFlagName),
 	}
 	return cfg
 }
@@ -33,6 +33,7 @@ type Config struct {
 	ZKWorkingDir     string
 	ZKProverMode     uint64
 	ThreadsPerShard  uint64
+	ProofCacheSize   uint64
 	SignerFnFactory  signer.SignerFactory
 	SignerAddr       common.Address
 	MinimumProfit    *big.Int
@@ -51,5 +52,6 @@ var DefaultConfig = Config{
 	ZKWorkingDir:     filepath.Join("build", "bin"),
 	ZKProverMode:     2,
 	ThreadsPerShard:  uint64(2 * runtime.NumCPU()),
+	ProofCacheSize:   256,
 	MinimumProfit:    common.Big0,
 }
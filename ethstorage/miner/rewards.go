@@ -0,0 +1,196 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package miner
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+)
+
+// rewardBlockStep is the max number of blocks the mined block events are filtered in at a time.
+const rewardBlockStep = 300
+
+var miningRewardsKey = []byte("MiningRewards")
+
+// rewardLogSource filters the events of the storage contract, implemented by eth.PollingClient.
+type rewardLogSource interface {
+	FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error)
+}
+
+// ShardRewards is the rewards of the blocks mined for a shard by the miners of the node.
+type ShardRewards struct {
+	ShardId uint64       `json:"shardId"`
+	Mined   uint64       `json:"mined"`  // number of blocks mined
+	Reward  *hexutil.Big `json:"reward"` // in wei
+}
+
+// MiningStats is the rewards received by the miners of the node up to the last processed block.
+type MiningStats struct {
+	LastBlock   uint64         `json:"lastBlock"`
+	Mined       uint64         `json:"mined"`
+	TotalReward *hexutil.Big   `json:"totalReward"`
+	Shards      []ShardRewards `json:"shards"`
+}
+
+// rewardState is the persisted accounting of the rewards.
+type rewardState struct {
+	LastBlock uint64                   `json:"lastBlock"` // 0 if no block is processed yet
+	Shards    map[uint64]*ShardRewards `json:"shards"`
+}
+
+// RewardWatcher accounts the rewards of the MinedBlock events of the storage contract paid to the miners of
+// the node. The events are processed up to the finalized blocks, and the last processed block is persisted
+// with the rewards, so the watcher resumes from it after a restart.
+type RewardWatcher struct {
+	l1     rewardLogSource
+	db     ethdb.KeyValueStore
+	miners map[common.Address]struct{}
+	lg     log.Logger
+
+	procLock sync.Mutex // serializes the processing of the events
+	lock     sync.Mutex // protects state
+	state    rewardState
+}
+
+// NewRewardWatcher creates a watcher of the rewards of the miners, processing the events from the start
+// block unless the processing is resumed from the db. With a start block of 0, the events are processed
+// from the first block the watcher is asked to process, instead of the genesis.
+func NewRewardWatcher(l1 rewardLogSource, db ethdb.KeyValueStore, miners []common.Address, startBlock uint64, lg log.Logger) *RewardWatcher {
+	w := &RewardWatcher{
+		l1:     l1,
+		db:     db,
+		miners: make(map[common.Address]struct{}),
+		lg:     lg,
+		state:  rewardState{Shards: make(map[uint64]*ShardRewards)},
+	}
+	for _, miner := range miners {
+		w.miners[miner] = struct{}{}
+	}
+	if startBlock > 0 {
+		w.state.LastBlock = startBlock - 1
+	}
+	if data, _ := db.Get(miningRewardsKey); data != nil {
+		var state rewardState
+		if err := json.Unmarshal(data, &state); err != nil {
+			lg.Error("Failed to decode mining rewards, start over", "err", err)
+		} else {
+			if state.Shards == nil {
+				state.Shards = make(map[uint64]*ShardRewards)
+			}
+			w.state = state
+		}
+	}
+	return w
+}
+
+// OnL1Finalized processes the events up to the finalized block in the background, unless the events
+// are already being processed, in which case the block is processed at the next finalized block.
+func (w *RewardWatcher) OnL1Finalized(number uint64) {
+	if !w.procLock.TryLock() {
+		return
+	}
+	go func() {
+		defer w.procLock.Unlock()
+		if err := w.process(number); err != nil {
+			w.lg.Warn("Failed to process mining rewards", "block", number, "err", err)
+		}
+	}()
+}
+
+// Process processes the events up to the block.
+func (w *RewardWatcher) Process(number uint64) error {
+	w.procLock.Lock()
+	defer w.procLock.Unlock()
+	return w.process(number)
+}
+
+func (w *RewardWatcher) process(number uint64) error {
+	w.lock.Lock()
+	if w.state.LastBlock == 0 && number > 0 {
+		w.state.LastBlock = number - 1
+	}
+	start := w.state.LastBlock + 1
+	w.lock.Unlock()
+	for start <= number {
+		end := min(start+rewardBlockStep-1, number)
+		logs, err := w.l1.FilterLogsByBlockRange(new(big.Int).SetUint64(start), new(big.Int).SetUint64(end), eth.MinedBlockEvent)
+		if err != nil {
+			return fmt.Errorf("filter mined block events from %d to %d: %w", start, end, err)
+		}
+
+		w.lock.Lock()
+		for _, l := range logs {
+			w.onMinedBlock(l)
+		}
+		w.state.LastBlock = end
+		w.save()
+		w.lock.Unlock()
+		start = end + 1
+	}
+	return nil
+}
+
+// onMinedBlock accounts the reward of a MinedBlock event paid to a miner of the node. The caller must hold w.lock.
+func (w *RewardWatcher) onMinedBlock(l types.Log) {
+	if l.Removed || len(l.Topics) < 2 || len(l.Data) < 96 {
+		return
+	}
+	miner := common.BytesToAddress(l.Data[44:64])
+	if _, ok := w.miners[miner]; !ok {
+		return
+	}
+	shardId := new(big.Int).SetBytes(l.Topics[1].Bytes()).Uint64()
+	reward := new(big.Int).SetBytes(l.Data[64:96])
+	sr, ok := w.state.Shards[shardId]
+	if !ok {
+		sr = &ShardRewards{ShardId: shardId, Reward: (*hexutil.Big)(new(big.Int))}
+		w.state.Shards[shardId] = sr
+	}
+	sr.Mined++
+	sr.Reward.ToInt().Add(sr.Reward.ToInt(), reward)
+	w.lg.Info("Mining reward received", "block", l.BlockNumber, "tx", l.TxHash, "shard", shardId, "miner", miner, "reward", reward)
+}
+
+// save persists the state. The caller must hold w.lock.
+func (w *RewardWatcher) save() {
+	data, err := json.Marshal(&w.state)
+	if err != nil {
+		panic(err) // This can only fail during implementation
+	}
+	if err := w.db.Put(miningRewardsKey, data); err != nil {
+		w.lg.Error("Failed to store mining rewards", "err", err)
+	}
+}
+
+// Stats returns the total rewards and the rewards of each shard.
+func (w *RewardWatcher) Stats() *MiningStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats := &MiningStats{
+		LastBlock:   w.state.LastBlock,
+		TotalReward: (*hexutil.Big)(new(big.Int)),
+		Shards:      make([]ShardRewards, 0, len(w.state.Shards)),
+	}
+	for _, sr := range w.state.Shards {
+		stats.Mined += sr.Mined
+		stats.TotalReward.ToInt().Add(stats.TotalReward.ToInt(), sr.Reward.ToInt())
+		stats.Shards = append(stats.Shards, ShardRewards{
+			ShardId: sr.ShardId,
+			Mined:   sr.Mined,
+			Reward:  (*hexutil.Big)(new(big.Int).Set(sr.Reward.ToInt())),
+		})
+	}
+	sort.Slice(stats.Shards, func(i, j int) bool { return stats.Shards[i].ShardId < stats.Shards[j].ShardId })
+	return stats
+}
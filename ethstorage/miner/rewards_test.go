@@ -0,0 +1,107 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package miner
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+)
+
+// fakeRewardLogs serves the synthetic logs within the filtered block range.
+type fakeRewardLogs struct {
+	logs    []types.Log
+	filters int
+}
+
+func (f *fakeRewardLogs) FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error) {
+	f.filters++
+	var logs []types.Log
+	for _, l := range f.logs {
+		if l.Topics[0] == crypto.Keccak256Hash([]byte(eventSig)) && l.BlockNumber >= start.Uint64() && l.BlockNumber <= end.Uint64() {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func minedBlockLog(block, shardId uint64, miner common.Address, reward int64) types.Log {
+	data := make([]byte, 96)
+	copy(data[44:64], miner.Bytes())
+	new(big.Int).SetInt64(reward).FillBytes(data[64:96])
+	return types.Log{
+		BlockNumber: block,
+		Topics: []common.Hash{
+			crypto.Keccak256Hash([]byte(eth.MinedBlockEvent)),
+			common.BigToHash(new(big.Int).SetUint64(shardId)),
+			common.BigToHash(big.NewInt(1000)),
+			common.BigToHash(new(big.Int).SetUint64(block)),
+		},
+		Data: data,
+	}
+}
+
+func TestRewardWatcher(t *testing.T) {
+	var (
+		minerA = common.HexToAddress("0x000000000000000000000000000000000000000a")
+		minerB = common.HexToAddress("0x000000000000000000000000000000000000000b")
+		other  = common.HexToAddress("0x00000000000000000000000000000000000000ff")
+		db     = rawdb.NewMemoryDatabase()
+		lg     = log.New("unittest")
+	)
+	l1 := &fakeRewardLogs{logs: []types.Log{
+		minedBlockLog(100, 0, minerA, 10),
+		minedBlockLog(150, 1, minerB, 20),
+		minedBlockLog(200, 0, other, 1000), // mined by another node
+		minedBlockLog(450, 0, minerA, 30),
+		minedBlockLog(700, 2, minerA, 40),
+	}}
+
+	w := NewRewardWatcher(l1, db, []common.Address{minerA, minerB}, 100, lg)
+	if err := w.Process(500); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if l1.filters != 2 {
+		t.Errorf("expected the blocks to be filtered in 2 steps, got %d", l1.filters)
+	}
+	checkStats(t, w.Stats(), 500, 3, 60, map[uint64][2]uint64{0: {2, 40}, 1: {1, 20}})
+
+	// a watcher on the same db resumes from the last processed block without counting the rewards twice
+	w = NewRewardWatcher(l1, db, []common.Address{minerA, minerB}, 100, lg)
+	checkStats(t, w.Stats(), 500, 3, 60, map[uint64][2]uint64{0: {2, 40}, 1: {1, 20}})
+	if err := w.Process(800); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	checkStats(t, w.Stats(), 800, 4, 100, map[uint64][2]uint64{0: {2, 40}, 1: {1, 20}, 2: {1, 40}})
+}
+
+// checkStats checks the totals and the mined blocks and rewards of each shard.
+func checkStats(t *testing.T, stats *MiningStats, lastBlock, mined uint64, total int64, shards map[uint64][2]uint64) {
+	t.Helper()
+	if stats.LastBlock != lastBlock {
+		t.Errorf("expected last block %d, got %d", lastBlock, stats.LastBlock)
+	}
+	if stats.Mined != mined || stats.TotalReward.ToInt().Int64() != total {
+		t.Errorf("expected %d blocks mined with reward %d, got %d with %v", mined, total, stats.Mined, stats.TotalReward)
+	}
+	if len(stats.Shards) != len(shards) {
+		t.Fatalf("expected %d shards, got %d", len(shards), len(stats.Shards))
+	}
+	for _, sr := range stats.Shards {
+		want, ok := shards[sr.ShardId]
+		if !ok {
+			t.Errorf("unexpected rewards of shard %d", sr.ShardId)
+			continue
+		}
+		if sr.Mined != want[0] || sr.Reward.ToInt().Uint64() != want[1] {
+			t.Errorf("shard %d: expected %d blocks mined with reward %d, got %d with %v", sr.ShardId, want[0], want[1], sr.Mined, sr.Reward)
+		}
+	}
+}
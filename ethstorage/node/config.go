@@ -16,6 +16,7 @@ import (
 	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
 	"github.com/ethstorage/go-ethstorage/ethstorage/miner"
 	"github.com/ethstorage/go-ethstorage/ethstorage/p2p"
+	"github.com/ethstorage/go-ethstorage/ethstorage/prover"
 	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
 	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
 )
@@ -45,11 +46,18 @@ type Config struct {
 
 	Metrics MetricsConfig
 
+	Dashboard DashboardConfig
+
 	Pprof oppprof.CLIConfig
 
 	// Used to poll the L1 for new finalized or safe blocks
 	L1EpochPollInterval time.Duration
 
+	// KZG library used for blob commitments and proofs, see prover.SetKZGBackend
+	KZGBackend string
+	// Path of the KZG trusted setup file, the embedded setup is used if empty
+	KZGTrustedSetup string
+
 	// // Optional
 	// Tracer    Tracer
 	// Heartbeat HeartbeatConfig
@@ -91,9 +99,15 @@ func (cfg *Config) Check() error {
 	// if err := cfg.Rollup.Check(); err != nil {
 	// 	return fmt.Errorf("rollup config error: %w", err)
 	// }
+	if err := cfg.Storage.Check(); err != nil {
+		return fmt.Errorf("storage config error: %w", err)
+	}
 	if err := cfg.Metrics.Check(); err != nil {
 		return fmt.Errorf("metrics config error: %w", err)
 	}
+	if err := cfg.Dashboard.Check(); err != nil {
+		return fmt.Errorf("dashboard config error: %w", err)
+	}
 	if err := cfg.Pprof.Check(); err != nil {
 		return fmt.Errorf("pprof config error: %w", err)
 	}
@@ -102,6 +116,10 @@ func (cfg *Config) Check() error {
 			return fmt.Errorf("p2p config error: %w", err)
 		}
 	}
+	// the custom trusted setup is loaded into a gokzg context, which the ckzg backend would not use
+	if cfg.KZGTrustedSetup != "" && cfg.KZGBackend == prover.KZGBackendC {
+		return fmt.Errorf("kzg config error: a custom trusted setup is only supported by the %s backend", prover.KZGBackendGo)
+	}
 	return nil
 }
 
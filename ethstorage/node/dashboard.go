@@ -0,0 +1,104 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package node
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	ophttp "github.com/ethereum-optimism/optimism/op-service/httputil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+type DashboardConfig struct {
+	Enabled    bool
+	ListenAddr string
+	ListenPort int
+}
+
+func (c DashboardConfig) Check() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.ListenPort < 0 || c.ListenPort > math.MaxUint16 {
+		return errors.New("invalid dashboard port")
+	}
+
+	return nil
+}
+
+type dashboardStatus struct {
+	Time     int64                `json:"time"`
+	Progress protocol.SyncState   `json:"progress"`
+	Tasks    []protocol.TaskState `json:"tasks"`
+	Peers    []protocol.PeerState `json:"peers"`
+}
+
+// syncDashboard serves a web page which visualizes the sync tasks and peers of the sync client.
+type syncDashboard struct {
+	endpoint   string
+	syncCl     *protocol.SyncClient
+	httpServer *http.Server
+	log        log.Logger
+}
+
+func newSyncDashboard(cfg *DashboardConfig, syncCl *protocol.SyncClient, log log.Logger) *syncDashboard {
+	return &syncDashboard{
+		endpoint: net.JoinHostPort(cfg.ListenAddr, strconv.Itoa(cfg.ListenPort)),
+		syncCl:   syncCl,
+		log:      log,
+	}
+}
+
+func (d *syncDashboard) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(dashboardPage)
+	})
+	mux.HandleFunc("/api/status", d.handleStatus)
+
+	listener, err := net.Listen("tcp", d.endpoint)
+	if err != nil {
+		return err
+	}
+	d.httpServer = ophttp.NewHttpServer(mux)
+	go func() {
+		if err := d.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.log.Error("Dashboard server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (d *syncDashboard) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := dashboardStatus{
+		Time:     time.Now().UnixMilli(),
+		Progress: d.syncCl.Progress(),
+		Tasks:    d.syncCl.DumpTasks(),
+		Peers:    d.syncCl.PeerShards(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		d.log.Debug("Failed to write dashboard status", "err", err)
+	}
+}
+
+func (d *syncDashboard) Stop() {
+	if d.httpServer != nil {
+		_ = d.httpServer.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package node
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/gofrs/flock"
+)
+
+const datadirLockName = "LOCK"
+
+// DataDirLock guards a datadir against being used by more than one process at a time,
+// since concurrent writers would corrupt the data files.
+type DataDirLock struct {
+	flock   *flock.Flock
+	pidPath string
+}
+
+// LockDataDir acquires an exclusive lock on the datadir and records the PID of the current
+// process in it. A lock left behind by a crashed process is taken over.
+func LockDataDir(datadir string, lg log.Logger) (*DataDirLock, error) {
+	if err := os.MkdirAll(datadir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create datadir %s: %w", datadir, err)
+	}
+	path := filepath.Join(datadir, datadirLockName)
+	fl := flock.New(path)
+	locked, err := fl.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock datadir %s: %w", datadir, err)
+	}
+	pid, hasPid := readLockPid(path)
+	if !locked {
+		if hasPid && pidAlive(pid) {
+			return nil, fmt.Errorf("datadir %s already in use by PID %d", datadir, pid)
+		}
+		return nil, fmt.Errorf("datadir %s already in use by another process", datadir)
+	}
+	if hasPid && pid != os.Getpid() && !pidAlive(pid) {
+		lg.Warn("Taking over stale datadir lock", "datadir", datadir, "stalePid", pid)
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		fl.Unlock()
+		return nil, fmt.Errorf("failed to write datadir lock %s: %w", path, err)
+	}
+	return &DataDirLock{flock: fl, pidPath: path}, nil
+}
+
+// Release clears the recorded PID and releases the datadir lock. The lock is released even if the PID
+// cannot be cleared, and releasing it again is a no-op.
+func (l *DataDirLock) Release() error {
+	if l == nil || l.flock == nil {
+		return nil
+	}
+	truncErr := os.Truncate(l.pidPath, 0)
+	if err := l.flock.Unlock(); err != nil {
+		return fmt.Errorf("failed to unlock datadir lock %s: %w", l.pidPath, err)
+	}
+	l.flock = nil
+	if truncErr != nil {
+		return fmt.Errorf("failed to clear datadir lock %s: %w", l.pidPath, truncErr)
+	}
+	return nil
+}
+
+func readLockPid(path string) (int, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+func pidAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -5,7 +5,10 @@ package node
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"slices"
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
@@ -15,13 +18,82 @@ import (
 	"github.com/ethstorage/go-ethstorage/cmd/es-utils/utils"
 	"github.com/ethstorage/go-ethstorage/ethstorage"
 	"github.com/ethstorage/go-ethstorage/ethstorage/downloader"
+	"github.com/ethstorage/go-ethstorage/ethstorage/miner"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// blobNotFoundErrorCode is the JSON-RPC error code returned for a blob which is empty or not stored.
+const blobNotFoundErrorCode = -32001
+
+// storageReader is the part of the storage manager the shard status and blob queries are built on.
+type storageReader interface {
+	protocol.StorageManagerReader
+	TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error)
+	TryReadChunks(kvIdx uint64, chunkIdxs []uint64, commit common.Hash) (map[uint64][]byte, bool, error)
+	ChunkSize() uint64
+	GetKvMetas(kvIndices []uint64) ([][32]byte, error)
+	LastKvIndex() uint64
+	IsShardComplete(shardIdx uint64) (bool, bool)
+}
+
+// peerManager adds and removes the peers pinned by the operator, implemented by p2p.StaticPeers.
+type peerManager interface {
+	Add(ctx context.Context, addr string, shards []*protocol.ContractShards) (peer.ID, error)
+	Remove(id peer.ID) bool
+}
+
+// miningStats reports the rewards of the blocks mined by the node, implemented by miner.RewardWatcher.
+type miningStats interface {
+	Stats() *miner.MiningStats
+}
+
 type esAPI struct {
-	rpcCfg *RPCConfig
-	log    log.Logger
-	sm     *ethstorage.StorageManager
-	dl     *downloader.Downloader
+	rpcCfg  *RPCConfig
+	log     log.Logger
+	sm      *ethstorage.StorageManager
+	storage storageReader
+	dl      *downloader.Downloader
+	peers   peerManager // nil if the p2p is disabled
+	rewards miningStats // nil if the mining is disabled
+}
+
+// ShardStatus is the fill status of a shard served by the node.
+type ShardStatus struct {
+	Contract   common.Address `json:"contract"`
+	ShardId    uint64         `json:"shardId"`
+	Miner      common.Address `json:"miner"`
+	EncodeType uint64         `json:"encodeType"`
+	KvEntries  uint64         `json:"kvEntries"`
+	Filled     uint64         `json:"filled"` // blobs with data
+	Empty      uint64         `json:"empty"`  // blobs not synced yet or without data
+	Complete   bool           `json:"complete"`
+}
+
+// BlobByIndex is a decoded blob read from the local storage, with the commit of the blob in the contract.
+type BlobByIndex struct {
+	KvIndex    uint64        `json:"kvIndex"`
+	Commit     common.Hash   `json:"commit"`
+	EncodeType uint64        `json:"encodeType"`
+	Data       hexutil.Bytes `json:"data"`
+}
+
+// blobNotFoundError is returned when the blob is beyond the last kv index, empty, or not synced yet.
+type blobNotFoundError struct {
+	KvIndex uint64 `json:"kvIndex"`
+	Reason  string `json:"reason"`
+}
+
+func (e *blobNotFoundError) Error() string {
+	return fmt.Sprintf("blob %d not found: %s", e.KvIndex, e.Reason)
+}
+
+func (e *blobNotFoundError) ErrorCode() int {
+	return blobNotFoundErrorCode
+}
+
+func (e *blobNotFoundError) ErrorData() interface{} {
+	return e
 }
 
 type DecodeType uint64
@@ -31,12 +103,16 @@ const (
 	PaddingPer31Bytes
 )
 
-func NewESAPI(config *RPCConfig, sm *ethstorage.StorageManager, dl *downloader.Downloader, log log.Logger) *esAPI {
+func NewESAPI(config *RPCConfig, sm *ethstorage.StorageManager, dl *downloader.Downloader, peers peerManager, rewards miningStats,
+	log log.Logger) *esAPI {
 	return &esAPI{
-		rpcCfg: config,
-		sm:     sm,
-		dl:     dl,
-		log:    log,
+		rpcCfg:  config,
+		sm:      sm,
+		storage: sm,
+		dl:      dl,
+		peers:   peers,
+		rewards: rewards,
+		log:     log,
 	}
 }
 
@@ -56,6 +132,10 @@ func (api *esAPI) GetBlob(kvIndex uint64, blobHash common.Hash, decodeType Decod
 		readCommit := common.Hash{}
 		copy(readCommit[0:ethstorage.HashSizeInContract], blobHash[0:ethstorage.HashSizeInContract])
 
+		if decodeType == RawData {
+			return api.readRange(kvIndex, readCommit, off, size)
+		}
+
 		var found bool
 		blob, found, err = api.sm.TryRead(kvIndex, int(api.sm.MaxKvSize()), readCommit)
 		if err != nil {
@@ -78,3 +158,169 @@ func (api *esAPI) GetBlob(kvIndex uint64, blobHash common.Hash, decodeType Decod
 
 	return ret[off : off+size], nil
 }
+
+// readRange reads the raw data of the blob in [off, off+size), decoding only the chunks covering the range
+// instead of the whole blob. The chunks are checked against their checksums, but not the blob against the
+// commit, which needs all its chunks.
+func (api *esAPI) readRange(kvIndex uint64, commit common.Hash, off, size uint64) (hexutil.Bytes, error) {
+	if off+size > api.storage.MaxKvSize() {
+		return nil, errors.New("beyond the range of blob size")
+	}
+	if size == 0 {
+		return hexutil.Bytes{}, nil
+	}
+	chunkSize := api.storage.ChunkSize()
+	first, last := off/chunkSize, (off+size-1)/chunkSize
+	chunkIdxs := make([]uint64, 0, last-first+1)
+	for chunkIdx := first; chunkIdx <= last; chunkIdx++ {
+		chunkIdxs = append(chunkIdxs, chunkIdx)
+	}
+	chunks, found, err := api.storage.TryReadChunks(kvIndex, chunkIdxs, commit)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ethereum.NotFound
+	}
+	data := make([]byte, 0, uint64(len(chunkIdxs))*chunkSize)
+	for _, chunkIdx := range chunkIdxs {
+		data = append(data, chunks[chunkIdx]...)
+	}
+	start := off - first*chunkSize
+	return data[start : start+size], nil
+}
+
+// ShardStatus returns the fill status of each shard served by the node. A blob is counted as
+// filled if the commit in its local meta is set, which is the case once it is synced with data.
+func (api *esAPI) ShardStatus() ([]ShardStatus, error) {
+	var (
+		contract  = api.storage.ContractAddress()
+		kvEntries = api.storage.KvEntries()
+		shards    = api.storage.Shards()
+		status    = make([]ShardStatus, 0, len(shards))
+	)
+	for _, shardId := range shards {
+		miner, _ := api.storage.GetShardMiner(shardId)
+		encodeType, _ := api.storage.GetShardEncodeType(shardId)
+		complete, _ := api.storage.IsShardComplete(shardId)
+		st := ShardStatus{
+			Contract:   contract,
+			ShardId:    shardId,
+			Miner:      miner,
+			EncodeType: encodeType,
+			KvEntries:  kvEntries,
+			Complete:   complete,
+		}
+		for kvIdx := shardId * kvEntries; kvIdx < (shardId+1)*kvEntries; kvIdx++ {
+			meta, found, err := api.storage.TryReadMeta(kvIdx)
+			if err != nil {
+				return nil, err
+			}
+			if found && !isEmptyCommit(meta) {
+				st.Filled++
+			} else {
+				st.Empty++
+			}
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// isEmptyCommit reports whether the blob is not synced yet or filled with empty, in which case the
+// commit in the local meta is zero, while the filling mask after it may be set.
+func isEmptyCommit(meta []byte) bool {
+	for _, b := range meta[:min(len(meta), ethstorage.HashSizeInContract)] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// GetBlobByIndex returns the decoded blob of the kv, which is read with the commit in the contract.
+// The kv must be in a shard of the contract served by the node.
+func (api *esAPI) GetBlobByIndex(contract common.Address, kvIndex uint64) (*BlobByIndex, error) {
+	if contract != api.storage.ContractAddress() {
+		return nil, fmt.Errorf("contract %s is not served", contract.Hex())
+	}
+	shardId := kvIndex / api.storage.KvEntries()
+	if !slices.Contains(api.storage.Shards(), shardId) {
+		return nil, fmt.Errorf("shard %d is not served", shardId)
+	}
+	if kvIndex >= api.storage.LastKvIndex() {
+		return nil, &blobNotFoundError{KvIndex: kvIndex, Reason: "beyond the last kv index"}
+	}
+
+	metas, err := api.storage.GetKvMetas([]uint64{kvIndex})
+	if err != nil {
+		return nil, err
+	}
+	commit := common.Hash{}
+	copy(commit[0:ethstorage.HashSizeInContract], metas[0][32-ethstorage.HashSizeInContract:])
+	if isEmptyCommit(commit[:]) {
+		return nil, &blobNotFoundError{KvIndex: kvIndex, Reason: "empty blob"}
+	}
+	localMeta, _, err := api.storage.TryReadMeta(kvIndex)
+	if err != nil {
+		return nil, err
+	}
+	if len(localMeta) < ethstorage.HashSizeInContract ||
+		!bytes.Equal(localMeta[0:ethstorage.HashSizeInContract], commit[0:ethstorage.HashSizeInContract]) {
+		return nil, &blobNotFoundError{KvIndex: kvIndex, Reason: "not synced"}
+	}
+
+	blob, found, err := api.storage.TryRead(kvIndex, int(api.storage.MaxKvSize()), commit)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &blobNotFoundError{KvIndex: kvIndex, Reason: "not stored"}
+	}
+	encodeType, _ := api.storage.GetShardEncodeType(shardId)
+	return &BlobByIndex{
+		KvIndex:    kvIndex,
+		Commit:     commit,
+		EncodeType: encodeType,
+		Data:       blob,
+	}, nil
+}
+
+// AddPeer connects the peer at the multiaddr, which must include the peer ID, and adds it to the sync
+// client as serving the shards. The peer is reconnected when the node restarts.
+func (api *esAPI) AddPeer(ctx context.Context, addr string, shards []*protocol.ContractShards) (string, error) {
+	if api.peers == nil {
+		return "", errors.New("p2p is not enabled")
+	}
+	id, err := api.peers.Add(ctx, addr, shards)
+	if err != nil {
+		return "", err
+	}
+	api.log.Info("Added peer", "peer", id, "addr", addr, "shards", shards)
+	return id.String(), nil
+}
+
+// RemovePeer disconnects a peer added by AddPeer and removes it from the sync client.
+func (api *esAPI) RemovePeer(peerID string) error {
+	if api.peers == nil {
+		return errors.New("p2p is not enabled")
+	}
+	id, err := peer.Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer id %q: %w", peerID, err)
+	}
+	if !api.peers.Remove(id) {
+		return fmt.Errorf("peer %s was not added", peerID)
+	}
+	api.log.Info("Removed peer", "peer", id)
+	return nil
+}
+
+// MiningStats returns the number of blocks mined by the miners of the node and the rewards received, in
+// total and per shard, up to the last finalized block processed.
+func (api *esAPI) MiningStats() (*miner.MiningStats, error) {
+	if api.rewards == nil {
+		return nil, errors.New("mining is not enabled")
+	}
+	return api.rewards.Stats(), nil
+}
@@ -0,0 +1,438 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/blank"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+)
+
+type mockStorageReader struct {
+	kvEntries     uint64
+	lastKvIdx     uint64
+	shards        []uint64
+	contract      common.Address
+	miner         common.Address
+	metas         map[uint64][]byte // local metas
+	contractMetas map[uint64][32]byte
+	blobs         map[uint64][]byte
+}
+
+// write stores the blob with the commit as it is synced, with the commit of the kv set in the contract.
+func (s *mockStorageReader) write(kvIdx uint64, blob []byte, commit common.Hash) {
+	meta := [32]byte{}
+	new(big.Int).SetUint64(kvIdx).FillBytes(meta[0:5])
+	copy(meta[32-ethstorage.HashSizeInContract:], commit[0:ethstorage.HashSizeInContract])
+	s.contractMetas[kvIdx] = meta
+	s.metas[kvIdx] = localMeta(commit[0:ethstorage.HashSizeInContract]...)
+	s.blobs[kvIdx] = blob
+}
+
+func (s *mockStorageReader) TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
+	blob, ok := s.blobs[kvIdx]
+	if !ok {
+		return nil, false, nil
+	}
+	if !bytes.Equal(s.metas[kvIdx][0:ethstorage.HashSizeInContract], commit[0:ethstorage.HashSizeInContract]) {
+		return nil, true, errors.New("commit mismatch")
+	}
+	return blob[:min(readLen, len(blob))], true, nil
+}
+
+func (s *mockStorageReader) TryReadChunks(kvIdx uint64, chunkIdxs []uint64, commit common.Hash) (map[uint64][]byte, bool, error) {
+	blob, ok, err := s.TryRead(kvIdx, int(s.MaxKvSize()), commit)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	data := make([]byte, s.MaxKvSize())
+	copy(data, blob)
+	chunks := make(map[uint64][]byte, len(chunkIdxs))
+	for _, chunkIdx := range chunkIdxs {
+		if chunkIdx >= s.MaxKvSize()/s.ChunkSize() {
+			return nil, true, errors.New("chunkIdx out of range")
+		}
+		chunks[chunkIdx] = data[chunkIdx*s.ChunkSize() : (chunkIdx+1)*s.ChunkSize()]
+	}
+	return chunks, true, nil
+}
+
+func (s *mockStorageReader) ChunkSize() uint64 {
+	return 4096
+}
+
+func (s *mockStorageReader) GetKvMetas(kvIndices []uint64) ([][32]byte, error) {
+	metas := make([][32]byte, len(kvIndices))
+	for i, idx := range kvIndices {
+		metas[i] = s.contractMetas[idx]
+	}
+	return metas, nil
+}
+
+func (s *mockStorageReader) LastKvIndex() uint64 {
+	return s.lastKvIdx
+}
+
+func (s *mockStorageReader) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
+	return nil, false, ethereum.NotFound
+}
+
+func (s *mockStorageReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	return s.TryReadEncoded(kvIdx, readLen)
+}
+
+func (s *mockStorageReader) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
+	if meta, ok := s.metas[kvIdx]; ok {
+		return meta, true, nil
+	}
+	return make([]byte, 32), true, nil
+}
+
+func (s *mockStorageReader) KvEntries() uint64 {
+	return s.kvEntries
+}
+
+func (s *mockStorageReader) ContractAddress() common.Address {
+	return s.contract
+}
+
+func (s *mockStorageReader) Shards() []uint64 {
+	return s.shards
+}
+
+func (s *mockStorageReader) MaxKvSize() uint64 {
+	return 1 << 17
+}
+
+func (s *mockStorageReader) ShardKvSize(shardIdx uint64) uint64 {
+	return s.MaxKvSize()
+}
+
+func (s *mockStorageReader) GetShardMiner(shardIdx uint64) (common.Address, bool) {
+	return s.miner, true
+}
+
+func (s *mockStorageReader) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
+	return ethstorage.ENCODE_BLOB_POSEIDON, true
+}
+
+func (s *mockStorageReader) IsShardComplete(shardIdx uint64) (bool, bool) {
+	return shardIdx == 1, true
+}
+
+// localMeta returns the local meta of a blob synced with the commit starting with the bytes.
+func localMeta(commit ...byte) []byte {
+	meta := make([]byte, 32)
+	copy(meta, commit)
+	meta[ethstorage.HashSizeInContract] = 0b10000000
+	return meta
+}
+
+func TestShardStatus(t *testing.T) {
+	shards := &mockStorageReader{
+		kvEntries: 8,
+		shards:    []uint64{1},
+		contract:  common.HexToAddress("0x0000000000000000000000000000000003330001"),
+		miner:     common.HexToAddress("0x0000000000000000000000000000000000000001"),
+		metas: map[uint64][]byte{
+			8:  localMeta(0x01),
+			9:  localMeta(0x02),
+			12: localMeta(0x03),
+			13: localMeta(0x00), // filled with empty
+		},
+	}
+	srv := rpc.NewServer()
+	defer srv.Stop()
+	if err := srv.RegisterName("es", &esAPI{storage: shards, log: log.New("unittest")}); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(srv)
+	defer client.Close()
+
+	var res []map[string]interface{}
+	if err := client.Call(&res, "es_shardStatus"); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("expected status of 1 shard, got %d", len(res))
+	}
+	expected := map[string]interface{}{
+		"contract":   shards.contract.Hex(),
+		"shardId":    float64(1),
+		"miner":      shards.miner.Hex(),
+		"encodeType": float64(ethstorage.ENCODE_BLOB_POSEIDON),
+		"kvEntries":  float64(8),
+		"filled":     float64(3),
+		"empty":      float64(5),
+		"complete":   true,
+	}
+	for field, want := range expected {
+		got, ok := res[0][field]
+		if !ok {
+			t.Errorf("field %s is missing", field)
+			continue
+		}
+		if s, isStr := got.(string); isStr {
+			got = common.HexToAddress(s).Hex()
+		}
+		if got != want {
+			t.Errorf("field %s: expected %v, got %v", field, want, got)
+		}
+	}
+	if len(res[0]) != len(expected) {
+		raw, _ := json.Marshal(res[0])
+		t.Errorf("unexpected fields %s", raw)
+	}
+}
+
+func TestGetBlobByIndex(t *testing.T) {
+	storage := &mockStorageReader{
+		kvEntries:     8,
+		lastKvIdx:     12,
+		shards:        []uint64{1},
+		contract:      common.HexToAddress("0x0000000000000000000000000000000003330001"),
+		metas:         make(map[uint64][]byte),
+		contractMetas: make(map[uint64][32]byte),
+		blobs:         make(map[uint64][]byte),
+	}
+	blob := bytes.Repeat([]byte{0x12, 0x34}, 64)
+	commit := common.HexToHash("0xabcdef0000000000000000000000000000000000000000000000000000000000")
+	storage.write(9, blob, commit)
+	// the blob of kv 10 is updated in the contract but not synced yet
+	storage.write(10, blob, commit)
+	storage.metas[10] = localMeta()
+
+	srv := rpc.NewServer()
+	defer srv.Stop()
+	if err := srv.RegisterName("es", &esAPI{storage: storage, log: log.New("unittest")}); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(srv)
+	defer client.Close()
+
+	var res BlobByIndex
+	if err := client.Call(&res, "es_getBlobByIndex", storage.contract, 9); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Data, blob) {
+		t.Fatalf("blob mismatch, expected %x, got %x", blob, res.Data)
+	}
+	if res.KvIndex != 9 || res.EncodeType != ethstorage.ENCODE_BLOB_POSEIDON {
+		t.Fatalf("unexpected blob %+v", res)
+	}
+	if !bytes.Equal(res.Commit[0:ethstorage.HashSizeInContract], commit[0:ethstorage.HashSizeInContract]) {
+		t.Fatalf("commit mismatch, expected %x, got %x", commit, res.Commit)
+	}
+
+	// empty, not synced and beyond the last kv index
+	for _, kvIdx := range []uint64{8, 10, 12} {
+		err := client.Call(&res, "es_getBlobByIndex", storage.contract, kvIdx)
+		var (
+			rpcErr  rpc.Error
+			dataErr rpc.DataError
+		)
+		if !errors.As(err, &rpcErr) || rpcErr.ErrorCode() != blobNotFoundErrorCode || !errors.As(err, &dataErr) {
+			t.Fatalf("expected not found error for kv %d, got %v", kvIdx, err)
+		}
+		data, ok := dataErr.ErrorData().(map[string]interface{})
+		if !ok || data["kvIndex"] != float64(kvIdx) || data["reason"] == "" {
+			t.Fatalf("unexpected error data for kv %d: %v", kvIdx, dataErr.ErrorData())
+		}
+	}
+
+	// the shard or contract is not served
+	if err := client.Call(&res, "es_getBlobByIndex", storage.contract, 1); err == nil {
+		t.Fatalf("expected error for a shard not served")
+	}
+	if err := client.Call(&res, "es_getBlobByIndex", common.Address{}, 9); err == nil {
+		t.Fatalf("expected error for a contract not served")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	storage := &mockStorageReader{
+		metas:         make(map[uint64][]byte),
+		contractMetas: make(map[uint64][32]byte),
+		blobs:         make(map[uint64][]byte),
+	}
+	blob := make([]byte, 3*storage.ChunkSize()+100)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	commit := common.HexToHash("0xabcdef0000000000000000000000000000000000000000000000000000000000")
+	storage.write(1, blob, commit)
+	api := &esAPI{storage: storage, log: log.New("unittest")}
+
+	full := make([]byte, storage.MaxKvSize())
+	copy(full, blob)
+	chunkSize := storage.ChunkSize()
+	for _, r := range []struct{ off, size uint64 }{
+		{0, 32},
+		{chunkSize - 10, 20},
+		{100, 2*chunkSize + 50},
+		{3 * chunkSize, chunkSize},
+		{storage.MaxKvSize() - 1, 1},
+		{5, 0},
+	} {
+		data, err := api.readRange(1, commit, r.off, r.size)
+		if err != nil {
+			t.Fatalf("read [%d, %d) failed: %v", r.off, r.off+r.size, err)
+		}
+		if !bytes.Equal(data, full[r.off:r.off+r.size]) {
+			t.Fatalf("data of [%d, %d) differs from the blob", r.off, r.off+r.size)
+		}
+	}
+
+	if _, err := api.readRange(1, commit, storage.MaxKvSize()-1, 2); err == nil {
+		t.Fatal("expected the error of a range beyond the blob")
+	}
+	if _, err := api.readRange(2, commit, 0, 32); !errors.Is(err, ethereum.NotFound) {
+		t.Fatalf("expected not found for a blob not stored, got %v", err)
+	}
+}
+
+// mockSyncStorage is the storage of a sync client which never gets the blobs synced.
+type mockSyncStorage struct {
+	*mockStorageReader
+}
+
+func (s *mockSyncStorage) CommitBlob(kvIndex uint64, blob []byte, commit common.Hash) error {
+	return nil
+}
+
+func (s *mockSyncStorage) CommitEmptyBlobs(start, limit uint64) (uint64, uint64, error) {
+	return 0, 0, nil
+}
+
+func (s *mockSyncStorage) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, []uint64, error) {
+	return nil, nil, nil
+}
+
+func (s *mockSyncStorage) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
+	return b, true, nil
+}
+
+func (s *mockSyncStorage) DownloadAllMetas(ctx context.Context, batchSize uint64) error {
+	return nil
+}
+
+func (s *mockSyncStorage) RefreshMetas(ctx context.Context, blockNumber int64, batchSize uint64) ([]uint64, error) {
+	return nil, nil
+}
+
+func (s *mockSyncStorage) InvalidateKv(kvIdx uint64) error {
+	delete(s.metas, kvIdx)
+	return nil
+}
+
+func newTestHost(t *testing.T) host.Host {
+	h := bhost.NewBlankHost(swarmt.GenSwarm(t))
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestAddRemovePeer(t *testing.T) {
+	var (
+		contract  = common.HexToAddress("0x0000000000000000000000000000000003330001")
+		kvEntries = uint64(8)
+		db        = rawdb.NewMemoryDatabase()
+		rollupCfg = &rollup.EsConfig{L2ChainID: new(big.Int).SetUint64(3333)}
+		shards    = []*protocol.ContractShards{{Contract: contract, ShardIds: []uint64{0}}}
+		syncerCfg = &protocol.SyncerParams{
+			MaxPeers:              30,
+			MaxRequestSize:        4 * 1024 * 1024,
+			SyncConcurrency:       1,
+			FillEmptyConcurrency:  1,
+			MetaDownloadBatchSize: 16,
+		}
+	)
+	ethstorage.NewShardManager(contract, 1<<17, kvEntries, 1<<17)
+	storage := &mockSyncStorage{&mockStorageReader{
+		kvEntries: kvEntries,
+		lastKvIdx: kvEntries,
+		shards:    []uint64{0},
+		contract:  contract,
+		metas:     make(map[uint64][]byte),
+	}}
+	localHost := newTestHost(t)
+	syncCl := protocol.NewSyncClient(log.New("unittest"), rollupCfg, localHost.NewStream, storage, syncerCfg, db,
+		metrics.NoopMetrics, new(event.Feed))
+	if err := syncCl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer syncCl.Close()
+	staticPeers := p2p.NewStaticPeers(localHost, syncCl, nil, db, log.New("unittest"))
+
+	// the remote peer is not discoverable, and only reports the range requests dispatched to it
+	requested := make(chan struct{}, 1)
+	remoteHost := newTestHost(t)
+	remoteHost.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), func(stream network.Stream) {
+		defer stream.Reset()
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		io.Copy(io.Discard, stream)
+	})
+
+	srv := rpc.NewServer()
+	defer srv.Stop()
+	if err := srv.RegisterName("es", &esAPI{storage: storage, peers: staticPeers, log: log.New("unittest")}); err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.DialInProc(srv)
+	defer client.Close()
+
+	addr := remoteHost.Addrs()[0].String() + "/p2p/" + remoteHost.ID().String()
+	var id string
+	if err := client.Call(&id, "es_addPeer", addr, shards); err != nil {
+		t.Fatal(err)
+	}
+	if id != remoteHost.ID().String() {
+		t.Fatalf("expected peer %s, got %s", remoteHost.ID(), id)
+	}
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no task is dispatched to the added peer")
+	}
+	// the added peer is persisted to be reconnected on restart
+	if peers := p2p.NewStaticPeers(localHost, syncCl, nil, db, log.New("unittest")).Peers(); len(peers) != 1 || peers[0].Addr != addr {
+		t.Fatalf("expected the added peer to be persisted, got %v", peers)
+	}
+
+	if err := client.Call(nil, "es_removePeer", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := syncCl.PeerScores()[remoteHost.ID()]; ok {
+		t.Fatalf("the removed peer is still in the sync client")
+	}
+	if peers := p2p.NewStaticPeers(localHost, syncCl, nil, db, log.New("unittest")).Peers(); len(peers) != 0 {
+		t.Fatalf("expected the removed peer to be deleted, got %v", peers)
+	}
+	if err := client.Call(nil, "es_removePeer", id); err == nil {
+		t.Fatalf("expected error removing a peer not added")
+	}
+}
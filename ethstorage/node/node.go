@@ -5,11 +5,15 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/ethdb"
 	ethRPC "github.com/ethereum/go-ethereum/rpc"
 
@@ -35,23 +39,28 @@ type EsNode struct {
 	l1FinalizedSub ethereum.Subscription // Subscription to get L1 Finalized blocks, a.k.a. justified data (polling)
 
 	l1Source   *eth.PollingClient     // L1 Client to fetch data from
+	l1Backups  []*eth.PollingClient   // Other L1 clients to read the storage contract from when l1Source fails
+	l1Reader   ethstorage.L1Reader    // Reads of L1, failing over from l1Source to l1Backups
 	l1Beacon   *eth.BeaconClient      // L1 Beacon Chain to fetch blobs from
 	downloader *downloader.Downloader // L2 Engine to Sync
 	// l2Source  *sources.EngineClient // L2 Execution Engine RPC bindings
 	// rpcSync   *sources.SyncClient   // Alt-sync RPC client, optional (may be nil)
-	server  *rpcServer   // RPC server hosting the rollup-node API
-	p2pNode *p2p.NodeP2P // P2P node functionality
+	server    *rpcServer     // RPC server hosting the rollup-node API
+	dashboard *syncDashboard // web page visualizing the p2p sync, optional (may be nil)
+	p2pNode   *p2p.NodeP2P   // P2P node functionality
 	// p2pSigner p2p.Signer            // p2p gogssip application messages will be signed with this signer
 	// tracer    Tracer                // tracer to get events for testing/debugging
 	// runCfg    *RuntimeConfig        // runtime configurables
 	storageManager *ethstorage.StorageManager
 	db             ethdb.Database
+	dataDirLock    *DataDirLock // prevents other processes from using the same datadir
 
 	// some resources cannot be stopped directly, like the p2p gossipsub router (not our design),
 	// and depend on this ctx to be closed.
 	resourcesCtx   context.Context
 	resourcesClose context.CancelFunc
 	miner          *miner.Miner
+	rewards        *miner.RewardWatcher // accounts the mining rewards, nil if the mining is disabled
 	// feed to notify miner of the sync done event to start mining
 	feed *event.Feed
 }
@@ -85,6 +94,12 @@ func (n *EsNode) init(ctx context.Context, cfg *Config) error {
 	// if err := n.initTracer(ctx, cfg); err != nil {
 	// 	return err
 	// }
+	if err := n.initDataDirLock(cfg); err != nil {
+		return err
+	}
+	if err := prover.SetKZGBackend(cfg.KZGBackend, n.log); err != nil {
+		return err
+	}
 	if err := n.initL1(ctx, cfg); err != nil {
 		return err
 	}
@@ -117,12 +132,15 @@ func (n *EsNode) init(ctx context.Context, cfg *Config) error {
 	if err := n.initMetricsServer(ctx, cfg); err != nil {
 		return err
 	}
+	if err := n.initDashboard(ctx, cfg); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (n *EsNode) initL2(ctx context.Context, cfg *Config) error {
 	n.downloader = downloader.NewDownloader(
-		n.l1Source,
+		n.l1Reader,
 		n.l1Beacon,
 		n.db,
 		n.storageManager,
@@ -141,6 +159,32 @@ func (n *EsNode) initL1(ctx context.Context, cfg *Config) error {
 		return fmt.Errorf("failed to create L1 source: %w", err)
 	}
 	n.l1Source = client
+	names := []string{cfg.L1.L1NodeAddr}
+	for _, addr := range cfg.L1.L1NodeAddrs {
+		if addr == cfg.L1.L1NodeAddr {
+			continue
+		}
+		c, err := ethclient.DialContext(ctx, addr)
+		if err != nil {
+			n.log.Warn("Failed to create backup L1 source, skipping it", "addr", addr, "err", err)
+			continue
+		}
+		// backups only serve the reads, so they don't need to poll the heads
+		n.l1Backups = append(n.l1Backups, eth.NewClient(n.resourcesCtx, c, false, cfg.Storage.L1Contract, n.log))
+		names = append(names, addr)
+	}
+	n.l1Reader = client
+	if len(n.l1Backups) > 0 {
+		sources := []ethstorage.L1Reader{client}
+		for _, backup := range n.l1Backups {
+			sources = append(sources, backup)
+		}
+		failover, err := ethstorage.NewFailoverL1Reader(names, sources, ethstorage.DefaultL1EndpointCooldown, n.log)
+		if err != nil {
+			return err
+		}
+		n.l1Reader = failover
+	}
 
 	n.l1Beacon = eth.NewBeaconClient(cfg.L1.L1BeaconURL, cfg.L1.L1BeaconBasedTime, cfg.L1.L1BeaconBasedSlot, cfg.L1.L1BeaconSlotTime)
 	return nil
@@ -177,6 +221,18 @@ func (n *EsNode) initP2P(ctx context.Context, cfg *Config) error {
 			return err
 		}
 		n.p2pNode = p2pNode
+		if syncCl := n.p2pNode.SyncClient(); syncCl != nil {
+			if cfg.KZGTrustedSetup != "" {
+				kzg, err := prover.NewKZGProverWithConfig(prover.KZGProverConfig{TrustedSetup: cfg.KZGTrustedSetup}, n.log)
+				if err != nil {
+					return err
+				}
+				syncCl.SetProver(kzg)
+			}
+			if cfg.L1.L1BeaconURL != "" {
+				syncCl.SetL1BlobSource(eth.NewL1BlobSource(n.l1Reader, n.l1Beacon, uint64(max(cfg.Downloader.DownloadStart, 0))))
+			}
+		}
 		if n.p2pNode.Dv5Udp() != nil {
 			go n.p2pNode.DiscoveryProcess(n.resourcesCtx, n.log, cfg.L1.L1ChainID, cfg.P2P.TargetPeers())
 		}
@@ -189,15 +245,35 @@ func (n *EsNode) initStorageManager(ctx context.Context, cfg *Config) error {
 	for _, filename := range cfg.Storage.Filenames {
 		var err error
 		var df *ethstorage.DataFile
-		df, err = ethstorage.OpenDataFile(filename)
+		if cfg.Storage.Mmap {
+			df, err = ethstorage.OpenMmapDataFile(filename)
+		} else {
+			df, err = ethstorage.OpenDataFile(filename)
+		}
 		if err != nil {
 			return fmt.Errorf("open failed: %w", err)
 		}
-		if df.Miner() != cfg.Storage.Miner {
-			log.Error("Miners mismatch", "fromDataFile", df.Miner(), "fromConfig", cfg.Storage.Miner)
+		if miner := cfg.Storage.MinerOf(df.KvIdxStart() / cfg.Storage.KvEntriesPerShard); df.Miner() != miner {
+			log.Error("Miners mismatch", "file", filename, "fromDataFile", df.Miner(), "fromConfig", miner)
 			return fmt.Errorf("miner mismatches datafile")
 		}
-		shardManager.AddDataFileAndShard(df)
+		if cfg.Storage.VerifyOnOpen {
+			if err := ethstorage.VerifyDataFile(df); err != nil {
+				var verifyErr *ethstorage.DataFileVerifyError
+				if errors.As(err, &verifyErr) {
+					for _, kvIdx := range verifyErr.KvIndices {
+						log.Error("Corrupted kv in data file", "file", filename, "kvIdx", kvIdx)
+					}
+				}
+				return fmt.Errorf("verify data file failed: %w", err)
+			}
+			log.Info("Verified data file", "file", filename)
+		}
+		// all the data files of a shard must share the encode type recorded in their headers
+		if err := shardManager.AddDataFileAndShard(df); err != nil {
+			return fmt.Errorf("add data file %s failed: %w", filename, err)
+		}
+		log.Info("Opened data file", "file", filename, "encodeType", df.EncodeType())
 	}
 
 	if shardManager.IsComplete() != nil {
@@ -211,12 +287,26 @@ func (n *EsNode) initStorageManager(ctx context.Context, cfg *Config) error {
 		"chunkSize", shardManager.ChunkSize(),
 		"kvsPerShard", shardManager.KvEntries())
 
-	n.storageManager = ethstorage.NewStorageManager(shardManager, n.l1Source)
+	metaCache := ethstorage.NewMetaCache(n.l1Reader, n.db, n.metrics, n.log)
+	metaLRU, err := ethstorage.NewMetaLRU(metaCache, cfg.L1.L1MetaCacheSize, cfg.L1.L1MetaBatchSize)
+	if err != nil {
+		return fmt.Errorf("create meta cache failed: %w", err)
+	}
+	n.storageManager = ethstorage.NewStorageManager(shardManager, metaLRU)
 	return nil
 }
 
 func (n *EsNode) initRPCServer(ctx context.Context, cfg *Config) error {
-	server, err := newRPCServer(ctx, &cfg.RPC, cfg.Rollup.L2ChainID, n.storageManager, n.downloader, n.log, n.appVersion)
+	var peers peerManager
+	if n.p2pNode != nil {
+		peers = n.p2pNode.StaticPeers()
+	}
+	var rewards miningStats
+	if n.rewards != nil {
+		rewards = n.rewards
+	}
+	server, err := newRPCServer(ctx, &cfg.RPC, cfg.Rollup.L2ChainID, n.storageManager, n.downloader, peers, rewards,
+		n.log, n.appVersion)
 	if err != nil {
 		return err
 	}
@@ -242,19 +332,52 @@ func (n *EsNode) initMetricsServer(ctx context.Context, cfg *Config) error {
 	return nil
 }
 
+func (n *EsNode) initDashboard(ctx context.Context, cfg *Config) error {
+	if !cfg.Dashboard.Enabled {
+		return nil
+	}
+	if n.p2pNode == nil || n.p2pNode.SyncClient() == nil {
+		n.log.Warn("Dashboard disabled as p2p sync is not enabled")
+		return nil
+	}
+	dashboard := newSyncDashboard(&cfg.Dashboard, n.p2pNode.SyncClient(), n.log)
+	n.log.Info("Starting dashboard server", "addr", cfg.Dashboard.ListenAddr, "port", cfg.Dashboard.ListenPort)
+	if err := dashboard.Start(); err != nil {
+		return fmt.Errorf("unable to start dashboard server: %w", err)
+	}
+	n.dashboard = dashboard
+	return nil
+}
+
 func (n *EsNode) initMiner(ctx context.Context, cfg *Config) error {
 	if cfg.Mining == nil {
 		// not enabled
 		return nil
 	}
+	// the mining API sends the transactions from its view of the chain, so it stays on the primary L1 source
 	l1api := miner.NewL1MiningAPI(n.l1Source, n.log)
+	kzg, err := prover.NewKZGProverWithConfig(prover.KZGProverConfig{
+		TrustedSetup:   cfg.KZGTrustedSetup,
+		ProofCacheSize: int(cfg.Mining.ProofCacheSize),
+	}, n.log)
+	if err != nil {
+		return err
+	}
 	pvr := prover.NewKZGPoseidonProver(
 		cfg.Mining.ZKWorkingDir,
 		cfg.Mining.ZKeyFileName,
 		cfg.Mining.ZKProverMode,
+		kzg,
 		n.log,
 	)
 	n.miner = miner.New(cfg.Mining, n.storageManager, l1api, &pvr, n.feed, n.log)
+	var miners []common.Address
+	for _, shardId := range n.storageManager.Shards() {
+		if addr, ok := n.storageManager.GetShardMiner(shardId); ok && !slices.Contains(miners, addr) {
+			miners = append(miners, addr)
+		}
+	}
+	n.rewards = miner.NewRewardWatcher(n.l1Reader, n.db, miners, uint64(max(cfg.Downloader.DownloadStart, 0)), n.log)
 	log.Info("Initialized miner")
 	return nil
 }
@@ -305,13 +428,19 @@ func (n *EsNode) OnNewL1Finalized(ctx context.Context, sig eth.L1BlockRef) {
 	if n.downloader != nil {
 		n.downloader.OnL1Finalized(sig.Number)
 	}
+	if n.rewards != nil {
+		n.rewards.OnL1Finalized(sig.Number)
+	}
+	if n.p2pNode != nil && n.p2pNode.SyncClient() != nil {
+		n.p2pNode.SyncClient().OnL1Finalized(sig.Number)
+	}
 }
 
-func (n *EsNode) RequestL2Range(ctx context.Context, start, end uint64) (uint64, error) {
+func (n *EsNode) RequestL2Range(ctx context.Context, contract common.Address, start, end uint64) (uint64, error) {
 	if n.p2pNode != nil {
-		return n.p2pNode.RequestL2Range(ctx, start, end)
+		return n.p2pNode.RequestL2Range(ctx, contract, start, end)
 	}
-	n.log.Debug("Ignoring request to sync L2 range, no sync method available", "start", start, "end", end)
+	n.log.Debug("Ignoring request to sync L2 range, no sync method available", "contract", contract, "start", start, "end", end)
 	return 0, nil
 }
 
@@ -321,6 +450,9 @@ func (n *EsNode) Close() error {
 	if n.server != nil {
 		n.server.Stop()
 	}
+	if n.dashboard != nil {
+		n.dashboard.Stop()
+	}
 	if n.p2pNode != nil {
 		if err := n.p2pNode.Close(); err != nil {
 			result = multierror.Append(result, fmt.Errorf("failed to close p2p node: %w", err))
@@ -374,12 +506,40 @@ func (n *EsNode) Close() error {
 	if n.l1Source != nil {
 		n.l1Source.Close()
 	}
+	for _, backup := range n.l1Backups {
+		backup.Close()
+	}
 	if n.storageManager != nil {
 		n.storageManager.Close()
 	}
+	// the database and the datadir lock are dropped once closed, so closing the node again skips them
+	if n.db != nil {
+		if err := n.db.Close(); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to close database: %w", err))
+		}
+		n.db = nil
+	}
+	if n.dataDirLock != nil {
+		if err := n.dataDirLock.Release(); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to release datadir lock: %w", err))
+		}
+		n.dataDirLock = nil
+	}
 	return result.ErrorOrNil()
 }
 
+func (n *EsNode) initDataDirLock(cfg *Config) error {
+	if cfg.DataDir == "" {
+		return nil
+	}
+	lock, err := LockDataDir(cfg.DataDir, n.log)
+	if err != nil {
+		return err
+	}
+	n.dataDirLock = lock
+	return nil
+}
+
 func (n *EsNode) initDatabase(cfg *Config) error {
 	var db ethdb.Database
 	var err error
@@ -6,6 +6,10 @@ package node
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -16,10 +20,10 @@ import (
 	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
 )
 
-func createSstorage(shardIdxList []uint64, cfg storage.StorageConfig) {
+func createSstorage(dir string, shardIdxList []uint64, cfg storage.StorageConfig) {
 	files := make([]string, 0)
 	for _, shardIdx := range shardIdxList {
-		fileName := fmt.Sprintf(".\\ss%d.dat", shardIdx)
+		fileName := filepath.Join(dir, fmt.Sprintf("ss%d.dat", shardIdx))
 		files = append(files, fileName)
 		chunkPerfile := cfg.KvSize / cfg.ChunkSize
 		startChunkId := shardIdx * cfg.KvEntriesPerShard * chunkPerfile
@@ -45,7 +49,7 @@ func test_InitDB(test *testing.T, dataDir string) {
 		L1Contract:        common.HexToAddress("0x0000000000000000000000000000000003330001"),
 		Miner:             common.HexToAddress("0x0000000000000000000000000000000000000001"),
 	}
-	createSstorage([]uint64{0}, storConfig)
+	createSstorage(test.TempDir(), []uint64{0}, storConfig)
 	cfg := Config{
 		DataDir:  dataDir,
 		DBConfig: db.DefaultDBConfig(),
@@ -59,8 +63,9 @@ func test_InitDB(test *testing.T, dataDir string) {
 	}
 	err := n.initDatabase(&cfg)
 	if err != nil {
-		test.Error(err.Error())
+		test.Fatal(err.Error())
 	}
+	defer n.Close()
 
 	err = n.db.Put(key, bs)
 	if err != nil {
@@ -79,6 +84,30 @@ func Test_InitDB_MemoryDB(test *testing.T) {
 }
 
 func Test_InitDB_LevelDB(test *testing.T) {
-	dataDir := ".\\"
+	dataDir := test.TempDir()
 	test_InitDB(test, dataDir)
 }
+
+func Test_LockDataDir(test *testing.T) {
+	dataDir := test.TempDir()
+	lg := log.New("unittest")
+
+	lock, err := LockDataDir(dataDir, lg)
+	if err != nil {
+		test.Fatal(err.Error())
+	}
+	if _, err := LockDataDir(dataDir, lg); err == nil {
+		test.Fatal("expected second lock on the same datadir to fail")
+	} else if !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		test.Errorf("expected error to contain the owner PID, got %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		test.Fatal(err.Error())
+	}
+
+	lock, err = LockDataDir(dataDir, lg)
+	if err != nil {
+		test.Fatal(err.Error())
+	}
+	lock.Release()
+}
@@ -34,10 +34,12 @@ func newRPCServer(
 	l2ChainId *big.Int,
 	sm *ethstorage.StorageManager,
 	dl *downloader.Downloader,
+	peers peerManager,
+	rewards miningStats,
 	log log.Logger,
 	appVersion string,
 ) (*rpcServer, error) {
-	esAPI := NewESAPI(rpcCfg, sm, dl, log)
+	esAPI := NewESAPI(rpcCfg, sm, dl, peers, rewards, log)
 	ethApi := NewETHAPI(rpcCfg, l2ChainId, log)
 
 	endpoint := net.JoinHostPort(rpcCfg.ListenAddr, strconv.Itoa(rpcCfg.ListenPort))
@@ -1,13 +1,9 @@
 package cli
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"os"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -72,6 +68,10 @@ func NewConfig(ctx *cli.Context, blockTime uint64) (*p2p.Config, error) {
 		return nil, fmt.Errorf("failed to load syncer params: %w", err)
 	}
 
+	if err := loadSyncServerParams(conf, ctx); err != nil {
+		return nil, fmt.Errorf("failed to load sync server params: %w", err)
+	}
+
 	conf.ConnGater = p2p.DefaultConnGater
 	conf.ConnMngr = p2p.DefaultConnManager
 
@@ -300,55 +300,13 @@ func loadLibp2pOpts(conf *p2p.Config, ctx *cli.Context) error {
 func loadNetworkPrivKey(ctx *cli.Context) (*crypto.Secp256k1PrivateKey, error) {
 	raw := ctx.GlobalString(flags.P2PPrivRaw.Name)
 	if raw != "" {
-		return parsePriv(raw)
+		return p2p.ParsePrivKey(raw)
 	}
 	keyPath := ctx.GlobalString(flags.P2PPrivPath.Name)
 	if keyPath == "" {
 		return nil, errors.New("no p2p private key path specified, cannot auto-generate key without path")
 	}
-	f, err := os.OpenFile(keyPath, os.O_RDONLY, 0600)
-	if os.IsNotExist(err) {
-		p, _, err := crypto.GenerateSecp256k1Key(rand.Reader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate new p2p priv key: %w", err)
-		}
-		b, err := p.Raw()
-		if err != nil {
-			return nil, fmt.Errorf("failed to encode new p2p priv key: %w", err)
-		}
-		f, err := os.OpenFile(keyPath, os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			return nil, fmt.Errorf("failed to store new p2p priv key: %w", err)
-		}
-		defer f.Close()
-		if _, err := f.WriteString(hex.EncodeToString(b)); err != nil {
-			return nil, fmt.Errorf("failed to write new p2p priv key: %w", err)
-		}
-		return (p).(*crypto.Secp256k1PrivateKey), nil
-	} else {
-		defer f.Close()
-		data, err := io.ReadAll(f)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read priv key file: %w", err)
-		}
-		return parsePriv(strings.TrimSpace(string(data)))
-	}
-}
-
-func parsePriv(data string) (*crypto.Secp256k1PrivateKey, error) {
-	if len(data) > 2 && data[:2] == "0x" {
-		data = data[2:]
-	}
-	b, err := hex.DecodeString(data)
-	if err != nil {
-		return nil, errors.New("p2p priv key is not formatted in hex chars")
-	}
-	p, err := crypto.UnmarshalSecp256k1PrivateKey(b)
-	if err != nil {
-		// avoid logging the priv key in the error, but hint at likely input length problem
-		return nil, fmt.Errorf("failed to parse priv key from %d bytes", len(b))
-	}
-	return (p).(*crypto.Secp256k1PrivateKey), nil
+	return p2p.LoadOrCreatePrivKey(keyPath)
 }
 
 func loadGossipOptions(conf *p2p.Config, ctx *cli.Context) error {
@@ -367,15 +325,141 @@ func loadSyncerParams(conf *p2p.Config, ctx *cli.Context) error {
 	syncConcurrency := ctx.GlobalUint64(flags.SyncConcurrency.Name)
 	fillEmptyConcurrency := ctx.GlobalInt(flags.FillEmptyConcurrency.Name)
 	maxPeers := ctx.GlobalInt(flags.PeersHi.Name)
+	peerJoinRate := ctx.GlobalFloat64(flags.PeerJoinRate.Name)
+	maxConcurrentRequests := ctx.GlobalInt(flags.SyncMaxConcurrentRequests.Name)
+	maxConcurrentWrites := ctx.GlobalInt(flags.SyncMaxConcurrentWrites.Name)
+	maxWriteQueue := ctx.GlobalInt(flags.SyncMaxWriteQueue.Name)
+	healBacklogThreshold := ctx.GlobalInt(flags.SyncHealBacklogThreshold.Name)
+	metaRefreshInterval := ctx.GlobalDuration(flags.SyncMetaRefreshInterval.Name)
+	requestTimeout := ctx.GlobalDuration(flags.SyncRequestTimeout.Name)
+	stallTimeout := ctx.GlobalDuration(flags.SyncStallTimeout.Name)
+	skipFilled := ctx.GlobalBool(flags.SyncSkipFilled.Name)
+	minRangeSize := ctx.GlobalUint64(flags.SyncMinRangeSize.Name)
+	maxRangeSize := ctx.GlobalUint64(flags.SyncMaxRangeSize.Name)
+	maxPeersPerShard := ctx.GlobalInt(flags.SyncMaxPeersPerShard.Name)
+	reconnectAttempts := ctx.GlobalInt(flags.SyncReconnectAttempts.Name)
+	reconnectBackoff := ctx.GlobalDuration(flags.SyncReconnectBackoff.Name)
+	reconnectMaxBackoff := ctx.GlobalDuration(flags.SyncReconnectMaxBackoff.Name)
+	l1HealTimeout := ctx.GlobalDuration(flags.SyncL1HealTimeout.Name)
+	emptyFillPolicy, err := protocol.ParseEmptyFillPolicy(ctx.GlobalString(flags.SyncEmptyFill.Name))
+	if err != nil {
+		return fmt.Errorf("p2p.sync.empty-fill param is invalid: %w", err)
+	}
 	if syncConcurrency < 1 {
 		return fmt.Errorf("p2p.sync.concurrency param is invalid: the value should larger than 0")
 	}
+	if peerJoinRate < 0 {
+		return fmt.Errorf("p2p.sync.peer-join-rate param is invalid: the value should not be negative")
+	}
+	if maxConcurrentRequests < 0 {
+		return fmt.Errorf("p2p.sync.max-concurrent-requests param is invalid: the value should not be negative")
+	}
+	if maxConcurrentWrites < 0 {
+		return fmt.Errorf("p2p.sync.max-concurrent-writes param is invalid: the value should not be negative")
+	}
+	if maxWriteQueue < 0 {
+		return fmt.Errorf("p2p.sync.max-write-queue param is invalid: the value should not be negative")
+	}
+	if healBacklogThreshold < 0 {
+		return fmt.Errorf("p2p.sync.heal-backlog-threshold param is invalid: the value should not be negative")
+	}
+	if metaRefreshInterval < 0 {
+		return fmt.Errorf("p2p.sync.meta-refresh-interval param is invalid: the value should not be negative")
+	}
+	if requestTimeout < 0 {
+		return fmt.Errorf("p2p.sync.request-timeout param is invalid: the value should not be negative")
+	}
+	if stallTimeout < 0 {
+		return fmt.Errorf("p2p.sync.stall-timeout param is invalid: the value should not be negative")
+	}
+	if maxRangeSize > 0 && minRangeSize > maxRangeSize {
+		return fmt.Errorf("p2p.sync.min-range-size param is invalid: the value should not be larger than p2p.sync.max-range-size")
+	}
+	if maxPeersPerShard < 0 {
+		return fmt.Errorf("p2p.sync.max-peers-per-shard param is invalid: the value should not be negative")
+	}
+	if reconnectAttempts < 0 {
+		return fmt.Errorf("p2p.sync.reconnect-attempts param is invalid: the value should not be negative")
+	}
+	if reconnectBackoff < 0 || reconnectMaxBackoff < 0 {
+		return fmt.Errorf("p2p.sync.reconnect-backoff params are invalid: the values should not be negative")
+	}
+	if l1HealTimeout < 0 {
+		return fmt.Errorf("p2p.sync.l1-heal-timeout param is invalid: the value should not be negative")
+	}
 	conf.SyncParams = &protocol.SyncerParams{
 		MaxPeers:              maxPeers,
 		MaxRequestSize:        maxRequestSize,
 		SyncConcurrency:       syncConcurrency,
 		FillEmptyConcurrency:  fillEmptyConcurrency,
 		MetaDownloadBatchSize: metaDownloadBatchSize,
+		PeerJoinRate:          peerJoinRate,
+		MaxConcurrentRequests: maxConcurrentRequests,
+		MaxConcurrentWrites:   maxConcurrentWrites,
+		MaxWriteQueue:         maxWriteQueue,
+		HealBacklogThreshold:  healBacklogThreshold,
+		MetaRefreshInterval:   metaRefreshInterval,
+		RequestTimeout:        requestTimeout,
+		StallTimeout:          stallTimeout,
+		SkipFilled:            skipFilled,
+		MinRangeSize:          minRangeSize,
+		MaxRangeSize:          maxRangeSize,
+		MaxPeersPerShard:      maxPeersPerShard,
+		ReconnectAttempts:     reconnectAttempts,
+		ReconnectBackoff:      reconnectBackoff,
+		ReconnectMaxBackoff:   reconnectMaxBackoff,
+		EmptyFillPolicy:       emptyFillPolicy,
+		L1HealTimeout:         l1HealTimeout,
+	}
+	return nil
+}
+
+// loadSyncServerParams loads [protocol.SyncServerParams] from the CLI context.
+func loadSyncServerParams(conf *p2p.Config, ctx *cli.Context) error {
+	params := &protocol.SyncServerParams{
+		GlobalRequestRate:  ctx.GlobalFloat64(flags.ServerRequestRate.Name),
+		GlobalRequestBurst: ctx.GlobalInt(flags.ServerRequestBurst.Name),
+		PeerRequestRate:    ctx.GlobalFloat64(flags.ServerPeerRequestRate.Name),
+		PeerRequestBurst:   ctx.GlobalInt(flags.ServerPeerRequestBurst.Name),
+		MaxPeerStreams:     ctx.GlobalInt(flags.ServerPeerMaxStreams.Name),
+		PeerBytesRate:      ctx.GlobalFloat64(flags.ServerPeerBytesRate.Name),
+		PeerBytesBurst:     ctx.GlobalInt(flags.ServerPeerBytesBurst.Name),
+		GlobalBytesRate:    ctx.GlobalFloat64(flags.ServerBytesRate.Name),
+		GlobalBytesBurst:   ctx.GlobalInt(flags.ServerBytesBurst.Name),
+		BlobCacheSize:      ctx.GlobalInt64(flags.ServerBlobCacheSize.Name),
+		MaxResponseSize:    ctx.GlobalUint64(flags.ServerMaxResponseSize.Name),
+	}
+	if params.GlobalRequestRate <= 0 || params.PeerRequestRate <= 0 {
+		return fmt.Errorf("p2p.server request rates are invalid: the values should larger than 0")
+	}
+	if params.GlobalRequestBurst < 1 || params.PeerRequestBurst < 1 {
+		return fmt.Errorf("p2p.server request bursts are invalid: the values should larger than 0")
+	}
+	if params.MaxPeerStreams < 0 {
+		return fmt.Errorf("p2p.server.peer-max-streams param is invalid: the value should not be negative")
+	}
+	if params.PeerBytesRate < 0 {
+		return fmt.Errorf("p2p.server.peer-bytes-rate param is invalid: the value should not be negative")
+	}
+	if params.PeerBytesRate > 0 && params.PeerBytesBurst < 1 {
+		return fmt.Errorf("p2p.server.peer-bytes-burst param is invalid: the value should larger than 0")
+	}
+	if params.GlobalBytesRate < 0 {
+		return fmt.Errorf("p2p.server.bytes-rate param is invalid: the value should not be negative")
+	}
+	if params.GlobalBytesRate > 0 && params.GlobalBytesBurst < 1 {
+		return fmt.Errorf("p2p.server.bytes-burst param is invalid: the value should larger than 0")
+	}
+	if params.BlobCacheSize < 0 {
+		return fmt.Errorf("p2p.server.blob-cache-size param is invalid: the value should not be negative")
+	}
+	if params.MaxResponseSize == 0 {
+		return fmt.Errorf("p2p.server.max-response-size param is invalid: the value should larger than 0")
+	}
+	if params.MaxResponseSize > protocol.DefaultMaxServerResponseSize {
+		return fmt.Errorf("p2p.server.max-response-size param is invalid: the value should not be larger than %d",
+			protocol.DefaultMaxServerResponseSize)
 	}
+	conf.ServerParams = params
 	return nil
 }
@@ -50,6 +50,7 @@ type SetupP2P interface {
 	Discovery(log log.Logger, l1ChainID uint64, tcpPort uint16, fallbackIP net.IP) (*enode.LocalNode, *discover.UDPv5, bool, error)
 	TargetPeers() uint
 	SyncerParams() *protocol.SyncerParams
+	SyncServerParams() *protocol.SyncServerParams
 	GossipSetupConfigurables
 }
 
@@ -92,6 +93,11 @@ type Config struct {
 	HostSecurity        []libp2p.Option
 	NoTransportSecurity bool
 
+	// Watermarks and grace period of the libp2p connection manager. Once the connection count exceeds
+	// PeersHi, the manager trims connections down to PeersLo, dropping the peers with the lowest tag
+	// values first; peers serving shards to the sync client are tagged with syncPeerTag.
+	// PeersHi is also used as SyncerParams.MaxPeers, so the sync client never accepts more peers than
+	// the connection manager is willing to keep.
 	PeersLo    uint
 	PeersHi    uint
 	PeersGrace time.Duration
@@ -118,6 +124,8 @@ type Config struct {
 
 	// Syncer params
 	SyncParams *protocol.SyncerParams
+	// Sync server rate limits
+	ServerParams *protocol.SyncServerParams
 
 	// Underlying store that hosts connection-gater and peerstore data.
 	Store ds.Batching
@@ -190,6 +198,10 @@ func (conf *Config) SyncerParams() *protocol.SyncerParams {
 	return conf.SyncParams
 }
 
+func (conf *Config) SyncServerParams() *protocol.SyncServerParams {
+	return conf.ServerParams
+}
+
 const maxMeshParam = 1000
 
 func (conf *Config) Check() error {
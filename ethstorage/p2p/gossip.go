@@ -4,10 +4,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
 	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
 	"github.com/golang/snappy"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -54,7 +57,8 @@ func blocksTopicV1(cfg *rollup.EsConfig) string {
 // BuildSubscriptionFilter builds a simple subscription filter,
 // to help protect against peers spamming useless subscriptions.
 func BuildSubscriptionFilter(cfg *rollup.EsConfig) pubsub.SubscriptionFilter {
-	return pubsub.NewAllowlistSubscriptionFilter(blocksTopicV1(cfg)) // add more topics here in the future, if any.
+	topics := fmt.Sprintf("^(%s|%s)$", regexp.QuoteMeta(blocksTopicV1(cfg)), protocol.BlobsTopicPattern(cfg.L2ChainID))
+	return pubsub.NewRegexpSubscriptionFilter(regexp.MustCompile(topics)) // add more topics here in the future, if any.
 }
 
 var msgBufPool = sync.Pool{New: func() any {
@@ -25,6 +25,7 @@ import (
 	madns "github.com/multiformats/go-multiaddr-dns"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
 )
 
 type ExtraHostFeatures interface {
@@ -148,7 +149,8 @@ func (conf *Config) Host(log log.Logger, reporter metrics.Reporter) (host.Host,
 		return nil, fmt.Errorf("failed to open connection gater: %w", err)
 	}
 
-	// TODO as we have MaxPeers to limit the connection count, do we still need this?
+	// MaxPeers only limits the peers accepted by the sync client, the connection manager also bounds the
+	// connections which are not used for syncing (e.g. discovery and gossip only peers).
 	connMngr, err := conf.ConnMngr(conf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open connection manager: %w", err)
@@ -181,7 +183,7 @@ func (conf *Config) Host(log log.Logger, reporter metrics.Reporter) (host.Host,
 		libp2p.DisableRelay(),
 		// host will start and listen to network directly after construction from config.
 		libp2p.ListenAddrs(listenAddr),
-		libp2p.ConnectionGater(connGtr),
+		libp2p.ConnectionGater(NewShardGater(connGtr, ps, ethstorage.Shards, log)),
 		libp2p.ConnectionManager(connMngr),
 		// libp2p.ResourceManager(nil), // TODO use resource manager interface to manage resources per peer better.
 		libp2p.NATManager(nat),
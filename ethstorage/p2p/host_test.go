@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol/selftest"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+)
+
+// TestSyncOnSecuredHosts syncs a shard between two hosts created by Config.Host, securing their connections
+// with Noise or TLS, where the remote host only speaks TLS so the transports are negotiated, and checks the
+// priv key loaded from the key file keeps the peer ID of the host.
+func TestSyncOnSecuredHosts(t *testing.T) {
+	lg := log.New("unittest")
+	// the shards of the peers are kept in the datastore of the peerstore, like the ones found by the discovery
+	gob.Register([]*protocol.ContractShards{})
+	keyPath := filepath.Join(t.TempDir(), "p2p_priv.txt")
+	localKey, err := LoadOrCreatePrivKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadedKey, err := LoadOrCreatePrivKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !localKey.Equals(reloadedKey) {
+		t.Fatalf("priv key changed after reloading from the key file")
+	}
+	remoteKey, err := LoadOrCreatePrivKey(filepath.Join(t.TempDir(), "p2p_priv.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newHost := func(priv *crypto.Secp256k1PrivateKey, security ...libp2p.Option) host.Host {
+		conf := &Config{
+			Priv:          priv,
+			ListenIP:      net.ParseIP("127.0.0.1"),
+			ListenTCPPort: 0,
+			HostMux:       []libp2p.Option{YamuxC()},
+			HostSecurity:  security,
+			PeersLo:       1,
+			PeersHi:       10,
+			TimeoutDial:   time.Second * 2,
+			Store:         sync.MutexWrap(ds.NewMapDatastore()),
+			ConnGater:     DefaultConnGater,
+			ConnMngr:      DefaultConnManager,
+		}
+		h, err := conf.Host(lg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	localHost := newHost(localKey, NoiseC(), TlsC())
+	remoteHost := newHost(remoteKey, TlsC())
+	if id, _ := peer.IDFromPrivateKey(localKey); localHost.ID() != id {
+		t.Fatalf("expected host id %s from the priv key, got %s", id, localHost.ID())
+	}
+
+	cfg := &selftest.Config{
+		KvSize:     1 << 17,
+		ChunkSize:  1 << 17,
+		KvEntries:  16,
+		KvCount:    8,
+		EncodeType: ethstorage.ENCODE_BLOB_POSEIDON,
+		Timeout:    time.Minute,
+	}
+	if _, err := selftest.RunOnHosts(context.Background(), cfg, localHost, remoteHost, lg); err != nil {
+		t.Fatal(err)
+	}
+	if conns := localHost.Network().ConnsToPeer(remoteHost.ID()); len(conns) == 0 || conns[0].ConnState().Security != tls.ID {
+		t.Fatalf("expected the connection secured by TLS, got %v", conns)
+	}
+}
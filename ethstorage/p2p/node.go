@@ -27,6 +27,13 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 )
 
+const (
+	// syncPeerTag is the connection manager tag of the peers serving shards to the sync client.
+	syncPeerTag         = "es-sync"
+	syncPeerTagBase     = 10
+	syncPeerTagPerShard = 5
+)
+
 // NodeP2P is a p2p node, which can be used to gossip messages.
 type NodeP2P struct {
 	host    host.Host           // p2p host (optional, may be nil)
@@ -39,6 +46,8 @@ type NodeP2P struct {
 	gs             *pubsub.PubSub   // p2p gossip router
 	syncCl         *protocol.SyncClient
 	syncSrv        *protocol.SyncServer
+	staticPeers    *StaticPeers
+	announcer      *protocol.BlobAnnouncer
 	storageManager *ethstorage.StorageManager
 }
 
@@ -87,6 +96,14 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 
 		// Activate the P2P req-resp sync
 		n.syncCl = protocol.NewSyncClient(log, rollupCfg, n.host.NewStream, storageManager, setup.SyncerParams(), db, m, feed)
+		n.syncCl.SetEvictPeerFn(func(id peer.ID) {
+			if err := n.host.Network().ClosePeer(id); err != nil {
+				log.Debug("Failed to close evicted peer", "peer", id, "err", err)
+			}
+		})
+		n.syncCl.SetConnectFn(func(ctx context.Context, id peer.ID) error {
+			return n.host.Connect(ctx, n.host.Peerstore().PeerInfo(id))
+		})
 		n.host.Network().Notify(&network.NotifyBundle{
 			ConnectedF: func(nw network.Network, conn network.Conn) {
 				var (
@@ -121,7 +138,9 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 				if !added {
 					log.Info("Close connection as AddPeer fail", "peer", remotePeerId)
 					conn.Close()
+					return
 				}
+				n.tagSyncPeer(remotePeerId, shards)
 			},
 			DisconnectedF: func(nw network.Network, conn network.Conn) {
 				if len(n.host.Peerstore().Addrs(conn.RemotePeer())) == 0 {
@@ -129,6 +148,9 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 					return
 				}
 				n.syncCl.RemovePeer(conn.RemotePeer())
+				if n.connMgr != nil {
+					n.connMgr.UntagPeer(conn.RemotePeer(), syncPeerTag)
+				}
 			},
 		})
 
@@ -145,15 +167,22 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 			added := n.syncCl.AddPeer(conn.RemotePeer(), shards, conn.Stat().Direction)
 			if !added {
 				conn.Close()
+				continue
 			}
+			n.tagSyncPeer(conn.RemotePeer(), shards)
 		}
 		go n.syncCl.ReportPeerSummary()
-		n.syncSrv = protocol.NewSyncServer(rollupCfg, storageManager, m)
+		n.staticPeers = NewStaticPeers(n.host, n.syncCl, n.connMgr, db, log.New("p2p", "static-peers"))
+		n.syncSrv = protocol.NewSyncServer(rollupCfg, storageManager, setup.SyncServerParams(), m)
+		// the blobs found corrupt when serving the peers are synced again
+		n.syncSrv.SetCorruptHandler(n.syncCl.HealCorrupt)
 
 		blobByRangeHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "blobs_by_range"), n.syncSrv.HandleGetBlobsByRangeRequest)
 		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+		n.host.SetStreamHandler(protocol.GetCompressedProtocolID(protocol.RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
 		blobByListHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "blobs_by_list"), n.syncSrv.HandleGetBlobsByListRequest)
 		n.host.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
+		n.host.SetStreamHandler(protocol.GetCompressedProtocolID(protocol.RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
 		requestShardListHandler := protocol.MakeStreamHandler(resourcesCtx, log.New("serve", "get_shard_list"), n.syncSrv.HandleRequestShardList)
 		n.host.SetStreamHandler(protocol.RequestShardList, requestShardListHandler)
 
@@ -165,6 +194,15 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 		if err != nil {
 			return fmt.Errorf("failed to start gossipsub router: %w", err)
 		}
+		contracts := make([]common.Address, 0)
+		for contract := range ethstorage.Shards() {
+			contracts = append(contracts, contract)
+		}
+		n.announcer, err = protocol.NewBlobAnnouncer(n.gs, n.host, rollupCfg.L2ChainID, contracts, n.syncCl,
+			protocol.DefaultAnnounceInterval, log.New("p2p", "announce"))
+		if err != nil {
+			return fmt.Errorf("failed to start blob announcer: %w", err)
+		}
 
 		log.Info("Started p2p host", "addrs", n.host.Addrs(), "peerID", n.host.ID().String(), "targetPeers", setup.TargetPeers())
 
@@ -186,8 +224,21 @@ func (n *NodeP2P) init(resourcesCtx context.Context, rollupCfg *rollup.EsConfig,
 	return nil
 }
 
-func (n *NodeP2P) RequestL2Range(ctx context.Context, start, end uint64) (uint64, error) {
-	return n.syncCl.RequestL2Range(start, end)
+// tagSyncPeer tags a peer accepted by the sync client in the connection manager, weighted by the number of
+// shards it serves, so that the connection manager prefers to keep it when trimming excess connections.
+func (n *NodeP2P) tagSyncPeer(id peer.ID, shards map[common.Address][]uint64) {
+	if n.connMgr == nil {
+		return
+	}
+	count := 0
+	for _, ids := range shards {
+		count += len(ids)
+	}
+	n.connMgr.TagPeer(id, syncPeerTag, syncPeerTagBase+count*syncPeerTagPerShard)
+}
+
+func (n *NodeP2P) RequestL2Range(ctx context.Context, contract common.Address, start, end uint64) (uint64, error) {
+	return n.syncCl.RequestL2Range(contract, start, end)
 }
 
 // RequestShardList fetches shard list from remote peer
@@ -233,9 +284,21 @@ func (n *NodeP2P) ConnectionManager() connmgr.ConnManager {
 	return n.connMgr
 }
 
+func (n *NodeP2P) SyncClient() *protocol.SyncClient {
+	return n.syncCl
+}
+
+// StaticPeers returns the peers added manually, which is nil if the p2p is disabled.
+func (n *NodeP2P) StaticPeers() *StaticPeers {
+	return n.staticPeers
+}
+
 func (n *NodeP2P) Start() error {
 	if n.syncCl != nil {
-		return n.syncCl.Start()
+		if err := n.syncCl.Start(); err != nil {
+			return err
+		}
+		go n.staticPeers.Reconnect(context.Background())
 	}
 	return nil
 }
@@ -250,6 +313,9 @@ func (n *NodeP2P) Close() error {
 	// 		result = multierror.Append(result, fmt.Errorf("failed to close gossip cleanly: %w", err))
 	// 	}
 	// }
+	if n.announcer != nil {
+		n.announcer.Close()
+	}
 	if n.host != nil {
 		if err := n.host.Close(); err != nil {
 			result = multierror.Append(result, fmt.Errorf("failed to close p2p host cleanly: %w", err))
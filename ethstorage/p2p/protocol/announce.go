@@ -0,0 +1,300 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/golang/snappy"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DefaultAnnounceInterval is the interval the newly written blobs are announced at.
+	DefaultAnnounceInterval = time.Second
+	// announcedBlobTTL is how long an announced blob is remembered, so it is not announced again.
+	announcedBlobTTL = 5 * time.Minute
+	// maxAnnouncementsPerFlush bounds the announcements published at an interval, the rest of the
+	// blobs are announced at the next intervals.
+	maxAnnouncementsPerFlush = 16
+	maxAnnouncementSize      = 1024
+	// maxAnnouncedConnects bounds the announcing peers connected at a time, the announcements of other
+	// peers not connected are dropped meanwhile.
+	maxAnnouncedConnects = 4
+)
+
+// BlobAnnouncement tells the peers that the blobs of the contract from First to Last (exclusive) are newly
+// written by the peer, so it can serve them now.
+type BlobAnnouncement struct {
+	Contract common.Address
+	Peer     peer.ID
+	First    uint64
+	Last     uint64
+}
+
+// BlobsTopic returns the gossip topic of the blob announcements of the contract.
+func BlobsTopic(l2ChainID *big.Int, contract common.Address) string {
+	return fmt.Sprintf("/ethstorage/%s/blobs/%s/1", l2ChainID.String(), strings.ToLower(contract.Hex()))
+}
+
+// BlobsTopicPattern returns the regular expression of the blob announcement topics of all contracts.
+func BlobsTopicPattern(l2ChainID *big.Int) string {
+	return fmt.Sprintf("/ethstorage/%s/blobs/0x[0-9a-f]{40}/1", l2ChainID.String())
+}
+
+// BlobAnnouncer publishes the blobs written by the sync client to the blob topics of their contracts, and
+// passes the announcements of the other peers to the sync client, so it connects the new providers of
+// the blobs and retries the blobs the announcing peer lacked before. The announcements are published at
+// most once an interval, with the blobs merged into ranges and the blobs announced recently skipped.
+type BlobAnnouncer struct {
+	host     host.Host
+	syncCl   *SyncClient
+	interval time.Duration
+	log      log.Logger
+	topics   map[common.Address]*pubsub.Topic
+
+	lock       sync.Mutex
+	pending    map[common.Address][]uint64
+	announced  map[common.Address]map[uint64]time.Time
+	connecting map[peer.ID]struct{} // the announcing peers being connected
+
+	resCtx    context.Context
+	resCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewBlobAnnouncer joins the blob topics of the contracts, and starts to publish the blobs written by
+// the sync client and handle the announcements of the other peers until it is closed. The sync client
+// may be nil for a node only serving the blobs, which ignores the announcements.
+func NewBlobAnnouncer(ps *pubsub.PubSub, h host.Host, l2ChainID *big.Int, contracts []common.Address, syncCl *SyncClient,
+	interval time.Duration, log log.Logger) (*BlobAnnouncer, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &BlobAnnouncer{
+		host:       h,
+		syncCl:     syncCl,
+		interval:   interval,
+		log:        log,
+		topics:     make(map[common.Address]*pubsub.Topic),
+		pending:    make(map[common.Address][]uint64),
+		announced:  make(map[common.Address]map[uint64]time.Time),
+		connecting: make(map[peer.ID]struct{}),
+		resCtx:     ctx,
+		resCancel:  cancel,
+	}
+	subs := make([]*pubsub.Subscription, 0, len(contracts))
+	for _, contract := range contracts {
+		name := BlobsTopic(l2ChainID, contract)
+		if err := ps.RegisterTopicValidator(name, a.validator(contract)); err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to register validator of topic %s: %w", name, err)
+		}
+		topic, err := ps.Join(name)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to join topic %s: %w", name, err)
+		}
+		a.topics[contract] = topic
+		sub, err := topic.Subscribe()
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to subscribe topic %s: %w", name, err)
+		}
+		subs = append(subs, sub)
+	}
+
+	for _, sub := range subs {
+		a.wg.Add(1)
+		go a.readLoop(sub)
+	}
+	a.wg.Add(1)
+	go a.publishLoop()
+	if syncCl != nil {
+		syncCl.setAnnouncer(a)
+	}
+	return a, nil
+}
+
+// Announce queues the blobs written to be announced at the next interval.
+func (a *BlobAnnouncer) Announce(contract common.Address, kvIndices []uint64) {
+	if _, ok := a.topics[contract]; !ok || len(kvIndices) == 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pending[contract] = append(a.pending[contract], kvIndices...)
+}
+
+func (a *BlobAnnouncer) Close() {
+	a.resCancel()
+	a.wg.Wait()
+	for _, topic := range a.topics {
+		topic.Close()
+	}
+}
+
+func (a *BlobAnnouncer) publishLoop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.resCtx.Done():
+			return
+		}
+	}
+}
+
+// flush publishes the pending blobs which are not announced recently, merged into ranges.
+func (a *BlobAnnouncer) flush() {
+	now := time.Now()
+	a.lock.Lock()
+	anns := make([]*BlobAnnouncement, 0)
+	rest := make(map[common.Address][]uint64)
+	for contract, indexes := range a.pending {
+		announced, ok := a.announced[contract]
+		if !ok {
+			announced = make(map[uint64]time.Time)
+			a.announced[contract] = announced
+		}
+		for idx, tm := range announced {
+			if now.Sub(tm) > announcedBlobTTL {
+				delete(announced, idx)
+			}
+		}
+		slices.Sort(indexes)
+		indexes = slices.Compact(indexes)
+		for i, idx := range indexes {
+			if _, ok := announced[idx]; ok {
+				continue
+			}
+			if last := len(anns) - 1; last >= 0 && anns[last].Contract == contract && anns[last].Last == idx {
+				anns[last].Last++
+			} else if len(anns) < maxAnnouncementsPerFlush {
+				anns = append(anns, &BlobAnnouncement{Contract: contract, Peer: a.host.ID(), First: idx, Last: idx + 1})
+			} else {
+				rest[contract] = indexes[i:]
+				break
+			}
+			announced[idx] = now
+		}
+	}
+	a.pending = rest
+	a.lock.Unlock()
+
+	for _, ann := range anns {
+		data, err := rlp.EncodeToBytes(ann)
+		if err != nil {
+			a.log.Error("Failed to encode blob announcement", "err", err)
+			continue
+		}
+		if err := a.topics[ann.Contract].Publish(a.resCtx, snappy.Encode(nil, data)); err != nil {
+			a.log.Warn("Failed to publish blob announcement", "contract", ann.Contract, "first", ann.First,
+				"last", ann.Last, "err", err)
+			continue
+		}
+		a.log.Debug("Announced blobs", "contract", ann.Contract, "first", ann.First, "last", ann.Last)
+	}
+}
+
+func (a *BlobAnnouncer) readLoop(sub *pubsub.Subscription) {
+	defer a.wg.Done()
+	defer sub.Cancel()
+
+	for {
+		msg, err := sub.Next(a.resCtx)
+		if err != nil {
+			return
+		}
+		ann, ok := msg.ValidatorData.(*BlobAnnouncement)
+		if !ok || ann.Peer == a.host.ID() || a.syncCl == nil {
+			continue
+		}
+		if a.host.Network().Connectedness(ann.Peer) != network.Connected {
+			// a new provider of the blobs, which is added to the sync client once connected
+			if info := a.host.Peerstore().PeerInfo(ann.Peer); len(info.Addrs) > 0 {
+				a.connect(info)
+			}
+			continue
+		}
+		a.syncCl.OnBlobAnnouncement(ann.Peer, ann.Contract, ann.First, ann.Last)
+	}
+}
+
+// connect connects the announcing peer in the background, unless the peer is being connected already or
+// maxAnnouncedConnects peers are being connected.
+func (a *BlobAnnouncer) connect(info peer.AddrInfo) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.connecting[info.ID]; ok || len(a.connecting) >= maxAnnouncedConnects {
+		return
+	}
+	a.connecting[info.ID] = struct{}{}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		ctx, cancel := context.WithTimeout(a.resCtx, NewStreamTimeout)
+		defer cancel()
+		if err := a.host.Connect(ctx, info); err != nil {
+			a.log.Debug("Failed to connect announcing peer", "peer", info.ID, "err", err)
+		}
+		a.lock.Lock()
+		delete(a.connecting, info.ID)
+		a.lock.Unlock()
+	}()
+}
+
+// validator decodes the announcements, and rejects the ones which are malformed, of another contract, or
+// published by a peer other than the one announced.
+func (a *BlobAnnouncer) validator(contract common.Address) pubsub.ValidatorEx {
+	return func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		ann, err := decodeBlobAnnouncement(msg.GetData())
+		if err != nil || ann.Contract != contract {
+			a.log.Debug("Reject blob announcement", "from", from, "err", err)
+			return pubsub.ValidationReject
+		}
+		if ann.Peer != msg.GetFrom() {
+			a.log.Debug("Reject blob announcement of another peer", "from", from, "publisher", msg.GetFrom(), "peer", ann.Peer)
+			return pubsub.ValidationReject
+		}
+		msg.ValidatorData = ann
+		return pubsub.ValidationAccept
+	}
+}
+
+func decodeBlobAnnouncement(data []byte) (*BlobAnnouncement, error) {
+	if n, err := snappy.DecodedLen(data); err != nil || n > maxAnnouncementSize {
+		return nil, errors.New("invalid announcement size")
+	}
+	dec, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	var ann BlobAnnouncement
+	if err := rlp.DecodeBytes(dec, &ann); err != nil {
+		return nil, err
+	}
+	if ann.First >= ann.Last {
+		return nil, fmt.Errorf("invalid range [%d, %d)", ann.First, ann.Last)
+	}
+	if err := ann.Peer.Validate(); err != nil {
+		return nil, errors.New("invalid peer")
+	}
+	return &ann, nil
+}
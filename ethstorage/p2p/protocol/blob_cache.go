@@ -0,0 +1,70 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"math"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+type blobCacheKey struct {
+	contract common.Address
+	kvIdx    uint64
+}
+
+// blobCache keeps the encoded blobs recently served by the SyncServer, so the blobs requested by many
+// peers at the same time are read from the disk once. It is bounded by the total size of the cached
+// blobs instead of their count, the oldest blobs are evicted first.
+type blobCache struct {
+	mu      sync.Mutex
+	lru     *simplelru.LRU[blobCacheKey, *BlobPayload]
+	size    int64
+	maxSize int64
+}
+
+func newBlobCache(maxSize int64) *blobCache {
+	c := &blobCache{maxSize: maxSize}
+	c.lru, _ = simplelru.NewLRU[blobCacheKey, *BlobPayload](math.MaxInt32, func(_ blobCacheKey, b *BlobPayload) {
+		c.size -= int64(len(b.EncodedBlob))
+	})
+	return c
+}
+
+// get returns the cached blob of the kv, nil if it is not cached.
+func (c *blobCache) get(contract common.Address, kvIdx uint64) *BlobPayload {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, _ := c.lru.Get(blobCacheKey{contract, kvIdx})
+	return b
+}
+
+// add caches the blob, replacing the blob cached for the same kv.
+func (c *blobCache) add(contract common.Address, blob *BlobPayload) {
+	size := int64(len(blob.EncodedBlob))
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := blobCacheKey{contract, blob.BlobIndex}
+	c.lru.Remove(key)
+	c.lru.Add(key, blob)
+	c.size += size
+	for c.size > c.maxSize {
+		c.lru.RemoveOldest()
+	}
+}
+
+// remove drops the blob cached for the kv, if any.
+func (c *blobCache) remove(contract common.Address, kvIdx uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Remove(blobCacheKey{contract, kvIdx})
+}
@@ -0,0 +1,165 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// l1HealBatchSize is the max number of blobs of a task downloaded from L1 in one round.
+const l1HealBatchSize = 16
+
+// L1BlobSource downloads the blob of a kv from L1, e.g. from the blob sidecars kept by a beacon node.
+type L1BlobSource interface {
+	// BlobByKvIndex returns the blob of the kv of the contract whose commit in the contract is commit.
+	BlobByKvIndex(ctx context.Context, contract common.Address, kvIdx uint64, commit common.Hash) ([]byte, error)
+}
+
+// kvKey identifies a kv among the kvs of all the contracts synced.
+type kvKey struct {
+	contract common.Address
+	kvIdx    uint64
+}
+
+// SetL1BlobSource sets the source to download the blobs staying in the heal tasks for L1HealTimeout from,
+// as no peer may have them. Without it, or with L1HealTimeout 0, the blobs are only healed from the peers.
+func (s *SyncClient) SetL1BlobSource(src L1BlobSource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.l1BlobSource = src
+}
+
+// healFromL1Loop periodically downloads the blobs stuck in the heal tasks from L1.
+func (s *SyncClient) healFromL1Loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(max(s.syncerParams.L1HealTimeout/2, time.Millisecond*100))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.resCtx.Done():
+			return
+		}
+		s.lock.Lock()
+		done := s.syncDone
+		s.lock.Unlock()
+		if done {
+			return
+		}
+		s.healFromL1()
+	}
+}
+
+// healFromL1 downloads the blobs which have been in the heal tasks for L1HealTimeout from the L1 blob source,
+// and writes the ones matching their commits in the contract.
+func (s *SyncClient) healFromL1() {
+	s.lock.Lock()
+	src := s.l1BlobSource
+	if src == nil {
+		s.lock.Unlock()
+		return
+	}
+	var (
+		now   = time.Now()
+		stuck = make(map[*task][]uint64)
+		seen  = make(map[kvKey]struct{})
+	)
+	for _, t := range s.tasks {
+		for idx := range t.healTask.Indexes {
+			key := kvKey{t.Contract, idx}
+			seen[key] = struct{}{}
+			since, ok := s.healSince[key]
+			if !ok {
+				s.healSince[key] = now
+				continue
+			}
+			if now.Sub(since) >= s.syncerParams.L1HealTimeout && len(stuck[t]) < l1HealBatchSize {
+				stuck[t] = append(stuck[t], idx)
+			}
+		}
+	}
+	// forget the blobs healed by the peers in the meantime
+	for key := range s.healSince {
+		if _, ok := seen[key]; !ok {
+			delete(s.healSince, key)
+		}
+	}
+	s.lock.Unlock()
+
+	for t, indexes := range stuck {
+		s.healTaskFromL1(t, src, indexes)
+	}
+	if len(stuck) > 0 {
+		s.notifyUpdate()
+	}
+}
+
+func (s *SyncClient) healTaskFromL1(t *task, src L1BlobSource, indexes []uint64) {
+	sm := s.storage(t.Contract)
+	metas, err := sm.GetKvMetas(indexes)
+	if err != nil {
+		s.log.Warn("Get blob metadata to heal from L1 failed", "shardId", t.ShardId, "err", err)
+		return
+	}
+	var (
+		indices      = make([]uint64, 0, len(indexes))
+		decodedBlobs = make([][]byte, 0, len(indexes))
+		commits      = make([]common.Hash, 0, len(indexes))
+	)
+	for i, idx := range indexes {
+		var commit common.Hash
+		copy(commit[:ethstorage.HashSizeInContract], metas[i][32-ethstorage.HashSizeInContract:])
+		blob, err := src.BlobByKvIndex(s.resCtx, t.Contract, idx, commit)
+		if err != nil {
+			s.log.Warn("Download blob from L1 failed", "kvIdx", idx, "err", err)
+			continue
+		}
+		root, err := s.prover.GetRoot(blob, 0, 0)
+		if err != nil {
+			s.log.Warn("Get root of blob from L1 failed", "kvIdx", idx, "err", err)
+			continue
+		}
+		if !bytes.Equal(root[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]) {
+			s.log.Warn("Blob from L1 mismatch with contract", "kvIdx", idx,
+				"root", common.Bytes2Hex(root[:ethstorage.HashSizeInContract]),
+				"contract", common.Bytes2Hex(commit[:ethstorage.HashSizeInContract]))
+			continue
+		}
+		indices = append(indices, idx)
+		decodedBlobs = append(decodedBlobs, blob)
+		commits = append(commits, commit)
+	}
+	if len(indices) == 0 {
+		return
+	}
+
+	// the blobs failed to commit stay in the heal task, so they are retried in the next round
+	inserted, _, err := s.commitBlobs(sm, indices, decodedBlobs, commits)
+	if err != nil {
+		s.log.Error("Commit blobs from L1 failed", "shardId", t.ShardId, "err", err)
+		return
+	}
+	s.log.Info("Healed blobs from L1", "shardId", t.ShardId, "count", len(inserted))
+	s.announceBlobs(t.Contract, inserted)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blobsSynced += uint64(len(inserted))
+	s.syncedBytes += common.StorageSize(uint64(len(inserted)) * sm.MaxKvSize())
+	for _, idx := range inserted {
+		delete(s.healSince, kvKey{t.Contract, idx})
+	}
+	t.healTask.remove(inserted)
+	t.meter.mark(uint64(len(inserted)), time.Now())
+	s.metrics.ClientSetShardHealCount(t.Contract, t.ShardId, t.healTask.count())
+	if len(inserted) > 0 {
+		s.saveTask(t)
+	}
+}
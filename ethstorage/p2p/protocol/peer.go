@@ -5,8 +5,10 @@ package protocol
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
@@ -14,6 +16,25 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+const (
+	maxPeerScore = 100
+	minPeerScore = -100
+	// a peer with a score below peerScoreThreshold gets no requests until its score recovers
+	peerScoreThreshold = -30
+	// a penalized peer regains one point of score per peerScoreRecoveryInterval
+	peerScoreRecoveryInterval = 10 * time.Second
+
+	peerScoreDelivered   = 1   // a response with blobs written to storage
+	peerScoreTimeout     = -5  // a request failed or timed out
+	peerScoreMalformed   = -10 // a response which does not match the request
+	peerScoreInvalidBlob = -20 // a blob which fails to decode or to match its commit
+)
+
+var (
+	errRequestTimeout  = errors.New("request timed out")
+	errRequestCanceled = errors.New("request canceled")
+)
+
 // Peer is a collection of relevant information we have about a `storage` peer.
 type Peer struct {
 	id          peer.ID // Unique ID for the peer, cached
@@ -25,6 +46,19 @@ type Peer struct {
 	resCtx      context.Context
 	resCancel   context.CancelFunc
 	logger      log.Logger // Contextual logger with the peer id injected
+
+	// the blob bytes per second of the recent range responses, and the number of blobs of the next
+	// range requested from the peer, protected by the lock of SyncClient
+	throughput float64
+	rangeSize  uint64
+
+	// requestTimeout bounds a request from opening the stream to reading the response,
+	// 0 means only the timeouts of the stream apply
+	requestTimeout time.Duration
+
+	// reputation of the peer and the time it was last updated, protected by the lock of SyncClient
+	score     int
+	scoreTime time.Time
 }
 
 // NewPeer create a wrapper for a network connection and negotiated  protocol version.
@@ -88,23 +122,17 @@ func (p *Peer) Log() log.Logger {
 // RequestBlobsByRange fetches a batch of kvs using a list of kv index
 func (p *Peer) RequestBlobsByRange(id uint64, contract common.Address, shardId uint64, origin uint64, limit uint64, maxReqestSize uint64,
 	blobs *BlobsByRangePacket) (byte, error) {
+	return p.RequestBlobsByRangeCtx(context.Background(), id, contract, shardId, origin, limit, maxReqestSize, blobs)
+}
+
+// RequestBlobsByRangeCtx fetches a range of kvs like RequestBlobsByRange, and gives up the request with
+// clientTimeout once the context is done.
+func (p *Peer) RequestBlobsByRangeCtx(ctx context.Context, id uint64, contract common.Address, shardId uint64, origin uint64,
+	limit uint64, maxReqestSize uint64, blobs *BlobsByRangePacket) (byte, error) {
 	p.logger.Trace("Fetching KVs", "reqId", id, "contract", contract,
 		"shardId", shardId, "origin", origin, "limit", limit)
 
-	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
-	defer cancel()
-
-	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestBlobsByRangeProtocolID, p.chainId))
-	if err != nil {
-		return clientError, err
-	}
-	defer func() {
-		if stream != nil {
-			stream.Close()
-		}
-	}()
-
-	return SendRPC(stream, &GetBlobsByRangePacket{
+	return p.sendRequest(ctx, RequestBlobsByRangeProtocolID, &GetBlobsByRangePacket{
 		ID:       id,
 		Contract: contract,
 		ShardId:  shardId,
@@ -120,20 +148,7 @@ func (p *Peer) RequestBlobsByList(id uint64, contract common.Address, shardId ui
 	p.logger.Trace("Fetching KVs", "reqId", id, "contract", contract,
 		"shardId", shardId, "count", len(kvList))
 
-	ctx, cancel := context.WithTimeout(p.resCtx, NewStreamTimeout)
-	defer cancel()
-
-	stream, err := p.newStreamFn(ctx, p.id, GetProtocolID(RequestBlobsByListProtocolID, p.chainId))
-	if err != nil {
-		return clientError, err
-	}
-	defer func() {
-		if stream != nil {
-			stream.Close()
-		}
-	}()
-
-	return SendRPC(stream, &GetBlobsByListPacket{
+	return p.sendRequest(context.Background(), RequestBlobsByListProtocolID, &GetBlobsByListPacket{
 		ID:       id,
 		Contract: contract,
 		ShardId:  shardId,
@@ -141,3 +156,63 @@ func (p *Peer) RequestBlobsByList(id uint64, contract common.Address, shardId ui
 		Bytes:    maxReqestSize,
 	}, blobs)
 }
+
+// sendRequest opens a stream of the protocol to the peer and sends the request over it. If the request
+// timeout of the peer expires or the context is done first, the stream is reset and clientTimeout is returned.
+func (p *Peer) sendRequest(callerCtx context.Context, protocolId string, req interface{}, resp interface{}) (byte, error) {
+	reqCtx, reqCancel := context.WithCancel(p.resCtx)
+	defer reqCancel()
+	stopCaller := context.AfterFunc(callerCtx, reqCancel)
+	defer stopCaller()
+	if p.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		reqCtx, cancelTimeout = context.WithTimeout(reqCtx, p.requestTimeout)
+		defer cancelTimeout()
+	}
+
+	ctx, cancel := context.WithTimeout(reqCtx, NewStreamTimeout)
+	defer cancel()
+
+	// prefer the compressed variant of the protocol, the peers which do not support it fall back to the plain one
+	stream, err := p.newStreamFn(ctx, p.id, GetCompressedProtocolID(protocolId, p.chainId), GetProtocolID(protocolId, p.chainId))
+	if err != nil {
+		if errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+			return clientTimeout, fmt.Errorf("%w: %v", errRequestTimeout, err)
+		}
+		if callerCtx.Err() != nil {
+			return clientTimeout, fmt.Errorf("%w: %v", errRequestCanceled, err)
+		}
+		return clientError, err
+	}
+	defer stream.Close()
+	// unblock the reads and writes on the stream once the request times out
+	stop := context.AfterFunc(reqCtx, func() { stream.Reset() })
+	defer stop()
+
+	returnCode, err := SendRPC(stream, req, resp)
+	if err != nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+		return clientTimeout, fmt.Errorf("%w after %v: %v", errRequestTimeout, p.requestTimeout, err)
+	}
+	if err != nil && callerCtx.Err() != nil {
+		return clientTimeout, fmt.Errorf("%w: %v", errRequestCanceled, err)
+	}
+	return returnCode, err
+}
+
+// Score returns the reputation of the peer at the given time, including the recovery of a
+// negative score since it was last updated.
+func (p *Peer) Score(now time.Time) int {
+	if p.score >= 0 {
+		return p.score
+	}
+	recovered := int(now.Sub(p.scoreTime) / peerScoreRecoveryInterval)
+	return min(p.score+recovered, 0)
+}
+
+// updateScore adds delta to the reputation of the peer and returns the new score.
+func (p *Peer) updateScore(delta int) int {
+	now := time.Now()
+	p.score = min(max(p.Score(now)+delta, minPeerScore), maxPeerScore)
+	p.scoreTime = now
+	return p.score
+}
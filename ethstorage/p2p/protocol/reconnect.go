@@ -0,0 +1,97 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DefaultReconnectBackoff is the delay before the first dial to reconnect a peer.
+	DefaultReconnectBackoff = time.Second * 2
+	// DefaultReconnectMaxBackoff caps the delay between the dials to reconnect a peer.
+	DefaultReconnectMaxBackoff = time.Minute * 2
+)
+
+// SetConnectFn sets the function to dial a peer, which is used to reconnect the peers serving the shards
+// still being synced once they disconnect. Without it, or with ReconnectAttempts 0, the peers are not
+// reconnected.
+func (s *SyncClient) SetConnectFn(fn func(ctx context.Context, id peer.ID) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connectFn = fn
+}
+
+// scheduleReconnect starts to reconnect the disconnected peer if its shards are needed and it is not being
+// reconnected yet. The caller must hold s.lock.
+func (s *SyncClient) scheduleReconnect(pr *Peer) {
+	if s.connectFn == nil || s.syncerParams.ReconnectAttempts <= 0 || s.closingPeers || s.syncDone {
+		return
+	}
+	if _, ok := s.reconnecting[pr.id]; ok || !s.needThisPeer(pr.shards) {
+		return
+	}
+	s.reconnecting[pr.id] = struct{}{}
+	s.wg.Add(1)
+	go s.reconnect(pr.id, s.connectFn)
+}
+
+// reconnect dials the peer until it connects or ReconnectAttempts dials failed, waiting a backoff before
+// each dial. Once connected, the peer is added back by the connection notifications like a new peer.
+func (s *SyncClient) reconnect(id peer.ID, connect func(ctx context.Context, id peer.ID) error) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.reconnecting, id)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+	for attempt := 1; attempt <= s.syncerParams.ReconnectAttempts; attempt++ {
+		select {
+		case <-time.After(s.reconnectBackoff(attempt)):
+		case <-s.resCtx.Done():
+			return
+		}
+		s.lock.Lock()
+		_, added := s.peers[id]
+		s.lock.Unlock()
+		if added {
+			// connected again by other means, e.g. the peer dialed in
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.resCtx, NewStreamTimeout)
+		err := connect(ctx, id)
+		cancel()
+		if err == nil {
+			s.log.Info("Peer reconnected", "peer", id, "attempt", attempt)
+			return
+		}
+		s.log.Debug("Reconnect peer failed", "peer", id, "attempt", attempt, "err", err)
+	}
+	s.log.Info("Give up reconnecting peer", "peer", id, "attempts", s.syncerParams.ReconnectAttempts)
+}
+
+// reconnectBackoff returns the delay before the dial of the attempt, which doubles with each attempt up to
+// ReconnectMaxBackoff, with a random jitter of up to half of it, so the peers dropped at once are not
+// dialed at once.
+func (s *SyncClient) reconnectBackoff(attempt int) time.Duration {
+	base, maxBackoff := s.syncerParams.ReconnectBackoff, s.syncerParams.ReconnectMaxBackoff
+	if base <= 0 {
+		base = DefaultReconnectBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultReconnectMaxBackoff
+	}
+	d := base
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,360 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+// Package selftest runs the sync protocol between a sync server and a sync client on in-memory storage,
+// and verifies the blobs synced, as a smoke test of a full sync cycle.
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
+	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const blobFillingMask = byte(0b10000000)
+
+// Config is the layout of the storage synced by Run.
+type Config struct {
+	KvSize     uint64
+	ChunkSize  uint64
+	KvEntries  uint64
+	KvCount    uint64 // kvs with data, the rest of the shard is filled with empty blobs
+	EncodeType uint64
+	Timeout    time.Duration
+}
+
+// Result reports the time taken by each step of Run.
+type Result struct {
+	Blobs    uint64
+	Generate time.Duration
+	Sync     time.Duration
+	Verify   time.Duration
+}
+
+var contract = common.HexToAddress("0x0000000000000000000000000000000003330e2e")
+
+// Run runs RunOnHosts on two in-memory hosts.
+func Run(ctx context.Context, cfg *Config, lg log.Logger) (*Result, error) {
+	mn := mocknet.New()
+	defer mn.Close()
+	localHost, err := mn.GenPeer()
+	if err != nil {
+		return nil, err
+	}
+	remoteHost, err := mn.GenPeer()
+	if err != nil {
+		return nil, err
+	}
+	if err := mn.LinkAll(); err != nil {
+		return nil, err
+	}
+	return RunOnHosts(ctx, cfg, localHost, remoteHost, lg)
+}
+
+// RunOnHosts generates the blobs of a shard, serves them with a SyncServer on the remote host, syncs them to
+// an in-memory shard with a SyncClient on the local host, and verifies every blob synced. An error is returned
+// if the local host fails to connect to the remote one, the sync does not finish within the timeout or any
+// blob mismatches.
+func RunOnHosts(ctx context.Context, cfg *Config, localHost, remoteHost host.Host, lg log.Logger) (*Result, error) {
+	if cfg.KvCount > cfg.KvEntries {
+		return nil, fmt.Errorf("kv count %d exceeds kv entries %d", cfg.KvCount, cfg.KvEntries)
+	}
+	var (
+		res       = &Result{Blobs: cfg.KvCount}
+		shards    = []uint64{0}
+		rollupCfg = &rollup.EsConfig{L2ChainID: new(big.Int).SetUint64(3333)}
+		start     = time.Now()
+	)
+	sm := ethstorage.NewShardManager(contract, cfg.KvSize, cfg.KvEntries, cfg.ChunkSize)
+	sm.AddDataShard(0)
+	df, err := ethstorage.CreateWithBackend(ethstorage.NewMemBackend("e2e-shard-0"), 0, cfg.KvEntries*cfg.KvSize/cfg.ChunkSize,
+		0, cfg.KvSize, cfg.EncodeType, common.Address{}, cfg.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.AddDataFile(df); err != nil {
+		return nil, err
+	}
+	ethstorage.ContractToShardManager[contract] = sm
+	defer func() {
+		sm.Close()
+		delete(ethstorage.ContractToShardManager, contract)
+	}()
+
+	blobs, metas, err := generateBlobs(sm, prv.NewKZGProver(lg), cfg)
+	if err != nil {
+		return nil, err
+	}
+	res.Generate = time.Since(start)
+	lg.Info("Blobs generated", "blobs", cfg.KvCount, "time", res.Generate)
+
+	sctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	reader := &memStorageReader{
+		kvEntries:  cfg.KvEntries,
+		maxKvSize:  cfg.KvSize,
+		encodeType: cfg.EncodeType,
+		shards:     shards,
+		blobs:      blobs,
+	}
+	serveSyncOnHost(sctx, remoteHost, rollupCfg, reader, metrics.NoopMetrics, lg)
+
+	storageManager := ethstorage.NewStorageManager(sm, &memL1Source{lastKvIdx: cfg.KvCount, metas: metas})
+	storageManager.Reset(0)
+	mux := new(event.Feed)
+	doneCh := make(chan protocol.EthStorageSyncDone, 16)
+	sub := mux.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+	params := &protocol.SyncerParams{MaxPeers: 30, MaxRequestSize: uint64(4 * 1024 * 1024), SyncConcurrency: 16,
+		FillEmptyConcurrency: 16, MetaDownloadBatchSize: 16}
+	syncCl := newSyncClientOnHost(localHost, lg, rollupCfg, rawdb.NewMemoryDatabase(), storageManager, params,
+		metrics.NoopMetrics, mux)
+	shardList := protocol.ConvertToContractShards(map[common.Address][]uint64{contract: shards})
+	localHost.Peerstore().Put(remoteHost.ID(), protocol.EthStorageENRKey, shardList)
+	remoteHost.Peerstore().Put(localHost.ID(), protocol.EthStorageENRKey, shardList)
+
+	start = time.Now()
+	if err := syncCl.Start(); err != nil {
+		return nil, err
+	}
+	defer syncCl.Close()
+	if err := localHost.Connect(sctx, peer.AddrInfo{ID: remoteHost.ID(), Addrs: remoteHost.Addrs()}); err != nil {
+		return nil, err
+	}
+	for done := false; !done; {
+		select {
+		case ev := <-doneCh:
+			done = ev.DoneType == protocol.AllShardDone
+		case <-sctx.Done():
+			return nil, fmt.Errorf("sync not done: %w", sctx.Err())
+		}
+	}
+	res.Sync = time.Since(start)
+	lg.Info("Blobs synced", "blobs", cfg.KvEntries, "time", res.Sync)
+
+	start = time.Now()
+	// the kvs after KvCount are generated as empty blobs, which are filled by the sync client
+	if err := verifyBlobs(sm, blobs); err != nil {
+		return nil, err
+	}
+	res.Verify = time.Since(start)
+	lg.Info("Blobs verified", "blobs", cfg.KvEntries, "time", res.Verify)
+	return res, nil
+}
+
+// newSyncClientOnHost creates a sync client on the host, which adds the peers connected to the host with
+// the shards in their peerstore records, and removes them once disconnected.
+func newSyncClientOnHost(h host.Host, lg log.Logger, rollupCfg *rollup.EsConfig, db ethdb.Database,
+	storageManager protocol.StorageManager, params *protocol.SyncerParams, metrics protocol.SyncClientMetrics, mux *event.Feed) *protocol.SyncClient {
+	syncCl := protocol.NewSyncClient(lg, rollupCfg, h.NewStream, storageManager, params, db, metrics, mux)
+	addPeer := func(conn network.Conn) {
+		shards := make(map[common.Address][]uint64)
+		css, err := h.Peerstore().Get(conn.RemotePeer(), protocol.EthStorageENRKey)
+		if err != nil {
+			lg.Warn("Get shards from peer failed", "error", err.Error())
+		} else {
+			shards = protocol.ConvertToShardList(css.([]*protocol.ContractShards))
+		}
+		added := syncCl.AddPeer(conn.RemotePeer(), shards, conn.Stat().Direction)
+		if !added {
+			conn.Close()
+		}
+	}
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(nw network.Network, conn network.Conn) {
+			addPeer(conn)
+		},
+		DisconnectedF: func(nw network.Network, conn network.Conn) {
+			syncCl.RemovePeer(conn.RemotePeer())
+		},
+	})
+	// the host may already be connected to peers, add them all to the sync client
+	for _, conn := range h.Network().Conns() {
+		addPeer(conn)
+	}
+	return syncCl
+}
+
+// serveSyncOnHost serves the blobs of the storage manager on the host with a sync server.
+func serveSyncOnHost(ctx context.Context, h host.Host, rollupCfg *rollup.EsConfig, storageManager protocol.StorageManagerReader,
+	metrics protocol.SyncServerMetrics, lg log.Logger) *protocol.SyncServer {
+	syncSrv := protocol.NewSyncServer(rollupCfg, storageManager, nil, metrics)
+	blobByRangeHandler := protocol.MakeStreamHandler(ctx, lg, syncSrv.HandleGetBlobsByRangeRequest)
+	h.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+	blobByListHandler := protocol.MakeStreamHandler(ctx, lg, syncSrv.HandleGetBlobsByListRequest)
+	h.SetStreamHandler(protocol.GetProtocolID(protocol.RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
+	return syncSrv
+}
+
+// blob is a generated blob with the data it is encoded from.
+type blob struct {
+	commit  common.Hash
+	encoded []byte
+	data    []byte
+}
+
+// memL1Source serves the metas of the generated kvs in place of the contract.
+type memL1Source struct {
+	lastKvIdx uint64
+	metas     map[uint64]common.Hash
+}
+
+func (l1 *memL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas := make([][32]byte, 0, len(kvIndices))
+	for _, idx := range kvIndices {
+		metas = append(metas, l1.metas[idx])
+	}
+	return metas, nil
+}
+
+func (l1 *memL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	return l1.lastKvIdx, nil
+}
+
+// memStorageReader serves the blobs kept in memory, like a remote peer holding the shards.
+type memStorageReader struct {
+	kvEntries  uint64
+	maxKvSize  uint64
+	encodeType uint64
+	shards     []uint64
+	blobs      map[uint64]*blob
+}
+
+func (s *memStorageReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	b, ok := s.blobs[kvIdx]
+	if !ok {
+		return nil, false, ethereum.NotFound
+	}
+	return b.encoded[:min(readLen, len(b.encoded))], true, nil
+}
+
+func (s *memStorageReader) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
+	b, ok := s.blobs[kvIdx]
+	if !ok {
+		return nil, false, ethereum.NotFound
+	}
+	return b.commit[:], true, nil
+}
+
+func (s *memStorageReader) KvEntries() uint64 {
+	return s.kvEntries
+}
+
+func (s *memStorageReader) ContractAddress() common.Address {
+	return contract
+}
+
+func (s *memStorageReader) Shards() []uint64 {
+	return s.shards
+}
+
+func (s *memStorageReader) MaxKvSize() uint64 {
+	return s.maxKvSize
+}
+
+func (s *memStorageReader) ShardKvSize(shardIdx uint64) uint64 {
+	return s.maxKvSize
+}
+
+func (s *memStorageReader) GetShardMiner(shardIdx uint64) (common.Address, bool) {
+	return common.Address{}, true
+}
+
+func (s *memStorageReader) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
+	return s.encodeType, true
+}
+
+// contractMeta returns the meta of a kv in the contract, which is the kv index, size and hash.
+func contractMeta(idx, size uint64, hash common.Hash) common.Hash {
+	meta := binary.BigEndian.AppendUint64(nil, idx)[3:]
+	meta = append(meta, binary.BigEndian.AppendUint64(nil, size)[5:]...)
+	meta = append(meta, hash[:ethstorage.HashSizeInContract]...)
+	return common.BytesToHash(meta)
+}
+
+// blobCommit returns the commit of a kv filled with the blob of the hash.
+func blobCommit(hash common.Hash) common.Hash {
+	commit := common.Hash{}
+	copy(commit[0:ethstorage.HashSizeInContract], hash[0:ethstorage.HashSizeInContract])
+	commit[ethstorage.HashSizeInContract] |= blobFillingMask
+	return commit
+}
+
+// generateBlobs generates the blobs of shard 0, with the data of the first KvCount kvs made of the contract
+// and kv index and the rest left empty, and returns them encoded by the shard manager together with the
+// metas of the kvs in the contract.
+func generateBlobs(sm *ethstorage.ShardManager, prover *prv.KZGProver, cfg *Config) (map[uint64]*blob, map[uint64]common.Hash, error) {
+	vals := make([][]byte, cfg.KvEntries)
+	for i := uint64(0); i < cfg.KvCount; i++ {
+		vals[i] = make([]byte, cfg.KvSize)
+		copy(vals[i][:20], contract.Bytes())
+		binary.BigEndian.PutUint64(vals[i][20:28], i)
+	}
+	// the roots of the empty kvs are left empty
+	roots, err := prover.GetRoots(vals, cfg.KvSize/cfg.ChunkSize, cfg.ChunkSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get roots failed: %w", err)
+	}
+	var (
+		blobs = make(map[uint64]*blob, cfg.KvEntries)
+		metas = make(map[uint64]common.Hash, cfg.KvEntries)
+	)
+	for i, val := range vals {
+		idx := uint64(i)
+		if val == nil {
+			val = make([]byte, cfg.KvSize)
+		}
+		commit := blobCommit(roots[i])
+		encoded, _, err := sm.EncodeKV(idx, val, commit, common.Address{}, cfg.EncodeType)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encode kv %d failed: %w", idx, err)
+		}
+		blobs[idx] = &blob{commit: commit, encoded: encoded, data: val}
+		metas[idx] = contractMeta(idx, cfg.KvSize, roots[i])
+	}
+	return blobs, metas, nil
+}
+
+// verifyBlobs checks the data and encoded data of the kvs in the shard manager against the generated blobs.
+func verifyBlobs(sm *ethstorage.ShardManager, blobs map[uint64]*blob) error {
+	for idx, b := range blobs {
+		data, ok, err := sm.TryRead(idx, len(b.data), b.commit)
+		if err != nil {
+			return fmt.Errorf("read kv %d failed: %w", idx, err)
+		}
+		if !ok {
+			return fmt.Errorf("read kv %d failed: shard not found", idx)
+		}
+		encoded, _, err := sm.TryReadEncoded(idx, len(b.encoded))
+		if err != nil {
+			return fmt.Errorf("read encoded kv %d failed: %w", idx, err)
+		}
+		if !bytes.Equal(b.data, data) {
+			return fmt.Errorf("data of kv %d mismatch: expected %s, got %s", idx, common.Bytes2Hex(b.data), common.Bytes2Hex(data))
+		}
+		if !bytes.Equal(b.encoded, encoded) {
+			return fmt.Errorf("encoded data of kv %d mismatch: expected %s, got %s", idx, common.Bytes2Hex(b.encoded),
+				common.Bytes2Hex(encoded))
+		}
+	}
+	return nil
+}
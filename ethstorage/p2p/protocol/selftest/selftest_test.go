@@ -0,0 +1,32 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package selftest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage"
+)
+
+// TestRun test the self test syncing a shard between in-memory hosts, it should pass with every blob verified.
+func TestRun(t *testing.T) {
+	cfg := &Config{
+		KvSize:     1 << 17,
+		ChunkSize:  1 << 17,
+		KvEntries:  16,
+		KvCount:    12,
+		EncodeType: ethstorage.ENCODE_BLOB_POSEIDON,
+		Timeout:    30 * time.Second,
+	}
+	res, err := Run(context.Background(), cfg, log.New("TestSelfTest"))
+	if err != nil {
+		t.Fatalf("self test failed: %v", err)
+	}
+	if res.Blobs != cfg.KvCount {
+		t.Fatalf("expected %d blobs, got %d", cfg.KvCount, res.Blobs)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// PlannedShard is a shard suggested by PlanShards with the number of peers advertising it.
+type PlannedShard struct {
+	ShardId   uint64
+	Providers int
+}
+
+// PlanShards suggests the shards of the contract to serve within available bytes of disk, given the shards
+// advertised by each peer. The shards with the fewest providers are picked first and a tie goes to the lower
+// shard index, so the under-served shards are covered before the replicated ones. Each shard takes
+// kvSize * kvEntries bytes, and the shards from 0 to shardCount - 1 are considered.
+func PlanShards(contract common.Address, shardCount, kvSize, kvEntries, available uint64, peers [][]*ContractShards) []PlannedShard {
+	shardSize := kvSize * kvEntries
+	if shardSize == 0 || shardCount == 0 {
+		return nil
+	}
+	providers := make([]int, shardCount)
+	for _, css := range peers {
+		for _, shardId := range ConvertToShardList(css)[contract] {
+			if shardId < shardCount {
+				providers[shardId]++
+			}
+		}
+	}
+	candidates := make([]PlannedShard, shardCount)
+	for shardId := range candidates {
+		candidates[shardId] = PlannedShard{ShardId: uint64(shardId), Providers: providers[shardId]}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Providers < candidates[j].Providers
+	})
+
+	n := available / shardSize
+	if n > shardCount {
+		n = shardCount
+	}
+	return candidates[:n]
+}
@@ -0,0 +1,47 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPlanShards(t *testing.T) {
+	const (
+		kvSize    = uint64(1 << 17)
+		kvEntries = uint64(16)
+		shardSize = kvSize * kvEntries
+	)
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330001")
+	other := common.HexToAddress("0x0000000000000000000000000000000003330002")
+	// providers: shard 0: 3, shard 1: 2, shard 2: 0, shard 3: 1, shard 4: 0 (shard 4 of the other contract is ignored)
+	peers := [][]*ContractShards{
+		{{contract, []uint64{0, 1}}},
+		{{contract, []uint64{0, 1, 3}}},
+		{{contract, []uint64{0}}, {other, []uint64{4}}},
+		{{other, []uint64{2, 4}}},
+	}
+
+	tests := []struct {
+		name      string
+		available uint64
+		want      []PlannedShard
+	}{
+		{"none fits", shardSize - 1, []PlannedShard{}},
+		{"unserved shards first", 2*shardSize + shardSize/2, []PlannedShard{{2, 0}, {4, 0}}},
+		{"then the rarest", 4 * shardSize, []PlannedShard{{2, 0}, {4, 0}, {3, 1}, {1, 2}}},
+		{"all shards", 100 * shardSize, []PlannedShard{{2, 0}, {4, 0}, {3, 1}, {1, 2}, {0, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PlanShards(contract, 5, kvSize, kvEntries, tt.available, peers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("PlanShards() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
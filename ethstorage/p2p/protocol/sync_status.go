@@ -0,0 +1,219 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package protocol
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SyncState is a snapshot of the overall sync progress.
+type SyncState struct {
+	SyncDone         bool   `json:"syncDone"`
+	PeerCount        int    `json:"peerCount"`
+	BlobsSynced      uint64 `json:"blobsSynced"`
+	SyncedBytes      uint64 `json:"syncedBytes"`
+	BlobsToSync      uint64 `json:"blobsToSync"`
+	EmptyBlobsFilled uint64 `json:"emptyBlobsFilled"`
+	EmptyBlobsToFill uint64 `json:"emptyBlobsToFill"`
+	TotalSecondsUsed uint64 `json:"totalSecondsUsed"`
+
+	Shards []ShardProgress `json:"shards"`
+}
+
+// ShardProgress is a snapshot of the sync progress of a shard. Total is the number of kvs of the shard,
+// and Completed the number of kvs synced or filled with empty blobs.
+type ShardProgress struct {
+	Contract       common.Address `json:"contract"`
+	ShardId        uint64         `json:"shardId"`
+	Completed      uint64         `json:"completed"`
+	Total          uint64         `json:"total"`
+	HealBacklog    int            `json:"healBacklog"`
+	BlobsPerSecond float64        `json:"blobsPerSecond"`
+	// ETASeconds is the estimated time to sync the remaining blobs, 0 if the shard makes no progress
+	ETASeconds uint64 `json:"etaSeconds"`
+}
+
+// SubTaskState is a snapshot of a subTask or a subEmptyTask, blobs in [First, Next) are finished.
+type SubTaskState struct {
+	First   uint64 `json:"first"`
+	Next    uint64 `json:"next"`
+	Last    uint64 `json:"last"`
+	Running bool   `json:"running"`
+}
+
+// TaskState is a snapshot of the sync task of a shard.
+type TaskState struct {
+	Contract       common.Address `json:"contract"`
+	ShardId        uint64         `json:"shardId"`
+	Done           bool           `json:"done"`
+	KvEntries      uint64         `json:"kvEntries"`
+	BlobsToSync    uint64         `json:"blobsToSync"`
+	BlobsToFill    uint64         `json:"blobsToFill"`
+	HealCount      int            `json:"healCount"`
+	PeerCount      int            `json:"peerCount"`
+	StatelessPeers int            `json:"statelessPeers"`
+	SubTasks       []SubTaskState `json:"subTasks"`
+	SubEmptyTasks  []SubTaskState `json:"subEmptyTasks"`
+}
+
+// PeerState is a snapshot of a peer used by the sync client.
+type PeerState struct {
+	ID        string                      `json:"id"`
+	Direction string                      `json:"direction"`
+	Shards    map[common.Address][]uint64 `json:"shards"`
+	Idle      bool                        `json:"idle"`
+	Pending   bool                        `json:"pending"`
+	// Stateless is the number of shards for which the peer failed to deliver data
+	Stateless int `json:"stateless"`
+}
+
+const (
+	// rateMeterInterval is the min interval between two samples of a rateMeter
+	rateMeterInterval = 5 * time.Second
+	// rateMeterAlpha is the weight of the latest sample in the moving average
+	rateMeterAlpha = 0.3
+)
+
+// rateMeter is an exponential moving average of the number of blobs synced per second.
+type rateMeter struct {
+	rate  float64
+	count uint64
+	start time.Time
+}
+
+// mark adds n blobs synced at now to the meter.
+func (m *rateMeter) mark(n uint64, now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.count += n
+	m.tick(now)
+}
+
+// tick takes a sample of the blobs counted since the last sample if the interval has passed,
+// so the rate also goes down while no blobs are synced.
+func (m *rateMeter) tick(now time.Time) {
+	elapsed := now.Sub(m.start)
+	if m.start.IsZero() || elapsed < rateMeterInterval {
+		return
+	}
+	sample := float64(m.count) / elapsed.Seconds()
+	if m.rate == 0 {
+		m.rate = sample
+	} else {
+		m.rate = rateMeterAlpha*sample + (1-rateMeterAlpha)*m.rate
+	}
+	m.count, m.start = 0, now
+}
+
+// Progress returns a snapshot of the overall sync progress and the progress of each shard.
+// It is cheap enough to be called by a metrics scraper.
+func (s *SyncClient) Progress() SyncState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := SyncState{
+		SyncDone:         s.syncDone,
+		PeerCount:        len(s.peers),
+		BlobsSynced:      s.blobsSynced,
+		SyncedBytes:      uint64(s.syncedBytes),
+		EmptyBlobsFilled: s.emptyBlobsFilled,
+		EmptyBlobsToFill: s.emptyBlobsToFill,
+		TotalSecondsUsed: s.totalSecondsUsed,
+	}
+	now := time.Now()
+	state.Shards = make([]ShardProgress, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		sp := ShardProgress{
+			Contract:    t.Contract,
+			ShardId:     t.ShardId,
+			Total:       s.storage(t.Contract).KvEntries(),
+			HealBacklog: t.healTask.count(),
+		}
+		toSync, toFill := uint64(sp.HealBacklog), uint64(0)
+		for _, st := range t.SubTasks {
+			toSync += st.Last - st.next
+		}
+		for _, et := range t.SubEmptyTasks {
+			toFill += et.Last - et.First
+		}
+		if toSync+toFill < sp.Total {
+			sp.Completed = sp.Total - toSync - toFill
+		}
+		t.meter.tick(now)
+		sp.BlobsPerSecond = t.meter.rate
+		if sp.BlobsPerSecond > 0 {
+			sp.ETASeconds = uint64(float64(toSync) / sp.BlobsPerSecond)
+		}
+		state.BlobsToSync += toSync
+		state.Shards = append(state.Shards, sp)
+	}
+	return state
+}
+
+// DumpTasks returns a snapshot of the sync tasks of all the shards.
+func (s *SyncClient) DumpTasks() []TaskState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tasks := make([]TaskState, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		ts := TaskState{
+			Contract:       t.Contract,
+			ShardId:        t.ShardId,
+			Done:           t.done,
+			KvEntries:      s.storage(t.Contract).KvEntries(),
+			HealCount:      t.healTask.count(),
+			PeerCount:      len(t.peers),
+			StatelessPeers: len(t.statelessPeers),
+			SubTasks:       make([]SubTaskState, 0, len(t.SubTasks)),
+			SubEmptyTasks:  make([]SubTaskState, 0, len(t.SubEmptyTasks)),
+		}
+		ts.BlobsToSync = uint64(ts.HealCount)
+		for _, st := range t.SubTasks {
+			ts.BlobsToSync += st.Last - st.next
+			ts.SubTasks = append(ts.SubTasks, SubTaskState{First: st.First, Next: st.next, Last: st.Last, Running: st.isRunning})
+		}
+		for _, et := range t.SubEmptyTasks {
+			ts.BlobsToFill += et.Last - et.First
+			ts.SubEmptyTasks = append(ts.SubEmptyTasks, SubTaskState{First: et.First, Next: et.First, Last: et.Last, Running: et.isRunning})
+		}
+		tasks = append(tasks, ts)
+	}
+	return tasks
+}
+
+// PeerShards returns a snapshot of the peers used by the sync client and the shards they serve.
+func (s *SyncClient) PeerShards() []PeerState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pending := make(map[string]struct{}, len(s.pendingPeers))
+	for _, id := range s.pendingPeers {
+		pending[id.String()] = struct{}{}
+	}
+	peers := make([]PeerState, 0, len(s.peers))
+	for id, p := range s.peers {
+		ps := PeerState{
+			ID:        id.String(),
+			Direction: p.direction.String(),
+			Shards:    p.Shards(),
+		}
+		_, ps.Idle = s.idlerPeers[id]
+		_, ps.Pending = pending[ps.ID]
+		for _, t := range s.tasks {
+			if _, ok := t.statelessPeers[id]; ok {
+				ps.Stateless++
+			}
+		}
+		peers = append(peers, ps)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
@@ -9,9 +9,19 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -22,21 +32,27 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethstorage/go-ethstorage/ethstorage"
 	"github.com/ethstorage/go-ethstorage/ethstorage/metrics"
 	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 	"github.com/ethstorage/go-ethstorage/ethstorage/rollup"
+	"github.com/golang/snappy"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	tu "github.com/libp2p/go-libp2p/core/test"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/blank"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
 )
 
 const (
-	defaultChunkSize     = uint64(1) << 17
-	defaultEncodeType    = ethstorage.ENCODE_BLOB_POSEIDON
-	blobEmptyFillingMask = byte(0b10000000)
-	metafileName         = "metafile.dat.meta"
+	defaultChunkSize  = uint64(1) << 17
+	defaultEncodeType = ethstorage.ENCODE_BLOB_POSEIDON
+	metafileName      = "metafile.dat.meta"
 )
 
 var (
@@ -132,7 +148,7 @@ type mockStorageManagerReader struct {
 	blobPayloads    map[uint64]*BlobPayloadWithRowData
 }
 
-func (s *mockStorageManagerReader) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
+func (s *mockStorageManagerReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
 	if blobPayload, ok := s.blobPayloads[kvIdx]; ok {
 		data := blobPayload.EncodedBlob
 		if len(data) > readLen {
@@ -168,6 +184,10 @@ func (s *mockStorageManagerReader) MaxKvSize() uint64 {
 	return s.maxKvSize
 }
 
+func (s *mockStorageManagerReader) ShardKvSize(shardIdx uint64) uint64 {
+	return s.maxKvSize
+}
+
 func (s *mockStorageManagerReader) GetShardMiner(shardIdx uint64) (common.Address, bool) {
 	return s.shardMiner, true
 }
@@ -222,14 +242,26 @@ func makeKVStorage(contract common.Address, shards []uint64, chunkSize, kvSize,
 	sm := ethstorage.ContractToShardManager[contract]
 
 	for _, sidx := range shards {
+		vals := make([][]byte, kvCount)
 		for i := sidx * kvCount; i < (sidx+1)*kvCount; i++ {
 			val := make([]byte, kvSize)
-			root := common.Hash{}
 			if i < lastKvIndex {
 				copy(val[:20], contract.Bytes())
 				binary.BigEndian.PutUint64(val[20:28], i)
-				root, _ = prover.GetRoot(val, kvSize/chunkSize, chunkSize)
+				vals[i-sidx*kvCount] = val
+			}
+		}
+		// the roots of the kvs beyond the last kv index are left empty
+		roots, err := prover.GetRoots(vals, kvSize/chunkSize, chunkSize)
+		if err != nil {
+			log.Crit("get roots failed", "error", err)
+		}
+		for i := sidx * kvCount; i < (sidx+1)*kvCount; i++ {
+			val := vals[i-sidx*kvCount]
+			if val == nil {
+				val = make([]byte, kvSize)
 			}
+			root := roots[i-sidx*kvCount]
 
 			commit := generateMetadata(root)
 			encodeData, _, _ := sm.EncodeKV(i, val, commit, miner, encodeType)
@@ -329,36 +361,16 @@ func connect(t *testing.T, a, b host.Host, as, bs map[common.Address][]uint64) {
 	}
 }
 
-func createLocalHostAndSyncClient(t *testing.T, testLog log.Logger, rollupCfg *rollup.EsConfig, db ethdb.Database,
-	storageManager StorageManager, metrics SyncClientMetrics, mux *event.Feed) (host.Host, *SyncClient) {
-	localHost := getNetHost(t)
-
-	syncCl := NewSyncClient(testLog, rollupCfg, localHost.NewStream, storageManager, &params, db, metrics, mux)
-	localHost.Network().Notify(&network.NotifyBundle{
-		ConnectedF: func(nw network.Network, conn network.Conn) {
-			shards := make(map[common.Address][]uint64)
-			css, err := localHost.Peerstore().Get(conn.RemotePeer(), EthStorageENRKey)
-			if err != nil {
-				log.Warn("Get shards from peer failed", "error", err.Error())
-			} else {
-				shards = ConvertToShardList(css.([]*ContractShards))
-			}
-
-			added := syncCl.AddPeer(conn.RemotePeer(), shards, conn.Stat().Direction)
-			if !added {
-				conn.Close()
-			}
-		},
-		DisconnectedF: func(nw network.Network, conn network.Conn) {
-			syncCl.RemovePeer(conn.RemotePeer())
-		},
-	})
-	// the host may already be connected to peers, add them all to the sync client
-	for _, conn := range localHost.Network().Conns() {
+// newSyncClientOnHost creates a sync client on the host, which adds the peers connected to the host with
+// the shards in their peerstore records, and removes them once disconnected.
+func newSyncClientOnHost(h host.Host, lg log.Logger, rollupCfg *rollup.EsConfig, db ethdb.Database,
+	storageManager StorageManager, params *SyncerParams, metrics SyncClientMetrics, mux *event.Feed) *SyncClient {
+	syncCl := NewSyncClient(lg, rollupCfg, h.NewStream, storageManager, params, db, metrics, mux)
+	addPeer := func(conn network.Conn) {
 		shards := make(map[common.Address][]uint64)
-		css, err := localHost.Peerstore().Get(conn.RemotePeer(), EthStorageENRKey)
+		css, err := h.Peerstore().Get(conn.RemotePeer(), EthStorageENRKey)
 		if err != nil {
-			log.Warn("Get shards from peer failed", "error", err.Error())
+			lg.Warn("Get shards from peer failed", "error", err.Error())
 		} else {
 			shards = ConvertToShardList(css.([]*ContractShards))
 		}
@@ -367,19 +379,42 @@ func createLocalHostAndSyncClient(t *testing.T, testLog log.Logger, rollupCfg *r
 			conn.Close()
 		}
 	}
-	return localHost, syncCl
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(nw network.Network, conn network.Conn) {
+			addPeer(conn)
+		},
+		DisconnectedF: func(nw network.Network, conn network.Conn) {
+			syncCl.RemovePeer(conn.RemotePeer())
+		},
+	})
+	// the host may already be connected to peers, add them all to the sync client
+	for _, conn := range h.Network().Conns() {
+		addPeer(conn)
+	}
+	return syncCl
+}
+
+// serveSyncOnHost serves the blobs of the storage manager on the host with a sync server.
+func serveSyncOnHost(ctx context.Context, h host.Host, rollupCfg *rollup.EsConfig, storageManager StorageManagerReader,
+	metrics SyncServerMetrics, lg log.Logger) *SyncServer {
+	syncSrv := NewSyncServer(rollupCfg, storageManager, nil, metrics)
+	blobByRangeHandler := MakeStreamHandler(ctx, lg, syncSrv.HandleGetBlobsByRangeRequest)
+	h.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
+	blobByListHandler := MakeStreamHandler(ctx, lg, syncSrv.HandleGetBlobsByListRequest)
+	h.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
+	return syncSrv
+}
+
+func createLocalHostAndSyncClient(t *testing.T, testLog log.Logger, rollupCfg *rollup.EsConfig, db ethdb.Database,
+	storageManager StorageManager, metrics SyncClientMetrics, mux *event.Feed) (host.Host, *SyncClient) {
+	localHost := getNetHost(t)
+	return localHost, newSyncClientOnHost(localHost, testLog, rollupCfg, db, storageManager, &params, metrics, mux)
 }
 
 func createRemoteHost(t *testing.T, ctx context.Context, rollupCfg *rollup.EsConfig,
 	storageManager *mockStorageManagerReader, metrics SyncServerMetrics, testLog log.Logger) host.Host {
-
 	remoteHost := getNetHost(t)
-	syncSrv := NewSyncServer(rollupCfg, storageManager, metrics)
-	blobByRangeHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest)
-	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), blobByRangeHandler)
-	blobByListHandler := MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest)
-	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), blobByListHandler)
-
+	serveSyncOnHost(ctx, remoteHost, rollupCfg, storageManager, metrics, testLog)
 	return remoteHost
 }
 
@@ -568,7 +603,7 @@ func TestSync_RequestL2Range(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 	// send request
-	_, err = syncCl.RequestL2Range(0, 16)
+	_, err = syncCl.RequestL2Range(contract, 0, 16)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -644,7 +679,7 @@ func TestSync_RequestL2List(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 	// send request
-	_, err = syncCl.RequestL2List(indexes)
+	_, err = syncCl.RequestL2List(contract, indexes)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -699,7 +734,6 @@ func TestSaveAndLoadSyncStatus(t *testing.T) {
 	syncCl.tasks = make([]*task, 0)
 	syncCl.totalSecondsUsed = 0
 	syncCl.loadSyncStatus()
-	tasks[0].healTask.Indexes = make(map[uint64]int64)
 	tasks[0].SubTasks[0].First = 5
 	tasks[0].SubTasks[0].next = 5
 	tasks[1].done = false
@@ -711,6 +745,90 @@ func TestSaveAndLoadSyncStatus(t *testing.T) {
 	}
 }
 
+// TestPersistAndReloadSyncTasks test tasks persisted by a sync client are reloaded by a new sync client
+// after restart, and reconciled with the last kv index which moved during the restart.
+func TestPersistAndReloadSyncTasks(t *testing.T) {
+	var (
+		entries     = uint64(1) << 10
+		kvSize      = defaultChunkSize
+		lastKvIndex = entries + 100
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries*2))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0, 1}, defaultChunkSize, kvSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	// sync part of the first subTask with blob 3 and 9 missing, and finish the second subTask
+	syncCl.tasks[0].healTask.insert([]uint64{3, 9})
+	syncCl.tasks[0].SubTasks[0].next = 16
+	syncCl.tasks[0].SubTasks[1].done = true
+	syncCl.cleanTasks()
+	// blob 3 is fetched by the heal task
+	syncCl.lock.Lock()
+	syncCl.tasks[0].healTask.remove([]uint64{3})
+	syncCl.saveTask(syncCl.tasks[0])
+	syncCl.lock.Unlock()
+
+	// a new sync client loads the tasks written without a forced saveSyncStatus
+	_, reloaded := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	reloaded.loadSyncStatus()
+	tasks := syncCl.tasks
+	tasks[0].SubTasks[0].next = tasks[0].SubTasks[0].First
+	if err := compareTasks(tasks, reloaded.tasks); err != nil {
+		t.Fatalf("compare kv task fail. err: %s", err.Error())
+	}
+	if _, ok := reloaded.tasks[0].healTask.Indexes[9]; !ok || reloaded.tasks[0].healTask.count() != 1 {
+		t.Fatalf("heal indexes mismatch, expected [9], got %v", reloaded.tasks[0].healTask.Indexes)
+	}
+
+	// blobs are uploaded while the node is down, the new range must be synced instead of filled with empty blobs
+	l1.lastBlobIndex = entries + 200
+	sm.Reset(0)
+	_, reloaded = createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	reloaded.loadSyncStatus()
+	task1 := reloaded.tasks[1]
+	synced, empty := uint64(0), uint64(0)
+	for _, st := range task1.SubTasks {
+		if st.Last > l1.lastBlobIndex {
+			t.Fatalf("subTask [%d, %d) exceeds last kv index %d", st.First, st.Last, l1.lastBlobIndex)
+		}
+		synced += st.Last - st.First
+	}
+	for _, st := range task1.SubEmptyTasks {
+		if st.First < l1.lastBlobIndex {
+			t.Fatalf("subEmptyTask [%d, %d) below last kv index %d", st.First, st.Last, l1.lastBlobIndex)
+		}
+		empty += st.Last - st.First
+	}
+	if synced != 200 || empty != entries-200 {
+		t.Fatalf("reconcile task fail, synced %d, empty %d", synced, empty)
+	}
+	if reloaded.emptyBlobsToFill != entries-200 {
+		t.Fatalf("emptyBlobsToFill mismatch, expected %d, got %d", entries-200, reloaded.emptyBlobsToFill)
+	}
+}
+
 // TestReadWrite tests a basic eth storage read/write
 func TestReadWrite(t *testing.T) {
 	var (
@@ -1196,6 +1314,88 @@ func TestAddPeerAfterSyncDone(t *testing.T) {
 	}
 }
 
+// TestHealCorruptAfterSyncDone test a blob found corrupt after the sync is done is synced again, with the
+// sync resumed.
+func TestHealCorruptAfterSyncDone(t *testing.T) {
+	var (
+		kvSize       = defaultChunkSize
+		kvEntries    = uint64(16)
+		lastKvIndex  = uint64(16)
+		corrupt      = uint64(3)
+		db           = rawdb.NewMemoryDatabase()
+		ctx, cancel  = context.WithCancel(context.Background())
+		mux          = new(event.Feed)
+		shards       = []uint64{0}
+		shardMap     = map[common.Address][]uint64{contract: shards}
+		excludedList = make(map[uint64]struct{})
+		m            = metrics.NewMetrics("sync_test")
+		rollupCfg    = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 3, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done")
+	}
+	verifyKVs(data, excludedList, t)
+
+	// the chunk of the blob is overwritten on disk
+	chunkIdx := corrupt * kvSize / defaultChunkSize
+	if err := shardManager.ShardMap()[0].GetStorageFile(chunkIdx).Write(chunkIdx, make([]byte, defaultChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if encoded, _, _ := shardManager.TryReadEncoded(corrupt, int(kvSize)); bytes.Equal(encoded, data[contract][corrupt].EncodedBlob) {
+		t.Fatalf("expected blob %d to be corrupt", corrupt)
+	}
+	if !syncCl.HealCorrupt(contract, &ethstorage.ChunkCorruptError{KvIdx: corrupt, ChunkIdx: chunkIdx}) {
+		t.Fatalf("expected the corrupt error to be healed")
+	}
+	checkStall(t, 3, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done again after the corrupt blob is healed")
+	}
+	verifyKVs(data, excludedList, t)
+}
+
 func TestFillEmpty(t *testing.T) {
 	var (
 		kvSize      = defaultChunkSize
@@ -1252,3 +1452,2784 @@ func TestFillEmpty(t *testing.T) {
 		t.Fatalf("emptyBlobsFilled is wrong, expect %d, value %d", kvEntries-lastKvIndex, syncCl.emptyBlobsFilled)
 	}
 }
+
+// syncWithEmptyFill syncs a shard whose kvs from lastKvIndex are beyond the last kv index into a sparse data
+// file with the empty fill policy, and returns the shard manager and the disk blocks taken by the data file.
+func syncWithEmptyFill(t *testing.T, policy EmptyFillPolicy, kvEntries, lastKvIndex uint64) (*ethstorage.ShardManager, int64) {
+	var (
+		kvSize      = defaultChunkSize
+		dir         = t.TempDir()
+		fileName    = filepath.Join(dir, "shard0.dat")
+		metaName    = filepath.Join(dir, "metafile.dat.meta")
+		ctx, cancel = context.WithCancel(context.Background())
+		db          = rawdb.NewMemoryDatabase()
+		mux         = new(event.Feed)
+		shardMap    = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metaName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafile fail", err)
+	}
+	defer metafile.Close()
+
+	shardManager := ethstorage.NewShardManager(contract, kvSize, kvEntries, defaultChunkSize)
+	ethstorage.ContractToShardManager[contract] = shardManager
+	shardManager.AddDataShard(0)
+	df, err := ethstorage.CreateSparse(fileName, 0, kvEntries, 0, kvSize, defaultEncodeType, common.Address{}, defaultChunkSize)
+	if err != nil {
+		t.Fatal("Create data file fail", err)
+	}
+	t.Cleanup(func() { df.Close() })
+	shardManager.AddDataFile(df)
+
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	l1 := NewMockL1Source(lastKvIndex, metaName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+
+	syncerParams := params
+	syncerParams.EmptyFillPolicy = policy
+	localHost := getNetHost(t)
+	syncCl := newSyncClientOnHost(localHost, testLog, rollupCfg, db, sm, &syncerParams, m, mux)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync with %s empty fill should be done", policy)
+	}
+
+	synced := make(map[uint64]*BlobPayloadWithRowData)
+	for idx := uint64(0); idx < lastKvIndex; idx++ {
+		synced[idx] = data[contract][idx]
+	}
+	verifyKVs(map[common.Address]map[uint64]*BlobPayloadWithRowData{contract: synced}, nil, t)
+
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shardManager, fi.Sys().(*syscall.Stat_t).Blocks
+}
+
+// TestEmptyFillPolicy tests that the lazy empty fill leaves the tail of a shard unwritten, taking less disk
+// than the eager one, while the kvs of the tail are read as empty blobs with either policy.
+func TestEmptyFillPolicy(t *testing.T) {
+	var (
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(6)
+	)
+	eager, eagerBlocks := syncWithEmptyFill(t, EmptyFillEager, kvEntries, lastKvIndex)
+	eagerMetas := make(map[uint64][]byte)
+	for idx := lastKvIndex; idx < kvEntries; idx++ {
+		meta, _, err := eager.TryReadMeta(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta[ethstorage.HashSizeInContract]&blobEmptyFillingMask == 0 {
+			t.Fatalf("meta of kv %d filled eagerly should have the empty filling mask: %x", idx, meta)
+		}
+		eagerMetas[idx] = meta
+	}
+	lazy, lazyBlocks := syncWithEmptyFill(t, EmptyFillLazy, kvEntries, lastKvIndex)
+	if lazyBlocks >= eagerBlocks {
+		t.Fatalf("lazy empty fill should take less disk, lazy %d blocks, eager %d blocks", lazyBlocks, eagerBlocks)
+	}
+
+	for idx := lastKvIndex; idx < kvEntries; idx++ {
+		for policy, sm := range map[EmptyFillPolicy]*ethstorage.ShardManager{EmptyFillEager: eager, EmptyFillLazy: lazy} {
+			blob, found, err := sm.TryRead(idx, int(defaultChunkSize), common.Hash{})
+			if err != nil || !found {
+				t.Fatalf("TryRead kv %d with %s empty fill failed, found %v: %v", idx, policy, found, err)
+			}
+			if !bytes.Equal(blob, make([]byte, defaultChunkSize)) {
+				t.Fatalf("kv %d with %s empty fill should be read as an empty blob", idx, policy)
+			}
+		}
+		meta, _, err := lazy.TryReadMeta(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(meta, make([]byte, len(eagerMetas[idx]))) {
+			t.Fatalf("meta of kv %d left by the lazy empty fill should be empty: %x", idx, meta)
+		}
+	}
+}
+
+// TestAddPeerWithJoinRate tests that peers beyond the join rate are queued and onboarded at the configured pace.
+func TestAddPeerWithJoinRate(t *testing.T) {
+	var (
+		entries     = uint64(16)
+		lastKvIndex = entries
+		db          = rawdb.NewMemoryDatabase()
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards = map[common.Address][]uint64{contract: {0}}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries))
+	if err != nil {
+		t.Error("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, defaultChunkSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	p := params
+	p.PeerJoinRate = 5
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &p, db, metrics.NoopMetrics, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	ids := []peer.ID{tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)}
+	for _, id := range ids {
+		if !syncCl.AddPeer(id, shards, network.DirOutbound) {
+			t.Fatalf("add peer %s failed", id)
+		}
+	}
+	syncCl.RemovePeer(ids[2])
+	if len(syncCl.idlerPeers) != 0 || len(syncCl.pendingPeers) != 2 {
+		t.Fatalf("expected 2 pending peers and no idle peer, got pending %d, idle %d", len(syncCl.pendingPeers), len(syncCl.idlerPeers))
+	}
+
+	syncCl.wg.Add(1)
+	go syncCl.onboardPeers()
+	defer syncCl.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	syncCl.lock.Lock()
+	idle := len(syncCl.idlerPeers)
+	syncCl.lock.Unlock()
+	if idle != 1 {
+		t.Fatalf("expected 1 onboarded peer at first, got %d", idle)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	syncCl.lock.Lock()
+	idle, pending := len(syncCl.idlerPeers), len(syncCl.pendingPeers)
+	syncCl.lock.Unlock()
+	if idle != 2 || pending != 0 {
+		t.Fatalf("expected all peers onboarded, got idle %d, pending %d", idle, pending)
+	}
+}
+
+// TestSyncServerThrottleFloodingPeer floods the server with requests from one peer and checks
+// the peer is told to slow down while another peer is still served.
+func TestSyncServerThrottleFloodingPeer(t *testing.T) {
+	params := &SyncServerParams{
+		GlobalRequestRate:  100,
+		GlobalRequestBurst: 100,
+		PeerRequestRate:    0.1,
+		PeerRequestBurst:   3,
+		MaxPeerStreams:     2,
+	}
+	srv := NewSyncServer(nil, nil, params, nil)
+	ctx := context.Background()
+	flooder, other := peer.ID("flooder"), peer.ID("other")
+
+	// requests in flight are capped per peer
+	var releases []func(uint64)
+	for i := 0; i < params.MaxPeerStreams; i++ {
+		release, err := srv.limitPeer(ctx, flooder)
+		if err != nil {
+			t.Fatalf("request %d should be served: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := srv.limitPeer(ctx, flooder); !errors.Is(err, errThrottled) {
+		t.Fatalf("expected too many streams to be throttled, got %v", err)
+	}
+	for _, release := range releases {
+		release(0)
+	}
+
+	// the last token of the burst is served, after that the peer is throttled instead of waiting
+	release, err := srv.limitPeer(ctx, flooder)
+	if err != nil {
+		t.Fatalf("request within burst should be served: %v", err)
+	}
+	release(0)
+	for i := 0; i < 10; i++ {
+		if _, err := srv.limitPeer(ctx, flooder); !errors.Is(err, errThrottled) {
+			t.Fatalf("expected flooding request %d to be throttled, got %v", i, err)
+		}
+	}
+
+	release, err = srv.limitPeer(ctx, other)
+	if err != nil {
+		t.Fatalf("other peer should not be affected: %v", err)
+	}
+	release(0)
+}
+
+// TestSyncServerThrottlePeerBytes serves a large response to one peer and checks the following
+// requests of the peer are throttled until its bytes budget recovers, while a second peer is unaffected.
+func TestSyncServerThrottlePeerBytes(t *testing.T) {
+	params := &SyncServerParams{
+		GlobalRequestRate:  100,
+		GlobalRequestBurst: 100,
+		PeerRequestRate:    100,
+		PeerRequestBurst:   100,
+		PeerBytesRate:      1024,
+		PeerBytesBurst:     16 * 1024,
+	}
+	srv := NewSyncServer(nil, nil, params, nil)
+	ctx := context.Background()
+	greedy, other := peer.ID("greedy"), peer.ID("other")
+
+	// spend the whole bytes burst, then run 8 seconds worth of bytes into debt
+	release, err := srv.limitPeer(ctx, greedy)
+	if err != nil {
+		t.Fatalf("first request should be served: %v", err)
+	}
+	release(uint64(params.PeerBytesBurst))
+	release, err = srv.limitPeer(ctx, greedy)
+	if err != nil {
+		t.Fatalf("request within the bytes burst should be served: %v", err)
+	}
+	release(8 * 1024)
+	for i := 0; i < 5; i++ {
+		if _, err := srv.limitPeer(ctx, greedy); !errors.Is(err, errThrottled) {
+			t.Fatalf("expected request %d over the bytes budget to be throttled, got %v", i, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		release, err = srv.limitPeer(ctx, other)
+		if err != nil {
+			t.Fatalf("other peer should not be affected: %v", err)
+		}
+		release(1024)
+	}
+}
+
+// TestSyncServerThrottleGlobalBytes serves a range of incompressible blobs with a low global bytes cap and
+// checks the response takes at least the time the cap allows for it.
+func TestSyncServerThrottleGlobalBytes(t *testing.T) {
+	var (
+		kvSize    = defaultChunkSize
+		kvEntries = uint64(16)
+		blobs     = uint64(4)
+		rollupCfg = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payloads := make(map[uint64]*BlobPayloadWithRowData)
+	for i := uint64(0); i < blobs; i++ {
+		blob := make([]byte, kvSize)
+		rand.Read(blob)
+		payloads[i] = &BlobPayloadWithRowData{BlobIndex: i, EncodeType: defaultEncodeType, EncodedBlob: blob}
+	}
+	reader := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		blobPayloads:    payloads,
+	}
+	params := DefaultSyncServerParams()
+	params.GlobalBytesRate = 256 * 1024
+	params.GlobalBytesBurst = 32 * 1024
+	syncSrv := NewSyncServer(rollupCfg, reader, params, nil)
+	remoteHost := getNetHost(t)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest))
+	localHost := getNetHost(t)
+	shards := map[common.Address][]uint64{contract: {0}}
+	connect(t, localHost, remoteHost, shards, shards)
+
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound, nil)
+	var res BlobsByRangePacket
+	start := time.Now()
+	code, err := pr.RequestBlobsByRange(1, contract, 0, 0, blobs-1, blobs*kvSize, &res)
+	elapsed := time.Since(start)
+	if err != nil || code != returnCodeSuccess {
+		t.Fatalf("request failed, code %d, error %v", code, err)
+	}
+	if uint64(len(res.Blobs)) != blobs {
+		t.Fatalf("expected %d blobs, got %d", blobs, len(res.Blobs))
+	}
+	minElapsed := time.Duration(float64(blobs*kvSize-uint64(params.GlobalBytesBurst)) / params.GlobalBytesRate * float64(time.Second))
+	if elapsed < minElapsed {
+		t.Fatalf("expected serving %d bytes to take at least %v, took %v", blobs*kvSize, minElapsed, elapsed)
+	}
+}
+
+// TestPeerReputation test a peer delivering tampered blobs is penalized and gets no more requests,
+// while a healthy peer delivering valid blobs keeps receiving work.
+func TestPeerReputation(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal(err)
+	}
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	shards := map[common.Address][]uint64{contract: {0}}
+	flaky, healthy := peer.ID("flaky-remote-peer"), peer.ID("healthy-remote-peer")
+	for _, id := range []peer.ID{flaky, healthy} {
+		if !syncCl.AddPeer(id, shards, network.DirOutbound) {
+			t.Fatalf("add peer %s failed", id)
+		}
+	}
+	st := syncCl.tasks[0].SubTasks[0]
+	respond := func(id peer.ID, blobs []*BlobPayload) {
+		req := &blobsByRangeRequest{peer: id, contract: contract, origin: 0, limit: kvEntries - 1, subTask: st}
+		syncCl.OnBlobsByRange(&blobsByRangeResponse{req: req, Blobs: blobs, time: time.Now()})
+	}
+
+	// the flaky peer returns tampered blobs
+	tampered := make([]*BlobPayload, 0)
+	for i := uint64(0); i < 2; i++ {
+		d := data[contract][i]
+		blob := make([]byte, len(d.EncodedBlob))
+		copy(blob, d.EncodedBlob)
+		blob[100] ^= 0xff
+		tampered = append(tampered, &BlobPayload{MinerAddress: d.MinerAddress, BlobIndex: d.BlobIndex,
+			BlobCommit: d.BlobCommit, EncodeType: d.EncodeType, EncodedBlob: blob})
+	}
+	respond(flaky, tampered)
+	if score := syncCl.PeerScores()[flaky]; score >= peerScoreThreshold {
+		t.Fatalf("flaky peer should be below the threshold, score %d", score)
+	}
+
+	// the healthy peer returns valid blobs
+	valid := make([]*BlobPayload, 0)
+	for i := uint64(0); i < 2; i++ {
+		d := data[contract][i]
+		valid = append(valid, &BlobPayload{MinerAddress: d.MinerAddress, BlobIndex: d.BlobIndex,
+			BlobCommit: d.BlobCommit, EncodeType: d.EncodeType, EncodedBlob: d.EncodedBlob})
+	}
+	respond(healthy, valid)
+	if score := syncCl.PeerScores()[healthy]; score != peerScoreDelivered {
+		t.Fatalf("healthy peer score mismatch, expected %d, got %d", peerScoreDelivered, score)
+	}
+
+	// only the score keeps the flaky peer from the task, not its stateless mark
+	syncCl.lock.Lock()
+	delete(syncCl.tasks[0].statelessPeers, flaky)
+	for i := 0; i < 10; i++ {
+		if pr := syncCl.getIdlePeerForTask(syncCl.tasks[0]); pr == nil || pr.ID() != healthy {
+			t.Fatalf("expected healthy peer to receive the work, got %v", pr)
+		}
+	}
+	// once the score of the flaky peer recovers it gets work again
+	delete(syncCl.idlerPeers, healthy)
+	syncCl.peers[flaky].scoreTime = time.Now().Add(-peerScoreRecoveryInterval * maxPeerScore)
+	pr := syncCl.getIdlePeerForTask(syncCl.tasks[0])
+	syncCl.lock.Unlock()
+	if pr == nil || pr.ID() != flaky {
+		t.Fatalf("expected recovered flaky peer to receive the work, got %v", pr)
+	}
+}
+
+// TestRejectTamperedBlobs test a blob whose commit matches the tampered data but not the contract is
+// rejected and requested again from another peer.
+func TestRejectTamperedBlobs(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		kvIdx       = uint64(3)
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal(err)
+	}
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	shards := map[common.Address][]uint64{contract: {0}}
+	malicious, honest := peer.ID("malicious-remote-peer"), peer.ID("honest-remote-peer")
+	for _, id := range []peer.ID{malicious, honest} {
+		if !syncCl.AddPeer(id, shards, network.DirOutbound) {
+			t.Fatalf("add peer %s failed", id)
+		}
+	}
+	shardTask := syncCl.tasks[0]
+	shardTask.healTask.insert([]uint64{kvIdx})
+	respond := func(id peer.ID, payload *BlobPayload) {
+		syncCl.lock.Lock()
+		shardTask.healTask.refresh([]uint64{kvIdx})
+		syncCl.lock.Unlock()
+		req := &blobsByListRequest{peer: id, contract: contract, indexes: []uint64{kvIdx}, healTask: shardTask.healTask}
+		syncCl.OnBlobsByList(&blobsByListResponse{req: req, Blobs: []*BlobPayload{payload}, time: time.Now()})
+	}
+
+	// the malicious peer tampers the blob and sends the commit of the tampered data
+	expected := data[contract][kvIdx]
+	val := make([]byte, len(expected.RowData))
+	copy(val, expected.RowData)
+	// keep the first byte of the field element so the tampered blob is still valid
+	val[1] ^= 0xff
+	root, err := prover.GetRoot(val, kvSize/defaultChunkSize, defaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := generateMetadata(root)
+	encoded, _, err := shardManager.EncodeKV(kvIdx, val, commit, common.Address{}, defaultEncodeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respond(malicious, &BlobPayload{BlobIndex: kvIdx, BlobCommit: commit, EncodeType: defaultEncodeType, EncodedBlob: encoded})
+
+	meta, _, err := sm.TryReadMeta(kvIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(meta[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]) {
+		t.Fatalf("tampered blob should not be written")
+	}
+	if score := syncCl.PeerScores()[malicious]; score >= 0 {
+		t.Fatalf("malicious peer should be penalized, score %d", score)
+	}
+	syncCl.lock.Lock()
+	indexes := shardTask.healTask.getBlobIndexesForRequest(16)
+	pr := syncCl.getIdlePeerForTask(shardTask)
+	syncCl.lock.Unlock()
+	if len(indexes) != 1 || indexes[0] != kvIdx {
+		t.Fatalf("tampered blob should be requested again at once, got %v", indexes)
+	}
+	if pr == nil || pr.ID() != honest {
+		t.Fatalf("expected the honest peer to receive the request, got %v", pr)
+	}
+
+	// the honest peer delivers the blob
+	respond(honest, &BlobPayload{MinerAddress: expected.MinerAddress, BlobIndex: kvIdx, BlobCommit: expected.BlobCommit,
+		EncodeType: expected.EncodeType, EncodedBlob: expected.EncodedBlob})
+	if shardTask.healTask.count() != 0 {
+		t.Fatalf("blob should be removed from heal task after delivery")
+	}
+	blob, _, err := sm.TryRead(kvIdx, len(expected.RowData), expected.BlobCommit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blob, expected.RowData) {
+		t.Fatalf("synced blob mismatch")
+	}
+}
+
+// TestSyncPartialRangeResponse test a range response from a peer lacking a few blobs of the range, the
+// blobs returned should be written and the skipped ones should land in the heal task, while the blobs
+// after the last one returned are left to the next range request.
+func TestSyncPartialRangeResponse(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		lastServed  = uint64(11)
+		excluded    = map[uint64]struct{}{2: {}, 5: {}, 9: {}}
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal(err)
+	}
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	remote := peer.ID("partial-remote-peer")
+	if !syncCl.AddPeer(remote, map[common.Address][]uint64{contract: {0}}, network.DirOutbound) {
+		t.Fatalf("add peer failed")
+	}
+	st := syncCl.tasks[0].SubTasks[0]
+	blobs := make([]*BlobPayload, 0)
+	for idx := st.next; idx <= lastServed; idx++ {
+		if _, ok := excluded[idx]; ok {
+			continue
+		}
+		b := data[contract][idx]
+		blobs = append(blobs, &BlobPayload{MinerAddress: b.MinerAddress, BlobIndex: idx, BlobCommit: b.BlobCommit,
+			EncodeType: b.EncodeType, EncodedBlob: b.EncodedBlob})
+	}
+	req := &blobsByRangeRequest{peer: remote, contract: contract, origin: st.next, limit: st.Last - 1, subTask: st}
+	syncCl.OnBlobsByRange(&blobsByRangeResponse{req: req, Blobs: blobs, time: time.Now()})
+
+	syncCl.lock.Lock()
+	healed := make(map[uint64]struct{})
+	for idx := range syncCl.tasks[0].healTask.Indexes {
+		healed[idx] = struct{}{}
+	}
+	next, done := st.next, st.done
+	syncCl.lock.Unlock()
+	if !reflect.DeepEqual(healed, excluded) {
+		t.Fatalf("expected the excluded blobs %v in heal task, got %v", excluded, healed)
+	}
+	if next != lastServed+1 || done {
+		t.Fatalf("expected next %d and not done, got next %d, done %v", lastServed+1, next, done)
+	}
+	for idx := uint64(0); idx < lastKvIndex; idx++ {
+		meta, _, err := sm.TryReadMeta(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, skipped := excluded[idx]
+		commit := data[contract][idx].BlobCommit
+		if written := bytes.Equal(meta[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]); written != (idx <= lastServed && !skipped) {
+			t.Fatalf("blob %d written %v", idx, written)
+		}
+	}
+}
+
+// concurrencyCounter counts the requests being served by remote peers, a request is done once
+// the server starts writing its response.
+type concurrencyCounter struct {
+	lock     sync.Mutex
+	inFlight int
+	max      int
+}
+
+type countedStream struct {
+	network.Stream
+	once sync.Once
+	done func()
+}
+
+func (s *countedStream) Write(b []byte) (int, error) {
+	s.once.Do(s.done)
+	return s.Stream.Write(b)
+}
+
+func (c *concurrencyCounter) wrap(fn requestHandlerFn) requestHandlerFn {
+	return func(ctx context.Context, log log.Logger, stream network.Stream) {
+		c.lock.Lock()
+		c.inFlight++
+		if c.inFlight > c.max {
+			c.max = c.inFlight
+		}
+		c.lock.Unlock()
+		cs := &countedStream{Stream: stream, done: func() {
+			c.lock.Lock()
+			c.inFlight--
+			c.lock.Unlock()
+		}}
+		defer cs.once.Do(cs.done)
+		// hold the request a little, so concurrent requests would overlap
+		time.Sleep(20 * time.Millisecond)
+		fn(ctx, log, cs)
+	}
+}
+
+// TestSyncWithMaxConcurrentRequests test sync from three remote peers with MaxConcurrentRequests set to 1,
+// it should be sync done while the remote peers never serve more than one request at the same time.
+func TestSyncWithMaxConcurrentRequests(t *testing.T) {
+	var (
+		kvSize        = defaultChunkSize
+		kvEntries     = uint64(64)
+		lastKvIndex   = uint64(64)
+		db            = rawdb.NewMemoryDatabase()
+		ctx, cancel   = context.WithCancel(context.Background())
+		mux           = new(event.Feed)
+		localShardMap = map[common.Address][]uint64{contract: {0}}
+		m             = metrics.NewMetrics("sync_test")
+		counter       = &concurrencyCounter{}
+		rollupCfg     = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncParams := params
+	syncParams.MaxConcurrentRequests = 1
+	syncCl.syncerParams = &syncParams
+	syncCl.Start()
+
+	for i := 0; i < 3; i++ {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		}
+		remoteHost := getNetHost(t)
+		syncSrv := NewSyncServer(rollupCfg, smr, nil, m)
+		remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+			MakeStreamHandler(ctx, testLog, counter.wrap(syncSrv.HandleGetBlobsByRangeRequest)))
+		remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID),
+			MakeStreamHandler(ctx, testLog, counter.wrap(syncSrv.HandleGetBlobsByListRequest)))
+		connect(t, localHost, remoteHost, localShardMap, localShardMap)
+	}
+
+	checkStall(t, 6, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done, peer count %d", len(syncCl.peers))
+	}
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	if counter.max != 1 {
+		t.Fatalf("expected requests to be served one at a time, max in flight %d", counter.max)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestHealBeforeRangeOverBacklog test heal indexes injected in the middle of a sync are requested
+// before the next range of the task once the heal backlog threshold is exceeded.
+func TestHealBeforeRangeOverBacklog(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		requested   = make(chan protocol.ID, 16)
+		remote      = peer.ID("remote-sync-peer")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	// record the requests instead of sending them
+	newStream := func(ctx context.Context, peerId peer.ID, protocolId ...protocol.ID) (network.Stream, error) {
+		requested <- protocolId[0]
+		return nil, errors.New("no stream in test")
+	}
+	syncParams := params
+	syncParams.HealBacklogThreshold = 2
+	syncCl := NewSyncClient(testLog, rollupCfg, newStream, sm, &syncParams, db, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+	if !syncCl.AddPeer(remote, map[common.Address][]uint64{contract: {0}}, network.DirOutbound) {
+		t.Fatalf("add peer failed")
+	}
+	rangeProtocol := GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID)
+	listProtocol := GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID)
+	assign := func() protocol.ID {
+		syncCl.assignBlobRangeTasks()
+		syncCl.assignBlobHealTasks()
+		select {
+		case id := <-requested:
+			// wait for the failed request to return the peer
+			for i := 0; i < 100; i++ {
+				syncCl.lock.Lock()
+				_, idle := syncCl.idlerPeers[remote]
+				running := syncCl.runningRequests
+				syncCl.lock.Unlock()
+				if idle && running == 0 {
+					return id
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Fatalf("peer is not returned after request")
+		case <-time.After(time.Second):
+			t.Fatalf("no request sent")
+		}
+		return ""
+	}
+
+	if id := assign(); id != rangeProtocol {
+		t.Fatalf("expected a range request, got %s", id)
+	}
+	// a backlog within the threshold does not hold back the ranges
+	syncCl.lock.Lock()
+	syncCl.tasks[0].healTask.insert([]uint64{40, 41})
+	syncCl.lock.Unlock()
+	if id := assign(); id != rangeProtocol {
+		t.Fatalf("expected a range request, got %s", id)
+	}
+	// once the threshold is exceeded, the heal indexes are requested first
+	syncCl.lock.Lock()
+	syncCl.tasks[0].healTask.insert([]uint64{42})
+	syncCl.lock.Unlock()
+	if id := assign(); id != listProtocol {
+		t.Fatalf("expected a heal request before the next range, got %s", id)
+	}
+	select {
+	case id := <-requested:
+		t.Fatalf("unexpected request %s", id)
+	default:
+	}
+}
+
+// shardRecordingReader records the shards of the blobs read by a remote peer in the order of reading.
+type shardRecordingReader struct {
+	*mockStorageManagerReader
+	lock   sync.Mutex
+	shards []uint64
+}
+
+func (r *shardRecordingReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	r.lock.Lock()
+	r.shards = append(r.shards, kvIdx/r.kvEntries)
+	r.lock.Unlock()
+	return r.mockStorageManagerReader.TryReadEncodedCtx(ctx, kvIdx, readLen)
+}
+
+// TestSyncShardsInterleaved test sync two shards from one remote peer serving both, the requests
+// should alternate between the shards instead of draining the first shard before the second one.
+func TestSyncShardsInterleaved(t *testing.T) {
+	var (
+		kvSize        = defaultChunkSize
+		kvEntries     = uint64(64)
+		lastKvIndex   = uint64(128)
+		shards        = []uint64{0, 1}
+		db            = rawdb.NewMemoryDatabase()
+		ctx, cancel   = context.WithCancel(context.Background())
+		mux           = new(event.Feed)
+		localShardMap = map[common.Address][]uint64{contract: shards}
+		m             = metrics.NewMetrics("sync_test")
+		rollupCfg     = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries)*int64(len(shards)))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+
+	doneCh := make(chan EthStorageSyncDone, 16)
+	sub := mux.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+
+	reader := &shardRecordingReader{mockStorageManagerReader: &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}}
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, reader, nil, m)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest))
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest))
+	connect(t, localHost, remoteHost, localShardMap, localShardMap)
+
+	shardsDone := make(map[uint64]struct{})
+	for allDone := false; !allDone; {
+		select {
+		case ev := <-doneCh:
+			if ev.DoneType == SingleShardDone {
+				shardsDone[ev.ShardId] = struct{}{}
+			} else if ev.DoneType == AllShardDone {
+				if len(shardsDone) != len(shards) {
+					t.Fatalf("all shards done before every shard is done, done shards %v", shardsDone)
+				}
+				allDone = true
+			}
+		case <-time.After(6 * time.Second):
+			t.Fatalf("sync stalled, done shards %v", shardsDone)
+		}
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+	firstOfShard1, lastOfShard0 := -1, -1
+	for i, shard := range reader.shards {
+		if shard == 1 && firstOfShard1 < 0 {
+			firstOfShard1 = i
+		}
+		if shard == 0 {
+			lastOfShard0 = i
+		}
+	}
+	if firstOfShard1 < 0 || firstOfShard1 > lastOfShard0 {
+		t.Fatalf("shard 1 should be synced while shard 0 is in progress, read order %v", reader.shards)
+	}
+}
+
+// failingWriter fails the writes of CommitBlobs for local reasons while fail is set.
+type failingWriter struct {
+	StorageManager
+	fail bool
+}
+
+func (w *failingWriter) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, []uint64, error) {
+	if w.fail {
+		return []uint64{}, kvIndices, nil
+	}
+	return w.StorageManager.CommitBlobs(kvIndices, blobs, commits)
+}
+
+// TestLocalCommitFailureNotScored test a valid blob failing to be written for a local reason does not
+// penalize the peer delivering it, and stays in the heal task to be written by the next delivery.
+func TestLocalCommitFailureNotScored(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		kvIdx       = uint64(5)
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), 16); err != nil {
+		t.Fatal(err)
+	}
+	writer := &failingWriter{StorageManager: sm, fail: true}
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, writer, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	pid := peer.ID("remote-peer")
+	if !syncCl.AddPeer(pid, map[common.Address][]uint64{contract: {0}}, network.DirOutbound) {
+		t.Fatalf("add peer %s failed", pid)
+	}
+	shardTask := syncCl.tasks[0]
+	shardTask.healTask.insert([]uint64{kvIdx})
+	expected := data[contract][kvIdx]
+	respond := func() {
+		syncCl.lock.Lock()
+		shardTask.healTask.refresh([]uint64{kvIdx})
+		syncCl.lock.Unlock()
+		req := &blobsByListRequest{peer: pid, contract: contract, indexes: []uint64{kvIdx}, healTask: shardTask.healTask}
+		syncCl.OnBlobsByList(&blobsByListResponse{req: req, Blobs: []*BlobPayload{{MinerAddress: expected.MinerAddress,
+			BlobIndex: kvIdx, BlobCommit: expected.BlobCommit, EncodeType: expected.EncodeType, EncodedBlob: expected.EncodedBlob}},
+			time: time.Now()})
+	}
+
+	respond()
+	if score := syncCl.PeerScores()[pid]; score < 0 {
+		t.Fatalf("peer should not be penalized for a local write failure, score %d", score)
+	}
+	syncCl.lock.Lock()
+	_, stateless := shardTask.statelessPeers[pid]
+	syncCl.lock.Unlock()
+	if stateless || shardTask.healTask.count() != 1 {
+		t.Fatalf("blob should stay in the heal task with the peer usable, stateless %v, heal %d", stateless, shardTask.healTask.count())
+	}
+
+	writer.fail = false
+	respond()
+	if shardTask.healTask.count() != 0 {
+		t.Fatalf("blob should be removed from heal task after delivery")
+	}
+	blob, _, err := sm.TryRead(kvIdx, len(expected.RowData), expected.BlobCommit)
+	if err != nil || !bytes.Equal(blob, expected.RowData) {
+		t.Fatalf("synced blob mismatch, err %v", err)
+	}
+}
+
+// contractRecordingReader records the contracts of the blobs read by a remote peer serving several contracts
+// in the order of reading.
+type contractRecordingReader struct {
+	*mockStorageManagerReader
+	lock      *sync.Mutex
+	contracts *[]common.Address
+}
+
+func (r *contractRecordingReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	r.lock.Lock()
+	*r.contracts = append(*r.contracts, r.contractAddress)
+	r.lock.Unlock()
+	return r.mockStorageManagerReader.TryReadEncodedCtx(ctx, kvIdx, readLen)
+}
+
+// TestSyncMultiContracts test sync the shards of two contracts from one remote peer serving both, the
+// requests should alternate between the contracts, and the sync is done only after both are synced.
+func TestSyncMultiContracts(t *testing.T) {
+	var (
+		kvSize        = defaultChunkSize
+		kvEntries     = uint64(32)
+		lastKvIndex   = uint64(64)
+		contract2     = common.HexToAddress("0x0000000000000000000000000000000003330002")
+		metafileName2 = "metafile2.dat.meta"
+		shards        = map[common.Address][]uint64{contract: {0}, contract2: {1}}
+		metafiles     = map[common.Address]string{contract: metafileName, contract2: metafileName2}
+		db            = rawdb.NewMemoryDatabase()
+		ctx, cancel   = context.WithCancel(context.Background())
+		mux           = new(event.Feed)
+		m             = metrics.NewMetrics("sync_test")
+		rollupCfg     = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		lock      sync.Mutex
+		readOrder []common.Address
+	)
+	defer cancel()
+	defer delete(ethstorage.ContractToShardManager, contract2)
+
+	var (
+		sms     = make([]*ethstorage.StorageManager, 0, 2)
+		data    = make(map[common.Address]map[uint64]*BlobPayloadWithRowData)
+		readers = make([]*contractRecordingReader, 0, 2)
+	)
+	for _, c := range []common.Address{contract, contract2} {
+		metafile, err := CreateMetaFile(metafiles[c], int64(kvEntries)*2)
+		if err != nil {
+			t.Fatal("Create metafileName fail", err.Error())
+		}
+		defer func(name string) {
+			metafile.Close()
+			os.Remove(name)
+		}(metafiles[c])
+		shardManager, files := createEthStorage(c, shards[c], defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+		if shardManager == nil {
+			t.Fatalf("createEthStorage failed")
+		}
+		defer func(files []string) {
+			for _, file := range files {
+				os.Remove(file)
+			}
+		}(files)
+
+		sm := ethstorage.NewStorageManager(shardManager, NewMockL1Source(lastKvIndex, metafiles[c]))
+		sm.Reset(0)
+		sms = append(sms, sm)
+		data[c] = makeKVStorage(c, shards[c], defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)[c]
+		readers = append(readers, &contractRecordingReader{mockStorageManagerReader: &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          shards[c],
+			contractAddress: c,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[c],
+		}, lock: &lock, contracts: &readOrder})
+	}
+
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sms[0], m, mux)
+	syncCl.AddStorageManager(sms[1])
+	if len(syncCl.tasks) != 0 {
+		t.Fatalf("expected no task before start, got %d", len(syncCl.tasks))
+	}
+
+	doneCh := make(chan EthStorageSyncDone, 16)
+	sub := mux.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, readers[0], nil, m)
+	syncSrv.AddStorageManager(readers[1])
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest))
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest))
+	connect(t, localHost, remoteHost, shards, shards)
+
+	contractsDone := make(map[common.Address]struct{})
+	for allDone := false; !allDone; {
+		select {
+		case ev := <-doneCh:
+			if ev.DoneType == SingleShardDone {
+				contractsDone[ev.Contract] = struct{}{}
+			} else if ev.DoneType == AllShardDone {
+				if len(contractsDone) != len(shards) {
+					t.Fatalf("all shards done before the shards of every contract are done, done contracts %v", contractsDone)
+				}
+				allDone = true
+			}
+		case <-time.After(6 * time.Second):
+			t.Fatalf("sync stalled, done contracts %v", contractsDone)
+		}
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	lock.Lock()
+	defer lock.Unlock()
+	firstOfContract2, lastOfContract := -1, -1
+	for i, c := range readOrder {
+		if c == contract2 && firstOfContract2 < 0 {
+			firstOfContract2 = i
+		}
+		if c == contract {
+			lastOfContract = i
+		}
+	}
+	if firstOfContract2 < 0 || firstOfContract2 > lastOfContract {
+		t.Fatalf("contract %s should be synced while contract %s is in progress, read order %v", contract2, contract, readOrder)
+	}
+}
+
+type kvSizeStorageManager struct {
+	StorageManager
+	contract common.Address
+	kvSize   uint64
+}
+
+func (s *kvSizeStorageManager) ContractAddress() common.Address { return s.contract }
+func (s *kvSizeStorageManager) MaxKvSize() uint64               { return s.kvSize }
+func (s *kvSizeStorageManager) Shards() []uint64                { return []uint64{0} }
+
+// TestMaxKvCountPerReq test the kvs per request are computed per contract from its kv size, and a
+// MaxRequestSize smaller than a kv still allows one kv per request.
+func TestMaxKvCountPerReq(t *testing.T) {
+	small := &kvSizeStorageManager{contract: common.HexToAddress("0x01"), kvSize: 32 * 1024}
+	large := &kvSizeStorageManager{contract: common.HexToAddress("0x02"), kvSize: 128 * 1024}
+	tests := []struct {
+		maxRequestSize uint64
+		small, large   uint64
+	}{
+		{maxRequestSize: 4 * 1024 * 1024, small: 128, large: 32},
+		{maxRequestSize: 256 * 1024, small: 8, large: 2},
+		{maxRequestSize: 64 * 1024, small: 2, large: 1},
+	}
+	for _, tt := range tests {
+		s := &SyncClient{
+			syncerParams:    &SyncerParams{MaxRequestSize: tt.maxRequestSize},
+			storageManagers: make(map[common.Address]StorageManager),
+		}
+		s.AddStorageManager(small)
+		s.AddStorageManager(large)
+		if count := s.maxKvCountPerReq(small.contract); count != tt.small {
+			t.Errorf("max request size %d: expected %d kvs per request of the small kvs, got %d", tt.maxRequestSize, tt.small, count)
+		}
+		if count := s.maxKvCountPerReq(large.contract); count != tt.large {
+			t.Errorf("max request size %d: expected %d kvs per request of the large kvs, got %d", tt.maxRequestSize, tt.large, count)
+		}
+	}
+}
+
+// TestSyncProgress test the progress of a shard which is synced partway.
+func TestSyncProgress(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(48)
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	progress := syncCl.Progress()
+	if len(progress.Shards) != 1 || progress.Shards[0].Completed != 0 || progress.Shards[0].Total != kvEntries {
+		t.Fatalf("unexpected progress before sync %+v", progress.Shards)
+	}
+	if progress.Shards[0].ETASeconds != 0 {
+		t.Fatalf("eta should be unknown before sync, got %d", progress.Shards[0].ETASeconds)
+	}
+
+	// subTask [0, 16) is done, subTask [16, 32) is synced to 24 with blob 20 and 21 missing,
+	// subTask [32, 48) is not started, and the empty blobs [48, 64) are filled.
+	shardTask := syncCl.tasks[0]
+	syncCl.lock.Lock()
+	shardTask.SubTasks[0].next = 16
+	shardTask.SubTasks[1].next = 24
+	shardTask.healTask.insert([]uint64{20, 21})
+	for _, et := range shardTask.SubEmptyTasks {
+		et.First = et.Last
+	}
+	shardTask.meter.mark(100, time.Now().Add(-10*time.Second))
+	syncCl.lock.Unlock()
+
+	sp := syncCl.Progress().Shards[0]
+	if sp.Completed != 38 || sp.Total != kvEntries || sp.HealBacklog != 2 {
+		t.Fatalf("unexpected shard progress %+v", sp)
+	}
+	if sp.BlobsPerSecond <= 9 || sp.BlobsPerSecond > 10 {
+		t.Fatalf("unexpected blobs per second %f", sp.BlobsPerSecond)
+	}
+	if sp.ETASeconds != uint64(float64(26)/sp.BlobsPerSecond) {
+		t.Fatalf("unexpected eta %d", sp.ETASeconds)
+	}
+}
+
+// TestRefreshMetas test the blobs whose metas are changed by an L1 reorg are synced again.
+func TestRefreshMetas(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		db          = rawdb.NewMemoryDatabase()
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer metafile.Close()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	if err := sm.DownloadAllMetas(context.Background(), params.MetaDownloadBatchSize); err != nil {
+		t.Fatal(err)
+	}
+	_, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, new(event.Feed))
+	syncCl.loadSyncStatus()
+
+	// blob 0 ~ 19 are synced, the rest are waiting to be synced
+	shardTask := syncCl.tasks[0]
+	shardTask.SubTasks[0].next = 16
+	shardTask.SubTasks[1].next = 20
+
+	// a reorg changes the commits of the synced blob 3 and the not synced blob 40
+	for _, idx := range []uint64{3, 40} {
+		meta := GenerateMetadata(idx, kvSize, common.Hash{byte(idx)}.Bytes())
+		if _, err := metafile.WriteAt(meta[:], int64(idx*32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncCl.refreshMetas(10)
+	if _, ok := shardTask.healTask.Indexes[3]; !ok {
+		t.Fatalf("blob 3 should be healed")
+	}
+	if _, ok := shardTask.healTask.Indexes[40]; ok || shardTask.healTask.count() != 1 {
+		t.Fatalf("only blob 3 should be healed, got %v", shardTask.healTask.Indexes)
+	}
+	metas, err := sm.GetKvMetas([]uint64{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metas[0] != GenerateMetadata(3, kvSize, common.Hash{3}.Bytes()) {
+		t.Fatalf("meta of blob 3 should be refreshed")
+	}
+
+	// a reorg drops the blobs from 24, so they are filled with empty blobs instead
+	l1.lastBlobIndex = 24
+	syncCl.refreshMetas(11)
+	if sm.LastKvIndex() != 24 {
+		t.Fatalf("last kv index should shrink to 24, got %d", sm.LastKvIndex())
+	}
+	syncCl.cleanTasks()
+	if len(shardTask.SubTasks) != 2 || shardTask.SubTasks[1].Last != 24 {
+		t.Fatalf("subTasks should be truncated to the last kv index")
+	}
+	if len(shardTask.SubEmptyTasks) != 1 || shardTask.SubEmptyTasks[0].First != 24 || shardTask.SubEmptyTasks[0].Last != 64 {
+		t.Fatalf("blobs beyond the last kv index should be filled with empty blobs")
+	}
+
+	// nothing changes if the local L1 view is newer than the block
+	sm.Reset(100)
+	syncCl.refreshMetas(50)
+	if shardTask.healTask.count() != 1 || len(shardTask.SubEmptyTasks) != 1 {
+		t.Fatalf("metas should not be refreshed at a block older than the local L1 view")
+	}
+}
+
+// TestSyncMetrics test the per shard sync metrics are exposed by the metrics endpoint after a sync.
+func TestSyncMetrics(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards = []uint64{0}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	syncCl.Start()
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    copyShardData(data[contract], shards, kvEntries, make(map[uint64]struct{})),
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, map[common.Address][]uint64{contract: shards}, map[common.Address][]uint64{contract: shards})
+	checkStall(t, 3, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done")
+	}
+
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scrape metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read metrics failed: %v", err)
+	}
+
+	// sample values by metric name, summed over the series of the synced shard
+	samples := make(map[string]float64)
+	labels := fmt.Sprintf("contract=\"%s\",shard_id=\"0\"", contract.Hex())
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "#") || !strings.Contains(line, labels) {
+			continue
+		}
+		name := line[:strings.Index(line, "{")]
+		value, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		samples[name] += value
+	}
+	prefix := metrics.Namespace + "_sync_test_" + metrics.SyncClientSubsystem + "_"
+	for _, name := range []string{
+		"shard_blobs_requested_total",
+		"shard_blobs_written_total",
+		"shard_bytes_received_total",
+		"shard_request_duration_seconds_count",
+	} {
+		if samples[prefix+name] <= 0 {
+			t.Errorf("expected non-zero metric %s, got %v", prefix+name, samples[prefix+name])
+		}
+	}
+	if written := samples[prefix+"shard_blobs_written_total"]; written != float64(lastKvIndex) {
+		t.Errorf("expected %d blobs written, got %v", lastKvIndex, written)
+	}
+	if heal, ok := samples[prefix+"shard_heal_count"]; !ok || heal != 0 {
+		t.Errorf("expected heal count 0 after sync, got %v (exists %v)", heal, ok)
+	}
+}
+
+// TestRequestTimeout test a request to a peer which never responds times out, and the range is synced
+// from another peer instead of hanging.
+func TestRequestTimeout(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards   = []uint64{0}
+		shardMap = map[common.Address][]uint64{contract: shards}
+		timeout  = 500 * time.Millisecond
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	p := params
+	p.RequestTimeout = timeout
+	syncCl.syncerParams = &p
+
+	// the silent peer reads the requests but never responds
+	requested := make(chan struct{}, 1)
+	silent := func(stream network.Stream) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		io.Copy(io.Discard, stream)
+		<-ctx.Done()
+	}
+	silentHost := getNetHost(t)
+	silentHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), silent)
+	silentHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), silent)
+	connect(t, localHost, silentHost, shardMap, shardMap)
+	syncCl.Start()
+
+	select {
+	case <-requested:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the silent peer got no request")
+	}
+	start := time.Now()
+	// the request to the silent peer fails with a timeout
+	pr := NewPeer(0, rollupCfg.L2ChainID, silentHost.ID(), localHost.NewStream, network.DirOutbound, shardMap)
+	pr.requestTimeout = timeout
+	var packet BlobsByRangePacket
+	code, err := pr.RequestBlobsByRange(1, contract, 0, 0, kvEntries-1, p.MaxRequestSize, &packet)
+	if code != clientTimeout || !errors.Is(err, errRequestTimeout) {
+		t.Fatalf("expected request timeout, got code %d, error %v", code, err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+2*time.Second {
+		t.Fatalf("expected request to time out after %v, took %v", timeout, elapsed)
+	}
+
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    copyShardData(data[contract], shards, kvEntries, make(map[uint64]struct{})),
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 5, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done with the responding peer")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	if score := syncCl.PeerScores()[silentHost.ID()]; score >= 0 {
+		t.Fatalf("expected the silent peer to be penalized, got score %d", score)
+	}
+}
+
+// testCompressedTransfer requests a range of blobs from a remote peer, which serves the compressed variant
+// of the protocol if compressed is true, and returns the blobs with the protocol the range is served over.
+func testCompressedTransfer(t *testing.T, compressed bool) ([]*BlobPayload, map[uint64]*BlobPayloadWithRowData, protocol.ID) {
+	var (
+		kvSize    = defaultChunkSize
+		kvEntries = uint64(16)
+		blobs     = uint64(8)
+		rollupCfg = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// half of the blobs are empty, which compress well
+	payloads := make(map[uint64]*BlobPayloadWithRowData)
+	for i := uint64(0); i < blobs; i++ {
+		blob := make([]byte, kvSize)
+		if i%2 == 0 {
+			rand.Read(blob)
+		}
+		payloads[i] = &BlobPayloadWithRowData{BlobIndex: i, EncodeType: defaultEncodeType, EncodedBlob: blob}
+	}
+	reader := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		blobPayloads:    payloads,
+	}
+	syncSrv := NewSyncServer(rollupCfg, reader, nil, nil)
+	var (
+		lock   sync.Mutex
+		served protocol.ID
+	)
+	handler := MakeStreamHandler(ctx, testLog, func(ctx context.Context, log log.Logger, stream network.Stream) {
+		lock.Lock()
+		served = stream.Protocol()
+		lock.Unlock()
+		syncSrv.HandleGetBlobsByRangeRequest(ctx, log, stream)
+	})
+	remoteHost := getNetHost(t)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), handler)
+	if compressed {
+		remoteHost.SetStreamHandler(GetCompressedProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), handler)
+	}
+	localHost := getNetHost(t)
+	shards := map[common.Address][]uint64{contract: {0}}
+	connect(t, localHost, remoteHost, shards, shards)
+
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound, shards)
+	var res BlobsByRangePacket
+	code, err := pr.RequestBlobsByRange(1, contract, 0, 0, blobs-1, blobs*kvSize, &res)
+	if err != nil || code != returnCodeSuccess {
+		t.Fatalf("request failed, code %d, error %v", code, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return res.Blobs, payloads, served
+}
+
+func TestCompressedBlobTransfer(t *testing.T) {
+	for _, compressed := range []bool{true, false} {
+		blobs, payloads, served := testCompressedTransfer(t, compressed)
+		if isCompressedProtocol(served) != compressed {
+			t.Fatalf("compressed %v: unexpected protocol %s", compressed, served)
+		}
+		if len(blobs) != len(payloads) {
+			t.Fatalf("compressed %v: expected %d blobs, got %d", compressed, len(payloads), len(blobs))
+		}
+		for _, blob := range blobs {
+			if !bytes.Equal(blob.EncodedBlob, payloads[blob.BlobIndex].EncodedBlob) {
+				t.Fatalf("compressed %v: blob %d mismatch", compressed, blob.BlobIndex)
+			}
+		}
+	}
+}
+
+// TestRangeSizeByThroughput syncs from a fast and a slow peer, and checks that the range requested from
+// each peer is sized by its throughput, so the slow peer is requested for smaller ranges.
+func TestRangeSizeByThroughput(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards   = []uint64{0}
+		shardMap = map[common.Address][]uint64{contract: shards}
+		delay    = time.Second
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	p := params
+	p.SyncConcurrency = 2
+	p.MinRangeSize = 2
+	p.MaxRangeSize = 16
+	syncCl.syncerParams = &p
+
+	newReader := func() *mockStorageManagerReader {
+		return &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], shards, kvEntries, make(map[uint64]struct{})),
+		}
+	}
+	fastHost := createRemoteHost(t, ctx, rollupCfg, newReader(), m, testLog)
+
+	// the slow peer takes longer than the target duration to serve any range
+	slowHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, newReader(), nil, m)
+	slow := func(fn requestHandlerFn) network.StreamHandler {
+		handler := MakeStreamHandler(ctx, testLog, fn)
+		return func(stream network.Stream) {
+			time.Sleep(delay)
+			handler(stream)
+		}
+	}
+	slowHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), slow(syncSrv.HandleGetBlobsByRangeRequest))
+	slowHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), slow(syncSrv.HandleGetBlobsByListRequest))
+
+	connect(t, localHost, slowHost, shardMap, shardMap)
+	connect(t, localHost, fastHost, shardMap, shardMap)
+	syncCl.Start()
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	rangeSize := func(id peer.ID) (uint64, float64) {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		pr, ok := syncCl.peers[id]
+		if !ok {
+			t.Fatalf("peer %s is not in the sync client", id)
+		}
+		return pr.rangeSize, pr.throughput
+	}
+	// the sync may be done by the fast peer before the first response of the slow peer
+	deadline := time.Now().Add(2 * delay)
+	for {
+		if _, throughput := rangeSize(slowHost.ID()); throughput > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fastSize, fastThroughput := rangeSize(fastHost.ID())
+	slowSize, slowThroughput := rangeSize(slowHost.ID())
+	if fastThroughput == 0 || slowThroughput == 0 {
+		t.Fatalf("expected throughput of both peers, got fast %f, slow %f", fastThroughput, slowThroughput)
+	}
+	if fastThroughput <= slowThroughput {
+		t.Fatalf("expected the fast peer to have a higher throughput, got fast %f, slow %f", fastThroughput, slowThroughput)
+	}
+	if fastSize <= slowSize {
+		t.Fatalf("expected a larger range for the fast peer, got fast %d, slow %d", fastSize, slowSize)
+	}
+	for _, size := range []uint64{fastSize, slowSize} {
+		if size < p.MinRangeSize || size > p.MaxRangeSize {
+			t.Fatalf("range size %d is out of [%d, %d]", size, p.MinRangeSize, p.MaxRangeSize)
+		}
+	}
+}
+
+// TestMaxPeersPerShard adds more peers than the limit for a shard, and checks the limit is kept while
+// the peer which is the only one serving another shard is kept.
+func TestMaxPeersPerShard(t *testing.T) {
+	var (
+		entries     = uint64(16)
+		lastKvIndex = entries * 2
+		db          = rawdb.NewMemoryDatabase()
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shard0   = map[common.Address][]uint64{contract: {0}}
+		shard01  = map[common.Address][]uint64{contract: {0, 1}}
+		maxPeers = 2
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries*2))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+
+	shardManager, files := createEthStorage(contract, []uint64{0, 1}, defaultChunkSize, defaultChunkSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	p := params
+	p.MaxPeersPerShard = maxPeers
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &p, db, metrics.NoopMetrics, new(event.Feed))
+	syncCl.loadSyncStatus()
+	var evicted []peer.ID
+	syncCl.SetEvictPeerFn(func(id peer.ID) { evicted = append(evicted, id) })
+
+	for _, id := range []peer.ID{"peer-1", "peer-2"} {
+		if !syncCl.AddPeer(id, shard0, network.DirOutbound) {
+			t.Fatalf("add peer %s failed", id)
+		}
+	}
+	// shard 0 is full
+	if syncCl.AddPeer("peer-3", shard0, network.DirOutbound) {
+		t.Fatalf("expected peer over the limit of shard 0 to be rejected")
+	}
+	// the only peer serving shard 1 is kept, and a peer of shard 0 is evicted for it
+	if !syncCl.AddPeer("peer-4", shard01, network.DirOutbound) {
+		t.Fatalf("expected peer serving shard 1 to be added")
+	}
+	if len(evicted) != 1 || (evicted[0] != "peer-1" && evicted[0] != "peer-2") {
+		t.Fatalf("expected a peer of shard 0 to be evicted, got %v", evicted)
+	}
+	if _, ok := syncCl.peers[evicted[0]]; ok {
+		t.Fatalf("evicted peer %s is still registered", evicted[0])
+	}
+	for _, task := range syncCl.tasks {
+		if len(task.peers) > maxPeers {
+			t.Fatalf("shard %d has %d peers over the limit", task.ShardId, len(task.peers))
+		}
+		if _, ok := task.peers["peer-4"]; !ok {
+			t.Fatalf("expected peer-4 to serve shard %d", task.ShardId)
+		}
+	}
+	if len(syncCl.peers) != maxPeers {
+		t.Fatalf("expected %d peers, got %d", maxPeers, len(syncCl.peers))
+	}
+}
+
+// hidingReader hides a blob of the remote peer until it is revealed, as if it is written later.
+type hidingReader struct {
+	*mockStorageManagerReader
+	hidden   uint64
+	revealed atomic.Bool
+}
+
+func (r *hidingReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	if kvIdx == r.hidden && !r.revealed.Load() {
+		return nil, false, ethereum.NotFound
+	}
+	return r.mockStorageManagerReader.TryReadEncodedCtx(ctx, kvIdx, readLen)
+}
+
+func (r *hidingReader) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
+	if kvIdx == r.hidden && !r.revealed.Load() {
+		return nil, false, ethereum.NotFound
+	}
+	return r.mockStorageManagerReader.TryReadMeta(kvIdx)
+}
+
+// TestBlobAnnouncement syncs from a remote peer lacking a blob, which is taken as stateless once it fails to
+// serve the blob. The announcement of the blob written by the peer later has the blob requested again.
+func TestBlobAnnouncement(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		missing     = uint64(5)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards   = []uint64{0}
+		shardMap = map[common.Address][]uint64{contract: shards}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	p := params
+	p.SyncConcurrency = 1
+	syncCl.syncerParams = &p
+
+	reader := &hidingReader{
+		mockStorageManagerReader: &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    copyShardData(data[contract], shards, kvEntries, make(map[uint64]struct{})),
+		},
+		hidden: missing,
+	}
+	remoteHost := getNetHost(t)
+	syncSrv := NewSyncServer(rollupCfg, reader, nil, m)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest))
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest))
+
+	newAnnouncer := func(h host.Host, syncCl *SyncClient) *BlobAnnouncer {
+		ps, err := pubsub.NewGossipSub(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := NewBlobAnnouncer(ps, h, rollupCfg.L2ChainID, []common.Address{contract}, syncCl, 100*time.Millisecond, testLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(a.Close)
+		return a
+	}
+	newAnnouncer(localHost, syncCl)
+	remoteAnnouncer := newAnnouncer(remoteHost, nil)
+
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	syncCl.Start()
+
+	stateless := func() bool {
+		syncCl.lock.Lock()
+		defer syncCl.lock.Unlock()
+		_, ok := syncCl.tasks[0].statelessPeers[remoteHost.ID()]
+		return ok
+	}
+	for deadline := time.Now().Add(5 * time.Second); !stateless(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the remote peer to be stateless after failing to serve blob %d", missing)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(remoteAnnouncer.topics[contract].ListPeers()) == 0; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the local peer did not join the blob topic")
+		}
+	}
+
+	// the remote peer writes the missing blob and announces it
+	reader.revealed.Store(true)
+	remoteAnnouncer.Announce(contract, []uint64{missing})
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done after the missing blob is announced")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	if stateless() {
+		t.Fatalf("expected the remote peer to be no longer stateless")
+	}
+}
+
+// TestBlobAnnouncementValidator test an announcement is only accepted from the peer it announces.
+func TestBlobAnnouncementValidator(t *testing.T) {
+	var (
+		publisher = getNetHost(t)
+		other     = getNetHost(t)
+		a         = &BlobAnnouncer{log: testLog}
+		validate  = a.validator(contract)
+	)
+	message := func(ann *BlobAnnouncement) *pubsub.Message {
+		data, err := rlp.EncodeToBytes(ann)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pubsub.Message{Message: &pb.Message{Data: snappy.Encode(nil, data), From: []byte(publisher.ID())}}
+	}
+
+	if res := validate(context.Background(), other.ID(), message(&BlobAnnouncement{Contract: contract, Peer: publisher.ID(), First: 1, Last: 2})); res != pubsub.ValidationAccept {
+		t.Fatalf("expected the announcement of the publisher accepted, got %v", res)
+	}
+	if res := validate(context.Background(), other.ID(), message(&BlobAnnouncement{Contract: contract, Peer: other.ID(), First: 1, Last: 2})); res != pubsub.ValidationReject {
+		t.Fatalf("expected the announcement of another peer rejected, got %v", res)
+	}
+}
+
+// TestReconnectPeer test a disconnected peer serving a shard being synced is reconnected, with the peer refusing
+// the first two dials and accepting the third one.
+func TestReconnectPeer(t *testing.T) {
+	var (
+		entries   = uint64(16)
+		db        = rawdb.NewMemoryDatabase()
+		rollupCfg = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shard0 = map[common.Address][]uint64{contract: {0}}
+		id     = peer.ID("flaky-peer")
+	)
+	metafile, err := CreateMetaFile(metafileName, int64(entries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, defaultChunkSize, entries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(entries, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	p := params
+	p.ReconnectAttempts = 5
+	p.ReconnectBackoff = 10 * time.Millisecond
+	p.ReconnectMaxBackoff = 40 * time.Millisecond
+	syncCl := NewSyncClient(testLog, rollupCfg, nil, sm, &p, db, metrics.NoopMetrics, new(event.Feed))
+	syncCl.loadSyncStatus()
+	defer syncCl.Close()
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		d := min(p.ReconnectBackoff<<(attempt-1), p.ReconnectMaxBackoff)
+		if backoff := syncCl.reconnectBackoff(attempt); backoff < d/2 || backoff > d {
+			t.Fatalf("backoff %v of attempt %d out of [%v, %v]", backoff, attempt, d/2, d)
+		}
+	}
+
+	var dials atomic.Int32
+	connected := make(chan struct{})
+	syncCl.SetConnectFn(func(ctx context.Context, pid peer.ID) error {
+		if dials.Add(1) < 3 {
+			return errors.New("connection refused")
+		}
+		// the connection notification adds the peer back
+		if !syncCl.AddPeer(pid, shard0, network.DirOutbound) {
+			t.Errorf("add reconnected peer failed")
+		}
+		close(connected)
+		return nil
+	})
+
+	if !syncCl.AddPeer(id, shard0, network.DirOutbound) {
+		t.Fatalf("add peer failed")
+	}
+	syncCl.RemovePeer(id)
+	// the peer disconnects again while being reconnected, which must not start another dial loop
+	syncCl.AddPeer(id, shard0, network.DirOutbound)
+	syncCl.RemovePeer(id)
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peer not reconnected, dials %d", dials.Load())
+	}
+	time.Sleep(100 * time.Millisecond)
+	syncCl.lock.Lock()
+	_, added := syncCl.peers[id]
+	reconnecting := len(syncCl.reconnecting)
+	syncCl.lock.Unlock()
+	if !added || reconnecting != 0 {
+		t.Fatalf("expected the peer added and reconnect done, added %v, reconnecting %d", added, reconnecting)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Fatalf("expected 3 dials, got %d", n)
+	}
+}
+
+// mockL1BlobSource serves the raw blobs of the kvs like a beacon node, and records the kvs requested.
+type mockL1BlobSource struct {
+	lock      sync.Mutex
+	blobs     map[uint64]*BlobPayloadWithRowData
+	requested map[uint64]struct{}
+}
+
+func (m *mockL1BlobSource) BlobByKvIndex(ctx context.Context, contract common.Address, kvIdx uint64, commit common.Hash) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requested[kvIdx] = struct{}{}
+	b, ok := m.blobs[kvIdx]
+	if !ok {
+		return nil, ethereum.NotFound
+	}
+	if !bytes.Equal(b.BlobCommit[:ethstorage.HashSizeInContract], commit[:ethstorage.HashSizeInContract]) {
+		return nil, fmt.Errorf("commit mismatch")
+	}
+	return b.RowData, nil
+}
+
+// TestHealFromL1 test sync process with local node support a shard and sync data from 1 remote peer which has
+// excluded list, the excluded blobs stuck in the heal task should be downloaded from L1 and it should be sync done.
+func TestHealFromL1(t *testing.T) {
+	var (
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		excluded    = map[uint64]struct{}{3: {}, 7: {}, 11: {}}
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shards      = map[common.Address][]uint64{contract: {0}}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, defaultChunkSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, defaultChunkSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	p := params
+	p.L1HealTimeout = 200 * time.Millisecond
+	localHost := getNetHost(t)
+	syncCl := newSyncClientOnHost(localHost, testLog, rollupCfg, db, sm, &p, m, mux)
+	src := &mockL1BlobSource{blobs: data[contract], requested: make(map[uint64]struct{})}
+	syncCl.SetL1BlobSource(src)
+	syncCl.Start()
+	defer syncCl.Close()
+
+	// no peer has the excluded blobs
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       defaultChunkSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    copyShardData(data[contract], []uint64{0}, kvEntries, excluded),
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, shards, shards)
+
+	checkStall(t, 10, mux, cancel)
+
+	syncCl.lock.Lock()
+	done, healCount := syncCl.syncDone, syncCl.tasks[0].healTask.count()
+	syncCl.lock.Unlock()
+	if !done || healCount != 0 {
+		t.Fatalf("expected sync done with the heal task drained, done %v, heal count %d", done, healCount)
+	}
+	src.lock.Lock()
+	requested := src.requested
+	src.lock.Unlock()
+	if !reflect.DeepEqual(requested, excluded) {
+		t.Fatalf("expected the excluded blobs %v downloaded from L1, got %v", excluded, requested)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// readCountingReader counts the blobs read from the storage.
+type readCountingReader struct {
+	*mockStorageManagerReader
+	reads atomic.Int64
+}
+
+func (r *readCountingReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	r.reads.Add(1)
+	return r.mockStorageManagerReader.TryReadEncodedCtx(ctx, kvIdx, readLen)
+}
+
+// TestSyncServerBlobCache test the blobs requested again by overlapping range requests of several peers
+// are served from the blob cache, and a rewritten blob is read from the storage again.
+func TestSyncServerBlobCache(t *testing.T) {
+	var (
+		kvSize    = defaultChunkSize
+		kvEntries = uint64(16)
+		rollupCfg = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		ranges = [][2]uint64{{0, 7}, {4, 11}, {8, 15}}
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payloads := make(map[uint64]*BlobPayloadWithRowData)
+	for i := uint64(0); i < kvEntries; i++ {
+		blob := make([]byte, kvSize)
+		rand.Read(blob)
+		payloads[i] = &BlobPayloadWithRowData{BlobIndex: i, EncodeType: defaultEncodeType, EncodedBlob: blob}
+	}
+	reader := &readCountingReader{mockStorageManagerReader: &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          []uint64{0},
+		contractAddress: contract,
+		blobPayloads:    payloads,
+	}}
+	syncSrv := NewSyncServer(rollupCfg, reader, nil, nil)
+	remoteHost := getNetHost(t)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByRangeRequest))
+	shards := map[common.Address][]uint64{contract: {0}}
+	peers := make([]*Peer, len(ranges))
+	for i := range peers {
+		localHost := getNetHost(t)
+		connect(t, localHost, remoteHost, shards, shards)
+		peers[i] = NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), localHost.NewStream, network.DirOutbound, shards)
+	}
+
+	request := func(pr *Peer, r [2]uint64) []*BlobPayload {
+		var res BlobsByRangePacket
+		code, err := pr.RequestBlobsByRange(1, contract, 0, r[0], r[1], kvEntries*kvSize, &res)
+		if err != nil || code != returnCodeSuccess {
+			t.Fatalf("request failed, code %d, error %v", code, err)
+		}
+		if uint64(len(res.Blobs)) != r[1]-r[0]+1 {
+			t.Fatalf("expected %d blobs, got %d", r[1]-r[0]+1, len(res.Blobs))
+		}
+		for _, blob := range res.Blobs {
+			if !bytes.Equal(blob.EncodedBlob, payloads[blob.BlobIndex].EncodedBlob) {
+				t.Fatalf("blob %d mismatch", blob.BlobIndex)
+			}
+		}
+		return res.Blobs
+	}
+
+	for i, pr := range peers {
+		request(pr, ranges[i])
+	}
+	if reads := reader.reads.Load(); reads != int64(kvEntries) {
+		t.Fatalf("expected each blob read once, got %d reads", reads)
+	}
+	// the other peers request the same ranges again
+	for i, pr := range peers {
+		request(pr, ranges[(i+1)%len(ranges)])
+	}
+	if reads := reader.reads.Load(); reads != int64(kvEntries) {
+		t.Fatalf("expected repeated requests served from the cache, got %d reads", reads)
+	}
+
+	// rewrite a blob, the cached blob should not be served anymore
+	rewritten := uint64(5)
+	blob := make([]byte, kvSize)
+	rand.Read(blob)
+	payloads[rewritten] = &BlobPayloadWithRowData{BlobIndex: rewritten, BlobCommit: common.Hash{0x01},
+		EncodeType: defaultEncodeType, EncodedBlob: blob}
+	for _, b := range request(peers[0], ranges[0]) {
+		if b.BlobIndex == rewritten && b.BlobCommit != payloads[rewritten].BlobCommit {
+			t.Fatalf("stale blob %d served", rewritten)
+		}
+	}
+	if reads := reader.reads.Load(); reads != int64(kvEntries)+1 {
+		t.Fatalf("expected the rewritten blob read again, got %d reads", reads-int64(kvEntries))
+	}
+}
+
+// TestSyncClientMaxRequestSize test a server capping its responses at a large size replies no more than the
+// small size accepted by the client, and the client requests the rest of each range again.
+func TestSyncClientMaxRequestSize(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		shards      = []uint64{0}
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+
+	reader := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	serverParams := DefaultSyncServerParams()
+	serverParams.MaxResponseSize = kvEntries * kvSize
+	syncSrv := NewSyncServer(rollupCfg, reader, serverParams, m)
+	var requests atomic.Int64
+	remoteHost := getNetHost(t)
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, func(ctx context.Context, log log.Logger, stream network.Stream) {
+			requests.Add(1)
+			syncSrv.HandleGetBlobsByRangeRequest(ctx, log, stream)
+		}))
+	remoteHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID),
+		MakeStreamHandler(ctx, testLog, syncSrv.HandleGetBlobsByListRequest))
+
+	// the client accepts 2 blobs per response, and requests ranges of 4 blobs
+	p := params
+	p.MaxRequestSize = 2 * kvSize
+	p.SyncConcurrency = 1
+	probeHost := getNetHost(t)
+	connect(t, probeHost, remoteHost, shardMap, shardMap)
+	pr := NewPeer(0, rollupCfg.L2ChainID, remoteHost.ID(), probeHost.NewStream, network.DirOutbound, shardMap)
+	var res BlobsByRangePacket
+	code, err := pr.RequestBlobsByRange(1, contract, 0, 0, kvEntries-1, p.MaxRequestSize, &res)
+	if err != nil || code != returnCodeSuccess {
+		t.Fatalf("request failed, code %d, error %v", code, err)
+	}
+	if uint64(len(res.Blobs)) != p.MaxRequestSize/kvSize {
+		t.Fatalf("expected %d blobs honoring the client limit, got %d", p.MaxRequestSize/kvSize, len(res.Blobs))
+	}
+	requests.Store(0)
+
+	localHost := getNetHost(t)
+	syncCl := newSyncClientOnHost(localHost, testLog, rollupCfg, db, sm, &p, m, mux)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	syncCl.Start()
+	checkStall(t, 10, mux, cancel)
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	if minRequests := int64(kvEntries * kvSize / p.MaxRequestSize); requests.Load() < minRequests {
+		t.Fatalf("expected at least %d range requests, got %d", minRequests, requests.Load())
+	}
+}
+
+// TestSyncServerResponseLimit test the response size is the smaller one of the client and server limits,
+// and never exceeds maxMessageSize whatever the server is configured with.
+func TestSyncServerResponseLimit(t *testing.T) {
+	serverParams := DefaultSyncServerParams()
+	for _, tt := range []struct {
+		serverMax, reqBytes, expected uint64
+	}{
+		{0, 1 << 20, 1 << 20},
+		{0, 2 * maxMessageSize, maxMessageSize},
+		{1 << 20, 2 << 20, 1 << 20},
+		{4 * maxMessageSize, 2 * maxMessageSize, maxMessageSize},
+	} {
+		serverParams.MaxResponseSize = tt.serverMax
+		srv := &SyncServer{params: serverParams}
+		if limit := srv.responseLimit(tt.reqBytes); limit != tt.expected {
+			t.Fatalf("server max %d, request %d: expected limit %d, got %d", tt.serverMax, tt.reqBytes, tt.expected, limit)
+		}
+	}
+}
+
+// TestSyncShardDoneEvents test a SingleShardDone event with the contract is sent once for each shard
+// before the AllShardDone event, and no event is sent again once the sync client is closed.
+func TestSyncShardDoneEvents(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(24)
+		shards      = []uint64{0, 1}
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		shardMap    = map[common.Address][]uint64{contract: shards}
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries)*int64(len(shards)))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+
+	doneCh := make(chan EthStorageSyncDone, 16)
+	sub := mux.Subscribe(doneCh)
+	defer sub.Unsubscribe()
+	syncCl.Start()
+
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+
+	shardsDone := make(map[uint64]int)
+	for allDone := false; !allDone; {
+		select {
+		case ev := <-doneCh:
+			switch ev.DoneType {
+			case SingleShardDone:
+				if ev.Contract != contract {
+					t.Fatalf("expected shard done of contract %s, got %s", contract, ev.Contract)
+				}
+				shardsDone[ev.ShardId]++
+			case AllShardDone:
+				allDone = true
+			}
+		case <-time.After(6 * time.Second):
+			t.Fatalf("sync stalled, done shards %v", shardsDone)
+		}
+	}
+	for _, shard := range shards {
+		if shardsDone[shard] != 1 {
+			t.Fatalf("expected one shard done event of each shard before all done, got %v", shardsDone)
+		}
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+
+	syncCl.Close()
+	select {
+	case ev := <-doneCh:
+		t.Fatalf("unexpected event after the sync is done: %+v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// slowWriter delays CommitBlobs to make the disk the bottleneck of the sync, and records the max depth of
+// the write queue of the sync client seen by the writes.
+type slowWriter struct {
+	StorageManager
+	delay    time.Duration
+	syncCl   *SyncClient
+	maxDepth int
+}
+
+func (w *slowWriter) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, []uint64, error) {
+	w.syncCl.lock.Lock()
+	if w.syncCl.writeQueue > w.maxDepth {
+		w.maxDepth = w.syncCl.writeQueue
+	}
+	w.syncCl.lock.Unlock()
+	time.Sleep(w.delay)
+	return w.StorageManager.CommitBlobs(kvIndices, blobs, commits)
+}
+
+// TestSyncWithMaxWriteQueue test sync from three remote peers to a slow storage with MaxWriteQueue set to 1,
+// it should be sync done while the new requests are paused as soon as a response waits to be written.
+func TestSyncWithMaxWriteQueue(t *testing.T) {
+	var (
+		kvSize        = defaultChunkSize
+		kvEntries     = uint64(64)
+		lastKvIndex   = uint64(64)
+		peerCount     = 3
+		db            = rawdb.NewMemoryDatabase()
+		ctx, cancel   = context.WithCancel(context.Background())
+		mux           = new(event.Feed)
+		localShardMap = map[common.Address][]uint64{contract: {0}}
+		m             = metrics.NewMetrics("sync_test")
+		rollupCfg     = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+	)
+	defer cancel()
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, []uint64{0}, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	writer := &slowWriter{StorageManager: sm, delay: 50 * time.Millisecond}
+	syncParams := params
+	syncParams.MaxWriteQueue = 1
+	localHost := getNetHost(t)
+	syncCl := newSyncClientOnHost(localHost, testLog, rollupCfg, db, writer, &syncParams, m, mux)
+	writer.syncCl = syncCl
+	syncCl.Start()
+
+	for i := 0; i < peerCount; i++ {
+		smr := &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          []uint64{0},
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		}
+		remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+		connect(t, localHost, remoteHost, localShardMap, localShardMap)
+	}
+
+	checkStall(t, 10, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done, peer count %d", len(syncCl.peers))
+	}
+	syncCl.lock.Lock()
+	defer syncCl.lock.Unlock()
+	// a request is only sent while the queue is not full, so besides the queued responses, only the requests
+	// already in flight to the other peers can join the queue
+	if limit := syncParams.MaxWriteQueue + peerCount - 1; writer.maxDepth > limit {
+		t.Fatalf("expected the write queue depth to stay within %d, got %d", limit, writer.maxDepth)
+	}
+	if syncCl.writeQueue != 0 {
+		t.Fatalf("expected the write queue drained after sync done, got %d", syncCl.writeQueue)
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+}
+
+// TestStallWatchdog test the subTask stalled on a peer which never responds is reassigned to another
+// peer by the watchdog, so the sync is done although the request to the stalled peer never times out.
+func TestStallWatchdog(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(64)
+		lastKvIndex = uint64(64)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards   = []uint64{0}
+		shardMap = map[common.Address][]uint64{contract: shards}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	// no request timeout, so only the watchdog gets the subTask off the stalled peer
+	p := params
+	p.RequestTimeout = 0
+	p.StallTimeout = 300 * time.Millisecond
+	syncCl.syncerParams = &p
+
+	// the stalled peer reads the requests but never responds
+	requested := make(chan struct{}, 1)
+	stalled := func(stream network.Stream) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		io.Copy(io.Discard, stream)
+		<-ctx.Done()
+	}
+	stalledHost := getNetHost(t)
+	stalledHost.SetStreamHandler(GetProtocolID(RequestBlobsByRangeProtocolID, rollupCfg.L2ChainID), stalled)
+	stalledHost.SetStreamHandler(GetProtocolID(RequestBlobsByListProtocolID, rollupCfg.L2ChainID), stalled)
+	connect(t, localHost, stalledHost, shardMap, shardMap)
+	syncCl.Start()
+
+	select {
+	case <-requested:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the stalled peer got no request")
+	}
+	smr := &mockStorageManagerReader{
+		kvEntries:       kvEntries,
+		maxKvSize:       kvSize,
+		encodeType:      defaultEncodeType,
+		shards:          shards,
+		contractAddress: contract,
+		shardMiner:      common.Address{},
+		blobPayloads:    data[contract],
+	}
+	remoteHost := createRemoteHost(t, ctx, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 6, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done with the subTask of the stalled peer reassigned")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	if score := syncCl.PeerScores()[stalledHost.ID()]; score >= 0 {
+		t.Fatalf("expected the stalled peer to be penalized, got score %d", score)
+	}
+}
+
+// kvRecordingReader records the indexes of the blobs read from the storage.
+type kvRecordingReader struct {
+	*mockStorageManagerReader
+	lock sync.Mutex
+	kvs  map[uint64]struct{}
+}
+
+func (r *kvRecordingReader) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
+	r.lock.Lock()
+	r.kvs[kvIdx] = struct{}{}
+	r.lock.Unlock()
+	return r.mockStorageManagerReader.TryReadEncodedCtx(ctx, kvIdx, readLen)
+}
+
+// TestSyncSkipFilled test resuming the sync of a shard whose first half is filled already, only the other
+// half should be requested from the remote peer, except the filled blob whose commit does not match the
+// contract, which should be healed.
+func TestSyncSkipFilled(t *testing.T) {
+	var (
+		kvSize      = defaultChunkSize
+		kvEntries   = uint64(16)
+		lastKvIndex = uint64(16)
+		mismatched  = uint64(2)
+		db          = rawdb.NewMemoryDatabase()
+		ctx, cancel = context.WithCancel(context.Background())
+		mux         = new(event.Feed)
+		m           = metrics.NewMetrics("sync_test")
+		rollupCfg   = &rollup.EsConfig{
+			L2ChainID: new(big.Int).SetUint64(3333),
+		}
+		shards   = []uint64{0}
+		shardMap = map[common.Address][]uint64{contract: shards}
+	)
+	defer cancel()
+
+	metafile, err := CreateMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func() {
+		metafile.Close()
+		os.Remove(metafileName)
+	}()
+	shardManager, files := createEthStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	l1 := NewMockL1Source(lastKvIndex, metafileName)
+	sm := ethstorage.NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	data := makeKVStorage(contract, shards, defaultChunkSize, kvSize, kvEntries, lastKvIndex, common.Address{}, defaultEncodeType, metafile)
+	for i := uint64(0); i < kvEntries/2; i++ {
+		commit := data[contract][i].BlobCommit
+		if i == mismatched {
+			commit = generateMetadata(common.Hash{0x01})
+		}
+		if _, err := shardManager.TryWrite(i, data[contract][i].RowData, commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	localHost, syncCl := createLocalHostAndSyncClient(t, testLog, rollupCfg, db, sm, m, mux)
+	p := params
+	p.SkipFilled = true
+	syncCl.syncerParams = &p
+	syncCl.Start()
+
+	smr := &kvRecordingReader{
+		mockStorageManagerReader: &mockStorageManagerReader{
+			kvEntries:       kvEntries,
+			maxKvSize:       kvSize,
+			encodeType:      defaultEncodeType,
+			shards:          shards,
+			contractAddress: contract,
+			shardMiner:      common.Address{},
+			blobPayloads:    data[contract],
+		},
+		kvs: make(map[uint64]struct{}),
+	}
+	remoteHost := getNetHost(t)
+	serveSyncOnHost(ctx, remoteHost, rollupCfg, smr, m, testLog)
+	connect(t, localHost, remoteHost, shardMap, shardMap)
+	checkStall(t, 3, mux, cancel)
+
+	if !syncCl.syncDone {
+		t.Fatalf("sync should be done")
+	}
+	verifyKVs(data, make(map[uint64]struct{}), t)
+	expected := map[uint64]struct{}{mismatched: {}}
+	for i := kvEntries / 2; i < kvEntries; i++ {
+		expected[i] = struct{}{}
+	}
+	if !reflect.DeepEqual(smr.kvs, expected) {
+		t.Fatalf("expected the blobs %v requested, got %v", expected, smr.kvs)
+	}
+}
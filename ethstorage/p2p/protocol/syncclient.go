@@ -6,12 +6,16 @@ package protocol
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"math/rand"
 	"runtime"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,6 +30,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/time/rate"
 )
 
 // StreamCtxFn provides a new context to use when handling stream requests
@@ -41,8 +46,17 @@ const (
 	clientReadResponseTimeout = time.Second * 10
 	// after the rate-limit reservation hits the max throttle delay, give up on serving a request and just close the stream
 	maxThrottleDelay = time.Second * 20
+	// how long a peer which asked us to slow down is left alone before it gets the next request
+	throttledPeerBackoff = time.Second * 2
 
 	NewStreamTimeout = time.Second * 15
+	// the range requested from a peer is sized to be served in about this long at the throughput of the peer
+	rangeSizeTargetDuration = 500 * time.Millisecond
+	// weight of the last response in the throughput of a peer
+	throughputWeight = 0.5
+
+	// DefaultRequestTimeout leaves a peer serving a full response under its rate limits plenty of time
+	DefaultRequestTimeout = time.Second * 30
 
 	defaultMinPeersPerShard = 5
 
@@ -53,11 +67,18 @@ const (
 	RequestBlobsByRangeProtocolID = "/ethstorage/dev/requestblobsbyrange/%d/1.0.0"
 	RequestBlobsByListProtocolID  = "/ethstorage/dev/requestblobsbylist/%d/1.0.0"
 	RequestShardList              = "/ethstorage/dev/shardlist/1.0.0"
+
+	// compressedProtocolSuffix is appended to the ID of a blobs protocol for the variant whose
+	// responses are compressed with zstd
+	compressedProtocolSuffix = "/zstd"
+
+	// blobEmptyFillingMask is set in the local meta of a kv once it is synced or filled with empty
+	blobEmptyFillingMask = byte(0b10000000)
 )
 
 var (
-	maxKvCountPerReq            = uint64(16)
 	syncStatusKey               = []byte("SyncStatus")
+	syncTaskKeyPrefix           = []byte("SyncTask")
 	maxFillEmptyTaskTreads      = 1
 	requestTimeoutInMillisecond = 1000 * time.Millisecond // Millisecond
 )
@@ -66,6 +87,15 @@ func GetProtocolID(format string, l2ChainID *big.Int) protocol.ID {
 	return protocol.ID(fmt.Sprintf(format, l2ChainID))
 }
 
+// GetCompressedProtocolID returns the ID of the variant of the protocol with zstd compressed responses.
+func GetCompressedProtocolID(format string, l2ChainID *big.Int) protocol.ID {
+	return GetProtocolID(format, l2ChainID) + compressedProtocolSuffix
+}
+
+func isCompressedProtocol(id protocol.ID) bool {
+	return strings.HasSuffix(string(id), compressedProtocolSuffix)
+}
+
 type requestHandlerFn func(ctx context.Context, log log.Logger, stream network.Stream)
 
 func MakeStreamHandler(resourcesCtx context.Context, log log.Logger, fn requestHandlerFn) network.StreamHandler {
@@ -90,6 +120,9 @@ type SyncClientMetrics interface {
 	ClientOnBlobsByRange(peerID string, reqCount, retBlobCount, insertedCount uint64, duration time.Duration)
 	ClientOnBlobsByList(peerID string, reqCount, retBlobCount, insertedCount uint64, duration time.Duration)
 	ClientRecordTimeUsed(method string) func()
+	ClientRecordShardSync(contract common.Address, shardId uint64, reqCount, insertedCount, bytes uint64, duration time.Duration)
+	ClientSetShardHealCount(contract common.Address, shardId uint64, count int)
+	ClientSetWriteQueueDepth(depth int)
 	IncDropPeerCount()
 	IncPeerCount()
 	DecPeerCount()
@@ -104,6 +137,8 @@ type ShardManagerInfo interface {
 
 	MaxKvSize() uint64
 
+	ShardKvSize(shardIdx uint64) uint64
+
 	GetShardMiner(shardIdx uint64) (common.Address, bool)
 
 	GetShardEncodeType(shardIdx uint64) (uint64, bool)
@@ -112,7 +147,7 @@ type ShardManagerInfo interface {
 type StorageManagerReader interface {
 	ShardManagerInfo
 
-	TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error)
+	TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error)
 
 	TryReadMeta(kvIdx uint64) ([]byte, bool, error)
 }
@@ -122,7 +157,7 @@ type StorageManagerWriter interface {
 
 	CommitEmptyBlobs(start, limit uint64) (uint64, uint64, error)
 
-	CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error)
+	CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, []uint64, error)
 }
 
 type StorageManager interface {
@@ -135,6 +170,12 @@ type StorageManager interface {
 	DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error)
 
 	DownloadAllMetas(ctx context.Context, batchSize uint64) error
+
+	GetKvMetas(kvIndices []uint64) ([][32]byte, error)
+
+	RefreshMetas(ctx context.Context, blockNumber int64, batchSize uint64) ([]uint64, error)
+
+	InvalidateKv(kvIdx uint64) error
 }
 
 type SyncClient struct {
@@ -150,38 +191,68 @@ type SyncClient struct {
 	minPeersPerShard int
 	syncerParams     *SyncerParams
 
+	// evictPeerFn disconnects a peer evicted to balance the peers of the shards, may be nil
+	evictPeerFn func(id peer.ID)
+	// announcer announces the blobs synced to the peers, may be nil
+	announcer *BlobAnnouncer
+	// connectFn dials a peer to reconnect it, may be nil
+	connectFn func(ctx context.Context, id peer.ID) error
+	// reconnecting holds the peers being reconnected, so a peer is not dialed by two loops at once
+	reconnecting map[peer.ID]struct{}
+	// l1BlobSource downloads the blobs no peer has from L1, may be nil
+	l1BlobSource L1BlobSource
+	// healSince holds the time each blob in the heal tasks was first seen by the loop healing from L1
+	healSince map[kvKey]time.Time
+
 	// Don't allow anything to be added to the wait-group while, or after, we are shutting down.
 	// This is protected by lock.
 	closingPeers               bool
 	syncDone                   bool // Flag to signal that eth storage sync is done
+	looping                    bool // Flag to signal that the main loop is running, it returns once the sync is done
 	peers                      map[peer.ID]*Peer
 	idlerPeers                 map[peer.ID]struct{} // Peers that aren't serving requests
 	runningFillEmptyTaskTreads int                  // Number of working threads for processing empty task
+	runningRequests            int                  // Number of sync requests in flight
+	writeQueue                 int                  // Number of responses whose blobs are not written yet
+	nextTaskIdx                int                  // Index of the task to dispatch requests for first
+	writeSlots                 chan struct{}        // Limits the synced blob batches written concurrently, nil if unlimited
+	l1Finalized                uint64               // Number of the latest finalized L1 block, the metas are refreshed at
 
 	peerJoin chan peer.ID
 	update   chan struct{} // Notification channel for possible sync progression
 
+	// Peers added but not yet handed to the sync tasks. If joinLimiter is set, they are moved to
+	// idlerPeers at its pace to avoid a burst of requests when many peers connect at once.
+	joinLimiter  *rate.Limiter
+	pendingPeers []peer.ID
+	peerQueued   chan struct{}
+
 	// resource context: all peers and mainLoop tasks inherit this, and origin shutting down once resCancel() is called.
 	resCtx    context.Context
 	resCancel context.CancelFunc
 
 	// wait group: wait for the resources to close. Adding to this is only safe if the peersLock is held.
 	wg sync.WaitGroup
-	// lock Protects fields (peers, idlerPeers, runningFillEmptyTaskTreads, closingPeers, syncDone,
-	// task.statelessPeers, healTask.Indexes, subTask.isRunning, subTask.done, subEmptyTask.isRunning, subEmptyTask.done)
+	// lock Protects fields (peers, idlerPeers, pendingPeers, runningFillEmptyTaskTreads, runningRequests, writeQueue, nextTaskIdx, l1Finalized, closingPeers, syncDone, looping,
+	// l1BlobSource, healSince,
+	// task.statelessPeers, healTask.Indexes, subTask.isRunning, subTask.done, the request state of subTask,
+	// subEmptyTask.isRunning, subEmptyTask.done)
 	lock sync.Mutex
 
-	prover         prv.IProver
-	startTime      time.Time // Time instance when storage sync started
-	logTime        time.Time // Time instance when status was last reported
-	saveTime       time.Time // Time instance when state was last saved to DB
-	storageManager StorageManager
+	prover    prv.IProver
+	startTime time.Time // Time instance when storage sync started
+	logTime   time.Time // Time instance when status was last reported
+	saveTime  time.Time // Time instance when state was last saved to DB
+
+	storageManagers map[common.Address]StorageManager // Storage of each contract synced
+	contracts       []common.Address                  // Contracts synced, in the order their storage was added
 
 	totalSecondsUsed uint64
 	blobsSynced      uint64
 	syncedBytes      common.StorageSize
 	emptyBlobsToFill uint64
 	emptyBlobsFilled uint64
+	emptyBytesFilled common.StorageSize
 }
 
 func NewSyncClient(log log.Logger, cfg *rollup.EsConfig, newStream newStreamFn, storageManager StorageManager, params *SyncerParams,
@@ -192,8 +263,6 @@ func NewSyncClient(log log.Logger, cfg *rollup.EsConfig, newStream newStreamFn,
 	} else if runtime.NumCPU() > 2 {
 		maxFillEmptyTaskTreads = runtime.NumCPU() - 2
 	}
-	maxKvCountPerReq = params.MaxRequestSize / storageManager.MaxKvSize()
-	shardCount := len(storageManager.Shards())
 	if m == nil {
 		m = metrics.NoopMetrics
 	}
@@ -207,20 +276,66 @@ func NewSyncClient(log log.Logger, cfg *rollup.EsConfig, newStream newStreamFn,
 		newStreamFn:                newStream,
 		idlerPeers:                 make(map[peer.ID]struct{}),
 		peers:                      make(map[peer.ID]*Peer),
+		reconnecting:               make(map[peer.ID]struct{}),
+		healSince:                  make(map[kvKey]time.Time),
 		peerJoin:                   make(chan peer.ID, 1),
 		update:                     make(chan struct{}, 1),
 		runningFillEmptyTaskTreads: 0,
+		peerQueued:                 make(chan struct{}, 1),
 		resCtx:                     ctx,
 		resCancel:                  cancel,
-		storageManager:             storageManager,
+		storageManagers:            make(map[common.Address]StorageManager),
 		prover:                     prv.NewKZGProver(log),
 		maxPeers:                   params.MaxPeers,
-		minPeersPerShard:           getMinPeersPerShard(params.MaxPeers, shardCount),
 		syncerParams:               params,
 	}
+	c.AddStorageManager(storageManager)
+	if params.MaxConcurrentWrites > 0 {
+		c.writeSlots = make(chan struct{}, params.MaxConcurrentWrites)
+	}
+	if params.PeerJoinRate > 0 {
+		// the peers join one by one, so a batch of peers connected at once is spread over time
+		c.joinLimiter = rate.NewLimiter(rate.Limit(params.PeerJoinRate), 1)
+	}
 	return c
 }
 
+// AddStorageManager adds the storage of another contract to sync, the tasks of its shards are created
+// along with the ones of the other contracts once the client starts, so it must be called before Start.
+// The storage of a contract added already is ignored.
+func (s *SyncClient) AddStorageManager(storageManager StorageManager) {
+	contract := storageManager.ContractAddress()
+	if _, ok := s.storageManagers[contract]; ok {
+		return
+	}
+	s.storageManagers[contract] = storageManager
+	s.contracts = append(s.contracts, contract)
+
+	shardCount := 0
+	for _, sm := range s.storageManagers {
+		shardCount += len(sm.Shards())
+	}
+	s.minPeersPerShard = getMinPeersPerShard(s.maxPeers, shardCount)
+}
+
+// maxKvCountPerReq returns the number of kvs of the contract fitting in a request of MaxRequestSize, at least 1.
+func (s *SyncClient) maxKvCountPerReq(contract common.Address) uint64 {
+	return max(s.syncerParams.MaxRequestSize/s.storage(contract).MaxKvSize(), 1)
+}
+
+// SetProver sets the prover computing the roots of the blobs synced to verify them against their commits
+// in the contract, e.g. one loading a custom KZG trusted setup. It must be called before Start.
+func (s *SyncClient) SetProver(p prv.IProver) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prover = p
+}
+
+// storage returns the storage manager of the contract, nil if the contract is not synced.
+func (s *SyncClient) storage(contract common.Address) StorageManager {
+	return s.storageManagers[contract]
+}
+
 func getMinPeersPerShard(maxPeers, shardCount int) int {
 	minPeersPerShard := (maxPeers + shardCount - 1) / shardCount
 	if minPeersPerShard < defaultMinPeersPerShard {
@@ -240,7 +355,7 @@ func (s *SyncClient) setSyncDone() {
 func (s *SyncClient) loadSyncStatus() {
 	// Start a fresh sync for retrieval.
 	s.blobsSynced, s.syncedBytes = 0, 0
-	s.emptyBlobsToFill, s.emptyBlobsFilled = 0, 0
+	s.emptyBlobsToFill, s.emptyBlobsFilled, s.emptyBytesFilled = 0, 0, 0
 	s.totalSecondsUsed = 0
 	var progress SyncProgress
 
@@ -248,53 +363,111 @@ func (s *SyncClient) loadSyncStatus() {
 		if err := json.Unmarshal(status, &progress); err != nil {
 			log.Error("Failed to decode storage sync status", "err", err)
 		} else {
-			for _, task := range progress.Tasks {
-				log.Debug("Load sync subTask", "contract", task.Contract.Hex(),
-					"shard", task.ShardId, "count", len(task.SubTasks))
-				task.healTask = &healTask{
-					Indexes: make(map[uint64]int64),
-					task:    task,
-				}
-				task.statelessPeers = make(map[peer.ID]struct{})
-				task.peers = make(map[peer.ID]struct{})
-				for _, sTask := range task.SubTasks {
-					sTask.task = task
-					sTask.next = sTask.First
-				}
-				for _, sEmptyTask := range task.SubEmptyTasks {
-					sEmptyTask.task = task
-					s.emptyBlobsToFill += sEmptyTask.Last - sEmptyTask.First
-				}
-			}
 			s.blobsSynced, s.syncedBytes = progress.BlobsSynced, progress.SyncedBytes
-			s.emptyBlobsFilled = progress.EmptyBlobsFilled
+			s.emptyBlobsFilled, s.emptyBytesFilled = progress.EmptyBlobsFilled, progress.EmptyBytesFilled
 			s.totalSecondsUsed = progress.TotalSecondsUsed
 		}
 	}
 
 	// create tasks
-	lastKvIndex := s.storageManager.LastKvIndex()
-	for _, sid := range s.storageManager.Shards() {
-		exist := false
-		for _, task := range progress.Tasks {
-			if task.Contract == s.storageManager.ContractAddress() && task.ShardId == sid {
-				s.tasks = append(s.tasks, task)
-				exist = true
+	for _, contract := range s.contracts {
+		sm := s.storageManagers[contract]
+		lastKvIndex := sm.LastKvIndex()
+		for _, sid := range sm.Shards() {
+			t := s.loadTask(contract, sid)
+			if t == nil {
+				// tasks saved by older versions are part of the sync status
+				for _, pt := range progress.Tasks {
+					if pt.Contract == contract && pt.ShardId == sid {
+						t = pt
+						break
+					}
+				}
+			}
+			if t == nil {
+				s.tasks = append(s.tasks, s.createTask(contract, sid, lastKvIndex))
 				continue
 			}
+
+			log.Debug("Load sync subTask", "contract", t.Contract.Hex(), "shard", t.ShardId,
+				"count", len(t.SubTasks), "healCount", len(t.HealIndexes))
+			s.restoreTask(t, lastKvIndex)
+			s.tasks = append(s.tasks, t)
 		}
-		if exist {
-			continue
-		}
+	}
+}
 
-		task := s.createTask(sid, lastKvIndex)
-		s.tasks = append(s.tasks, task)
+// loadTask reads the task of the shard from DB, nil is returned if the task was not saved.
+func (s *SyncClient) loadTask(contract common.Address, sid uint64) *task {
+	data, _ := s.db.Get(syncTaskKey(contract, sid))
+	if data == nil {
+		return nil
 	}
+	var t task
+	if err := json.Unmarshal(data, &t); err != nil {
+		log.Error("Failed to decode sync task", "contract", contract.Hex(), "shard", sid, "err", err)
+		return nil
+	}
+	return &t
 }
 
-func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
+// restoreTask rebuilds the in memory state of a task loaded from DB. As blobs may have been
+// added to the contract while the node was down, the ranges of the task are reconciled
+// against lastKvIndex: ranges below it are synced from peers, and ranges above it are filled
+// with empty blobs.
+func (s *SyncClient) restoreTask(t *task, lastKvIndex uint64) {
+	t.healTask = &healTask{
+		Indexes: make(map[uint64]int64),
+		task:    t,
+	}
+	t.statelessPeers = make(map[peer.ID]struct{})
+	t.peers = make(map[peer.ID]struct{})
+
+	subTasks := make([]*subTask, 0, len(t.SubTasks))
+	subEmptyTasks := make([]*subEmptyTask, 0, len(t.SubEmptyTasks))
+	for _, sTask := range t.SubTasks {
+		if sTask.Last > lastKvIndex {
+			first := max(sTask.First, lastKvIndex)
+			subEmptyTasks = append(subEmptyTasks, &subEmptyTask{task: t, First: first, Last: sTask.Last})
+			sTask.Last = first
+		}
+		if sTask.First < sTask.Last {
+			sTask.task = t
+			sTask.next = sTask.First
+			subTasks = append(subTasks, sTask)
+		}
+	}
+	for _, sEmptyTask := range t.SubEmptyTasks {
+		if sEmptyTask.First < lastKvIndex {
+			last := min(sEmptyTask.Last, lastKvIndex)
+			subTasks = append(subTasks, &subTask{task: t, next: sEmptyTask.First, First: sEmptyTask.First, Last: last})
+			sEmptyTask.First = last
+		}
+		if sEmptyTask.First < sEmptyTask.Last {
+			sEmptyTask.task = t
+			subEmptyTasks = append(subEmptyTasks, sEmptyTask)
+		}
+	}
+	// heal indexes are always inside the range of a subTask, so those beyond
+	// lastKvIndex are already covered by the subEmptyTasks above.
+	for _, idx := range t.HealIndexes {
+		if idx < lastKvIndex {
+			t.healTask.Indexes[idx] = 0
+		}
+	}
+	t.HealIndexes = nil
+	t.SubTasks, t.SubEmptyTasks = subTasks, subEmptyTasks
+	if s.syncerParams.EmptyFillPolicy == EmptyFillLazy {
+		return
+	}
+	for _, sEmptyTask := range t.SubEmptyTasks {
+		s.emptyBlobsToFill += sEmptyTask.Last - sEmptyTask.First
+	}
+}
+
+func (s *SyncClient) createTask(contract common.Address, sid uint64, lastKvIndex uint64) *task {
 	task := task{
-		Contract:       s.storageManager.ContractAddress(),
+		Contract:       contract,
 		ShardId:        sid,
 		nextIdx:        0,
 		statelessPeers: make(map[peer.ID]struct{}),
@@ -306,7 +479,8 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 		Indexes: make(map[uint64]int64),
 	}
 
-	first, limit := s.storageManager.KvEntries()*sid, s.storageManager.KvEntries()*(sid+1)
+	kvEntries := s.storage(contract).KvEntries()
+	first, limit := kvEntries*sid, kvEntries*(sid+1)
 	firstEmpty, limitForEmpty := uint64(0), uint64(0)
 	if first >= lastKvIndex {
 		firstEmpty, limitForEmpty = first, limit
@@ -343,7 +517,9 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 
 	subEmptyTasks := make([]*subEmptyTask, 0)
 	if limitForEmpty > 0 {
-		s.emptyBlobsToFill += limitForEmpty - firstEmpty
+		if s.syncerParams.EmptyFillPolicy != EmptyFillLazy {
+			s.emptyBlobsToFill += limitForEmpty - firstEmpty
+		}
 		maxEmptyTaskSize := (limitForEmpty - firstEmpty + uint64(maxFillEmptyTaskTreads) - 1) / uint64(maxFillEmptyTaskTreads)
 		if maxEmptyTaskSize < minSubTaskSize {
 			maxEmptyTaskSize = minSubTaskSize
@@ -370,7 +546,7 @@ func (s *SyncClient) createTask(sid uint64, lastKvIndex uint64) *task {
 	return &task
 }
 
-// saveSyncStatus marshals the remaining sync tasks into leveldb.
+// saveSyncStatus marshals the sync progress and the remaining sync tasks into leveldb.
 func (s *SyncClient) saveSyncStatus(force bool) {
 	if !force && time.Since(s.saveTime) < 5*time.Minute {
 		return
@@ -379,13 +555,16 @@ func (s *SyncClient) saveSyncStatus(force bool) {
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	// Store the actual progress markers
+	for _, t := range s.tasks {
+		s.saveTask(t)
+	}
+	// Store the actual progress markers, tasks are saved under their own keys
 	progress := &SyncProgress{
-		Tasks:            s.tasks,
 		BlobsSynced:      s.blobsSynced,
 		SyncedBytes:      s.syncedBytes,
 		EmptyBlobsToFill: s.emptyBlobsToFill,
 		EmptyBlobsFilled: s.emptyBlobsFilled,
+		EmptyBytesFilled: s.emptyBytesFilled,
 		TotalSecondsUsed: s.totalSecondsUsed,
 	}
 	status, err := json.Marshal(progress)
@@ -398,6 +577,32 @@ func (s *SyncClient) saveSyncStatus(force bool) {
 	log.Debug("Save sync state to DB")
 }
 
+// saveTask marshals the task together with its heal indexes into leveldb under the key of
+// its contract and shard. The caller must hold s.lock.
+func (s *SyncClient) saveTask(t *task) {
+	t.HealIndexes = make([]uint64, 0, len(t.healTask.Indexes))
+	for idx := range t.healTask.Indexes {
+		t.HealIndexes = append(t.HealIndexes, idx)
+	}
+	sort.Slice(t.HealIndexes, func(i, j int) bool { return t.HealIndexes[i] < t.HealIndexes[j] })
+	data, err := json.Marshal(t)
+	t.HealIndexes = nil
+	if err != nil {
+		panic(err) // This can only fail during implementation
+	}
+	if err := s.db.Put(syncTaskKey(t.Contract, t.ShardId), data); err != nil {
+		log.Error("Failed to store sync task", "contract", t.Contract.Hex(), "shard", t.ShardId, "err", err)
+	}
+}
+
+// syncTaskKey returns the leveldb key of the sync task for the shard of the contract.
+func syncTaskKey(contract common.Address, shardId uint64) []byte {
+	key := make([]byte, 0, len(syncTaskKeyPrefix)+common.AddressLength+8)
+	key = append(key, syncTaskKeyPrefix...)
+	key = append(key, contract.Bytes()...)
+	return binary.BigEndian.AppendUint64(key, shardId)
+}
+
 // cleanTasks removes kv range retrieval tasks that have already been completed.
 func (s *SyncClient) cleanTasks() {
 	// Sync wasn't finished previously, check for any subTask that can be finalized
@@ -405,6 +610,8 @@ func (s *SyncClient) cleanTasks() {
 	defer s.lock.Unlock()
 	allDone := true
 	for _, t := range s.tasks {
+		lastKvIndex := s.storage(t.Contract).LastKvIndex()
+		completed := false
 		for i := 0; i < len(t.SubTasks); i++ {
 			exist, first := t.healTask.hasIndexInRange(t.SubTasks[i].First, t.SubTasks[i].next)
 			// if existed, min will be the smallest index in range [subTask.First, subTask.next)
@@ -416,26 +623,33 @@ func (s *SyncClient) cleanTasks() {
 					t.nextIdx--
 				}
 				i--
+				completed = true
 			}
 		}
 		for i := 0; i < len(t.SubEmptyTasks); i++ {
 			if t.SubEmptyTasks[i].done {
 				t.SubEmptyTasks = append(t.SubEmptyTasks[:i], t.SubEmptyTasks[i+1:]...)
 				i--
+				completed = true
 			}
 		}
-		if len(t.SubTasks) > 0 || len(t.SubEmptyTasks) > 0 {
+		if completed {
+			s.saveTask(t)
+		}
+		// the requeued kvs may be healed after all the subTasks are done
+		if len(t.SubTasks) > 0 || t.healTask.count() > 0 || s.hasEmptyToFill(t, lastKvIndex) {
 			allDone = false
 		} else if !t.done {
 			t.done = true
-			if s.mux != nil {
-				s.mux.Send(EthStorageSyncDone{DoneType: SingleShardDone, ShardId: t.ShardId})
+			if s.mux != nil && !t.doneSent {
+				s.mux.Send(EthStorageSyncDone{DoneType: SingleShardDone, Contract: t.Contract, ShardId: t.ShardId})
 			}
+			t.doneSent = true
 		}
 	}
 
 	// If everything was just finalized, generate the account trie and origin heal
-	if allDone {
+	if allDone && !s.syncDone {
 		s.setSyncDone()
 		log.Info("Storage sync done", "subTaskCount", len(s.tasks))
 
@@ -443,6 +657,24 @@ func (s *SyncClient) cleanTasks() {
 	}
 }
 
+// leftUnfilled reports whether the subEmptyTask is left unwritten by the EmptyFillLazy policy. Only the
+// kvs beyond the last kv index are left, the empty kvs found by the heal below it are always filled as
+// they may still hold the data of a removed blob. The subEmptyTask is kept in the task, so it is turned
+// into a subTask if the last kv index has grown over it by the next start.
+func (s *SyncClient) leftUnfilled(et *subEmptyTask, lastKvIndex uint64) bool {
+	return s.syncerParams.EmptyFillPolicy == EmptyFillLazy && et.First >= lastKvIndex
+}
+
+// hasEmptyToFill reports whether the task has empty kvs to fill before it is done.
+func (s *SyncClient) hasEmptyToFill(t *task, lastKvIndex uint64) bool {
+	for _, et := range t.SubEmptyTasks {
+		if !s.leftUnfilled(et, lastKvIndex) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *SyncClient) Start() error {
 	if s.startTime == (time.Time{}) {
 		s.startTime = time.Now()
@@ -452,14 +684,197 @@ func (s *SyncClient) Start() error {
 	s.loadSyncStatus()
 	s.lock.Lock()
 	s.closingPeers = false
+	s.looping = true
 	s.lock.Unlock()
 
 	s.wg.Add(1)
 	go s.mainLoop()
+	if s.joinLimiter != nil {
+		s.wg.Add(1)
+		go s.onboardPeers()
+	}
+	if s.syncerParams.MetaRefreshInterval > 0 {
+		s.wg.Add(1)
+		go s.refreshMetasLoop()
+	}
+	if s.syncerParams.L1HealTimeout > 0 {
+		s.wg.Add(1)
+		go s.healFromL1Loop()
+	}
+	if s.syncerParams.StallTimeout > 0 {
+		s.wg.Add(1)
+		go s.stallWatchdog()
+	}
 
 	return nil
 }
 
+// OnL1Finalized records the latest finalized L1 block, which the metas are refreshed at.
+func (s *SyncClient) OnL1Finalized(number uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if number > s.l1Finalized {
+		s.l1Finalized = number
+	}
+}
+
+// refreshMetasLoop periodically re-reads the metas of the local kvs at the finalized block,
+// so the blobs whose commits were changed by an L1 reorg after their metas were downloaded get synced again.
+func (s *SyncClient) refreshMetasLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.syncerParams.MetaRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.resCtx.Done():
+			return
+		}
+		s.lock.Lock()
+		finalized, done := s.l1Finalized, s.syncDone
+		s.lock.Unlock()
+		if done {
+			return
+		}
+		if finalized == 0 {
+			continue
+		}
+		s.refreshMetas(int64(finalized))
+	}
+}
+
+func (s *SyncClient) refreshMetas(blockNumber int64) {
+	for _, contract := range s.contracts {
+		changed, err := s.storageManagers[contract].RefreshMetas(s.resCtx, blockNumber, s.syncerParams.MetaDownloadBatchSize)
+		if err != nil {
+			s.log.Warn("Refresh blob metadata failed", "contract", contract, "blockNumber", blockNumber, "err", err)
+			continue
+		}
+		if len(changed) > 0 {
+			s.log.Info("Blob metadata changed, sync the blobs again", "contract", contract, "blockNumber", blockNumber, "count", len(changed))
+			s.requeueKvs(contract, changed)
+		}
+	}
+}
+
+// requeueKvs syncs the kvs whose metas changed again. The kvs waiting to be synced need nothing as they
+// are checked against the new metas; synced kvs are healed, or filled with empty blobs if they are beyond
+// the last kv index. Ranges beyond a shrunk last kv index are moved from the subTasks to the subEmptyTasks.
+// If the sync is done, it is resumed to sync the kvs.
+func (s *SyncClient) requeueKvs(contract common.Address, kvIndices []uint64) {
+	sm := s.storage(contract)
+	if sm == nil {
+		return
+	}
+	lastKvIndex, kvEntries := sm.LastKvIndex(), sm.KvEntries()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closingPeers {
+		return
+	}
+	requeued := false
+	for _, t := range s.tasks {
+		if t.Contract != contract {
+			continue
+		}
+		first, limit := kvEntries*t.ShardId, kvEntries*(t.ShardId+1)
+		empty := make(map[uint64]struct{})
+		for _, st := range t.SubTasks {
+			if st.Last > lastKvIndex {
+				for idx := max(st.next, lastKvIndex); idx < st.Last; idx++ {
+					empty[idx] = struct{}{}
+				}
+				st.Last = max(st.next, lastKvIndex)
+				if st.next == st.Last {
+					st.done = true
+				}
+			}
+		}
+		for idx := range t.healTask.Indexes {
+			if idx >= lastKvIndex {
+				delete(t.healTask.Indexes, idx)
+				empty[idx] = struct{}{}
+			}
+		}
+
+		heal := make([]uint64, 0)
+		for _, idx := range kvIndices {
+			if idx < first || idx >= limit || t.isPending(idx) {
+				continue
+			}
+			if idx < lastKvIndex {
+				heal = append(heal, idx)
+			} else {
+				empty[idx] = struct{}{}
+			}
+		}
+		if len(heal) == 0 && len(empty) == 0 {
+			continue
+		}
+		requeued = true
+		t.healTask.insert(heal)
+		emptyIndexes := make([]uint64, 0, len(empty))
+		for idx := range empty {
+			emptyIndexes = append(emptyIndexes, idx)
+		}
+		sort.Slice(emptyIndexes, func(i, j int) bool { return emptyIndexes[i] < emptyIndexes[j] })
+		for i := 0; i < len(emptyIndexes); {
+			j := i + 1
+			for j < len(emptyIndexes) && emptyIndexes[j] == emptyIndexes[j-1]+1 {
+				j++
+			}
+			t.SubEmptyTasks = append(t.SubEmptyTasks, &subEmptyTask{task: t, First: emptyIndexes[i], Last: emptyIndexes[j-1] + 1})
+			s.emptyBlobsToFill += uint64(j - i)
+			i = j
+		}
+		t.done = false
+		s.saveTask(t)
+	}
+	if requeued && s.syncDone {
+		s.resumeSync()
+	}
+	s.notifyUpdate()
+}
+
+// resumeSync marks the sync not done, and starts the main loop again if it has returned. The caller must
+// hold s.lock.
+func (s *SyncClient) resumeSync() {
+	s.syncDone = false
+	if s.looping || s.resCtx.Err() != nil {
+		return
+	}
+	s.log.Info("Resume sync for the requeued blobs")
+	s.looping = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.runTasks()
+	}()
+}
+
+// HealCorrupt queues the kv of the contract in a *ethstorage.ChunkCorruptError to be synced again from the
+// peers, and reports whether err is such an error. The sync is resumed to heal the kv if it is done.
+func (s *SyncClient) HealCorrupt(contract common.Address, err error) bool {
+	var ce *ethstorage.ChunkCorruptError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	sm := s.storage(contract)
+	if sm == nil {
+		return true
+	}
+	s.log.Warn("Local blob corrupt, sync it again", "contract", contract, "kvIdx", ce.KvIdx, "chunkIdx", ce.ChunkIdx, "file", ce.Filename)
+	// the local meta still matches the contract, so the blob would not be written again without clearing it
+	if err := sm.InvalidateKv(ce.KvIdx); err != nil {
+		s.log.Warn("Invalidate corrupt blob failed", "kvIdx", ce.KvIdx, "err", err)
+		return true
+	}
+	s.requeueKvs(contract, []uint64{ce.KvIdx})
+	return true
+}
+
 func (s *SyncClient) AddPeer(id peer.ID, shards map[common.Address][]uint64, direction network.Direction) bool {
 	s.lock.Lock()
 	if _, ok := s.peers[id]; ok {
@@ -478,32 +893,238 @@ func (s *SyncClient) AddPeer(id peer.ID, shards map[common.Address][]uint64, dir
 		s.lock.Unlock()
 		return false
 	}
+	if !s.underShardCap(shards) {
+		s.log.Info("Shards of the peer have enough peers, the connection would be closed later",
+			"maxPeersPerShard", s.syncerParams.MaxPeersPerShard, "peer", id.String(), "shards", shards)
+		s.metrics.IncDropPeerCount()
+		s.lock.Unlock()
+		return false
+	}
 	// add new peer routine
 	pr := NewPeer(0, s.cfg.L2ChainID, id, s.newStreamFn, direction, shards)
+	pr.requestTimeout = s.syncerParams.RequestTimeout
 	s.peers[id] = pr
 
-	s.idlerPeers[id] = struct{}{}
 	s.addPeerToTask(id, shards)
 	s.metrics.IncPeerCount()
+	evicted := s.balanceShardPeers(id)
+	if s.joinLimiter != nil {
+		s.pendingPeers = append(s.pendingPeers, id)
+		s.lock.Unlock()
+
+		s.evictPeers(evicted)
+		select {
+		case s.peerQueued <- struct{}{}:
+		default:
+		}
+		return true
+	}
+	s.idlerPeers[id] = struct{}{}
 	s.lock.Unlock()
 
+	s.evictPeers(evicted)
 	s.notifyPeerJoin(id)
 	return true
 }
 
+// SetEvictPeerFn sets the function to disconnect the peers evicted to keep the peers of each shard
+// under MaxPeersPerShard.
+func (s *SyncClient) SetEvictPeerFn(fn func(id peer.ID)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.evictPeerFn = fn
+}
+
+func (s *SyncClient) setAnnouncer(a *BlobAnnouncer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.announcer = a
+}
+
+// announceBlobs queues the blobs synced to be announced to the peers.
+func (s *SyncClient) announceBlobs(contract common.Address, kvIndices []uint64) {
+	s.lock.Lock()
+	a := s.announcer
+	s.lock.Unlock()
+	if a != nil {
+		a.Announce(contract, kvIndices)
+	}
+}
+
+// OnBlobAnnouncement handles the announcement of a peer that it has newly written the blobs of the contract
+// from first to last (exclusive). The peer is no longer taken as stateless by the tasks of the blobs, and
+// the blobs queued in the heal tasks are requested again at once, so they are requested from the peer
+// which may have lacked them before.
+func (s *SyncClient) OnBlobAnnouncement(id peer.ID, contract common.Address, first, last uint64) {
+	sm := s.storage(contract)
+	if sm == nil {
+		return
+	}
+	kvEntries := sm.KvEntries()
+	s.lock.Lock()
+	if _, ok := s.peers[id]; !ok {
+		s.lock.Unlock()
+		return
+	}
+	retried := 0
+	for _, t := range s.tasks {
+		if t.Contract != contract || last <= t.ShardId*kvEntries || first >= (t.ShardId+1)*kvEntries {
+			continue
+		}
+		delete(t.statelessPeers, id)
+		indexes := make([]uint64, 0)
+		for idx := range t.healTask.Indexes {
+			if idx >= first && idx < last {
+				indexes = append(indexes, idx)
+			}
+		}
+		t.healTask.retry(indexes)
+		retried += len(indexes)
+	}
+	s.lock.Unlock()
+	s.log.Debug("Peer announced blobs", "peer", id, "contract", contract, "first", first, "last", last, "retried", retried)
+	s.notifyUpdate()
+}
+
+// underShardCap reports whether a shard of the peer has fewer peers than MaxPeersPerShard, so the
+// peer is needed by the shard. The caller must hold s.lock.
+func (s *SyncClient) underShardCap(shards map[common.Address][]uint64) bool {
+	maxPeers := s.syncerParams.MaxPeersPerShard
+	if maxPeers <= 0 {
+		return true
+	}
+	for _, t := range s.tasks {
+		if slices.Contains(shards[t.Contract], t.ShardId) && len(t.peers) < maxPeers {
+			return true
+		}
+	}
+	return false
+}
+
+// balanceShardPeers removes the peers from the shards over MaxPeersPerShard after the peer joined. Only
+// the peers whose shards are all over the limit are removed, preferring the ones serving fewer shards,
+// so the peers serving the shards with fewer providers are kept. The caller must hold s.lock.
+func (s *SyncClient) balanceShardPeers(joined peer.ID) []peer.ID {
+	maxPeers := s.syncerParams.MaxPeersPerShard
+	if maxPeers <= 0 {
+		return nil
+	}
+	var evicted []peer.ID
+	for _, t := range s.tasks {
+		for len(t.peers) > maxPeers {
+			var (
+				candidate peer.ID
+				served    int
+			)
+			for id := range t.peers {
+				if id == joined {
+					continue
+				}
+				if n, ok := s.redundantPeerShards(id); ok && (candidate == "" || n < served) {
+					candidate, served = id, n
+				}
+			}
+			if candidate == "" {
+				break
+			}
+			s.log.Info("Evict peer to balance the peers of shards", "peer", candidate, "contract", t.Contract.Hex(),
+				"shard", t.ShardId, "peers", len(t.peers))
+			s.removePeer(candidate)
+			evicted = append(evicted, candidate)
+		}
+	}
+	return evicted
+}
+
+// redundantPeerShards returns the number of local shards served by the peer, and whether all of them
+// have more peers than MaxPeersPerShard. The caller must hold s.lock.
+func (s *SyncClient) redundantPeerShards(id peer.ID) (int, bool) {
+	served := 0
+	for _, t := range s.tasks {
+		if _, ok := t.peers[id]; !ok {
+			continue
+		}
+		if len(t.peers) <= s.syncerParams.MaxPeersPerShard {
+			return 0, false
+		}
+		served++
+	}
+	return served, true
+}
+
+func (s *SyncClient) evictPeers(ids []peer.ID) {
+	s.lock.Lock()
+	evict := s.evictPeerFn
+	s.lock.Unlock()
+	for _, id := range ids {
+		s.metrics.IncDropPeerCount()
+		if evict != nil {
+			evict(id)
+		}
+	}
+}
+
+// onboardPeers hands the pending peers to the sync tasks at the pace of joinLimiter.
+func (s *SyncClient) onboardPeers() {
+	defer s.wg.Done()
+
+	for {
+		s.lock.Lock()
+		pending := len(s.pendingPeers)
+		s.lock.Unlock()
+		if pending == 0 {
+			select {
+			case <-s.peerQueued:
+				continue
+			case <-s.resCtx.Done():
+				return
+			}
+		}
+		if err := s.joinLimiter.Wait(s.resCtx); err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		if len(s.pendingPeers) == 0 {
+			s.lock.Unlock()
+			continue
+		}
+		id := s.pendingPeers[0]
+		s.pendingPeers = s.pendingPeers[1:]
+		s.idlerPeers[id] = struct{}{}
+		s.lock.Unlock()
+
+		s.log.Debug("Peer onboarded to sync tasks", "peer", id, "pending", pending-1)
+		s.notifyPeerJoin(id)
+	}
+}
+
 func (s *SyncClient) RemovePeer(id peer.ID) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	pr, ok := s.peers[id]
-	if !ok {
+	if _, ok := s.peers[id]; !ok {
 		s.log.Debug("Cannot remove peer from sync duties, peer was not registered", "peer", id)
 		return
 	}
+	pr := s.peers[id]
+	s.removePeer(id)
+	s.scheduleReconnect(pr)
+}
+
+// removePeer removes a registered peer from the sync duties. The caller must hold s.lock.
+func (s *SyncClient) removePeer(id peer.ID) {
+	pr := s.peers[id]
 	pr.resCancel() // once loop exits
 	delete(s.peers, id)
 	s.removePeerFromTask(id, pr.shards)
 	s.metrics.DecPeerCount()
 	delete(s.idlerPeers, id)
+	for i, pid := range s.pendingPeers {
+		if pid == id {
+			s.pendingPeers = append(s.pendingPeers[:i], s.pendingPeers[i+1:]...)
+			break
+		}
+	}
 	for _, t := range s.tasks {
 		delete(t.statelessPeers, id)
 	}
@@ -523,15 +1144,20 @@ func (s *SyncClient) Close() error {
 	return nil
 }
 
-func (s *SyncClient) RequestL2Range(start, end uint64) (uint64, error) {
+// RequestL2Range requests the blobs of the contract from start to end from a peer, and writes them.
+func (s *SyncClient) RequestL2Range(contract common.Address, start, end uint64) (uint64, error) {
+	sm := s.storage(contract)
+	if sm == nil {
+		return 0, fmt.Errorf("contract %s is not synced", contract.Hex())
+	}
 	for _, pr := range s.peers {
 		id := rand.Uint64()
 		var packet BlobsByRangePacket
-		_, err := pr.RequestBlobsByRange(id, s.storageManager.ContractAddress(), start/s.storageManager.KvEntries(), start, end, s.syncerParams.MaxRequestSize, &packet)
+		_, err := pr.RequestBlobsByRange(id, sm.ContractAddress(), start/sm.KvEntries(), start, end, s.syncerParams.MaxRequestSize, &packet)
 		if err != nil {
 			return 0, err
 		}
-		_, _, _, err = s.onResult(packet.Blobs)
+		_, _, _, _, _, err = s.onResult(sm, packet.Blobs)
 		if err != nil {
 			return 0, err
 		}
@@ -540,18 +1166,23 @@ func (s *SyncClient) RequestL2Range(start, end uint64) (uint64, error) {
 	return 0, fmt.Errorf("no peer can be used to send requests")
 }
 
-func (s *SyncClient) RequestL2List(indexes []uint64) (uint64, error) {
+// RequestL2List requests the blobs of the contract in indexes from a peer, and writes them.
+func (s *SyncClient) RequestL2List(contract common.Address, indexes []uint64) (uint64, error) {
 	if len(indexes) == 0 {
 		return 0, nil
 	}
+	sm := s.storage(contract)
+	if sm == nil {
+		return 0, fmt.Errorf("contract %s is not synced", contract.Hex())
+	}
 	for _, pr := range s.peers {
 		id := rand.Uint64()
 		var packet BlobsByListPacket
-		_, err := pr.RequestBlobsByList(id, s.storageManager.ContractAddress(), indexes[0]/s.storageManager.KvEntries(), indexes, s.syncerParams.MaxRequestSize, &packet)
+		_, err := pr.RequestBlobsByList(id, sm.ContractAddress(), indexes[0]/sm.KvEntries(), indexes, s.syncerParams.MaxRequestSize, &packet)
 		if err != nil {
 			return 0, err
 		}
-		_, _, _, err = s.onResult(packet.Blobs)
+		_, _, _, _, _, err = s.onResult(sm, packet.Blobs)
 		if err != nil {
 			return 0, err
 		}
@@ -565,21 +1196,34 @@ func (s *SyncClient) mainLoop() {
 
 	s.cleanTasks()
 	if !s.syncDone {
-		err := s.storageManager.DownloadAllMetas(s.resCtx, s.syncerParams.MetaDownloadBatchSize)
-		if err != nil {
-			log.Error("Download blob metadata failed", "error", err)
-			return
+		for _, contract := range s.contracts {
+			err := s.storageManagers[contract].DownloadAllMetas(s.resCtx, s.syncerParams.MetaDownloadBatchSize)
+			if err != nil {
+				log.Error("Download blob metadata failed", "contract", contract, "error", err)
+				s.lock.Lock()
+				s.looping = false
+				s.lock.Unlock()
+				return
+			}
 		}
 	}
 
+	s.runTasks()
+}
+
+// runTasks assigns the tasks to the peers until the sync is done or the client is closed.
+func (s *SyncClient) runTasks() {
 	s.logTime = time.Now()
 	for {
 		// Remove all completed tasks and terminate sync if everything's done
 		s.cleanTasks()
-		if s.syncDone {
+		if s.stopLooping() {
 			s.saveSyncStatus(true)
 			return
 		}
+		if s.syncerParams.SkipFilled {
+			s.scanFilledSubTasks()
+		}
 		s.assignBlobRangeTasks()
 		// Assign all the Data retrieval tasks to any free peers
 		s.assignBlobHealTasks()
@@ -603,6 +1247,18 @@ func (s *SyncClient) mainLoop() {
 	}
 }
 
+// stopLooping reports whether the sync is done, in which case the main loop is marked returned, so the
+// sync is resumed by requeueKvs with the loop started again.
+func (s *SyncClient) stopLooping() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.syncDone {
+		return false
+	}
+	s.looping = false
+	return true
+}
+
 func (s *SyncClient) notifyPeerJoin(id peer.ID) {
 	select {
 	case s.peerJoin <- id:
@@ -617,6 +1273,24 @@ func (s *SyncClient) notifyUpdate() {
 	}
 }
 
+// returnIdlePeer marks the peer idle again after a request. If the peer asked us to slow down, or
+// did not answer in time, it is only marked idle after throttledPeerBackoff, so the request is
+// retried with another peer first.
+func (s *SyncClient) returnIdlePeer(id peer.ID, returnCode byte) {
+	if returnCode == returnCodeThrottled || returnCode == clientTimeout {
+		time.AfterFunc(throttledPeerBackoff, func() {
+			s.returnIdlePeer(id, returnCodeSuccess)
+		})
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.peers[id]; ok {
+		s.idlerPeers[id] = struct{}{}
+		s.notifyUpdate()
+	}
+}
+
 // assignBlobRangeTasks attempts to match idle peers to pending blob range retrievals.
 func (s *SyncClient) assignBlobRangeTasks() {
 	s.lock.Lock()
@@ -626,84 +1300,316 @@ func (s *SyncClient) assignBlobRangeTasks() {
 		return
 	}
 
-	// Iterate over all the tasks and try to find a pending one
-	for _, t := range s.tasks {
-		maxRange := s.syncerParams.MaxRequestSize / ethstorage.ContractToShardManager[t.Contract].MaxKvSize() * 2
-		subTaskCount := len(t.SubTasks)
-		for idx := 0; idx < subTaskCount; idx++ {
-			pr := s.getIdlePeerForTask(t)
-			if pr == nil {
-				break
+	// Dispatch one request per task in turn, so the idle peers serving several tasks
+	// are shared between the tasks instead of being drained by the first one
+	for assigned := true; assigned; {
+		assigned = false
+		for i := range s.tasks {
+			if !s.requestSlotAvailable() {
+				return
 			}
-			t.nextIdx = t.nextIdx % subTaskCount
-			st := t.SubTasks[t.nextIdx]
-			t.nextIdx++
-			if st.done {
+			t := s.tasks[(s.nextTaskIdx+i)%len(s.tasks)]
+			// leave the idle peers to the heal requests until the backlog of the task is worked off
+			if s.syncerParams.HealBacklogThreshold > 0 && t.healTask.count() > s.syncerParams.HealBacklogThreshold {
 				continue
 			}
-			// Skip any tasks already running
-			if st.isRunning {
-				continue
+			if s.assignBlobRangeTask(t) {
+				assigned = true
 			}
+		}
+	}
+	s.nextTaskIdx++
+}
 
-			last := st.next + maxRange
-			if last > st.Last {
-				last = st.Last
-			}
-			req := &blobsByRangeRequest{
-				peer:     pr.ID(),
-				id:       rand.Uint64(),
-				contract: t.Contract,
-				shardId:  t.ShardId,
-				origin:   st.next,
-				limit:    last - 1,
-				time:     time.Now(),
-				subTask:  st,
-			}
-			delete(s.idlerPeers, pr.ID())
-			st.isRunning = true
+// assignBlobRangeTask sends a request for the next pending subTask of the task to an idle peer,
+// it returns false if there is no pending subTask or no idle peer. The caller must hold s.lock.
+func (s *SyncClient) assignBlobRangeTask(t *task) bool {
+	kvSize := s.storage(t.Contract).MaxKvSize()
+	subTaskCount := len(t.SubTasks)
+	for idx := 0; idx < subTaskCount; idx++ {
+		pr := s.getIdlePeerForTask(t)
+		if pr == nil {
+			return false
+		}
+		t.nextIdx = t.nextIdx % subTaskCount
+		st := t.SubTasks[t.nextIdx]
+		t.nextIdx++
+		if st.done {
+			continue
+		}
+		// Skip any tasks already running
+		if st.isRunning {
+			continue
+		}
+		// leave the subTask to the other peers for a while after it stalled on this one
+		if st.stalledPeer == pr.ID() && time.Since(st.stalledAt) < s.syncerParams.StallTimeout {
+			continue
+		}
 
-			s.wg.Add(1)
-			go func(id peer.ID) {
-				defer func() {
-					s.lock.Lock()
-					st.isRunning = false
-					s.lock.Unlock()
-					s.wg.Done()
-				}()
-				start := time.Now()
-				var packet BlobsByRangePacket
-				// Attempt to send the remote request and revert if it fails
-				returnCode, err := pr.RequestBlobsByRange(req.id, req.contract, req.shardId, req.origin, req.limit, s.syncerParams.MaxRequestSize, &packet)
-				s.metrics.ClientGetBlobsByRangeEvent(req.peer.String(), returnCode, time.Since(start))
+		rangeSize := s.peerRangeSize(pr, kvSize)
+		last := st.next + rangeSize
+		if last > st.Last {
+			last = st.Last
+		}
+		if s.syncerParams.SkipFilled {
+			if last = s.skipFilled(st, rangeSize); st.done {
+				continue
+			}
+		}
+		req := &blobsByRangeRequest{
+			peer:     pr.ID(),
+			id:       rand.Uint64(),
+			contract: t.Contract,
+			shardId:  t.ShardId,
+			origin:   st.next,
+			limit:    last - 1,
+			bytes:    s.syncerParams.MaxRequestSize,
+			time:     time.Now(),
+			subTask:  st,
+		}
+		delete(s.idlerPeers, pr.ID())
+		reqCtx, cancel := context.WithCancel(s.resCtx)
+		st.isRunning = true
+		st.peer, st.cancel, st.writing, st.activeAt = pr.ID(), cancel, false, req.time
+		s.runningRequests++
 
+		s.wg.Add(1)
+		go func(id peer.ID) {
+			defer func() {
+				cancel()
 				s.lock.Lock()
-				if _, ok := s.peers[id]; ok {
-					s.idlerPeers[id] = struct{}{}
-					s.notifyUpdate()
-				}
+				st.isRunning = false
+				st.cancel, st.writing = nil, false
+				s.runningRequests--
 				s.lock.Unlock()
+				s.notifyUpdate()
+				s.wg.Done()
+			}()
+			start := time.Now()
+			var packet BlobsByRangePacket
+			// Attempt to send the remote request and revert if it fails
+			returnCode, err := pr.RequestBlobsByRangeCtx(reqCtx, req.id, req.contract, req.shardId, req.origin, req.limit, req.bytes, &packet)
+			elapsed := time.Since(start)
+			s.metrics.ClientGetBlobsByRangeEvent(req.peer.String(), returnCode, elapsed)
+			if err == nil {
+				// the response may wait on the write queue from now on, which is not a stall of the peer
+				s.lock.Lock()
+				st.writing = true
+				s.lock.Unlock()
+				// queue the blobs before the peer is idle, so no request is sent to it while the queue is full
+				defer s.enqueueWrite()()
+			}
+			s.returnIdlePeer(id, returnCode)
 
-				if err != nil {
-					log.Info("Failed to request blobs", "peer", pr.id.String(), "err", err)
-					return
+			if err != nil {
+				log.Info("Failed to request blobs", "peer", pr.id.String(), "err", err)
+				if returnCode != returnCodeThrottled {
+					s.scorePeer(id, peerScoreTimeout)
 				}
+				return
+			}
 
-				if req.id != packet.ID || req.contract != packet.Contract || req.shardId != packet.ShardId {
-					log.Info("Req mismatch with res", "reqId", req.id, "packetId", packet.ID,
-						"reqContract", req.contract.Hex(), "packetContract", packet.Contract.Hex(),
-						"reqShardId", req.shardId, "packetShardId", packet.ShardId)
-					return
-				}
-				res := &blobsByRangeResponse{
-					req:   req,
-					Blobs: packet.Blobs,
-					time:  time.Now(),
-				}
-				s.OnBlobsByRange(res)
-			}(pr.id)
+			if req.id != packet.ID || req.contract != packet.Contract || req.shardId != packet.ShardId {
+				log.Info("Req mismatch with res", "reqId", req.id, "packetId", packet.ID,
+					"reqContract", req.contract.Hex(), "packetContract", packet.Contract.Hex(),
+					"reqShardId", req.shardId, "packetShardId", packet.ShardId)
+				s.scorePeer(id, peerScoreMalformed)
+				return
+			}
+			s.updatePeerRangeSize(id, packet.Blobs, elapsed, kvSize)
+			res := &blobsByRangeResponse{
+				req:   req,
+				Blobs: packet.Blobs,
+				time:  time.Now(),
+			}
+			s.OnBlobsByRange(res)
+		}(pr.id)
+		return true
+	}
+	return false
+}
+
+// skipFilled moves next of the subTask over the kvs already filled with their commit in the contract, e.g.
+// before a restart, and queues the kvs filled with another commit to the heal task. It returns the end of
+// the range to request from next, at most rangeSize kvs, which stops before the next filled kv so the kvs
+// from there are checked before the following request. The filled kvs are the ones found by the scan of
+// scanFilledSubTasks, so no meta is read here. The caller must hold s.lock.
+func (s *SyncClient) skipFilled(st *subTask, rangeSize uint64) uint64 {
+	skipped, mismatched := 0, make([]uint64, 0)
+	for ; st.next < st.Last; st.next++ {
+		state := st.filledState(st.next)
+		if state == kvNotFilled {
+			break
+		}
+		if state == kvFilledMatched {
+			skipped++
+		} else {
+			mismatched = append(mismatched, st.next)
 		}
 	}
+	if skipped > 0 || len(mismatched) > 0 {
+		st.activeAt = time.Now()
+		st.task.healTask.insert(mismatched)
+		s.metrics.ClientSetShardHealCount(st.task.Contract, st.task.ShardId, st.task.healTask.count())
+		s.log.Debug("Skipped filled kvs", "shardId", st.task.ShardId, "next", st.next, "skipped", skipped, "mismatched", len(mismatched))
+	}
+	if st.next >= st.Last {
+		st.done = true
+		return st.Last
+	}
+	last := min(st.next+rangeSize, st.Last)
+	for idx := st.next + 1; idx < last; idx++ {
+		if st.filledState(idx) != kvNotFilled {
+			return idx
+		}
+	}
+	return last
+}
+
+// scanFilledSubTasks scans the filled kvs of the subTasks not scanned yet for skipFilled. The metas are
+// read without s.lock, so the disk reads do not hold up the requests and responses of the other subTasks.
+func (s *SyncClient) scanFilledSubTasks() {
+	type scan struct {
+		st          *subTask
+		first, last uint64
+	}
+	scans := make([]scan, 0)
+	s.lock.Lock()
+	for _, t := range s.tasks {
+		for _, st := range t.SubTasks {
+			if !st.scanned && !st.done {
+				scans = append(scans, scan{st: st, first: st.next, last: st.Last})
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	for _, sc := range scans {
+		filled := s.scanFilled(s.storage(sc.st.task.Contract), sc.first, sc.last)
+		s.lock.Lock()
+		sc.st.filled, sc.st.filledFrom, sc.st.scanned = filled, sc.first, true
+		s.lock.Unlock()
+	}
+}
+
+// scanFilled returns the filled states of the kvs from first to last. The metas of the filled kvs in the
+// contract are read in batches of MetaDownloadBatchSize, a kv whose meta is not known is not filled.
+func (s *SyncClient) scanFilled(sm StorageManager, first, last uint64) []kvFilledState {
+	states := make([]kvFilledState, last-first)
+	batch := max(s.syncerParams.MetaDownloadBatchSize, 1)
+	for from := first; from < last; from += batch {
+		to := min(from+batch, last)
+		indexes, locals := make([]uint64, 0, to-from), make([][]byte, 0, to-from)
+		for idx := from; idx < to; idx++ {
+			local, found, err := sm.TryReadMeta(idx)
+			if err != nil || !found || len(local) <= ethstorage.HashSizeInContract ||
+				local[ethstorage.HashSizeInContract]&blobEmptyFillingMask == 0 {
+				continue
+			}
+			indexes, locals = append(indexes, idx), append(locals, local)
+		}
+		if len(indexes) == 0 {
+			continue
+		}
+		metas, err := sm.GetKvMetas(indexes)
+		if err != nil || len(metas) != len(indexes) {
+			continue
+		}
+		for i, idx := range indexes {
+			states[idx-first] = kvFilledMismatch
+			if bytes.Equal(locals[i][:ethstorage.HashSizeInContract], metas[i][32-ethstorage.HashSizeInContract:]) {
+				states[idx-first] = kvFilledMatched
+			}
+		}
+	}
+	return states
+}
+
+// stallWatchdog periodically gives up the range requests whose subTask has not advanced for StallTimeout,
+// so the subTask is requested from another peer instead of waiting for the request timeout.
+func (s *SyncClient) stallWatchdog() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.syncerParams.StallTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.resCtx.Done():
+			return
+		}
+		s.lock.Lock()
+		done := s.syncDone
+		if !done {
+			s.cancelStalledRequests(time.Now())
+		}
+		s.lock.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// cancelStalledRequests cancels the running requests of the subTasks stalled at now. The subTasks whose
+// responses wait to be written are held back by the disk instead of the peer, and are left alone.
+// The caller must hold s.lock.
+func (s *SyncClient) cancelStalledRequests(now time.Time) {
+	for _, t := range s.tasks {
+		for _, st := range t.SubTasks {
+			if !st.isRunning || st.writing || st.cancel == nil || now.Sub(st.activeAt) < s.syncerParams.StallTimeout {
+				continue
+			}
+			s.log.Warn("Sync subtask stalled, reassigning it to another peer", "contract", t.Contract, "shardId", t.ShardId,
+				"next", st.next, "last", st.Last, "peer", st.peer, "idle", now.Sub(st.activeAt))
+			st.stalledPeer, st.stalledAt = st.peer, now
+			st.cancel()
+			st.cancel = nil
+		}
+	}
+}
+
+// peerRangeSize returns the number of blobs of the next range requested from the peer. Without a max
+// range size, it is twice the blobs fitting in a request. The caller must hold s.lock.
+func (s *SyncClient) peerRangeSize(pr *Peer, kvSize uint64) uint64 {
+	fixed := s.syncerParams.MaxRequestSize / kvSize * 2
+	if s.syncerParams.MaxRangeSize == 0 {
+		return fixed
+	}
+	if pr.rangeSize == 0 {
+		pr.rangeSize = s.clampRangeSize(fixed)
+	}
+	return pr.rangeSize
+}
+
+// updatePeerRangeSize measures the throughput of the peer from a range response, and sizes the next
+// range of the peer to be served in about rangeSizeTargetDuration, so the slow peers get smaller
+// ranges and do not hold back the sync of a task.
+func (s *SyncClient) updatePeerRangeSize(id peer.ID, blobs []*BlobPayload, elapsed time.Duration, kvSize uint64) {
+	if s.syncerParams.MaxRangeSize == 0 || len(blobs) == 0 || elapsed <= 0 {
+		return
+	}
+	bytes := 0
+	for _, blob := range blobs {
+		bytes += len(blob.EncodedBlob)
+	}
+	throughput := float64(bytes) / elapsed.Seconds()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pr, ok := s.peers[id]
+	if !ok {
+		return
+	}
+	if pr.throughput == 0 {
+		pr.throughput = throughput
+	} else {
+		pr.throughput = pr.throughput*(1-throughputWeight) + throughput*throughputWeight
+	}
+	pr.rangeSize = s.clampRangeSize(uint64(pr.throughput * rangeSizeTargetDuration.Seconds() / float64(kvSize)))
+}
+
+func (s *SyncClient) clampRangeSize(size uint64) uint64 {
+	return min(max(size, s.syncerParams.MinRangeSize, 1), s.syncerParams.MaxRangeSize)
 }
 
 // assignBlobHealTasks attempts to match idle peers to heal blob requests to retrieval missing blob from the blob list request.
@@ -715,15 +1621,16 @@ func (s *SyncClient) assignBlobHealTasks() {
 		return
 	}
 
-	// Iterate over all the tasks and try to find a pending one
-	for _, t := range s.tasks {
+	// Iterate over all the tasks, starting from the same task as the range requests, and try to find a pending one
+	for i := range s.tasks {
+		t := s.tasks[(s.nextTaskIdx+i)%len(s.tasks)]
 		// All the kvs are downloading, wait for request time or success
-		batch := s.syncerParams.MaxRequestSize / ethstorage.ContractToShardManager[t.Contract].MaxKvSize() * 2
+		batch := s.syncerParams.MaxRequestSize / s.storage(t.Contract).MaxKvSize() * 2
 
 		// kvHealTask pending retrieval, try to find an idle peer. If no such peer
 		// exists, we probably assigned tasks for all (or they are stateless).
 		// Abort the entire assignment mechanism.
-		if len(s.idlerPeers) == 0 {
+		if len(s.idlerPeers) == 0 || !s.requestSlotAvailable() {
 			return
 		}
 		indexes := t.healTask.getBlobIndexesForRequest(batch)
@@ -748,10 +1655,15 @@ func (s *SyncClient) assignBlobHealTasks() {
 		}
 		delete(s.idlerPeers, pr.ID())
 		req.healTask.refresh(indexes)
+		s.runningRequests++
 
 		s.wg.Add(1)
 		go func(id peer.ID) {
 			defer func() {
+				s.lock.Lock()
+				s.runningRequests--
+				s.lock.Unlock()
+				s.notifyUpdate()
 				s.wg.Done()
 			}()
 			start := time.Now()
@@ -759,22 +1671,29 @@ func (s *SyncClient) assignBlobHealTasks() {
 			// Attempt to send the remote request and revert if it fails
 			returnCode, err := pr.RequestBlobsByList(req.id, req.contract, req.shardId, req.indexes, s.syncerParams.MaxRequestSize, &packet)
 			s.metrics.ClientGetBlobsByListEvent(req.peer.String(), returnCode, time.Since(start))
-
-			s.lock.Lock()
-			if _, ok := s.peers[id]; ok {
-				s.idlerPeers[id] = struct{}{}
-				s.notifyUpdate()
+			if err == nil {
+				defer s.enqueueWrite()()
 			}
-			s.lock.Unlock()
+			s.returnIdlePeer(id, returnCode)
 
 			if err != nil {
 				log.Info("Failed to request packet", "peer", pr.id.String(), "err", err)
+				if returnCode != returnCodeThrottled {
+					s.scorePeer(id, peerScoreTimeout)
+				}
+				if returnCode == clientTimeout {
+					// request the blobs from another peer at once
+					s.lock.Lock()
+					req.healTask.retry(req.indexes)
+					s.lock.Unlock()
+				}
 				return
 			}
 			if req.id != packet.ID || req.contract != packet.Contract || req.shardId != packet.ShardId {
 				log.Info("Req mismatch with res", "reqId", req.id, "packetId", packet.ID,
 					"reqContract", req.contract.Hex(), "packetContract", packet.Contract.Hex(),
 					"reqShardId", req.shardId, "packetShardId", packet.ShardId)
+				s.scorePeer(id, peerScoreMalformed)
 				return
 			}
 			res := &blobsByListResponse{
@@ -792,6 +1711,7 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	for _, task := range s.tasks {
+		lastKvIndex := s.storage(task.Contract).LastKvIndex()
 		for _, emptyTask := range task.SubEmptyTasks {
 			if s.closingPeers {
 				return
@@ -799,7 +1719,7 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 			if s.runningFillEmptyTaskTreads >= maxFillEmptyTaskTreads {
 				return
 			}
-			if emptyTask.isRunning || emptyTask.done {
+			if emptyTask.isRunning || emptyTask.done || s.leftUnfilled(emptyTask, lastKvIndex) {
 				continue
 			}
 			eTask := emptyTask
@@ -816,7 +1736,7 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 					s.wg.Done()
 				}()
 				t := time.Now()
-				next, err := s.FillFileWithEmptyBlob(start, limit)
+				next, err := s.FillFileWithEmptyBlob(contract, start, limit)
 				if err != nil {
 					log.Warn("Fill in empty fail", "err", err.Error())
 				} else {
@@ -826,6 +1746,7 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 
 				s.lock.Lock()
 				s.emptyBlobsFilled += filled
+				s.emptyBytesFilled += common.StorageSize(filled * s.storage(contract).MaxKvSize())
 				if s.emptyBlobsToFill >= filled {
 					s.emptyBlobsToFill -= filled
 				} else {
@@ -843,17 +1764,82 @@ func (s *SyncClient) assignFillEmptyBlobTasks() {
 	}
 }
 
+// requestSlotAvailable returns whether one more sync request can be sent within MaxConcurrentRequests,
+// and the write queue has room for its response. The caller must hold s.lock.
+func (s *SyncClient) requestSlotAvailable() bool {
+	if s.syncerParams.MaxWriteQueue > 0 && s.writeQueue >= s.syncerParams.MaxWriteQueue {
+		return false
+	}
+	return s.syncerParams.MaxConcurrentRequests <= 0 || s.runningRequests < s.syncerParams.MaxConcurrentRequests
+}
+
+// enqueueWrite counts a response in the write queue until the returned func is called once its blobs
+// are written, so the sync does not request blobs faster than the disk takes them.
+func (s *SyncClient) enqueueWrite() func() {
+	s.lock.Lock()
+	s.writeQueue++
+	depth := s.writeQueue
+	s.lock.Unlock()
+	s.metrics.ClientSetWriteQueueDepth(depth)
+	return func() {
+		s.lock.Lock()
+		s.writeQueue--
+		depth := s.writeQueue
+		s.lock.Unlock()
+		s.metrics.ClientSetWriteQueueDepth(depth)
+	}
+}
+
+// getIdlePeerForTask returns the idle peer with the best score which serves the shard of the task.
+// Peers with a score below peerScoreThreshold are skipped until their score recovers.
 func (s *SyncClient) getIdlePeerForTask(t *task) *Peer {
+	var (
+		best      *Peer
+		bestScore int
+		now       = time.Now()
+	)
 	for id := range s.idlerPeers {
 		if _, ok := t.statelessPeers[id]; ok {
 			continue
 		}
 		p := s.peers[id]
-		if p.IsShardExist(t.Contract, t.ShardId) {
-			return p
+		if !p.IsShardExist(t.Contract, t.ShardId) {
+			continue
+		}
+		score := p.Score(now)
+		if score < peerScoreThreshold {
+			continue
+		}
+		if best == nil || score > bestScore {
+			best, bestScore = p, score
 		}
 	}
-	return nil
+	return best
+}
+
+// scorePeer updates the reputation of the peer with delta.
+func (s *SyncClient) scorePeer(id peer.ID, delta int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pr, ok := s.peers[id]
+	if !ok {
+		return
+	}
+	if score := pr.updateScore(delta); delta < 0 && score < peerScoreThreshold {
+		s.log.Info("Peer score below threshold, stop dispatching requests to it", "peer", id, "score", score)
+	}
+}
+
+// PeerScores returns the current reputation of the peers.
+func (s *SyncClient) PeerScores() map[peer.ID]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	scores := make(map[peer.ID]int, len(s.peers))
+	for id, pr := range s.peers {
+		scores[id] = pr.Score(now)
+	}
+	return scores
 }
 
 // OnBlobsByRange is a callback method to invoke when a batch of Contract
@@ -866,8 +1852,8 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 		reqCount = req.limit - req.origin + 1
 	)
 
-	if reqCount > maxKvCountPerReq {
-		reqCount = maxKvCountPerReq
+	if maxCount := s.maxKvCountPerReq(req.contract); reqCount > maxCount {
+		reqCount = maxCount
 	}
 	for _, blob := range res.Blobs {
 		if blob != nil {
@@ -897,10 +1883,13 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 		}
 		s.lock.Unlock()
 		s.metrics.ClientOnBlobsByRange(req.peer.String(), reqCount, uint64(len(res.Blobs)), 0, time.Since(start))
+		s.metrics.ClientRecordShardSync(req.subTask.task.Contract, req.subTask.task.ShardId, reqCount, 0, uint64(size), time.Since(start))
 		return
 	}
 
-	synced, syncedBytes, inserted, err := s.onResult(blobsInRange)
+	// the blobs failed for local reasons are left missing below, so they are healed later
+	synced, syncedBytes, invalid, inserted, failed, err := s.onResult(s.storage(req.subTask.task.Contract), blobsInRange)
+	s.scoreResult(req.peer, len(invalid), len(inserted))
 	if err != nil {
 		log.Error("OnBlobsByRange fail", "err", err.Error())
 		return
@@ -909,10 +1898,11 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 	s.blobsSynced += synced
 	s.syncedBytes += common.StorageSize(syncedBytes)
 	s.metrics.ClientOnBlobsByRange(req.peer.String(), reqCount, uint64(len(res.Blobs)), synced, time.Since(start))
+	s.metrics.ClientRecordShardSync(req.subTask.task.Contract, req.subTask.task.ShardId, reqCount, synced, uint64(size), time.Since(start))
 	log.Debug("Persisted set of kvs", "count", synced, "bytes", syncedBytes)
 
 	// set peer to stateless peer if fail too much
-	if len(inserted) == 0 {
+	if len(inserted) == 0 && len(failed) == 0 {
 		s.lock.Lock()
 		if _, ok := s.peers[req.peer]; ok {
 			req.subTask.task.statelessPeers[req.peer] = struct{}{}
@@ -921,25 +1911,23 @@ func (s *SyncClient) OnBlobsByRange(res *blobsByRangeResponse) {
 		return
 	}
 
-	sort.Slice(inserted, func(i, j int) bool {
-		return inserted[i] < inserted[j]
-	})
-	last := inserted[len(inserted)-1]
-	missing := make([]uint64, 0)
-	for i, n := 0, res.req.subTask.next; n <= last; n++ {
-		if inserted[i] == n {
-			i++
-		} else if inserted[i] > n {
-			missing = append(missing, n)
+	s.announceBlobs(req.subTask.task.Contract, inserted)
+	// the peer may return a part of the range, so only the range up to the last blob returned is confirmed
+	last := blobsInRange[0].BlobIndex
+	for _, blob := range blobsInRange {
+		if blob.BlobIndex > last {
+			last = blob.BlobIndex
 		}
 	}
 	s.lock.Lock()
+	missing := res.req.subTask.confirmRange(inserted, last)
+	res.req.subTask.task.meter.mark(uint64(len(inserted)), time.Now())
 	res.req.subTask.task.healTask.insert(missing)
-	if last == res.req.subTask.Last-1 {
-		res.req.subTask.done = true
-	}
-	res.req.subTask.next = last + 1
+	s.metrics.ClientSetShardHealCount(req.subTask.task.Contract, req.subTask.task.ShardId, req.subTask.task.healTask.count())
 	s.lock.Unlock()
+	if len(missing) > 0 {
+		s.log.Debug("Blobs missing in range response", "peer", req.peer, "origin", req.origin, "last", last, "missing", len(missing))
+	}
 }
 
 // OnBlobsByList is a callback method to invoke when a batch of Contract
@@ -957,7 +1945,8 @@ func (s *SyncClient) OnBlobsByList(res *blobsByListResponse) {
 	}
 	s.log.Debug("OnBlobsByList: static", "reqId", req.id, "blobCount", len(res.Blobs), "bytes", size)
 
-	startIdx, endIdx := s.storageManager.KvEntries()*req.shardId, s.storageManager.KvEntries()*(req.shardId+1)-1
+	sm := s.storage(req.healTask.task.Contract)
+	startIdx, endIdx := sm.KvEntries()*req.shardId, sm.KvEntries()*(req.shardId+1)-1
 	blobsInRange := make([]*BlobPayload, 0)
 	for _, blob := range res.Blobs {
 		if startIdx <= blob.BlobIndex && endIdx >= blob.BlobIndex {
@@ -980,10 +1969,14 @@ func (s *SyncClient) OnBlobsByList(res *blobsByListResponse) {
 		s.lock.Unlock()
 		s.metrics.ClientOnBlobsByList(req.peer.String(), uint64(len(req.indexes)), uint64(len(res.Blobs)),
 			0, time.Since(start))
+		s.metrics.ClientRecordShardSync(req.healTask.task.Contract, req.healTask.task.ShardId, uint64(len(req.indexes)), 0,
+			uint64(size), time.Since(start))
 		return
 	}
 
-	synced, syncedBytes, inserted, err := s.onResult(blobsInRange)
+	// the blobs failed for local reasons stay in the heal task, so they are requested again later
+	synced, syncedBytes, invalid, inserted, failed, err := s.onResult(sm, blobsInRange)
+	s.scoreResult(req.peer, len(invalid), len(inserted))
 	if err != nil {
 		log.Error("OnBlobsByList fail", "err", err.Error())
 		return
@@ -993,28 +1986,39 @@ func (s *SyncClient) OnBlobsByList(res *blobsByListResponse) {
 	s.syncedBytes += common.StorageSize(syncedBytes)
 	s.metrics.ClientOnBlobsByList(req.peer.String(), uint64(len(req.indexes)), uint64(len(res.Blobs)),
 		synced, time.Since(start))
+	s.metrics.ClientRecordShardSync(req.healTask.task.Contract, req.healTask.task.ShardId, uint64(len(req.indexes)), synced,
+		uint64(size), time.Since(start))
 	log.Debug("Persisted set of kvs", "count", synced, "bytes", syncedBytes)
 
+	s.announceBlobs(req.healTask.task.Contract, inserted)
 	s.lock.Lock()
 	// set peer to stateless peer if fail too much
-	if len(inserted) == 0 {
+	if len(inserted) == 0 && len(failed) == 0 {
 		if _, ok := s.peers[req.peer]; ok {
 			req.healTask.task.statelessPeers[req.peer] = struct{}{}
 		}
 	}
 	res.req.healTask.remove(inserted)
+	res.req.healTask.task.meter.mark(uint64(len(inserted)), time.Now())
+	// the invalid blobs are requested again at once, most likely from another peer as this one is penalized
+	res.req.healTask.retry(invalid)
+	s.metrics.ClientSetShardHealCount(req.healTask.task.Contract, req.healTask.task.ShardId, req.healTask.count())
+	if len(inserted) > 0 {
+		s.saveTask(res.req.healTask.task)
+	}
 	s.lock.Unlock()
 }
 
-// FillFileWithEmptyBlob this func is used to fill empty blobs to storage file to make the whole file data encoded.
+// FillFileWithEmptyBlob this func is used to fill empty blobs to storage file of the contract to make the whole file data encoded.
 // file in the blobs between origin and limit (include limit). if the lastKvIdx larger than kv idx to fill, ignore it.
-func (s *SyncClient) FillFileWithEmptyBlob(start, limit uint64) (uint64, error) {
+func (s *SyncClient) FillFileWithEmptyBlob(contract common.Address, start, limit uint64) (uint64, error) {
 	var (
 		st       = time.Now()
 		inserted = uint64(0)
 		next     = start
+		sm       = s.storage(contract)
 	)
-	lastBlobIdx := s.storageManager.LastKvIndex()
+	lastBlobIdx := sm.LastKvIndex()
 	if lastBlobIdx > limit {
 		return limit + 1, nil
 	}
@@ -1022,7 +2026,7 @@ func (s *SyncClient) FillFileWithEmptyBlob(start, limit uint64) (uint64, error)
 	if start < lastBlobIdx {
 		start = lastBlobIdx
 	}
-	inserted, next, err := s.storageManager.CommitEmptyBlobs(start, limit)
+	inserted, next, err := sm.CommitEmptyBlobs(start, limit)
 	if inserted > 0 {
 		s.metrics.ClientFillEmptyBlobsEvent(inserted, time.Since(st))
 	}
@@ -1032,26 +2036,50 @@ func (s *SyncClient) FillFileWithEmptyBlob(start, limit uint64) (uint64, error)
 
 // onResult is exclusively called by the main loop, and has thus direct access to the request bookkeeping state.
 // This function verifies if the result is canonical, and either promotes the result or moves the result into quarantine.
-func (s *SyncClient) onResult(blobs []*BlobPayload) (uint64, uint64, []uint64, error) {
+// The indexes of the blobs which fail to match the commit in the contract, to decode or to match their commit are
+// returned as invalid. The indexes of the blobs failing to be written for local reasons are returned as failed, which
+// are retried without blaming the peer.
+func (s *SyncClient) onResult(sm StorageManager, blobs []*BlobPayload) (uint64, uint64, []uint64, []uint64, []uint64, error) {
 	var (
 		synced       uint64
 		syncedBytes  uint64
+		invalid      = make([]uint64, 0)
 		inserted     = make([]uint64, 0)
+		failed       = make([]uint64, 0)
 		indices      = make([]uint64, 0)
 		decodedBlobs = make([][]byte, 0)
 		commits      = make([]common.Hash, 0)
 	)
 	for _, payload := range blobs {
+		indices = append(indices, payload.BlobIndex)
+	}
+	// the commits in the payloads come from the peer, so the expected ones are taken from the contract
+	metas, err := sm.GetKvMetas(indices)
+	if err != nil {
+		return 0, 0, nil, nil, nil, err
+	}
+	indices = indices[:0]
+	for i, payload := range blobs {
 		synced++
 		syncedBytes += uint64(len(payload.EncodedBlob))
 
-		decodedBlob, success := s.decodeKV(payload)
+		if !bytes.Equal(metas[i][32-ethstorage.HashSizeInContract:], payload.BlobCommit[:ethstorage.HashSizeInContract]) {
+			s.log.Info("Blob commit mismatch with contract", "idx", payload.BlobIndex,
+				"commit", common.Bytes2Hex(payload.BlobCommit[:ethstorage.HashSizeInContract]),
+				"contract", common.Bytes2Hex(metas[i][32-ethstorage.HashSizeInContract:]))
+			invalid = append(invalid, payload.BlobIndex)
+			continue
+		}
+
+		decodedBlob, success := s.decodeKV(sm, payload)
 		if !success {
+			invalid = append(invalid, payload.BlobIndex)
 			continue
 		}
 
 		success = s.checkBlobCommit(decodedBlob, payload)
 		if !success {
+			invalid = append(invalid, payload.BlobIndex)
 			continue
 		}
 
@@ -1060,15 +2088,28 @@ func (s *SyncClient) onResult(blobs []*BlobPayload) (uint64, uint64, []uint64, e
 		commits = append(commits, payload.BlobCommit)
 	}
 
-	inserted, err := s.commitBlobs(indices, decodedBlobs, commits)
-	return synced, syncedBytes, inserted, err
+	inserted, failed, err = s.commitBlobs(sm, indices, decodedBlobs, commits)
+	if len(failed) > 0 {
+		s.log.Warn("Failed to commit blobs, retry them later", "count", len(failed))
+	}
+	return synced, syncedBytes, invalid, inserted, failed, err
 }
 
-func (s *SyncClient) decodeKV(payload *BlobPayload) ([]byte, bool) {
+// scoreResult penalizes the peer for every invalid blob it delivered, or rewards it if
+// the blobs it delivered are written to storage.
+func (s *SyncClient) scoreResult(id peer.ID, invalid, inserted int) {
+	if invalid > 0 {
+		s.scorePeer(id, invalid*peerScoreInvalidBlob)
+	} else if inserted > 0 {
+		s.scorePeer(id, peerScoreDelivered)
+	}
+}
+
+func (s *SyncClient) decodeKV(sm StorageManager, payload *BlobPayload) ([]byte, bool) {
 	recordDur := s.metrics.ClientRecordTimeUsed("decodeKv")
 	defer recordDur()
 
-	decodedBlob, found, err := s.storageManager.DecodeKV(payload.BlobIndex, payload.EncodedBlob, payload.BlobCommit,
+	decodedBlob, found, err := sm.DecodeKV(payload.BlobIndex, payload.EncodedBlob, payload.BlobCommit,
 		payload.MinerAddress, payload.EncodeType)
 	if err != nil || !found {
 		if err != nil {
@@ -1081,6 +2122,7 @@ func (s *SyncClient) decodeKV(payload *BlobPayload) ([]byte, bool) {
 	return decodedBlob, true
 }
 
+// checkBlobCommit recomputes the root of the decoded blob and compares it with the commit of the payload.
 func (s *SyncClient) checkBlobCommit(decodedBlob []byte, payload *BlobPayload) bool {
 	recordDur := s.metrics.ClientRecordTimeUsed("getRoot")
 	root, err := s.prover.GetRoot(decodedBlob, 0, 0)
@@ -1101,10 +2143,15 @@ func (s *SyncClient) checkBlobCommit(decodedBlob []byte, payload *BlobPayload) b
 	return true
 }
 
-func (s *SyncClient) commitBlobs(kvIndices []uint64, decodedBlobs [][]byte, commits []common.Hash) ([]uint64, error) {
+func (s *SyncClient) commitBlobs(sm StorageManager, kvIndices []uint64, decodedBlobs [][]byte, commits []common.Hash) ([]uint64, []uint64, error) {
+	// wait for a write slot, so the responses of concurrent requests do not all hit the disk at once
+	if s.writeSlots != nil {
+		s.writeSlots <- struct{}{}
+		defer func() { <-s.writeSlots }()
+	}
 	recordDur := s.metrics.ClientRecordTimeUsed("commitBlobs")
 	defer recordDur()
-	return s.storageManager.CommitBlobs(kvIndices, decodedBlobs, commits)
+	return sm.CommitBlobs(kvIndices, decodedBlobs, commits)
 }
 
 // report calculates various status reports and provides it to the user.
@@ -1167,7 +2214,7 @@ func (s *SyncClient) reportFillEmptyState() {
 	var (
 		totalSecondsUsed  = s.totalSecondsUsed
 		emptyFilled       = s.emptyBlobsFilled
-		filledBytes       = common.StorageSize(s.emptyBlobsFilled * s.storageManager.MaxKvSize())
+		filledBytes       = s.emptyBytesFilled
 		emptyToFill       = s.emptyBlobsToFill
 		taskRemain        = 0
 		subFillTaskRemain = 0
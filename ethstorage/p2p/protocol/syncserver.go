@@ -5,6 +5,7 @@ package protocol
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -27,17 +28,36 @@ const (
 	returnCodeReadError
 	returnCodeInvalidRequest
 	returnCodeServerError
+	// returnCodeThrottled asks the client to slow down, the request can be retried later
+	returnCodeThrottled
 )
 
 const (
 	// Do not serve more than 20 requests per second
-	globalServerBlocksRateLimit rate.Limit = 20
+	DefaultGlobalServerRequestRate = 20
 	// Allow up to 30 concurrent requests to be served, eating into our rate-limit
-	globalServerBlocksBurst = 30
+	DefaultGlobalServerRequestBurst = 30
 	// Do not serve more than 5 requests per second to the same peer, so we can serve other peers at the same time
-	peerServerBlocksRateLimit rate.Limit = 5
+	DefaultPeerServerRequestRate = 5
 	// Allow a peer to burst 10 requests, so it does not have to wait
-	peerServerBlocksBurst = 10
+	DefaultPeerServerRequestBurst = 10
+	// A well-behaved client sends one request per peer at a time, so a handful of parallel streams is plenty
+	DefaultMaxPeerServerStreams = 4
+	// Do not serve more than 16 MiB of blobs per second to the same peer, so it cannot saturate our disk and bandwidth
+	DefaultPeerServerBytesRate = 16 * 1024 * 1024
+	// Allow a peer to burst 4 full responses
+	DefaultPeerServerBytesBurst = 4 * maxMessageSize
+	// Do not cap the bytes written to all peers together unless the upload bandwidth of the node is configured
+	DefaultGlobalServerBytesRate = 0
+	// Release the global bytes budget to the streams in pieces of up to 1 MiB
+	DefaultGlobalServerBytesBurst = 1024 * 1024
+	// Keep up to 64 MiB of the recently served blobs in memory
+	DefaultServerBlobCacheSize = 64 * 1024 * 1024
+	// Do not reply with more than 8 MiB of blobs to a request, even if the client accepts more
+	DefaultMaxServerResponseSize = maxMessageSize
+
+	// a peer which would have to wait longer than this for its rate limit is told to slow down instead
+	maxPeerThrottleDelay = time.Second * 2
 
 	// maxMessageSize is the target maximum size of replies to data retrievals.
 	maxMessageSize = 8 * 1024 * 1024
@@ -47,6 +67,29 @@ const (
 type peerStat struct {
 	// Requests tokenizes each request to sync
 	Requests *rate.Limiter
+	// Bytes tokenizes the blob bytes served to the peer, it is charged after a request is served
+	Bytes *rate.Limiter
+	// Streams is the number of requests of the peer being served
+	Streams int
+}
+
+var errThrottled = errors.New("peer exceeded its request budget")
+
+// DefaultSyncServerParams returns the rate limits used when none are configured.
+func DefaultSyncServerParams() *SyncServerParams {
+	return &SyncServerParams{
+		GlobalRequestRate:  DefaultGlobalServerRequestRate,
+		GlobalRequestBurst: DefaultGlobalServerRequestBurst,
+		PeerRequestRate:    DefaultPeerServerRequestRate,
+		PeerRequestBurst:   DefaultPeerServerRequestBurst,
+		MaxPeerStreams:     DefaultMaxPeerServerStreams,
+		PeerBytesRate:      DefaultPeerServerBytesRate,
+		PeerBytesBurst:     DefaultPeerServerBytesBurst,
+		GlobalBytesRate:    DefaultGlobalServerBytesRate,
+		GlobalBytesBurst:   DefaultGlobalServerBytesBurst,
+		BlobCacheSize:      DefaultServerBlobCacheSize,
+		MaxResponseSize:    DefaultMaxServerResponseSize,
+	}
 }
 
 type SyncServerMetrics interface {
@@ -59,33 +102,62 @@ type SyncServerMetrics interface {
 type SyncServer struct {
 	cfg *rollup.EsConfig
 
-	storageManager StorageManagerReader
-	metrics        SyncServerMetrics
+	storageManagers map[common.Address]StorageManagerReader // Storage of each contract served
+	params          *SyncServerParams
+	metrics         SyncServerMetrics
 
 	peerRateLimits *simplelru.LRU[peer.ID, *peerStat]
 	peerStatsLock  sync.Mutex
 
 	globalRequestsRL *rate.Limiter
+	globalBytesRL    *rate.Limiter // nil if the bytes written to the peers are not capped
+
+	corruptFn func(contract common.Address, err error) bool // handles the errors of the blobs failing their checksums, nil if unset
+
+	blobCache *blobCache // nil if the served blobs are not cached
 }
 
-func NewSyncServer(cfg *rollup.EsConfig, storageManager StorageManagerReader, m SyncServerMetrics) *SyncServer {
+func NewSyncServer(cfg *rollup.EsConfig, storageManager StorageManagerReader, params *SyncServerParams, m SyncServerMetrics) *SyncServer {
 	// We should never allow over 1000 different peers to churn through quickly,
 	// so it's fine to prune rate-limit details past this.
 
 	peerRateLimits, _ := simplelru.NewLRU[peer.ID, *peerStat](1000, nil)
-	// 3 sync requests per second, with 2 burst
-	globalRequestsRL := rate.NewLimiter(globalServerBlocksRateLimit, globalServerBlocksBurst)
+	if params == nil {
+		params = DefaultSyncServerParams()
+	}
+	globalRequestsRL := rate.NewLimiter(rate.Limit(params.GlobalRequestRate), params.GlobalRequestBurst)
+	var globalBytesRL *rate.Limiter
+	if params.GlobalBytesRate > 0 {
+		globalBytesRL = rate.NewLimiter(rate.Limit(params.GlobalBytesRate), params.GlobalBytesBurst)
+	}
+	var cache *blobCache
+	if params.BlobCacheSize > 0 {
+		cache = newBlobCache(params.BlobCacheSize)
+	}
 
 	if m == nil {
 		m = metrics.NoopMetrics
 	}
-	return &SyncServer{
+	srv := &SyncServer{
 		cfg:              cfg,
-		storageManager:   storageManager,
+		storageManagers:  make(map[common.Address]StorageManagerReader),
+		params:           params,
 		metrics:          m,
 		peerRateLimits:   peerRateLimits,
 		globalRequestsRL: globalRequestsRL,
+		globalBytesRL:    globalBytesRL,
+		blobCache:        cache,
+	}
+	if storageManager != nil {
+		srv.AddStorageManager(storageManager)
 	}
+	return srv
+}
+
+// AddStorageManager adds the storage of another contract to serve the blobs of, the requests for the
+// contracts not added are replied with no blobs. It must be called before the requests are served.
+func (srv *SyncServer) AddStorageManager(storageManager StorageManagerReader) {
+	srv.storageManagers[storageManager.ContractAddress()] = storageManager
 }
 
 // HandleGetBlobsByRangeRequest is a stream handler function to register the L2 unsafe payloads alt-sync protocol.
@@ -95,18 +167,16 @@ func NewSyncServer(cfg *rollup.EsConfig, storageManager StorageManagerReader, m
 //
 // The caller must Close the stream.
 func (srv *SyncServer) HandleGetBlobsByRangeRequest(ctx context.Context, log log.Logger, stream network.Stream) {
-	// We wait as long as necessary; we throttle the peer instead of disconnecting,
-	// unless the delay reaches a threshold that is unreasonable to wait for.
-	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
 	start := time.Now()
 	returnCode, data, err := srv.handleGetBlobsByRangeRequest(ctx, stream)
 	srv.metrics.ServerGetBlobsByRangeEvent(stream.Conn().RemotePeer().String(), returnCode, time.Since(start))
-	cancel()
 
-	if err != nil {
+	if returnCode == returnCodeThrottled {
+		log.Debug("Throttled p2p sync request", "peer", stream.Conn().RemotePeer(), "err", err)
+	} else if err != nil {
 		log.Warn("Failed to serve p2p sync request", "err", err)
 	}
-	err = WriteMsg(stream, &Msg{returnCode, data})
+	err = srv.writeResponse(ctx, stream, &Msg{returnCode, data})
 	if err != nil {
 		log.Debug("write message fail", "err", err.Error())
 	} else {
@@ -115,18 +185,16 @@ func (srv *SyncServer) HandleGetBlobsByRangeRequest(ctx context.Context, log log
 }
 
 func (srv *SyncServer) HandleGetBlobsByListRequest(ctx context.Context, log log.Logger, stream network.Stream) {
-	// We wait as long as necessary; we throttle the peer instead of disconnecting,
-	// unless the delay reaches a threshold that is unreasonable to wait for.
-	ctx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
 	start := time.Now()
 	returnCode, data, err := srv.handleGetBlobsByListRequest(ctx, stream)
 	srv.metrics.ServerGetBlobsByListEvent(stream.Conn().RemotePeer().String(), returnCode, time.Since(start))
-	cancel()
 
-	if err != nil {
+	if returnCode == returnCodeThrottled {
+		log.Debug("Throttled p2p sync request", "peer", stream.Conn().RemotePeer(), "err", err)
+	} else if err != nil {
 		log.Warn("Failed to serve p2p sync request", "err", err)
 	}
-	err = WriteMsg(stream, &Msg{returnCode, data})
+	err = srv.writeResponse(ctx, stream, &Msg{returnCode, data})
 	if err != nil {
 		log.Debug("write message fail", "err", err.Error())
 	} else {
@@ -137,10 +205,18 @@ func (srv *SyncServer) HandleGetBlobsByListRequest(ctx context.Context, log log.
 func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream network.Stream) (byte, []byte, error) {
 	peerID := stream.Conn().RemotePeer()
 
-	err := srv.limitPeer(ctx, peerID)
-	if err != nil {
+	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
+	// We wait as long as necessary; we throttle the peer instead of disconnecting,
+	// unless the delay reaches a threshold that is unreasonable to wait for.
+	limitCtx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
+	release, err := srv.limitPeer(limitCtx, peerID)
+	cancel()
+	if errors.Is(err, errThrottled) {
+		return returnCodeThrottled, []byte{}, err
+	} else if err != nil {
 		return returnCodeServerError, []byte{}, err
 	}
+	defer func() { release(readBytes) }()
 
 	msg, _, err := ReadMsg(stream)
 	if err != nil {
@@ -158,19 +234,26 @@ func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream
 		ShardId:  req.ShardId,
 		Blobs:    make([]*BlobPayload, 0),
 	}
-	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
+	limit := srv.responseLimit(req.Bytes)
 	start := time.Now()
 	for id := req.Origin; id <= req.Limit; id++ {
-		payload, err := srv.BlobByIndex(id)
+		payload, err := srv.BlobByIndex(ctx, req.Contract, id)
 		read++
+		if ctxErr := readAborted(ctx, stream); ctxErr != nil {
+			return returnCodeServerError, []byte{}, ctxErr
+		}
 		if err != nil {
 			log.Debug("Get blob fail", "id", id, "error", err.Error())
 			continue
 		}
+		// the first blob is always served, so the client makes progress with a limit below the blob size
+		if len(res.Blobs) > 0 && readBytes+uint64(len(payload.EncodedBlob)) > limit {
+			break
+		}
 		sucRead++
 		res.Blobs = append(res.Blobs, payload)
 		readBytes += uint64(len(payload.EncodedBlob))
-		if readBytes >= req.Bytes || readBytes >= maxMessageSize {
+		if readBytes >= limit {
 			break
 		}
 	}
@@ -189,10 +272,18 @@ func (srv *SyncServer) handleGetBlobsByRangeRequest(ctx context.Context, stream
 func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream network.Stream) (byte, []byte, error) {
 	peerID := stream.Conn().RemotePeer()
 
-	err := srv.limitPeer(ctx, peerID)
-	if err != nil {
+	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
+	// We wait as long as necessary; we throttle the peer instead of disconnecting,
+	// unless the delay reaches a threshold that is unreasonable to wait for.
+	limitCtx, cancel := context.WithTimeout(ctx, maxThrottleDelay)
+	release, err := srv.limitPeer(limitCtx, peerID)
+	cancel()
+	if errors.Is(err, errThrottled) {
+		return returnCodeThrottled, []byte{}, err
+	} else if err != nil {
 		return returnCodeServerError, []byte{}, err
 	}
+	defer func() { release(readBytes) }()
 
 	msg, _, err := ReadMsg(stream)
 	if err != nil {
@@ -210,19 +301,25 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 		ShardId:  req.ShardId,
 		Blobs:    make([]*BlobPayload, 0),
 	}
-	read, sucRead, readBytes := uint64(0), uint64(0), uint64(0)
+	limit := srv.responseLimit(req.Bytes)
 	start := time.Now()
 	for _, idx := range req.BlobList {
-		payload, err := srv.BlobByIndex(idx)
+		payload, err := srv.BlobByIndex(ctx, req.Contract, idx)
 		read++
+		if ctxErr := readAborted(ctx, stream); ctxErr != nil {
+			return returnCodeServerError, []byte{}, ctxErr
+		}
 		if err != nil {
 			log.Debug("Get blob fail", "idx", idx, "error", err.Error())
 			continue
 		}
+		if len(res.Blobs) > 0 && readBytes+uint64(len(payload.EncodedBlob)) > limit {
+			break
+		}
 		sucRead++
 		res.Blobs = append(res.Blobs, payload)
 		readBytes += uint64(len(payload.EncodedBlob))
-		if readBytes >= req.Bytes || readBytes >= maxMessageSize {
+		if readBytes >= limit {
 			break
 		}
 	}
@@ -238,56 +335,203 @@ func (srv *SyncServer) handleGetBlobsByListRequest(ctx context.Context, stream n
 	return returnCodeSuccess, data, nil
 }
 
-func (srv *SyncServer) limitPeer(ctx context.Context, peerId peer.ID) error {
-	// take a token from the global rate-limiter,
-	// to make sure there's not too much concurrent server work between different peers.
-	if err := srv.globalRequestsRL.Wait(ctx); err != nil {
-		return fmt.Errorf("timed out waiting for global sync rate limit: %w", err)
-	}
-
+// limitPeer waits until the request of the peer can be served within the per-peer and global rate limits.
+// A peer which exceeds its request or bytes budget by too much, or has too many requests in flight, gets
+// errThrottled instead of tying up a stream. The returned func must be called with the number of blob
+// bytes served once the request is done, so they are charged to the bytes budget of the peer.
+func (srv *SyncServer) limitPeer(ctx context.Context, peerId peer.ID) (func(uint64), error) {
 	// find rate limiting data of peer, or add otherwise
 	srv.peerStatsLock.Lock()
-	defer srv.peerStatsLock.Unlock()
 	ps, _ := srv.peerRateLimits.Get(peerId)
 	if ps == nil {
 		ps = &peerStat{
-			Requests: rate.NewLimiter(peerServerBlocksRateLimit, peerServerBlocksBurst),
+			Requests: rate.NewLimiter(rate.Limit(srv.params.PeerRequestRate), srv.params.PeerRequestBurst),
+			Bytes:    rate.NewLimiter(rate.Inf, 0),
+		}
+		if srv.params.PeerBytesRate > 0 {
+			ps.Bytes = rate.NewLimiter(rate.Limit(srv.params.PeerBytesRate), srv.params.PeerBytesBurst)
 		}
 		srv.peerRateLimits.Add(peerId, ps)
-		ps.Requests.Reserve() // count the hit, but make it delay the next request rather than immediately waiting
-	} else {
-		// Only wait if it's an existing peer, otherwise the instant rate-limit Wait call always errors.
+	}
+	if srv.params.MaxPeerStreams > 0 && ps.Streams >= srv.params.MaxPeerStreams {
+		srv.peerStatsLock.Unlock()
+		return nil, fmt.Errorf("%w: %d requests in flight", errThrottled, ps.Streams)
+	}
+	// check the peer limit before the global one, so a flooding peer does not eat into the budget of the others
+	r := ps.Requests.Reserve()
+	if !r.OK() || r.Delay() > maxPeerThrottleDelay {
+		r.Cancel()
+		srv.peerStatsLock.Unlock()
+		return nil, fmt.Errorf("%w: request rate exceeded", errThrottled)
+	}
+	// the bytes served before are charged as debt, so the peer has to wait until it is paid off
+	delay := r.Delay()
+	if tokens := ps.Bytes.TokensAt(time.Now()); tokens < 0 {
+		debtDelay := time.Duration(-tokens / float64(ps.Bytes.Limit()) * float64(time.Second))
+		if debtDelay > maxPeerThrottleDelay {
+			r.Cancel()
+			srv.peerStatsLock.Unlock()
+			return nil, fmt.Errorf("%w: bytes rate exceeded", errThrottled)
+		}
+		delay = max(delay, debtDelay)
+	}
+	ps.Streams++
+	srv.peerStatsLock.Unlock()
+
+	release := func(servedBytes uint64) {
+		srv.peerStatsLock.Lock()
+		ps.Streams--
+		if servedBytes > 0 && ps.Bytes.Limit() != rate.Inf {
+			ps.Bytes.ReserveN(time.Now(), int(min(servedBytes, uint64(ps.Bytes.Burst()))))
+		}
+		srv.peerStatsLock.Unlock()
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			release(0)
+			return nil, fmt.Errorf("timed out waiting for peer sync rate limit: %w", ctx.Err())
+		}
+	}
 
-		// If the requester thinks we're taking too long, then it's their problem and they can disconnect.
-		// We'll disconnect ourselves only when failing to read/write,
-		// if the work is invalid (range validation), or when individual sub tasks timeout.
-		if err := ps.Requests.Wait(ctx); err != nil {
-			return fmt.Errorf("timed out waiting for global sync rate limit: %w", err)
+	// take a token from the global rate-limiter,
+	// to make sure there's not too much concurrent server work between different peers.
+	if err := srv.globalRequestsRL.Wait(ctx); err != nil {
+		release(0)
+		return nil, fmt.Errorf("timed out waiting for global sync rate limit: %w", err)
+	}
+	return release, nil
+}
+
+// writeResponse writes the response, compressed if the request came over the compressed variant of the protocol.
+func (srv *SyncServer) writeResponse(ctx context.Context, stream network.Stream, msg *Msg) error {
+	if isCompressedProtocol(stream.Protocol()) {
+		return WriteCompressedMsg(srv.throttleStream(ctx, stream), msg)
+	}
+	return WriteMsg(srv.throttleStream(ctx, stream), msg)
+}
+
+// throttleStream wraps the stream so the bytes written to it are charged to the global bytes limiter,
+// which keeps the responses to all peers together within the upload cap of the node.
+func (srv *SyncServer) throttleStream(ctx context.Context, stream network.Stream) network.Stream {
+	if srv.globalBytesRL == nil {
+		return stream
+	}
+	return &throttledStream{Stream: stream, ctx: ctx, limiter: srv.globalBytesRL}
+}
+
+// throttledStream writes to the stream in pieces of up to the burst of the limiter, each waiting for its budget.
+type throttledStream struct {
+	network.Stream
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (s *throttledStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, s.limiter.Burst())
+		// WaitN fails right away without taking the budget if it cannot be granted before the timeout,
+		// so a stream which cannot make progress does not hold the budget of the other peers
+		ctx, cancel := context.WithTimeout(s.ctx, clientWriteRequestTimeout)
+		err := s.limiter.WaitN(ctx, n)
+		cancel()
+		if err != nil {
+			return written, fmt.Errorf("timed out waiting for global bytes rate limit: %w", err)
+		}
+		// the deadline set by WriteMsg is for the whole message, extend it as the throttled pieces are written
+		_ = s.Stream.SetWriteDeadline(time.Now().Add(clientWriteRequestTimeout))
+		m, err := s.Stream.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
 		}
 	}
+	return written, nil
+}
+
+// SetCorruptHandler sets the function handling the read errors of the blobs corrupt in the local storage,
+// which is expected to sync them again. It must be set before the requests are served.
+func (srv *SyncServer) SetCorruptHandler(fn func(contract common.Address, err error) bool) {
+	srv.corruptFn = fn
+}
 
+// readAborted returns the error stopping the reads of a request: the context is done, e.g. the server is
+// shutting down, or the connection of the stream is closed by the peer.
+func readAborted(ctx context.Context, stream network.Stream) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if stream.Conn().IsClosed() {
+		return errors.New("connection closed")
+	}
 	return nil
 }
 
-func (srv *SyncServer) BlobByIndex(idx uint64) (*BlobPayload, error) {
+// responseLimit returns the max bytes of blobs replied to a request, which is the smaller one of the
+// size the client accepts and the cap of the server, and never exceeds maxMessageSize.
+func (srv *SyncServer) responseLimit(reqBytes uint64) uint64 {
+	if srv.params.MaxResponseSize == 0 {
+		return min(reqBytes, maxMessageSize)
+	}
+	return min(reqBytes, srv.params.MaxResponseSize, maxMessageSize)
+}
+
+func (srv *SyncServer) BlobByIndex(ctx context.Context, contract common.Address, idx uint64) (*BlobPayload, error) {
 	recordDur := srv.metrics.ServerRecordTimeUsed("readBlobByIndex")
 	defer recordDur()
 
-	shardIdx := idx / srv.storageManager.KvEntries()
-	blob, found, err := srv.storageManager.TryReadEncoded(idx, int(srv.storageManager.MaxKvSize()))
+	sm, ok := srv.storageManagers[contract]
+	if !ok {
+		return nil, fmt.Errorf("contract %s not served", contract.Hex())
+	}
+	shardIdx := idx / sm.KvEntries()
+	if srv.blobCache == nil {
+		return srv.readBlob(ctx, sm, idx, shardIdx)
+	}
+
+	// A cached blob is served only if the kv still holds the same blob encoded for the same miner,
+	// so a kv rewritten since it was cached is read from the disk again.
+	commit, _, err := sm.TryReadMeta(idx)
 	if err != nil {
 		return nil, err
 	}
+	miner, _ := sm.GetShardMiner(shardIdx)
+	if b := srv.blobCache.get(contract, idx); b != nil {
+		if b.BlobCommit == common.BytesToHash(commit) && b.MinerAddress == miner {
+			return b, nil
+		}
+		srv.blobCache.remove(contract, idx)
+	}
+	b, err := srv.readBlob(ctx, sm, idx, shardIdx)
+	if err != nil {
+		return nil, err
+	}
+	srv.blobCache.add(contract, b)
+	return b, nil
+}
+
+func (srv *SyncServer) readBlob(ctx context.Context, sm StorageManagerReader, idx, shardIdx uint64) (*BlobPayload, error) {
+	blob, found, err := sm.TryReadEncodedCtx(ctx, idx, int(sm.ShardKvSize(shardIdx)))
+	if err != nil {
+		if errors.Is(err, ethstorage.ErrChunkCorrupt) && srv.corruptFn != nil {
+			srv.corruptFn(sm.ContractAddress(), err)
+		}
+		return nil, err
+	}
 	if !found {
 		return nil, ethereum.NotFound
 	}
-	commit, _, err := srv.storageManager.TryReadMeta(idx)
+	commit, _, err := sm.TryReadMeta(idx)
 	if err != nil {
 		return nil, err
 	}
 
-	miner, _ := srv.storageManager.GetShardMiner(shardIdx)
-	encodeType, _ := srv.storageManager.GetShardEncodeType(shardIdx)
+	miner, _ := sm.GetShardMiner(shardIdx)
+	encodeType, _ := sm.GetShardEncodeType(shardIdx)
 	return &BlobPayload{
 		MinerAddress: miner,
 		BlobIndex:    idx,
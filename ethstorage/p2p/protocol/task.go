@@ -4,6 +4,7 @@
 package protocol
 
 import (
+	"context"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -19,12 +20,33 @@ type task struct {
 	nextIdx       int
 	healTask      *healTask
 	SubEmptyTasks []*subEmptyTask
+	HealIndexes   []uint64 // Indexes of healTask, it is only used for serialization and deserialization of task
 
 	// TODO: consider whether we need to retry those stateless peers or disconnect the peer
 	statelessPeers map[peer.ID]struct{} // Peers that failed to deliver kv Data
 	peers          map[peer.ID]struct{}
+	meter          rateMeter // Blobs synced per second, protected by the lock of SyncClient
 
-	done bool // Flag whether the task has done
+	done     bool // Flag whether the task has done
+	doneSent bool // Flag whether the SingleShardDone of the task is sent, it is sent once even if the task is requeued
+}
+
+// isPending reports whether the blob is waiting to be synced or filled by a subTask, subEmptyTask or the healTask.
+func (t *task) isPending(idx uint64) bool {
+	if _, ok := t.healTask.Indexes[idx]; ok {
+		return true
+	}
+	for _, st := range t.SubTasks {
+		if idx >= st.next && idx < st.Last {
+			return true
+		}
+	}
+	for _, et := range t.SubEmptyTasks {
+		if idx >= et.First && idx < et.Last {
+			return true
+		}
+	}
+	return false
 }
 
 // task which is used to write empty to storage file, so the files will fill up with encode data
@@ -49,17 +71,71 @@ type subTask struct {
 	// Then next will change to 16, and First will change to 3,
 	// which means next range request start from blob 16
 	// and the range should cover by this subTask is from 3 to 127.
-	// When saveSyncStatus() be called to serialize tasks and save it to DB,
-	// healTask will be dropped, only subTask's First and Last params will be saved
+	// When the task is serialized and saved to DB, the heal indexes are saved with it,
+	// but only subTask's First and Last params are saved for the subTask.
 	// That means when task be reloaded from DB, the subTask's First and next will be set to 3
 	// and blobs 4 ~ 15 will retrieval again.
-	// That is a balance between saving heal list which may be large and retrieving blobs.
 	next  uint64 // next blob start to sync in the next BlobsByRange request
 	First uint64 // First blob to sync in this interval, it is use for serialization and deserialization of subtask
 	Last  uint64 // Last blob to sync in this interval
 
 	isRunning bool
 	done      bool // Flag whether the subTask can be removed
+
+	// The state of the running request watched for stalls, protected by the lock of SyncClient
+	peer        peer.ID            // Peer serving the running request
+	cancel      context.CancelFunc // Gives up the running request
+	writing     bool               // Flag whether the response of the running request is being written
+	activeAt    time.Time          // When the request was sent or next last advanced
+	stalledPeer peer.ID            // Peer the subTask last stalled on, which is not requested again for a while
+	stalledAt   time.Time
+
+	// The filled states of the kvs from filledFrom, scanned once for SkipFilled without the lock of SyncClient
+	filled     []kvFilledState
+	filledFrom uint64
+	scanned    bool
+}
+
+// kvFilledState is the state of a kv in the local storage found by the scan for SkipFilled.
+type kvFilledState byte
+
+const (
+	kvNotFilled      kvFilledState = iota
+	kvFilledMatched                // filled with the commit of the kv in the contract
+	kvFilledMismatch               // filled with another commit, to be healed
+)
+
+// filledState returns the scanned filled state of the kv, a kv out of the scanned range is not filled.
+func (st *subTask) filledState(kvIdx uint64) kvFilledState {
+	if !st.scanned || kvIdx < st.filledFrom || kvIdx-st.filledFrom >= uint64(len(st.filled)) {
+		return kvNotFilled
+	}
+	return st.filled[kvIdx-st.filledFrom]
+}
+
+// confirmRange moves next over the blobs answered by a range response, i.e. up to last, the highest index
+// returned by the peer, and returns the indexes in between which are not inserted. Those are the blobs the
+// peer skipped, e.g. for lacking them, or returned invalid, and are left to the heal task, so the rest of the
+// range is not requested again. The blobs after last, e.g. cut off by the response size, stay in the range.
+func (st *subTask) confirmRange(inserted []uint64, last uint64) []uint64 {
+	written := make(map[uint64]struct{}, len(inserted))
+	for _, idx := range inserted {
+		written[idx] = struct{}{}
+	}
+	missing := make([]uint64, 0)
+	for idx := st.next; idx <= last; idx++ {
+		if _, ok := written[idx]; !ok {
+			missing = append(missing, idx)
+		}
+	}
+	if last+1 > st.next {
+		st.next = last + 1
+		st.activeAt = time.Now()
+	}
+	if st.next >= st.Last {
+		st.done = true
+	}
+	return missing
 }
 
 // healTask represents the sync task for healing blobs fail to fetch from remote  .
@@ -93,6 +169,15 @@ func (h *healTask) refresh(list []uint64) {
 	}
 }
 
+// retry makes the blobs in the list, which are still queued for retrieval, available for the next request at once.
+func (h *healTask) retry(list []uint64) {
+	for _, idx := range list {
+		if _, ok := h.Indexes[idx]; ok {
+			h.Indexes[idx] = 0
+		}
+	}
+}
+
 func (h *healTask) hasIndexInRange(first, next uint64) (bool, uint64) {
 	min, exist := next, false
 	for idx := range h.Indexes {
@@ -130,5 +215,6 @@ type SyncProgress struct {
 	SyncedBytes      common.StorageSize // Number of kv bytes downloaded
 	EmptyBlobsToFill uint64
 	EmptyBlobsFilled uint64
+	EmptyBytesFilled common.StorageSize // Number of kv bytes filled with empty, with the kv size of each contract
 	TotalSecondsUsed uint64
 }
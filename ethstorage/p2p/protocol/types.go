@@ -38,6 +38,7 @@ type blobsByRangeRequest struct {
 	shardId  uint64
 	origin   uint64
 	limit    uint64
+	bytes    uint64 // max bytes of the response
 
 	subTask *subTask
 	time    time.Time // Timestamp when the request was sent
@@ -129,8 +130,11 @@ func (e *EthStorageENRData) ENRKey() string {
 	return EthStorageENRKey
 }
 
+// EthStorageSyncDone is sent on the mux of the SyncClient once for each shard synced, with DoneType
+// SingleShardDone and the contract and shard, and then once with DoneType AllShardDone.
 type EthStorageSyncDone struct {
 	DoneType int
+	Contract common.Address
 	ShardId  uint64
 }
 
@@ -140,4 +144,59 @@ type SyncerParams struct {
 	SyncConcurrency       uint64
 	FillEmptyConcurrency  int
 	MetaDownloadBatchSize uint64
+	PeerJoinRate          float64         // max number of new peers per second handed to the sync tasks, 0 means unlimited
+	MaxConcurrentRequests int             // max number of sync requests in flight, 0 means one request per idle peer
+	MaxConcurrentWrites   int             // max number of synced blob batches written to storage concurrently, 0 means unlimited
+	MaxWriteQueue         int             // max number of synced blob batches waiting to be written before new requests pause, 0 means unlimited
+	HealBacklogThreshold  int             // heal count of a task above which its heal requests go before new ranges, 0 means disabled
+	MetaRefreshInterval   time.Duration   // interval to re-read the metas from the contract at the finalized block during the sync, 0 means disabled
+	RequestTimeout        time.Duration   // max time of a request to a peer before it is retried with another one, 0 means disabled
+	StallTimeout          time.Duration   // max time a running subTask may not advance before it is reassigned to another peer, 0 means disabled
+	SkipFilled            bool            // skip the kvs already filled with the commit in the contract instead of requesting them again
+	MinRangeSize          uint64          // min number of blobs in a range request when the range is sized by the peer throughput
+	MaxRangeSize          uint64          // max number of blobs in a range request sized by the peer throughput, 0 means a fixed range size
+	MaxPeersPerShard      int             // max number of peers kept for a shard, 0 means no limit
+	ReconnectAttempts     int             // max dials to reconnect a disconnected peer serving the shards being synced, 0 means disabled
+	ReconnectBackoff      time.Duration   // delay before the first dial to reconnect a peer, doubled with each dial
+	ReconnectMaxBackoff   time.Duration   // max delay between the dials to reconnect a peer
+	EmptyFillPolicy       EmptyFillPolicy // whether the kvs beyond the last kv index are filled with empty blobs
+	L1HealTimeout         time.Duration   // time a blob stays in the heal task before it is downloaded from L1, 0 means disabled
+}
+
+// EmptyFillPolicy decides how the kvs beyond the last kv index of the contract are handled by the sync.
+type EmptyFillPolicy string
+
+const (
+	// EmptyFillEager fills the kvs beyond the last kv index with encoded empty blobs, so the data files
+	// match the layout expected by the contract and the shards can be mined.
+	EmptyFillEager EmptyFillPolicy = "eager"
+	// EmptyFillLazy leaves the kvs beyond the last kv index unwritten until their blobs arrive, which saves
+	// the disk space of sparse data files and the time to encode the empty blobs. The kvs still read as
+	// empty blobs, but the shards cannot be mined before the kvs are filled.
+	EmptyFillLazy EmptyFillPolicy = "lazy"
+)
+
+// ParseEmptyFillPolicy parses the name of an EmptyFillPolicy, where an empty name means EmptyFillEager.
+func ParseEmptyFillPolicy(name string) (EmptyFillPolicy, error) {
+	switch p := EmptyFillPolicy(name); p {
+	case "":
+		return EmptyFillEager, nil
+	case EmptyFillEager, EmptyFillLazy:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown empty fill policy %q", name)
+}
+
+type SyncServerParams struct {
+	GlobalRequestRate  float64 // max requests per second served to all peers
+	GlobalRequestBurst int
+	PeerRequestRate    float64 // max requests per second served to a single peer
+	PeerRequestBurst   int
+	MaxPeerStreams     int     // max requests of a single peer served concurrently, 0 means unlimited
+	PeerBytesRate      float64 // max blob bytes per second served to a single peer, 0 means unlimited
+	PeerBytesBurst     int
+	GlobalBytesRate    float64 // max bytes per second written to the streams of all peers, 0 means unlimited
+	GlobalBytesBurst   int
+	BlobCacheSize      int64  // max bytes of the served blobs cached in memory, 0 disables the cache
+	MaxResponseSize    uint64 // max bytes of blobs replied to a request, the smaller one of it and the size accepted by the client is used
 }
@@ -12,10 +12,15 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-const clientError = 255
+const (
+	clientError = 255
+	// clientTimeout is returned for a request which did not complete within the request timeout
+	clientTimeout = 254
+)
 
 func WriteMsg(stream network.Stream, msg *Msg) error {
 	_ = stream.SetWriteDeadline(time.Now().Add(clientWriteRequestTimeout))
@@ -48,6 +53,71 @@ func WriteMsg(stream network.Stream, msg *Msg) error {
 	return nil
 }
 
+var (
+	// the encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxGossipSize))
+)
+
+// WriteCompressedMsg writes the msg with the payload compressed with zstd. The header after the
+// return code holds the uncompressed and the compressed size of the payload.
+func WriteCompressedMsg(stream network.Stream, msg *Msg) error {
+	_ = stream.SetWriteDeadline(time.Now().Add(clientWriteRequestTimeout))
+	compressed := zstdEncoder.EncodeAll(msg.Payload, nil)
+	buf := make([]byte, 9, 9+len(compressed))
+	buf[0] = msg.ReturnCode
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(msg.Payload)))
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(compressed)))
+	buf = append(buf, compressed...)
+	n, err := stream.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("not fully write")
+	}
+	return nil
+}
+
+// ReadCompressedMsg reads a msg written by WriteCompressedMsg and returns the decompressed payload.
+func ReadCompressedMsg(stream network.Stream) ([]byte, byte, error) {
+	_ = stream.SetReadDeadline(time.Now().Add(clientReadResponseTimeout))
+	var returnCode [1]byte
+	if _, err := io.ReadFull(stream, returnCode[:]); err != nil {
+		return nil, clientError, fmt.Errorf("failed to read result part of response: %w", err)
+	}
+	code := returnCode[0]
+	if code != 0 {
+		return nil, code, requestResultErr(code)
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return nil, code, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	compressedSize := binary.BigEndian.Uint32(header[4:8])
+	if size > maxGossipSize || compressedSize > maxGossipSize {
+		return nil, code, fmt.Errorf("response too large, size %d, compressed size %d", size, compressedSize)
+	}
+	compressed := make([]byte, compressedSize)
+	_, err := io.ReadFull(stream, compressed)
+	if err := stream.CloseRead(); err != nil {
+		return nil, code, fmt.Errorf("failed to close reading side")
+	}
+	if err != nil {
+		return nil, code, err
+	}
+	payload, err := zstdDecoder.DecodeAll(compressed, make([]byte, 0, size))
+	if err != nil {
+		return nil, code, fmt.Errorf("failed to decompress response: %w", err)
+	}
+	if uint32(len(payload)) != size {
+		return nil, code, fmt.Errorf("decompressed size %d mismatch with %d", len(payload), size)
+	}
+	return payload, code, nil
+}
+
 func ReadMsg(stream network.Stream) ([]byte, byte, error) {
 	_ = stream.SetReadDeadline(time.Now().Add(clientReadResponseTimeout))
 	var returnCode [1]byte
@@ -102,7 +172,11 @@ func SendRPC(stream network.Stream, req interface{}, resp interface{}) (byte, er
 		return clientError, err
 	}
 
-	msg, returnCode, err := ReadMsg(s)
+	read := ReadMsg
+	if isCompressedProtocol(s.Protocol()) {
+		read = ReadCompressedMsg
+	}
+	msg, returnCode, err := read(s)
 	if err != nil {
 		return returnCode, err
 	}
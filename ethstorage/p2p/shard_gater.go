@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// shardGater wraps a connection gater, and refuses the connections of the peers known to serve no shard of
+// the local node, instead of closing them after the sync client has declined them. The shards of a peer are
+// known from its ENR found by the discovery; the peers with unknown shards are allowed, as their shard
+// list is requested once connected.
+type shardGater struct {
+	connmgr.ConnectionGater
+	ps          peerstore.Peerstore
+	localShards func() map[common.Address][]uint64
+	log         log.Logger
+}
+
+// NewShardGater returns a connection gater refusing the peers sharing no shard with the local shards,
+// with the other interceptions delegated to the gater.
+func NewShardGater(gater connmgr.ConnectionGater, ps peerstore.Peerstore, localShards func() map[common.Address][]uint64,
+	log log.Logger) connmgr.ConnectionGater {
+	return &shardGater{
+		ConnectionGater: gater,
+		ps:              ps,
+		localShards:     localShards,
+		log:             log,
+	}
+}
+
+func (g *shardGater) InterceptPeerDial(id peer.ID) bool {
+	return g.ConnectionGater.InterceptPeerDial(id) && g.sharesShard(id)
+}
+
+func (g *shardGater) InterceptSecured(dir network.Direction, id peer.ID, addrs network.ConnMultiaddrs) bool {
+	return g.ConnectionGater.InterceptSecured(dir, id, addrs) && g.sharesShard(id)
+}
+
+// sharesShard reports whether the peer serves a shard of the local node, or its shards are unknown.
+// A node without local shards, e.g. a bootnode, accepts all the peers.
+func (g *shardGater) sharesShard(id peer.ID) bool {
+	local := g.localShards()
+	if len(local) == 0 {
+		return true
+	}
+	css, err := g.ps.Get(id, protocol.EthStorageENRKey)
+	if err != nil {
+		return true
+	}
+	remote, ok := css.([]*protocol.ContractShards)
+	if !ok {
+		return true
+	}
+	for _, cs := range remote {
+		for _, shardId := range cs.ShardIds {
+			for _, localId := range local[cs.Contract] {
+				if shardId == localId {
+					return true
+				}
+			}
+		}
+	}
+	g.log.Debug("Refuse connection of peer sharing no shard", "peer", id, "shards", remote)
+	return false
+}
@@ -0,0 +1,73 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/blank"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/libp2p/go-libp2p/p2p/net/conngater"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+)
+
+func TestShardGater(t *testing.T) {
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330001")
+	localShards := map[common.Address][]uint64{contract: {0, 1}}
+
+	// the shards of the remote peers are known as if found by the discovery
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	basic, err := conngater.NewBasicConnectionGater(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gater := NewShardGater(basic, ps, func() map[common.Address][]uint64 { return localShards }, log.New("unittest"))
+
+	newHost := func(opts ...swarmt.Option) host.Host {
+		h := bhost.NewBlankHost(swarmt.GenSwarm(t, opts...))
+		t.Cleanup(func() { h.Close() })
+		return h
+	}
+	local := newHost(swarmt.OptConnGater(gater))
+	overlapping := newHost()
+	disjoint := newHost()
+	ps.Put(overlapping.ID(), protocol.EthStorageENRKey, []*protocol.ContractShards{{Contract: contract, ShardIds: []uint64{1, 2}}})
+	ps.Put(disjoint.ID(), protocol.EthStorageENRKey, []*protocol.ContractShards{
+		{Contract: contract, ShardIds: []uint64{2, 3}},
+		{Contract: common.HexToAddress("0x0000000000000000000000000000000003330002"), ShardIds: []uint64{0}},
+	})
+	localInfo := peer.AddrInfo{ID: local.ID(), Addrs: local.Addrs()}
+
+	// the peer sharing a shard is accepted
+	if err := overlapping.Connect(context.Background(), localInfo); err != nil {
+		t.Fatalf("expected the overlapping peer to connect, got %v", err)
+	}
+	if local.Network().Connectedness(overlapping.ID()) != network.Connected {
+		t.Fatalf("expected the overlapping peer to be connected")
+	}
+
+	// the disjoint peer is gated out, both inbound and outbound
+	disjoint.Connect(context.Background(), localInfo)
+	if local.Network().Connectedness(disjoint.ID()) == network.Connected {
+		t.Fatalf("expected the inbound connection of the disjoint peer to be refused")
+	}
+	err = local.Connect(context.Background(), peer.AddrInfo{ID: disjoint.ID(), Addrs: disjoint.Addrs()})
+	if err == nil || local.Network().Connectedness(disjoint.ID()) == network.Connected {
+		t.Fatalf("expected the outbound connection to the disjoint peer to be refused, got %v", err)
+	}
+
+	// a peer with unknown shards is accepted, as its shard list is requested once connected
+	unknown := newHost()
+	if err := unknown.Connect(context.Background(), localInfo); err != nil {
+		t.Fatalf("expected the peer with unknown shards to connect, got %v", err)
+	}
+}
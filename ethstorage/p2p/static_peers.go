@@ -0,0 +1,199 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethstorage/go-ethstorage/ethstorage/p2p/protocol"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// staticPeerTag protects the static peers from being trimmed by the connection manager.
+	staticPeerTag = "es-static"
+	// staticPeerConnectTimeout bounds the dial of a static peer.
+	staticPeerConnectTimeout = 10 * time.Second
+)
+
+var staticPeersKey = []byte("StaticPeers")
+
+// StaticPeer is a peer added manually with the shards it serves, which is reconnected on restart.
+type StaticPeer struct {
+	Addr   string                     `json:"addr"`
+	Shards []*protocol.ContractShards `json:"shards"`
+}
+
+// StaticPeers connects the peers added manually, e.g. in private deployments where the peers serving
+// known shards are not discoverable via ENR, and registers them to the sync client with their shards.
+type StaticPeers struct {
+	host    host.Host
+	syncCl  *protocol.SyncClient
+	connMgr connmgr.ConnManager // may be nil
+	db      ethdb.KeyValueStore
+	log     log.Logger
+
+	lock  sync.Mutex
+	peers map[peer.ID]*StaticPeer
+}
+
+// NewStaticPeers creates the static peers of the host, with the peers persisted in the db loaded.
+func NewStaticPeers(h host.Host, syncCl *protocol.SyncClient, connMgr connmgr.ConnManager, db ethdb.KeyValueStore, log log.Logger) *StaticPeers {
+	s := &StaticPeers{
+		host:    h,
+		syncCl:  syncCl,
+		connMgr: connMgr,
+		db:      db,
+		log:     log,
+		peers:   make(map[peer.ID]*StaticPeer),
+	}
+	if data, _ := db.Get(staticPeersKey); data != nil {
+		var peers []*StaticPeer
+		if err := json.Unmarshal(data, &peers); err != nil {
+			log.Error("Failed to decode static peers", "err", err)
+			return s
+		}
+		for _, sp := range peers {
+			info, err := parseStaticPeerAddr(sp.Addr)
+			if err != nil {
+				log.Warn("Drop invalid static peer", "addr", sp.Addr, "err", err)
+				continue
+			}
+			s.peers[info.ID] = sp
+		}
+	}
+	return s
+}
+
+// Peers returns the static peers.
+func (s *StaticPeers) Peers() []*StaticPeer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	peers := make([]*StaticPeer, 0, len(s.peers))
+	for _, sp := range s.peers {
+		peers = append(peers, sp)
+	}
+	return peers
+}
+
+// Add connects the peer at the multiaddr, which must include the peer ID, and registers it to the sync
+// client with the shards. The peer is persisted, so it is reconnected on restart.
+func (s *StaticPeers) Add(ctx context.Context, addr string, shards []*protocol.ContractShards) (peer.ID, error) {
+	info, err := parseStaticPeerAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if info.ID == s.host.ID() {
+		return "", fmt.Errorf("cannot add self as a peer")
+	}
+	if err := s.connect(ctx, info, shards); err != nil {
+		return "", err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.peers[info.ID] = &StaticPeer{Addr: addr, Shards: shards}
+	s.save()
+	return info.ID, nil
+}
+
+// Remove disconnects the static peer and removes it from the sync client. It returns false if the peer
+// is not a static peer.
+func (s *StaticPeers) Remove(id peer.ID) bool {
+	s.lock.Lock()
+	_, ok := s.peers[id]
+	if ok {
+		delete(s.peers, id)
+		s.save()
+	}
+	s.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	if s.connMgr != nil {
+		s.connMgr.Unprotect(id, staticPeerTag)
+	}
+	s.host.Peerstore().ClearAddrs(id)
+	s.syncCl.RemovePeer(id)
+	if err := s.host.Network().ClosePeer(id); err != nil {
+		s.log.Debug("Failed to close static peer", "peer", id, "err", err)
+	}
+	return true
+}
+
+// Reconnect connects the persisted static peers, which is done when the node starts.
+func (s *StaticPeers) Reconnect(ctx context.Context) {
+	for _, sp := range s.Peers() {
+		info, err := parseStaticPeerAddr(sp.Addr)
+		if err != nil {
+			continue
+		}
+		if err := s.connect(ctx, info, sp.Shards); err != nil {
+			s.log.Warn("Failed to reconnect static peer", "addr", sp.Addr, "err", err)
+			continue
+		}
+		s.log.Info("Reconnected static peer", "peer", info.ID)
+	}
+}
+
+func (s *StaticPeers) connect(ctx context.Context, info *peer.AddrInfo, shards []*protocol.ContractShards) error {
+	// the shards are put in the peer store before connecting, so that they are used by the
+	// connection notifiee instead of requesting the shard list from the peer
+	if err := s.host.Peerstore().Put(info.ID, protocol.EthStorageENRKey, shards); err != nil {
+		return err
+	}
+	s.host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	if s.connMgr != nil {
+		s.connMgr.Protect(info.ID, staticPeerTag)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, staticPeerConnectTimeout)
+	defer cancel()
+	if err := s.host.Connect(ctx, *info); err != nil {
+		return fmt.Errorf("connect peer %s failed: %w", info.ID, err)
+	}
+	if !s.syncCl.AddPeer(info.ID, protocol.ConvertToShardList(shards), network.DirOutbound) {
+		return fmt.Errorf("peer %s is not accepted by the sync client", info.ID)
+	}
+	return nil
+}
+
+// save persists the static peers. The caller must hold s.lock.
+func (s *StaticPeers) save() {
+	peers := make([]*StaticPeer, 0, len(s.peers))
+	for _, sp := range s.peers {
+		peers = append(peers, sp)
+	}
+	data, err := json.Marshal(peers)
+	if err != nil {
+		panic(err) // This can only fail during implementation
+	}
+	if err := s.db.Put(staticPeersKey, data); err != nil {
+		s.log.Error("Failed to store static peers", "err", err)
+	}
+}
+
+func parseStaticPeerAddr(addr string) (*peer.AddrInfo, error) {
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multiaddr %q: %w", addr, err)
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %q: %w", addr, err)
+	}
+	return info, nil
+}
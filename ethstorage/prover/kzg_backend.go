@@ -0,0 +1,63 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package prover
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// KZGBackendGo is the pure Go implementation, available on every platform.
+	KZGBackendGo = "gokzg"
+	// KZGBackendC is the cgo binding of c-kzg-4844, only available in binaries built
+	// with CGO_ENABLED=1 and the "ckzg" build tag.
+	KZGBackendC = "ckzg"
+)
+
+// SetKZGBackend selects the library used for all KZG commitments and proofs in the process.
+// It also initializes the trusted setup of the backend, which can take a few seconds.
+func SetKZGBackend(backend string, lg log.Logger) error {
+	switch backend {
+	case "", KZGBackendGo:
+		backend = KZGBackendGo
+		if err := kzg4844.UseCKZG(false); err != nil {
+			return err
+		}
+	case KZGBackendC:
+		if err := kzg4844.UseCKZG(true); err != nil {
+			return fmt.Errorf("failed to use KZG backend %s, the binary must be built with CGO_ENABLED=1 and '-tags ckzg': %w", backend, err)
+		}
+	default:
+		return fmt.Errorf("unknown KZG backend %s, must be %s or %s", backend, KZGBackendGo, KZGBackendC)
+	}
+	lg.Info("KZG backend selected", "backend", backend)
+	return nil
+}
+
+// loadTrustedSetup reads the trusted setup JSON file at path, and checks that all its points are
+// valid before creating a go-kzg-4844 context with it.
+func loadTrustedSetup(path string) (*gokzg4844.Context, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted setup: %w", err)
+	}
+	var setup gokzg4844.JSONTrustedSetup
+	if err := json.Unmarshal(content, &setup); err != nil {
+		return nil, fmt.Errorf("failed to parse trusted setup %s: %w", path, err)
+	}
+	if err := gokzg4844.CheckTrustedSetupIsWellFormed(&setup); err != nil {
+		return nil, fmt.Errorf("malformed trusted setup %s: %w", path, err)
+	}
+	ctx, err := gokzg4844.NewContext4096(&setup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trusted setup %s: %w", path, err)
+	}
+	return ctx, nil
+}
@@ -0,0 +1,395 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package prover
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var kzgTestLog = log.New("TestKZGBackend")
+
+func randomBlob(t testing.TB) []byte {
+	blob := make([]byte, blobSize)
+	for i := 0; i < blobSize; i += 32 {
+		var e fr.Element
+		if _, err := e.SetRandom(); err != nil {
+			t.Fatal(err)
+		}
+		b := e.Bytes()
+		copy(blob[i:i+32], b[:])
+	}
+	return blob
+}
+
+func TestKZGBackend_SameOutput(t *testing.T) {
+	if err := SetKZGBackend(KZGBackendC, kzgTestLog); err != nil {
+		t.Skipf("C backend unavailable: %v", err)
+	}
+	defer SetKZGBackend(KZGBackendGo, kzgTestLog)
+
+	p := NewKZGProver(kzgTestLog)
+	blob := randomBlob(t)
+	sampleIdxes := []uint64{0, 1, 2048, 4095}
+	compute := func() (common.Hash, [][]byte) {
+		root, err := p.GetRoot(blob, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs := make([][]byte, len(sampleIdxes))
+		for i, idx := range sampleIdxes {
+			if proofs[i], err = p.GenerateKZGProof(blob, idx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root, proofs
+	}
+
+	cRoot, cProofs := compute()
+	if err := SetKZGBackend(KZGBackendGo, kzgTestLog); err != nil {
+		t.Fatal(err)
+	}
+	goRoot, goProofs := compute()
+
+	if cRoot != goRoot {
+		t.Errorf("root mismatch: ckzg %x, gokzg %x", cRoot, goRoot)
+	}
+	for i, idx := range sampleIdxes {
+		if !bytes.Equal(cProofs[i], goProofs[i]) {
+			t.Errorf("proof mismatch at sample %d", idx)
+		}
+	}
+}
+
+func TestKZGBackend_Unknown(t *testing.T) {
+	if err := SetKZGBackend("unknown", kzgTestLog); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+}
+
+func TestKZGProver_GetRoots(t *testing.T) {
+	p := NewKZGProver(kzgTestLog)
+	vals := make([][]byte, 9)
+	for i := range vals {
+		if i != 4 {
+			vals[i] = randomBlob(t)
+		}
+	}
+	roots, err := p.GetRoots(vals, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != len(vals) {
+		t.Fatalf("expected %d roots, got %d", len(vals), len(roots))
+	}
+	for i, val := range vals {
+		root, err := p.GetRoot(val, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roots[i] != root {
+			t.Errorf("root mismatch at %d: batch %x, single %x", i, roots[i], root)
+		}
+	}
+
+	if roots, err = p.GetRoots(nil, 0, 0); err != nil || len(roots) != 0 {
+		t.Errorf("expected no roots for no blobs, got %v, %v", roots, err)
+	}
+	vals[2] = vals[2][1:]
+	if _, err = p.GetRoots(vals, 0, 0); err == nil {
+		t.Error("expected error for invalid blob size")
+	}
+}
+
+func TestKZGProver_ProofCache(t *testing.T) {
+	for _, capacity := range []int{0, 2} {
+		p := NewKZGProverWithCache(capacity, kzgTestLog)
+		computed := 0
+		p.computeProof = func(blob kzg4844.Blob, point kzg4844.Point) (kzg4844.Proof, kzg4844.Claim, error) {
+			computed++
+			return kzg4844.ComputeProof(blob, point)
+		}
+		blob := randomBlob(t)
+		first, err := p.GenerateKZGProof(blob, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := p.GenerateKZGProof(blob, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("capacity %d: proof mismatch", capacity)
+		}
+		expected := 1
+		if capacity == 0 {
+			expected = 2
+		}
+		if computed != expected {
+			t.Fatalf("capacity %d: expected %d proofs computed, got %d", capacity, expected, computed)
+		}
+
+		// another sample of the blob is not served from the cache
+		other, err := p.GenerateKZGProof(blob, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if computed != expected+1 || bytes.Equal(other, first) {
+			t.Fatalf("capacity %d: expected the proof of another sample computed", capacity)
+		}
+	}
+}
+
+func TestKZGProver_InvalidCachedProof(t *testing.T) {
+	p := NewKZGProverWithCache(2, kzgTestLog)
+	computed := 0
+	p.computeProof = func(blob kzg4844.Blob, point kzg4844.Point) (kzg4844.Proof, kzg4844.Claim, error) {
+		computed++
+		return kzg4844.ComputeProof(blob, point)
+	}
+	blob := randomBlob(t)
+	proof, err := p.GenerateKZGProof(blob, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt the cached entry to be the proof of another sample
+	root, _ := p.GetRoot(blob, 0, 0)
+	entry, _ := p.proofs.Get(proofCacheKey{root, 1})
+	wrong, err := NewKZGProver(kzgTestLog).GenerateKZGProof(blob, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.pointEvalInput = wrong
+
+	again, err := p.GenerateKZGProof(blob, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if computed != 2 || !bytes.Equal(again, proof) {
+		t.Fatalf("expected the invalid cached proof recomputed")
+	}
+}
+
+func TestKZGProver_VerifyProof(t *testing.T) {
+	p := NewKZGProver(kzgTestLog)
+	blob := randomBlob(t)
+	root, err := p.GetRoot(blob, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(idx uint64) []byte {
+		return common.CopyBytes(blob[idx*32 : (idx+1)*32])
+	}
+	for _, idx := range []uint64{0, 1, 2048, 4095} {
+		proof, err := p.GenerateKZGProof(blob, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := p.VerifyProof(root, idx, chunk(idx), proof); err != nil || !ok {
+			t.Fatalf("expected valid proof of chunk %d, got %v, %v", idx, ok, err)
+		}
+	}
+
+	proof, err := p.GenerateKZGProof(blob, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedChunk := chunk(5)
+	tamperedChunk[31] ^= 1
+	tamperedProof := common.CopyBytes(proof)
+	tamperedProof[len(proof)-1] ^= 1
+	tamperedClaim := common.CopyBytes(proof)
+	copy(tamperedClaim[64:96], tamperedChunk)
+	otherRoot, _ := p.GetRoot(randomBlob(t), 0, 0)
+	for name, tc := range map[string]struct {
+		root  common.Hash
+		idx   uint64
+		chunk []byte
+		proof []byte
+	}{
+		"tampered chunk": {root, 5, tamperedChunk, proof},
+		"tampered proof": {root, 5, chunk(5), tamperedProof},
+		"tampered claim": {root, 5, tamperedChunk, tamperedClaim},
+		"other chunk":    {root, 6, chunk(6), proof},
+		"other root":     {otherRoot, 5, chunk(5), proof},
+	} {
+		if ok, err := p.VerifyProof(tc.root, tc.idx, tc.chunk, tc.proof); err != nil || ok {
+			t.Errorf("%s: expected invalid proof, got %v, %v", name, ok, err)
+		}
+	}
+
+	if _, err := p.VerifyProof(root, 5, chunk(5), proof[1:]); err == nil {
+		t.Error("expected error for invalid proof size")
+	}
+	if _, err := p.VerifyProof(root, 4096, chunk(5), proof); err == nil {
+		t.Error("expected error for sample index out of scope")
+	}
+}
+
+// writeTestTrustedSetup writes an insecure trusted setup with a known secret to a file in the format
+// of the go-ethereum embedded one, i.e. the G1 points in Lagrange form over the roots of unity in
+// natural order, and the G2 points in monomial form.
+func writeTestTrustedSetup(t *testing.T, secret uint64) string {
+	var ru, tau, tauN, n fr.Element
+	ru.SetString(ruBLS)
+	tau.SetUint64(secret)
+	tauN.Exp(tau, big.NewInt(gokzg4844.ScalarsPerBlob))
+	tauN.Sub(&tauN, new(fr.Element).SetOne())
+	n.SetUint64(gokzg4844.ScalarsPerBlob)
+
+	// L_i(tau) = w^i * (tau^n - 1) / (n * (tau - w^i))
+	lagrange := make([]fr.Element, gokzg4844.ScalarsPerBlob)
+	w := new(fr.Element).SetOne()
+	for i := range lagrange {
+		var denom fr.Element
+		denom.Sub(&tau, w).Mul(&denom, &n).Inverse(&denom)
+		lagrange[i].Mul(w, &tauN).Mul(&lagrange[i], &denom)
+		w.Mul(w, &ru)
+	}
+	_, _, g1, g2 := bls12381.Generators()
+	setup := struct {
+		G1Lagrange []string `json:"g1_lagrange"`
+		G2Monomial []string `json:"g2_monomial"`
+	}{}
+	for _, p := range bls12381.BatchScalarMultiplicationG1(&g1, lagrange) {
+		b := p.Bytes()
+		setup.G1Lagrange = append(setup.G1Lagrange, hexutil.Encode(b[:]))
+	}
+	tauI := new(fr.Element).SetOne()
+	for i := 0; i < 65; i++ {
+		var p bls12381.G2Affine
+		p.ScalarMultiplication(&g2, tauI.BigInt(new(big.Int)))
+		b := p.Bytes()
+		setup.G2Monomial = append(setup.G2Monomial, hexutil.Encode(b[:]))
+		tauI.Mul(tauI, &tau)
+	}
+
+	content, err := json.Marshal(setup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "trusted_setup.json")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKZGProver_TrustedSetup(t *testing.T) {
+	path := writeTestTrustedSetup(t, 0x1234567)
+	p, err := NewKZGProverWithConfig(KZGProverConfig{TrustedSetup: path}, kzgTestLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := randomBlob(t)
+	root, err := p.GetRoot(blob, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if embedded, _ := NewKZGProver(kzgTestLog).GetRoot(blob, 0, 0); embedded == root {
+		t.Fatal("expected the root with the custom setup to differ from the embedded one")
+	}
+	proof, err := p.GenerateKZGProof(blob, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(proof[0:32], root[:]) {
+		t.Fatalf("proof root mismatch")
+	}
+	if ok, err := p.VerifyProof(root, 10, blob[10*32:11*32], proof); err != nil || !ok {
+		t.Fatalf("expected valid proof with the custom setup, got %v, %v", ok, err)
+	}
+}
+
+func TestKZGProver_MalformedTrustedSetup(t *testing.T) {
+	path := writeTestTrustedSetup(t, 0x1234567)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var setup map[string][]string
+	if err := json.Unmarshal(content, &setup); err != nil {
+		t.Fatal(err)
+	}
+	// not a point on the curve
+	setup["g1_lagrange"][7] = "0x" + common.Bytes2Hex(bytes.Repeat([]byte{0x9a}, 48))
+	corrupted, _ := json.Marshal(setup)
+
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"corrupted point": corrupted,
+		"truncated":       content[:len(content)/2],
+	} {
+		file := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewKZGProverWithConfig(KZGProverConfig{TrustedSetup: file}, kzgTestLog); err == nil {
+			t.Errorf("%s: expected error for malformed trusted setup", name)
+		}
+	}
+	if _, err := NewKZGProverWithConfig(KZGProverConfig{TrustedSetup: filepath.Join(dir, "missing.json")}, kzgTestLog); err == nil {
+		t.Error("expected error for missing trusted setup")
+	}
+}
+
+func benchmarkGetRoot(b *testing.B, backend string) {
+	if err := SetKZGBackend(backend, kzgTestLog); err != nil {
+		b.Skipf("backend %s unavailable: %v", backend, err)
+	}
+	defer SetKZGBackend(KZGBackendGo, kzgTestLog)
+	p := NewKZGProver(kzgTestLog)
+	blob := randomBlob(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.GetRoot(blob, 0, 0)
+	}
+}
+
+func benchmarkGenerateKZGProof(b *testing.B, backend string) {
+	if err := SetKZGBackend(backend, kzgTestLog); err != nil {
+		b.Skipf("backend %s unavailable: %v", backend, err)
+	}
+	defer SetKZGBackend(KZGBackendGo, kzgTestLog)
+	p := NewKZGProver(kzgTestLog)
+	blob := randomBlob(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.GenerateKZGProof(blob, uint64(i)%4096)
+	}
+}
+
+func BenchmarkGoKZGGetRoots(b *testing.B) {
+	p := NewKZGProver(kzgTestLog)
+	vals := make([][]byte, 32)
+	for i := range vals {
+		vals[i] = randomBlob(b)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.GetRoots(vals, 0, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGoKZGGetRoot(b *testing.B)          { benchmarkGetRoot(b, KZGBackendGo) }
+func BenchmarkCKZGGetRoot(b *testing.B)           { benchmarkGetRoot(b, KZGBackendC) }
+func BenchmarkGoKZGGenerateKZGProof(b *testing.B) { benchmarkGenerateKZGProof(b, KZGBackendGo) }
+func BenchmarkCKZGGenerateKZGProof(b *testing.B)  { benchmarkGenerateKZGProof(b, KZGBackendC) }
@@ -14,18 +14,21 @@ import (
 type KZGPoseidonProver struct {
 	dir, zkey    string
 	zkProverMode uint64
+	kzg          *KZGProver
 	lg           log.Logger
 }
 
 // Prover that can be used directly by miner to prove both KZG and Poseidon hash
 // workingDir specifies the working directory of the command relative to the caller.
 // zkeyFileName specifies the zkey file name used by snarkjs to generate snark proof
+// kzg specifies the prover generating the KZG proofs, see NewKZGProverWithConfig
 // returns a prover that can generate a combined KZG + zk proof
-func NewKZGPoseidonProver(workingDir, zkeyFileName string, mode uint64, lg log.Logger) KZGPoseidonProver {
+func NewKZGPoseidonProver(workingDir, zkeyFileName string, mode uint64, kzg *KZGProver, lg log.Logger) KZGPoseidonProver {
 	return KZGPoseidonProver{
 		dir:          workingDir,
 		zkProverMode: mode,
 		zkey:         zkeyFileName,
+		kzg:          kzg,
 		lg:           lg,
 	}
 }
@@ -40,7 +43,7 @@ func NewKZGPoseidonProver(workingDir, zkeyFileName string, mode uint64, lg log.L
 func (p *KZGPoseidonProver) GetStorageProof(data [][]byte, encodingKeys []common.Hash, sampleIdxInKv []uint64) ([]*big.Int, [][]byte, [][]byte, error) {
 	var peInputs [][]byte
 	for i, d := range data {
-		peInput, err := NewKZGProver(p.lg).GenerateKZGProof(d, sampleIdxInKv[i])
+		peInput, err := p.kzg.GenerateKZGProof(d, sampleIdxInKv[i])
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -8,11 +8,15 @@ import (
 	"fmt"
 	"math/big"
 	"math/bits"
+	"runtime"
+	"sync"
 
 	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
 	gokzg4844 "github.com/crate-crypto/go-kzg-4844"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
 	"github.com/protolambda/go-kzg/eth"
 	"github.com/status-im/keycard-go/hexutils"
 )
@@ -20,22 +24,74 @@ import (
 const (
 	ruBLS    = "0x564c0a11a0f704f4fc3e8acfe0f8245f0ad1347b378fbf96e206da11a5d36306"
 	blobSize = gokzg4844.ScalarsPerBlob * gokzg4844.SerializedScalarSize
+	// versioned hash, point, claimed value, commitment and proof
+	pointEvalInputSize = 32 + 32 + 32 + 48 + 48
 )
 
+// KZGProver computes commitments and proofs with the KZG backend selected by SetKZGBackend, or with
+// the trusted setup it is configured with.
 type KZGProver struct {
-	ctx *gokzg4844.Context
 	ru  fr.Element
+	ctx *gokzg4844.Context // nil to use the embedded trusted setup of the backend
 	lg  log.Logger
+
+	computeProof func(kzg4844.Blob, kzg4844.Point) (kzg4844.Proof, kzg4844.Claim, error)
+
+	mu     sync.Mutex
+	proofs *simplelru.LRU[proofCacheKey, *proofCacheEntry] // nil if the cache is bypassed
+}
+
+// KZGProverConfig holds the optional settings of a KZGProver.
+type KZGProverConfig struct {
+	// TrustedSetup is the path of a trusted setup JSON file with the g1_lagrange and g2_monomial
+	// points, as embedded in go-ethereum. The embedded setup is used if it is empty.
+	TrustedSetup string
+	// ProofCacheSize is the number of point evaluation inputs kept, 0 to bypass the cache.
+	ProofCacheSize int
+}
+
+type proofCacheKey struct {
+	root      common.Hash
+	sampleIdx uint64
+}
+
+type proofCacheEntry struct {
+	proofCacheKey
+	pointEvalInput []byte
 }
 
 func NewKZGProver(lg log.Logger) *KZGProver {
-	ctx, err := gokzg4844.NewContext4096Secure()
-	if err != nil {
-		lg.Crit("Failed to init KZG prover", "error", err)
-	}
+	return NewKZGProverWithCache(0, lg)
+}
+
+// NewKZGProverWithCache returns a prover which keeps up to capacity point evaluation inputs it generated,
+// keyed by the blob root and sample index, so proving the same sample of a blob again is not recomputed.
+// A capacity of 0 bypasses the cache.
+func NewKZGProverWithCache(capacity int, lg log.Logger) *KZGProver {
+	// cannot fail without a trusted setup to load
+	p, _ := NewKZGProverWithConfig(KZGProverConfig{ProofCacheSize: capacity}, lg)
+	return p
+}
+
+// NewKZGProverWithConfig returns a prover with the config. If a trusted setup is configured, it is
+// loaded and validated here, and an error is returned if it is malformed.
+func NewKZGProverWithConfig(cfg KZGProverConfig, lg log.Logger) (*KZGProver, error) {
 	var ru fr.Element
 	ru.SetString(ruBLS)
-	return &KZGProver{ctx, ru, lg}
+	p := &KZGProver{ru: ru, lg: lg, computeProof: kzg4844.ComputeProof}
+	if cfg.TrustedSetup != "" {
+		ctx, err := loadTrustedSetup(cfg.TrustedSetup)
+		if err != nil {
+			return nil, err
+		}
+		lg.Info("Loaded KZG trusted setup", "path", cfg.TrustedSetup)
+		p.ctx = ctx
+		p.computeProof = p.ctxComputeProof
+	}
+	if cfg.ProofCacheSize > 0 {
+		p.proofs, _ = simplelru.NewLRU[proofCacheKey, *proofCacheEntry](cfg.ProofCacheSize, nil)
+	}
+	return p, nil
 }
 
 func (p *KZGProver) GetProof(data []byte, nChunkBits, chunkIdx, chunkSize uint64) ([]byte, error) {
@@ -49,9 +105,9 @@ func (p *KZGProver) GetRoot(data []byte, chunkPerKV, chunkSize uint64) (common.H
 	if len(data) != blobSize {
 		return common.Hash{}, fmt.Errorf("invalid blob size: %v", len(data))
 	}
-	var blob gokzg4844.Blob
+	var blob kzg4844.Blob
 	copy(blob[:], data)
-	commitment, err := p.ctx.BlobToKZGCommitment(blob, -1)
+	commitment, err := p.blobToCommitment(blob)
 	if err != nil {
 		return common.Hash{}, fmt.Errorf("could not convert blob to commitment: %v", err)
 	}
@@ -59,6 +115,38 @@ func (p *KZGProver) GetRoot(data []byte, chunkPerKV, chunkSize uint64) (common.H
 	return common.BytesToHash(versionedHash[:]), nil
 }
 
+// GetRoots computes the roots of the blobs in parallel with up to GOMAXPROCS goroutines.
+// The roots are returned in the order of the blobs, and the first error met fails the batch.
+func (p *KZGProver) GetRoots(vals [][]byte, chunksPerKv, chunkSize uint64) ([]common.Hash, error) {
+	roots := make([]common.Hash, len(vals))
+	workers := min(runtime.GOMAXPROCS(0), len(vals))
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(vals); i += workers {
+				root, err := p.GetRoot(vals[i], chunksPerKv, chunkSize)
+				if err != nil {
+					errs[w] = fmt.Errorf("blob %d: %w", i, err)
+					return
+				}
+				roots[i] = root
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
 func (p *KZGProver) GetRootWithProof(dataHash common.Hash, chunkIdx uint64, proofs []byte) (common.Hash, error) {
 	panic("no implement")
 }
@@ -74,23 +162,27 @@ func (p *KZGProver) GenerateKZGProof(data []byte, sampleIdx uint64) ([]byte, err
 	if sampleIdx >= gokzg4844.ScalarsPerBlob {
 		return nil, fmt.Errorf("sample index out of scope")
 	}
-	var blob gokzg4844.Blob
+	var blob kzg4844.Blob
 	copy(blob[:], data)
 
 	// use bit reverse of sampleIdx to get the right claimedValue
 	sampleIdxReversed := reverseBits(sampleIdx)
 	var xe fr.Element
 	inputPoint := gokzg4844.SerializeScalar(*xe.Exp(p.ru, new(big.Int).SetUint64(sampleIdxReversed)))
-	proof, claimedValue, err := p.ctx.ComputeKZGProof(blob, inputPoint, -1)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compute proofs: %v", err)
-	}
-	commitment, err := p.ctx.BlobToKZGCommitment(blob, -1)
+	commitment, err := p.blobToCommitment(blob)
 	if err != nil {
 		return nil, fmt.Errorf("could not convert blob to commitment: %v", err)
 	}
-
 	versionedHash := eth.KZGToVersionedHash(eth.KZGCommitment(commitment))
+	key := proofCacheKey{common.BytesToHash(versionedHash[:]), sampleIdx}
+	if pointEvalInput, ok := p.cachedProof(key, inputPoint[:]); ok {
+		return pointEvalInput, nil
+	}
+
+	proof, claimedValue, err := p.computeProof(blob, kzg4844.Point(inputPoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute proofs: %v", err)
+	}
 	pointEvalInput := bytes.Join(
 		[][]byte{
 			versionedHash[:],
@@ -101,10 +193,107 @@ func (p *KZGProver) GenerateKZGProof(data []byte, sampleIdx uint64) ([]byte, err
 		},
 		[]byte{},
 	)
+	p.cacheProof(key, pointEvalInput)
 	p.lg.Debug("Generate KZG proof", "pointEvalInput", hexutils.BytesToHex(pointEvalInput))
 	return pointEvalInput, nil
 }
 
+// VerifyProof checks that the chunk is the sample at chunkIdx of the blob with the root, using the point
+// evaluation input generated by GenerateKZGProof as the proof. It returns false if the proof does not prove
+// the chunk against the root, and an error if the arguments are malformed.
+func (p *KZGProver) VerifyProof(root common.Hash, chunkIdx uint64, chunk []byte, proof []byte) (bool, error) {
+	if len(chunk) != gokzg4844.SerializedScalarSize {
+		return false, fmt.Errorf("invalid chunk size: %v", len(chunk))
+	}
+	if len(proof) != pointEvalInputSize {
+		return false, fmt.Errorf("invalid proof size: %v", len(proof))
+	}
+	if chunkIdx >= gokzg4844.ScalarsPerBlob {
+		return false, fmt.Errorf("sample index out of scope")
+	}
+	var (
+		commitment kzg4844.Commitment
+		point      kzg4844.Point
+		claim      kzg4844.Claim
+		kzgProof   kzg4844.Proof
+	)
+	copy(point[:], proof[32:64])
+	copy(claim[:], proof[64:96])
+	copy(commitment[:], proof[96:144])
+	copy(kzgProof[:], proof[144:192])
+
+	versionedHash := eth.KZGToVersionedHash(eth.KZGCommitment(commitment))
+	if !bytes.Equal(proof[0:32], root[:]) || !bytes.Equal(versionedHash[:], root[:]) {
+		p.lg.Debug("KZG proof root mismatch", "root", root, "chunkIdx", chunkIdx)
+		return false, nil
+	}
+	var xe fr.Element
+	inputPoint := gokzg4844.SerializeScalar(*xe.Exp(p.ru, new(big.Int).SetUint64(reverseBits(chunkIdx))))
+	if !bytes.Equal(point[:], inputPoint[:]) || !bytes.Equal(claim[:], chunk) {
+		p.lg.Debug("KZG proof point mismatch", "root", root, "chunkIdx", chunkIdx)
+		return false, nil
+	}
+	if err := p.verifyProof(commitment, point, claim, kzgProof); err != nil {
+		p.lg.Debug("KZG proof verification failed", "root", root, "chunkIdx", chunkIdx, "error", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (p *KZGProver) blobToCommitment(blob kzg4844.Blob) (kzg4844.Commitment, error) {
+	if p.ctx == nil {
+		return kzg4844.BlobToCommitment(blob)
+	}
+	commitment, err := p.ctx.BlobToKZGCommitment(gokzg4844.Blob(blob), 0)
+	return kzg4844.Commitment(commitment), err
+}
+
+func (p *KZGProver) ctxComputeProof(blob kzg4844.Blob, point kzg4844.Point) (kzg4844.Proof, kzg4844.Claim, error) {
+	proof, claim, err := p.ctx.ComputeKZGProof(gokzg4844.Blob(blob), gokzg4844.Scalar(point), 0)
+	return kzg4844.Proof(proof), kzg4844.Claim(claim), err
+}
+
+func (p *KZGProver) verifyProof(commitment kzg4844.Commitment, point kzg4844.Point, claim kzg4844.Claim, proof kzg4844.Proof) error {
+	if p.ctx == nil {
+		return kzg4844.VerifyProof(commitment, point, claim, proof)
+	}
+	return p.ctx.VerifyKZGProof(gokzg4844.KZGCommitment(commitment), gokzg4844.Scalar(point), gokzg4844.Scalar(claim), gokzg4844.KZGProof(proof))
+}
+
+// cachedProof returns a copy of the point evaluation input cached for the blob root and sample index.
+// An entry is only served if it was generated for the same root and evaluation point as requested.
+func (p *KZGProver) cachedProof(key proofCacheKey, inputPoint []byte) ([]byte, bool) {
+	if p.proofs == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	entry, ok := p.proofs.Get(key)
+	p.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if entry.proofCacheKey != key ||
+		!bytes.Equal(entry.pointEvalInput[0:32], key.root[:]) ||
+		!bytes.Equal(entry.pointEvalInput[32:64], inputPoint) {
+		p.lg.Warn("Invalid cached KZG proof", "root", key.root, "sampleIdx", key.sampleIdx)
+		p.mu.Lock()
+		p.proofs.Remove(key)
+		p.mu.Unlock()
+		return nil, false
+	}
+	p.lg.Debug("Generate KZG proof from cache", "root", key.root, "sampleIdx", key.sampleIdx)
+	return common.CopyBytes(entry.pointEvalInput), true
+}
+
+func (p *KZGProver) cacheProof(key proofCacheKey, pointEvalInput []byte) {
+	if p.proofs == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proofs.Add(key, &proofCacheEntry{key, common.CopyBytes(pointEvalInput)})
+}
+
 func reverseBits(x uint64) uint64 {
 	// The standard library's bits.Reverse64 inverts its input as a 64-bit unsigned integer.
 	// However, we need to invert it as a log2(len(list))-bit integer, so we need to correct this by
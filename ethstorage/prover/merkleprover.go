@@ -96,3 +96,66 @@ func (MerkleProver) GetRoot(data []byte, chunkPerKV, chunkSize uint64) common.Ha
 	}
 	return nodes[0]
 }
+
+// ChunkTree is the merkle tree over the chunks of a blob built like GetRoot, with the leaves at level 0
+// and the root at the last level. It is kept with all the levels so two versions of a blob can be
+// compared by BlobDiff without hashing the chunks again.
+type ChunkTree [][]common.Hash
+
+// GetTree builds the ChunkTree of the data like GetRoot, whose nodes are all zero for empty data.
+func (MerkleProver) GetTree(data []byte, chunkPerKV, chunkSize uint64) ChunkTree {
+	l := uint64(len(data))
+	leaves := make([]common.Hash, chunkPerKV)
+	for i := uint64(0); i < chunkPerKV && l > 0; i++ {
+		off := i * chunkSize
+		if off >= l {
+			// empty mean the leaf is zero
+			break
+		}
+		leaves[i] = crypto.Keccak256Hash(data[off:min(off+chunkSize, l)])
+	}
+	tree := ChunkTree{leaves}
+	for nodes := leaves; len(nodes) > 1; {
+		parents := make([]common.Hash, len(nodes)/2)
+		if l > 0 {
+			for i := range parents {
+				parents[i] = crypto.Keccak256Hash(nodes[i*2].Bytes(), nodes[i*2+1].Bytes())
+			}
+		}
+		tree = append(tree, parents)
+		nodes = parents
+	}
+	return tree
+}
+
+// Root returns the root of the tree, which is the one returned by GetRoot for the data.
+func (t ChunkTree) Root() common.Hash {
+	if len(t) == 0 || len(t[len(t)-1]) == 0 {
+		return common.Hash{}
+	}
+	return t[len(t)-1][0]
+}
+
+// BlobDiff returns the indexes of the chunks differing between the local and remote trees of a blob in
+// ascending order, so only those chunks need to be transferred to update the blob. The subtrees whose
+// roots match are skipped, so the comparison only descends along the changed chunks.
+func BlobDiff(local, remote ChunkTree) ([]uint64, error) {
+	if len(local) != len(remote) || len(local) == 0 || len(local[0]) != len(remote[0]) {
+		return nil, fmt.Errorf("chunk trees of different shapes")
+	}
+	changed := make([]uint64, 0)
+	var diff func(level int, idx uint64)
+	diff = func(level int, idx uint64) {
+		if local[level][idx] == remote[level][idx] {
+			return
+		}
+		if level == 0 {
+			changed = append(changed, idx)
+			return
+		}
+		diff(level-1, idx*2)
+		diff(level-1, idx*2+1)
+	}
+	diff(len(local)-1, 0)
+	return changed, nil
+}
@@ -4,6 +4,7 @@
 package prover
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -213,3 +214,53 @@ func Test_MerkleProver(test *testing.T) {
 		}
 	}
 }
+
+func TestBlobDiff(t *testing.T) {
+	var (
+		prover     = MerkleProver{}
+		chunkSize  = uint64(64)
+		chunkPerKV = uint64(32)
+		local      = make([]byte, chunkSize*chunkPerKV)
+		changed    = []uint64{3, 17, 18, 31}
+	)
+	for i := range local {
+		local[i] = byte(i * 7)
+	}
+	remote := make([]byte, len(local))
+	copy(remote, local)
+	for _, chunkIdx := range changed {
+		remote[chunkIdx*chunkSize+5] ^= 0xff
+	}
+
+	localTree := prover.GetTree(local, chunkPerKV, chunkSize)
+	remoteTree := prover.GetTree(remote, chunkPerKV, chunkSize)
+	if localTree.Root() != prover.GetRoot(local, chunkPerKV, chunkSize) {
+		t.Fatalf("root of the tree differs from GetRoot")
+	}
+	diff, err := BlobDiff(localTree, remoteTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, changed) {
+		t.Fatalf("expected the changed chunks %v, got %v", changed, diff)
+	}
+	if diff, err := BlobDiff(localTree, localTree); err != nil || len(diff) != 0 {
+		t.Fatalf("expected no chunk changed, got %v, %v", diff, err)
+	}
+
+	// a blob shorter than the kv leaves the chunks after its data zero
+	short := prover.GetTree(local[:chunkSize*10], chunkPerKV, chunkSize)
+	if short.Root() != prover.GetRoot(local[:chunkSize*10], chunkPerKV, chunkSize) {
+		t.Fatalf("root of the tree differs from GetRoot")
+	}
+	if diff, err := BlobDiff(short, localTree); err != nil || len(diff) != int(chunkPerKV-10) || diff[0] != 10 {
+		t.Fatalf("expected the chunks from 10 changed, got %v, %v", diff, err)
+	}
+	empty := prover.GetTree(nil, chunkPerKV, chunkSize)
+	if empty.Root() != (common.Hash{}) {
+		t.Fatalf("expected an empty root, got %x", empty.Root())
+	}
+	if _, err := BlobDiff(localTree, prover.GetTree(local, chunkPerKV/2, chunkSize*2)); err == nil {
+		t.Fatalf("expected the error of comparing trees of different shapes")
+	}
+}
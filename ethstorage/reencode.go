@@ -0,0 +1,157 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// statusReencoding is set in the status of the header if the kvs of the data file are being re-encoded,
+	// in which case the new miner and the progress follow the first kv punched in the header.
+	statusReencoding = uint64(1) << 2
+	// reencodeCheckpointInterval is the number of kvs re-encoded between two checkpoints of the progress.
+	reencodeCheckpointInterval = 64
+)
+
+// targetMiner returns the miner the kvs of the data file are encoded for once its re-encoding, if any, is done.
+func (df *DataFile) targetMiner() common.Address {
+	if df.reencoding {
+		return df.reencodeMiner
+	}
+	return df.miner
+}
+
+// checkpointReencoding records in the header that the kvs before next are re-encoded for miner. The chunks
+// written before are synced first, so the checkpoint never covers a kv whose chunks may be lost.
+func (df *DataFile) checkpointReencoding(miner common.Address, next uint64) error {
+	if err := df.backend.Sync(); err != nil {
+		return err
+	}
+	df.reencoding, df.reencodeMiner, df.reencodeNext = true, miner, next
+	if err := df.writeHeader(); err != nil {
+		return err
+	}
+	return df.backend.Sync()
+}
+
+// finishReencoding makes the miner the kvs are re-encoded for the miner of the data file.
+func (df *DataFile) finishReencoding() error {
+	df.miner = df.reencodeMiner
+	df.reencoding, df.reencodeMiner, df.reencodeNext = false, common.Address{}, 0
+	if err := df.writeHeader(); err != nil {
+		return err
+	}
+	return df.backend.Sync()
+}
+
+// ReEncodeShard re-encodes the kvs of the shard for newMiner, e.g. after the miner address is changed for the
+// payouts, as the kvs encoded for the old miner give no valid mining proofs. Each kv is decoded for the old
+// miner and rewritten in place encoded for the new one. The progress is checkpointed in the headers of the
+// data files, so an interrupted re-encoding is resumed by calling it again with the same miner. The shard
+// must be neither served nor mined until it returns.
+func ReEncodeShard(sm *ShardManager, shardIdx uint64, newMiner common.Address) error {
+	ds, ok := sm.shardMap[shardIdx]
+	if !ok {
+		return fmt.Errorf("shard %d not found", shardIdx)
+	}
+	if !ds.IsComplete() {
+		return fmt.Errorf("shard %d is not complete", shardIdx)
+	}
+	// all the data files are marked first, so the shard is not left with the files of two miners
+	pending := make([]*DataFile, 0, len(ds.dataFiles))
+	for _, df := range ds.dataFiles {
+		if df.reencoding {
+			if df.reencodeMiner != newMiner {
+				return fmt.Errorf("data file %s is being re-encoded for miner %s", df.backend.Name(), df.reencodeMiner)
+			}
+			pending = append(pending, df)
+			continue
+		}
+		if df.miner == newMiner {
+			continue
+		}
+		pending = append(pending, df)
+	}
+	// the kvs of the files resumed may be re-encoded beyond the checkpoint, which is told by decoding them
+	resumeEnd := make(map[*DataFile]uint64, len(pending))
+	for _, df := range pending {
+		if df.reencoding {
+			resumeEnd[df] = min(df.reencodeNext+reencodeCheckpointInterval, df.KvIdxEnd())
+			continue
+		}
+		if err := df.checkpointReencoding(newMiner, df.KvIdxStart()); err != nil {
+			return err
+		}
+	}
+
+	for _, df := range pending {
+		log.Info("Re-encoding data file", "file", df.backend.Name(), "from", df.reencodeNext, "to", df.KvIdxEnd(),
+			"oldMiner", df.miner, "newMiner", newMiner)
+		for kvIdx := df.reencodeNext; kvIdx < df.KvIdxEnd(); kvIdx++ {
+			if err := reencodeKv(sm, ds, df, kvIdx, newMiner, kvIdx < resumeEnd[df]); err != nil {
+				return err
+			}
+			if next := kvIdx + 1; (next-df.KvIdxStart())%reencodeCheckpointInterval == 0 || next == df.KvIdxEnd() {
+				if err := df.checkpointReencoding(newMiner, next); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, df := range pending {
+		if err := df.finishReencoding(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencodeKv rewrites the kv of the data file encoded for newMiner. With resumed, the kv may have been
+// re-encoded before an interruption, which is skipped if it only decodes for newMiner.
+func reencodeKv(sm *ShardManager, ds *DataShard, df *DataFile, kvIdx uint64, newMiner common.Address, resumed bool) error {
+	meta, err := df.ReadMeta(kvIdx)
+	if err != nil {
+		return err
+	}
+	// a kv never written holds no encoded data
+	if bytes.Equal(meta, make([]byte, len(meta))) {
+		return nil
+	}
+	var commit common.Hash
+	copy(commit[:], meta)
+
+	encoded := make([]byte, 0, ds.kvSize)
+	for i := uint64(0); i < ds.chunksPerKv; i++ {
+		chunk, err := df.readVerified(kvIdx*ds.chunksPerKv+i, int(ds.chunkSize))
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, chunk...)
+	}
+	decoded, _, err := sm.DecodeKV(kvIdx, encoded, commit, df.miner, df.encodeType)
+	if err != nil {
+		return err
+	}
+	if resumed && checkCommit(commit, decoded) != nil {
+		if done, _, err := sm.DecodeKV(kvIdx, encoded, commit, newMiner, df.encodeType); err == nil && checkCommit(commit, done) == nil {
+			return nil
+		}
+		return fmt.Errorf("kv %d decodes for neither the old miner nor the new one", kvIdx)
+	}
+	reencoded, _, err := sm.EncodeKV(kvIdx, decoded, commit, newMiner, df.encodeType)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < ds.chunksPerKv; i++ {
+		if err := df.Write(kvIdx*ds.chunksPerKv+i, reencoded[i*ds.chunkSize:(i+1)*ds.chunkSize]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestReEncodeShard(t *testing.T) {
+	var (
+		oldMiner = common.HexToAddress("0x0000000000000000000000000000000000000a01")
+		newMiner = common.HexToAddress("0x0000000000000000000000000000000000000b02")
+		resumed  = common.HexToAddress("0x0000000000000000000000000000000000000c03")
+		blobs    = make(map[uint64][]byte)
+		commits  = make(map[uint64]common.Hash)
+	)
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, oldMiner, defaultEncodeType)
+	if sm == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	// kvs 0 ~ 3 hold blobs, kv 4 is filled with empty, and the rest are never written
+	for idx := uint64(0); idx < 4; idx++ {
+		blob, hash := createBlob(idx)
+		blobs[idx], commits[idx] = blob, prepareCommit(hash)
+		if _, err := sm.TryWrite(idx, blob, commits[idx]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs[4], commits[4] = make([]byte, 131072), prepareCommit(common.Hash{})
+	if _, err := sm.TryWrite(4, blobs[4], commits[4]); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(miner common.Address) {
+		t.Helper()
+		if m, _ := sm.GetShardMiner(0); m != miner {
+			t.Fatalf("expected shard miner %s, got %s", miner, m)
+		}
+		for idx, blob := range blobs {
+			got, _, err := sm.TryRead(idx, len(blob), commits[idx])
+			if err != nil {
+				t.Fatalf("read kv %d failed: %v", idx, err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Fatalf("kv %d read differs from the blob", idx)
+			}
+			encoded, _, err := sm.TryReadEncoded(idx, len(blob))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _, err := sm.EncodeKV(idx, blob, commits[idx], miner, defaultEncodeType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encoded, expected) {
+				t.Fatalf("kv %d is not encoded for miner %s", idx, miner)
+			}
+		}
+	}
+
+	if err := ReEncodeShard(sm, 0, newMiner); err != nil {
+		t.Fatal(err)
+	}
+	verify(newMiner)
+	df, err := OpenDataFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df.Miner() != newMiner || df.reencoding {
+		t.Fatalf("expected the header of miner %s without re-encoding, got %s, re-encoding %v", newMiner, df.Miner(), df.reencoding)
+	}
+	df.Close()
+
+	// interrupt a re-encoding after kvs 0 and 1 are rewritten but before they are checkpointed
+	ds := sm.shardMap[0]
+	df = ds.dataFiles[0]
+	if err := df.checkpointReencoding(resumed, 0); err != nil {
+		t.Fatal(err)
+	}
+	for idx := uint64(0); idx < 2; idx++ {
+		if err := reencodeKv(sm, ds, df, idx, resumed, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ReEncodeShard(sm, 0, oldMiner); err == nil {
+		t.Fatal("expected the re-encoding for another miner to be refused")
+	}
+	if err := ReEncodeShard(sm, 0, resumed); err != nil {
+		t.Fatal(err)
+	}
+	verify(resumed)
+}
@@ -0,0 +1,86 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
+)
+
+// AuditReport is the result of a SelfAudit.
+type AuditReport struct {
+	Sampled         uint64   // filled kvs checked
+	Passed          uint64   // kvs whose data matches the commit in their metas
+	Failed          uint64   // kvs whose data does not match, or whose chunks fail their checksums
+	FailedKvIndices []uint64 // indices of the failed kvs, in ascending order
+}
+
+// SelfAudit checks a random sample of the filled kvs of the shard manager without the original data of the
+// blobs: each sampled kv is read and decoded with the commit in its meta, and the root of the decoded data,
+// recomputed with the prover, is compared with that commit. Each filled kv is sampled with the probability
+// sampleRate, which must be in (0, 1]. An error is returned only if the kvs cannot be read.
+func SelfAudit(sm *ShardManager, prover prv.IProver, sampleRate float64) (AuditReport, error) {
+	var report AuditReport
+	if sampleRate <= 0 || sampleRate > 1 {
+		return report, fmt.Errorf("invalid sample rate %v", sampleRate)
+	}
+	shards := sm.ShardIds()
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	for _, sid := range shards {
+		miner, _ := sm.GetShardMiner(sid)
+		encodeType, _ := sm.GetShardEncodeType(sid)
+		kvSize := sm.ShardKvSize(sid)
+		for kvIdx := sm.KvEntries() * sid; kvIdx < sm.KvEntries()*(sid+1); kvIdx++ {
+			meta, _, err := sm.TryReadMeta(kvIdx)
+			if err != nil {
+				return report, fmt.Errorf("read meta of kv %d failed: %w", kvIdx, err)
+			}
+			if meta[HashSizeInContract]&blobFillingMask == 0 || rand.Float64() >= sampleRate {
+				continue
+			}
+			ok, err := auditKv(sm, prover, kvIdx, kvSize, common.BytesToHash(meta), miner, encodeType)
+			if err != nil {
+				return report, err
+			}
+			report.Sampled++
+			if ok {
+				report.Passed++
+			} else {
+				report.Failed++
+				report.FailedKvIndices = append(report.FailedKvIndices, kvIdx)
+			}
+		}
+	}
+	return report, nil
+}
+
+// auditKv decodes the kv and checks the root of the data against the commit.
+func auditKv(sm *ShardManager, prover prv.IProver, kvIdx, kvSize uint64, commit common.Hash, miner common.Address, encodeType uint64) (bool, error) {
+	encoded, _, err := sm.TryReadEncoded(kvIdx, int(kvSize))
+	if errors.Is(err, ErrChunkCorrupt) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("read kv %d failed: %w", kvIdx, err)
+	}
+	data, _, err := sm.DecodeKV(kvIdx, encoded, commit, miner, encodeType)
+	if err != nil {
+		return false, fmt.Errorf("decode kv %d failed: %w", kvIdx, err)
+	}
+	// the root of an empty blob is not zero, a kv filled with empty must hold zeros only
+	if bytes.Equal(commit[:HashSizeInContract], EmptyBlobCommit) {
+		return bytes.Count(data, []byte{0}) == len(data), nil
+	}
+	root, err := prover.GetRoot(data, kvSize/sm.ChunkSize(), sm.ChunkSize())
+	if err != nil {
+		// the decoded data is not a valid blob
+		return false, nil
+	}
+	return bytes.Equal(root[:HashSizeInContract], commit[:HashSizeInContract]), nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSelfAudit(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	if sm == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	// kvs 0 ~ 3 hold blobs, kv 4 is filled with empty, and the rest are never written
+	commits := make(map[uint64]common.Hash)
+	for idx := uint64(0); idx < 4; idx++ {
+		blob, hash := createBlob(idx)
+		commits[idx] = prepareCommit(hash)
+		if _, err := sm.TryWrite(idx, blob, commits[idx]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sm.TryWrite(4, make([]byte, 131072), prepareCommit(common.Hash{})); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := SelfAudit(sm, prover, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sampled != 5 || report.Passed != 5 || report.Failed != 0 {
+		t.Fatalf("expected 5 kvs passed, got %+v", report)
+	}
+
+	// corrupt the data of kv 2, keeping its meta
+	corrupted := make([]byte, 131072)
+	rand.Read(corrupted)
+	if _, err := sm.TryWriteEncoded(2, corrupted, commits[2]); err != nil {
+		t.Fatal(err)
+	}
+	report, err = SelfAudit(sm, prover, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sampled != 5 || report.Passed != 4 || report.Failed != 1 || !slices.Equal(report.FailedKvIndices, []uint64{2}) {
+		t.Fatalf("expected kv 2 failed, got %+v", report)
+	}
+
+	if _, err := SelfAudit(sm, prover, 0); err == nil {
+		t.Fatalf("expected an error with a zero sample rate")
+	}
+}
@@ -4,6 +4,7 @@
 package ethstorage
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -14,6 +15,9 @@ import (
 // TODO: move to config?
 var ContractToShardManager = make(map[common.Address]*ShardManager)
 
+// ErrKvNotServed is returned by TryReadRange for the kvs of the shards not served by the node.
+var ErrKvNotServed = errors.New("kv not served")
+
 type ShardInfo struct {
 	Contract  common.Address
 	KVSize    uint64
@@ -32,12 +36,20 @@ func InitializeConfig() {
 	}
 }
 
+// findShardManaager returns the shard manager whose default kv size, or the kv size of any of its shards, is kvSize.
 func findShardManaager(kvSize uint64) *ShardManager {
 	for _, v := range ContractToShardManager {
 		if v.kvSize == kvSize {
 			return v
 		}
 	}
+	for _, v := range ContractToShardManager {
+		for _, ds := range v.shardMap {
+			if ds.kvSize == kvSize {
+				return v
+			}
+		}
+	}
 	return nil
 }
 
@@ -58,9 +70,10 @@ func parseKvSize(s string) (uint64, error) {
 }
 
 func AddDataShardFromConfig(cfg string) error {
-	// Format is kvSize,shardIdx
+	// Format is kvSize,shardIdx[,contract], the shard of a contract given may have a kv size other than
+	// the default kv size of the contract
 	ss := strings.Split(cfg, ",")
-	if len(ss) != 2 || len(ss[0]) == 0 || len(ss[1]) == 0 {
+	if len(ss) < 2 || len(ss) > 3 || len(ss[0]) == 0 || len(ss[1]) == 0 {
 		return fmt.Errorf("incorrect data shard cfg")
 	}
 
@@ -70,8 +83,16 @@ func AddDataShardFromConfig(cfg string) error {
 	}
 	var shardIdx uint64
 
-	sm := findShardManaager(kvSize)
-	if sm == nil {
+	var sm *ShardManager
+	if len(ss) == 3 {
+		if !common.IsHexAddress(ss[2]) {
+			return fmt.Errorf("invalid contract %s", ss[2])
+		}
+		sm = ContractToShardManager[common.HexToAddress(ss[2])]
+		if sm == nil {
+			return fmt.Errorf("shard manager of contract %s not found", ss[2])
+		}
+	} else if sm = findShardManaager(kvSize); sm == nil {
 		return fmt.Errorf("shard with kv size %d not found", kvSize)
 	}
 
@@ -80,7 +101,7 @@ func AddDataShardFromConfig(cfg string) error {
 	} else {
 		shardIdx = uint64(v)
 	}
-	return sm.AddDataShard(shardIdx)
+	return sm.AddDataShardWithKvSize(shardIdx, kvSize)
 }
 
 func AddDataFileFromConfig(cfg string) error {
@@ -120,3 +141,38 @@ func Shards() map[common.Address][]uint64 {
 
 	return shardList
 }
+
+// TryReadRange reads and decodes count kvs of the contract from startKvIdx, which may span several shards,
+// and returns the blobs in the order of the kvs, each checked against its commit in commits. If any of the
+// kvs is in a shard not served by the node, ErrKvNotServed is returned before anything is read.
+func TryReadRange(contract common.Address, startKvIdx, count uint64, commits []common.Hash) ([][]byte, error) {
+	sm := ContractToShardManager[contract]
+	if sm == nil {
+		return nil, fmt.Errorf("%w: contract %s", ErrKvNotServed, contract.Hex())
+	}
+	if uint64(len(commits)) != count {
+		return nil, fmt.Errorf("expected %d commits, got %d", count, len(commits))
+	}
+	if count == 0 {
+		return [][]byte{}, nil
+	}
+	for shardIdx := startKvIdx / sm.kvEntries; shardIdx <= (startKvIdx+count-1)/sm.kvEntries; shardIdx++ {
+		if _, ok := sm.shardMap[shardIdx]; !ok {
+			return nil, fmt.Errorf("%w: shard %d of contract %s", ErrKvNotServed, shardIdx, contract.Hex())
+		}
+	}
+
+	blobs := make([][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		kvIdx := startKvIdx + i
+		b, found, err := sm.TryRead(kvIdx, int(sm.ShardKvSize(kvIdx/sm.kvEntries)), commits[i])
+		if err != nil {
+			return nil, fmt.Errorf("read kv %d failed: %w", kvIdx, err)
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: kv %d of contract %s", ErrKvNotServed, kvIdx, contract.Hex())
+		}
+		blobs[i] = b
+	}
+	return blobs, nil
+}
@@ -4,12 +4,26 @@
 package ethstorage
 
 import (
+	"context"
 	"fmt"
 	"math/bits"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// WriteEntry is a raw KV value to be written by TryWriteBatch.
+type WriteEntry struct {
+	KvIdx  uint64
+	Data   []byte
+	Commit common.Hash
+}
+
+// WriteResult is the outcome of an entry of TryWriteBatch, with the same meaning as the results of TryWrite.
+type WriteResult struct {
+	Managed bool
+	Err     error
+}
+
 type ShardManager struct {
 	shardMap        map[uint64]*DataShard
 	contractAddress common.Address
@@ -109,8 +123,17 @@ func (sm *ShardManager) MaxKvSizeBits() uint64 {
 }
 
 func (sm *ShardManager) AddDataShard(shardIdx uint64) error {
+	return sm.AddDataShardWithKvSize(shardIdx, sm.kvSize)
+}
+
+// AddDataShardWithKvSize adds a data shard whose kvs are kvSize bytes, which may differ from the
+// kv size of the other shards of the contract.
+func (sm *ShardManager) AddDataShardWithKvSize(shardIdx uint64, kvSize uint64) error {
+	if !isPow2n(kvSize) || kvSize < sm.chunkSize {
+		return fmt.Errorf("invalid kv size %d of data shard %d", kvSize, shardIdx)
+	}
 	if _, ok := sm.shardMap[shardIdx]; !ok {
-		ds := NewDataShard(shardIdx, sm.kvSize, sm.kvEntries, sm.chunkSize)
+		ds := NewDataShard(shardIdx, kvSize, sm.kvEntries, sm.chunkSize)
 		sm.shardMap[shardIdx] = ds
 		return nil
 	} else {
@@ -118,8 +141,17 @@ func (sm *ShardManager) AddDataShard(shardIdx uint64) error {
 	}
 }
 
+// ShardKvSize returns the kv size of the shard, or the default kv size of the contract if the shard is
+// not managed by the ShardManager.
+func (sm *ShardManager) ShardKvSize(shardIdx uint64) uint64 {
+	if ds, ok := sm.shardMap[shardIdx]; ok {
+		return ds.kvSize
+	}
+	return sm.kvSize
+}
+
 func (sm *ShardManager) AddDataFile(df *DataFile) error {
-	shardIdx := df.chunkIdxStart / sm.chunksPerKv / sm.kvEntries
+	shardIdx := df.KvIdxStart() / sm.kvEntries
 	var ds *DataShard
 	var ok bool
 	if ds, ok = sm.shardMap[shardIdx]; !ok {
@@ -129,36 +161,83 @@ func (sm *ShardManager) AddDataFile(df *DataFile) error {
 	return ds.AddDataFile(df)
 }
 
+// AddDataFileAndShard adds the data file, and the data shard of the file with the kv size of the file
+// if the shard is not added yet.
 func (sm *ShardManager) AddDataFileAndShard(df *DataFile) error {
-	shardIdx := df.chunkIdxStart / sm.chunksPerKv / sm.kvEntries
-	var ds *DataShard
-	var ok bool
-	if ds, ok = sm.shardMap[shardIdx]; !ok {
-		ds = NewDataShard(shardIdx, sm.kvSize, sm.kvEntries, sm.chunkSize)
-		sm.shardMap[shardIdx] = ds
+	shardIdx := df.KvIdxStart() / sm.kvEntries
+	if _, ok := sm.shardMap[shardIdx]; !ok {
+		if err := sm.AddDataShardWithKvSize(shardIdx, df.maxKvSize); err != nil {
+			return err
+		}
 	}
 
-	return ds.AddDataFile(df)
+	return sm.shardMap[shardIdx].AddDataFile(df)
 }
 
 // TryWrite Encode a raw KV data, and write it to the underly storage file.
+// Writes to a shard are serialized and exclude the Try* reads of the same shard,
+// so TryWrite is safe to call from multiple goroutines.
 // Return error if the write IO fails.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryWrite(kvIdx uint64, b []byte, commit common.Hash) (bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
 		return true, ds.Write(kvIdx, b, commit)
 	} else {
 		return false, nil
 	}
 }
 
+// TryWriteBatch encodes and writes the raw KV data of the entries like TryWrite, but runs of adjacent
+// kvIdx in the same data file are written with a single WriteAt for the chunks and one for the metas.
+// The result of each entry is returned in the order of the entries; all entries of a run share the
+// error if the write of the run fails.
+func (sm *ShardManager) TryWriteBatch(entries []WriteEntry) []WriteResult {
+	results := make([]WriteResult, len(entries))
+	for i := 0; i < len(entries); {
+		ds, ok := sm.shardMap[entries[i].KvIdx/sm.kvEntries]
+		if !ok {
+			i++
+			continue
+		}
+		if uint64(len(entries[i].Data)) > ds.kvSize {
+			results[i] = WriteResult{true, fmt.Errorf("write data too large")}
+			i++
+			continue
+		}
+		df := ds.GetStorageFile(entries[i].KvIdx * ds.chunksPerKv)
+		if df == nil {
+			results[i] = WriteResult{true, fmt.Errorf("kv not found: the shard is not completed?")}
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(entries) && entries[j].KvIdx == entries[j-1].KvIdx+1 && df.ContainsKv(entries[j].KvIdx) &&
+			uint64(len(entries[j].Data)) <= ds.kvSize {
+			j++
+		}
+
+		ds.mu.Lock()
+		err := ds.writeBatch(df, entries[i:j])
+		ds.mu.Unlock()
+		for k := i; k < j; k++ {
+			results[k] = WriteResult{true, err}
+		}
+		i = j
+	}
+	return results
+}
+
 // TryWriteEncoded write the encoded data to the underly storage file directly.
 // Return error if the write IO fails.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryWriteEncoded(kvIdx uint64, b []byte, commit common.Hash) (bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
 		err := ds.WriteWith(kvIdx, b, commit, func(cdata []byte, chunkIdx uint64) []byte {
 			return cdata
 		})
@@ -172,9 +251,17 @@ func (sm *ShardManager) TryWriteEncoded(kvIdx uint64, b []byte, commit common.Ha
 // Return error if the read IO fails.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
+	return sm.TryReadCtx(context.Background(), kvIdx, readLen, commit)
+}
+
+// TryReadCtx reads and decodes the KV data like TryRead, and returns ctx.Err() once the context is done,
+// which is checked between the chunks of the KV.
+func (sm *ShardManager) TryReadCtx(ctx context.Context, kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
-		b, err := ds.Read(kvIdx, readLen, commit)
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		b, err := ds.ReadCtx(ctx, kvIdx, readLen, commit)
 		return b, true, err
 	} else {
 		return nil, false, nil
@@ -200,6 +287,8 @@ func (sm *ShardManager) TryEncodeKV(kvIdx uint64, b []byte, hash common.Hash) ([
 func (sm *ShardManager) TryReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
 		b, commit, err := ds.ReadWithMeta(kvIdx, readLen)
 		return b, commit, true, err
 	} else {
@@ -221,6 +310,13 @@ func (sm *ShardManager) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
 	return NO_ENCODE, false
 }
 
+func (sm *ShardManager) IsShardComplete(shardIdx uint64) (bool, bool) {
+	if ds, ok := sm.shardMap[shardIdx]; ok {
+		return ds.IsComplete(), true
+	}
+	return false, false
+}
+
 // DecodeKV Decode the encoded KV data.
 func (sm *ShardManager) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
 	return sm.DecodeOrEncodeKV(kvIdx, b, hash, providerAddr, false, encodeType)
@@ -266,10 +362,36 @@ func (sm *ShardManager) DecodeOrEncodeKV(kvIdx uint64, b []byte, hash common.Has
 // Return error if the read IO fails.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
+	return sm.TryReadEncodedCtx(context.Background(), kvIdx, readLen)
+}
+
+// TryReadEncodedCtx reads the encoded KV data like TryReadEncoded, and returns ctx.Err() once the context
+// is done, which is checked between the chunks of the KV.
+func (sm *ShardManager) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
-		b, err := ds.ReadEncoded(kvIdx, readLen) // read all the data
-		return b[:readLen], true, err
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		b, err := ds.ReadEncodedCtx(ctx, kvIdx, readLen) // read all the data
+		if err != nil {
+			return nil, true, err
+		}
+		return b[:readLen], true, nil
+	} else {
+		return nil, false, nil
+	}
+}
+
+// TryReadEncodedRange Read readLen bytes of the encoded KV data starting at off from storage file and return it.
+// Return error if the read IO fails or the range exceeds the max KV size.
+// Return false if the data is not managed by the ShardManager.
+func (sm *ShardManager) TryReadEncodedRange(kvIdx uint64, off, readLen int) ([]byte, bool, error) {
+	shardIdx := kvIdx / sm.kvEntries
+	if ds, ok := sm.shardMap[shardIdx]; ok {
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		b, err := ds.ReadEncodedRange(kvIdx, off, readLen)
+		return b, true, err
 	} else {
 		return nil, false, nil
 	}
@@ -281,6 +403,8 @@ func (sm *ShardManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool,
 func (sm *ShardManager) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
 		b, err := ds.ReadMeta(kvIdx) // read all the data
 		return b, true, err
 	} else {
@@ -288,30 +412,72 @@ func (sm *ShardManager) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
 	}
 }
 
+// isPunched returns whether the kv is in the tail of its data file punched by Compact.
+func (sm *ShardManager) isPunched(kvIdx uint64) bool {
+	if ds, ok := sm.shardMap[kvIdx/sm.kvEntries]; ok {
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		for _, df := range ds.dataFiles {
+			if df.ContainsKv(kvIdx) {
+				return df.isPunched(kvIdx)
+			}
+		}
+	}
+	return false
+}
+
+// shardOfChunk returns the shard containing the chunk counted in the chunks of the kv size of the shard,
+// which is the lowest shard containing it if shards of different kv sizes overlap.
+func (sm *ShardManager) shardOfChunk(chunkIdx uint64) (*DataShard, bool) {
+	var found *DataShard
+	for _, ds := range sm.shardMap {
+		if ds.ContainsChunk(chunkIdx) && (found == nil || ds.shardIdx < found.shardIdx) {
+			found = ds
+		}
+	}
+	return found, found != nil
+}
+
 // TryReadChunk Read the encoded KV data using chunkIdx from storage file and decode it.
+// The chunkIdx is counted in the chunks of kvs of the kv size of the shard.
 // Return error if the read IO fails.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryReadChunk(chunkIdx uint64, commit common.Hash) ([]byte, bool, error) {
-	kvIdx := chunkIdx / sm.chunksPerKv
-	cIdx := chunkIdx % sm.chunksPerKv
+	if ds, ok := sm.shardOfChunk(chunkIdx); ok {
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		b, err := ds.ReadChunk(chunkIdx/ds.chunksPerKv, chunkIdx%ds.chunksPerKv, commit) // read all the data
+		return b, true, err
+	} else {
+		return nil, false, nil
+	}
+}
+
+// TryReadChunks Read the chunks at chunkIdxs of the KV from storage file and decode only them, keyed by
+// their indexes in the KV. The chunks are not checked against the commit, which covers the whole KV.
+// Return error if the read IO fails.
+// Return false if the data is not managed by the ShardManager.
+func (sm *ShardManager) TryReadChunks(kvIdx uint64, chunkIdxs []uint64, commit common.Hash) (map[uint64][]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	if ds, ok := sm.shardMap[shardIdx]; ok {
-		b, err := ds.ReadChunk(kvIdx, cIdx, commit) // read all the data
-		return b, true, err
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		chunks, err := ds.ReadChunks(kvIdx, chunkIdxs, commit)
+		return chunks, true, err
 	} else {
 		return nil, false, nil
 	}
 }
 
 // TryReadChunkEncoded Read the encoded KV data using chunkIdx from storage file and return it.
+// The chunkIdx is counted in the chunks of kvs of the kv size of the shard.
 // Return error if the read IO fails.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryReadChunkEncoded(chunkIdx uint64) ([]byte, bool, error) {
-	kvIdx := chunkIdx / sm.chunksPerKv
-	cIdx := chunkIdx % sm.chunksPerKv
-	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
-		b, err := ds.ReadChunkEncoded(kvIdx, cIdx) // read all the data
+	if ds, ok := sm.shardOfChunk(chunkIdx); ok {
+		ds.mu.RLock()
+		defer ds.mu.RUnlock()
+		b, err := ds.ReadChunkEncoded(chunkIdx/ds.chunksPerKv, chunkIdx%ds.chunksPerKv) // read all the data
 		return b, true, err
 	} else {
 		return nil, false, nil
@@ -0,0 +1,677 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethstorage/go-ethstorage/ethstorage/storage"
+)
+
+func TestShardManager_ConcurrentWrite(t *testing.T) {
+	const (
+		chunkSize = uint64(1024)
+		kvSize    = uint64(4096)
+		writers   = 8
+		rounds    = 50
+	)
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330002")
+	sm, files := createEthStorage(contract, []uint64{0}, chunkSize, kvSize, kvEntries, common.Address{}, NO_ENCODE)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	// every writer fills the whole KV with its own byte, so a torn write shows up as mixed bytes
+	value := func(kvIdx uint64, w int) []byte {
+		return bytes.Repeat([]byte{byte(kvIdx*writers + uint64(w) + 1)}, int(kvSize))
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, writers*int(kvEntries)*2)
+	for kvIdx := uint64(0); kvIdx < kvEntries; kvIdx++ {
+		for w := 0; w < writers; w++ {
+			wg.Add(2)
+			go func(kvIdx uint64, w int) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					if _, err := sm.TryWrite(kvIdx, value(kvIdx, w), common.Hash{}); err != nil {
+						errCh <- err
+						return
+					}
+				}
+			}(kvIdx, w)
+			go func(kvIdx uint64) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					b, _, err := sm.TryReadEncoded(kvIdx, int(kvSize))
+					if err != nil {
+						errCh <- err
+						return
+					}
+					if !bytes.Equal(b, bytes.Repeat(b[:1], int(kvSize))) {
+						t.Errorf("torn read of kv %d", kvIdx)
+						return
+					}
+				}
+			}(kvIdx)
+		}
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	// the final value of every KV must come from one of its writers
+	for kvIdx := uint64(0); kvIdx < kvEntries; kvIdx++ {
+		b, _, err := sm.TryReadEncoded(kvIdx, int(kvSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for w := 0; w < writers; w++ {
+			if bytes.Equal(b, value(kvIdx, w)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("kv %d is corrupted", kvIdx)
+		}
+	}
+}
+
+func TestShardManager_TryReadEncodedRange(t *testing.T) {
+	const (
+		chunkSize = uint64(1024)
+		kvSize    = uint64(4096)
+	)
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330003")
+	sm, files := createEthStorage(contract, []uint64{0}, chunkSize, kvSize, kvEntries, common.Address{}, NO_ENCODE)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	kvIdx := uint64(3)
+	blob := make([]byte, kvSize)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	if _, err := sm.TryWrite(kvIdx, blob, common.Hash{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		off     int
+		len     int
+		wantErr bool
+	}{
+		{"within a chunk", 100, 200, false},
+		{"chunk aligned", 1024, 1024, false},
+		{"across chunks", 1000, 2100, false},
+		{"whole blob", 0, int(kvSize), false},
+		{"empty", 4096, 0, false},
+		{"exceeds blob", 4000, 200, true},
+		{"negative offset", -1, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok, err := sm.TryReadEncodedRange(kvIdx, tt.off, tt.len)
+			if !ok {
+				t.Fatal("kv should be managed by the shard manager")
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TryReadEncodedRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(b, blob[tt.off:tt.off+tt.len]) {
+				t.Errorf("TryReadEncodedRange() returned wrong data")
+			}
+		})
+	}
+
+	if _, ok, _ := sm.TryReadEncodedRange(kvEntries, 0, 10); ok {
+		t.Error("kv of another shard should not be found")
+	}
+}
+
+func TestShardManager_EncodeTypeRoundTrip(t *testing.T) {
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	for _, encodeType := range []uint64{ENCODE_KECCAK_256, ENCODE_BLOB_POSEIDON} {
+		t.Run(fmt.Sprintf("encodeType %d", encodeType), func(t *testing.T) {
+			contract := common.HexToAddress("0x0000000000000000000000000000000003330004")
+			sm, files := createEthStorage(contract, []uint64{0}, 131072, 131072, kvEntries, miner, encodeType)
+			defer func() {
+				sm.Close()
+				for _, file := range files {
+					os.Remove(file)
+				}
+			}()
+
+			kvIdx := uint64(5)
+			blob, hash := createBlob(kvIdx)
+			encoded, ok, err := sm.TryEncodeKV(kvIdx, blob, hash)
+			if !ok || err != nil {
+				t.Fatalf("TryEncodeKV failed: %v", err)
+			}
+			if bytes.Equal(encoded, blob) {
+				t.Fatal("encoded blob should differ from the raw blob")
+			}
+			if _, err := sm.TryWrite(kvIdx, blob, hash); err != nil {
+				t.Fatal(err)
+			}
+			stored, _, err := sm.TryReadEncoded(kvIdx, len(blob))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, encoded) {
+				t.Fatal("stored blob differs from TryEncodeKV output")
+			}
+			decoded, _, err := sm.TryRead(kvIdx, len(blob), hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, blob) {
+				t.Fatal("decoded blob differs from the raw blob")
+			}
+		})
+	}
+}
+
+func TestShardManager_ShardMiners(t *testing.T) {
+	cfg := &storage.StorageConfig{
+		Miner: common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"),
+		ShardMiners: map[uint64]common.Address{
+			1: common.HexToAddress("0x0000000000000000000000000000000000000b01"),
+		},
+	}
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330006")
+	sm := NewShardManager(contract, 131072, kvEntries, 131072)
+	var files []string
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	for _, shardIdx := range []uint64{0, 1} {
+		file := fmt.Sprintf("ss-miner-%d.dat", shardIdx)
+		files = append(files, file)
+		df, err := Create(file, shardIdx*kvEntries, kvEntries, 0, 131072, ENCODE_KECCAK_256, cfg.MinerOf(shardIdx), 131072)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.AddDataFileAndShard(df); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, shardIdx := range []uint64{0, 1} {
+		miner := cfg.MinerOf(shardIdx)
+		if got, ok := sm.GetShardMiner(shardIdx); !ok || got != miner {
+			t.Fatalf("shard %d: expected miner %s, got %s", shardIdx, miner, got)
+		}
+		// the same blob is encoded with the miner of its shard
+		kvIdx := shardIdx*kvEntries + 3
+		blob, hash := createBlob(3)
+		enc, ok, err := sm.TryEncodeKV(kvIdx, blob, hash)
+		if !ok || err != nil {
+			t.Fatalf("TryEncodeKV failed: %v", err)
+		}
+		want, _, err := sm.EncodeKV(kvIdx, blob, hash, miner, ENCODE_KECCAK_256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(enc, want) {
+			t.Fatalf("shard %d: blob is not encoded with miner %s", shardIdx, miner)
+		}
+		if shardIdx == 1 {
+			withDefault, _, err := sm.EncodeKV(kvIdx, blob, hash, cfg.Miner, ENCODE_KECCAK_256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(enc, withDefault) {
+				t.Fatal("shard 1 should not be encoded with the default miner")
+			}
+		}
+	}
+}
+
+func TestShardManager_MismatchedEncodeType(t *testing.T) {
+	sm := NewShardManager(common.HexToAddress("0x0000000000000000000000000000000003330005"), 131072, 2, 131072)
+	files := []string{"ss-encode-0.dat", "ss-encode-1.dat"}
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	for i, encodeType := range []uint64{ENCODE_BLOB_POSEIDON, ENCODE_KECCAK_256} {
+		df, err := Create(files[i], uint64(i), 1, 0, 131072, encodeType, common.Address{}, 131072)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sm.AddDataFileAndShard(df)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && err == nil {
+			t.Fatal("data file with a different encode type should be rejected")
+		}
+	}
+
+	if _, err := Create("ss-encode-bad.dat", 0, 1, 0, 131072, ENCODE_END+1, common.Address{}, 131072); err == nil {
+		os.Remove("ss-encode-bad.dat")
+		t.Fatal("unknown encode type should be rejected")
+	}
+}
+
+func TestShardManager_TryWriteBatch(t *testing.T) {
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330007")
+	sm, files := createEthStorage(contract, []uint64{0}, 1024, 4096, kvEntries, miner, ENCODE_KECCAK_256)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	// two runs of adjacent kvs, an oversized value, and a kv of a shard which is not managed
+	kvIndices := []uint64{1, 2, 3, 7, 8, 9, 10, kvEntries}
+	entries := make([]WriteEntry, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		entries[i] = WriteEntry{
+			KvIdx:  kvIdx,
+			Data:   bytes.Repeat([]byte{byte(kvIdx + 1)}, 4000),
+			Commit: common.Hash{byte(kvIdx + 1)},
+		}
+	}
+	entries[5].Data = make([]byte, 4097)
+
+	results := sm.TryWriteBatch(entries)
+	for i, r := range results {
+		switch {
+		case kvIndices[i] == kvEntries:
+			if r.Managed {
+				t.Errorf("kv %d should not be managed", kvIndices[i])
+			}
+		case i == 5:
+			if r.Err == nil {
+				t.Errorf("oversized kv %d should fail", kvIndices[i])
+			}
+		default:
+			if !r.Managed || r.Err != nil {
+				t.Fatalf("write kv %d failed: %v", kvIndices[i], r.Err)
+			}
+			meta, _, err := sm.TryReadMeta(kvIndices[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(meta, entries[i].Commit[:]) {
+				t.Errorf("meta of kv %d mismatch", kvIndices[i])
+			}
+			encoded, _, err := sm.TryReadEncoded(kvIndices[i], 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _, _ := sm.TryEncodeKV(kvIndices[i], entries[i].Data, entries[i].Commit)
+			if !bytes.Equal(encoded, expected) {
+				t.Errorf("data of kv %d mismatch", kvIndices[i])
+			}
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, batch bool) {
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330008")
+	sm, files := createEthStorage(contract, []uint64{0}, 4096, 131072, kvEntries, common.Address{}, NO_ENCODE)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	entries := make([]WriteEntry, kvEntries)
+	for i := range entries {
+		entries[i] = WriteEntry{KvIdx: uint64(i), Data: bytes.Repeat([]byte{byte(i)}, 131072)}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if batch {
+			sm.TryWriteBatch(entries)
+			continue
+		}
+		for _, e := range entries {
+			sm.TryWrite(e.KvIdx, e.Data, e.Commit)
+		}
+	}
+}
+
+func BenchmarkShardManager_TryWrite(b *testing.B)      { benchmarkWrite(b, false) }
+func BenchmarkShardManager_TryWriteBatch(b *testing.B) { benchmarkWrite(b, true) }
+
+func TestShardManager_KvFilter(t *testing.T) {
+	const (
+		chunkSize = uint64(1024)
+		kvSize    = uint64(4096)
+		rounds    = 200
+	)
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330008")
+	sm, files := createEthStorage(contract, []uint64{0}, chunkSize, kvSize, kvEntries, miner, ENCODE_KECCAK_256)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	// a kv which is neither synced nor filled reads as zero without reading the file
+	if b, _, err := sm.TryReadEncoded(3, int(kvSize)); err != nil || !bytes.Equal(b, make([]byte, kvSize)) {
+		t.Fatalf("unexpected read of an empty kv: %v", err)
+	}
+
+	// the filter must hold every kv with a meta in the file, and the reads must match the file
+	check := func(sm *ShardManager) {
+		ds := sm.ShardMap()[0]
+		df := ds.dataFiles[0]
+		for kvIdx := uint64(0); kvIdx < kvEntries; kvIdx++ {
+			meta, err := df.ReadMeta(kvIdx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(meta, make([]byte, len(meta))) && !ds.mayContain(kvIdx) {
+				t.Fatalf("false negative for kv %d", kvIdx)
+			}
+			read, _, err := sm.TryReadMeta(kvIdx)
+			if err != nil || !bytes.Equal(read, meta) {
+				t.Fatalf("meta of kv %d mismatch: %x vs %x, err %v", kvIdx, read, meta, err)
+			}
+			encoded, _, err := sm.TryReadEncoded(kvIdx, int(kvSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := make([]byte, kvSize)
+			for i := uint64(0); i < kvSize/chunkSize; i++ {
+				chunk, err := df.Read(kvIdx*kvSize/chunkSize+i, int(chunkSize))
+				if err != nil {
+					t.Fatal(err)
+				}
+				copy(expected[i*chunkSize:], chunk)
+			}
+			if !bytes.Equal(encoded, expected) {
+				t.Fatalf("data of kv %d mismatch", kvIdx)
+			}
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < rounds; i++ {
+		kvIdx := uint64(rng.Intn(int(kvEntries - 1)))
+		data := bytes.Repeat([]byte{byte(i + 1)}, int(kvSize))
+		commit := common.Hash{byte(i + 1)}
+		var err error
+		switch rng.Intn(4) {
+		case 0:
+			_, err = sm.TryWrite(kvIdx, data, commit)
+		case 1:
+			results := sm.TryWriteBatch([]WriteEntry{{kvIdx, data, commit}, {kvIdx + 1, data, commit}})
+			err = errors.Join(results[0].Err, results[1].Err)
+		case 2:
+			// filled with empty
+			_, err = sm.TryWriteEncoded(kvIdx, make([]byte, kvSize), prepareCommit(common.Hash{}))
+		case 3:
+			// deleted
+			err = sm.ShardMap()[0].WriteMeta(kvIdx, make([]byte, 32))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(sm)
+	}
+
+	// the filter is populated from the metas when the data file is opened again
+	sm.Close()
+	reopened := NewShardManager(contract, kvSize, kvEntries, chunkSize)
+	df, err := OpenDataFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.AddDataFileAndShard(df); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	ds := reopened.ShardMap()[0]
+	for kvIdx := uint64(0); kvIdx < kvEntries; kvIdx++ {
+		meta, err := df.ReadMeta(kvIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(meta, make([]byte, len(meta))) && !ds.mayContain(kvIdx) {
+			t.Fatalf("false negative for kv %d after reopen", kvIdx)
+		}
+	}
+}
+
+// cancelAfterCtx reports context.Canceled once Err has been checked more than n times.
+type cancelAfterCtx struct {
+	context.Context
+	n int
+}
+
+func (c *cancelAfterCtx) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestShardManager_TryReadCtx(t *testing.T) {
+	const (
+		chunkSize = uint64(4096)
+		kvSize    = uint64(131072)
+	)
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330009")
+	sm, files := createEthStorage(contract, []uint64{0}, chunkSize, kvSize, kvEntries, miner, NO_ENCODE)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	// the decoded read checks the data against the commit, so the commit is the versioned hash of the blob
+	data, commit := createBlob(0)
+	if _, err := sm.TryWrite(0, data, prepareCommit(commit)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the read stops after the first chunk once the context is cancelled
+	if _, _, err := sm.TryReadEncodedCtx(&cancelAfterCtx{context.Background(), 1}, 0, int(kvSize)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the encoded read to be cancelled, got %v", err)
+	}
+	if _, _, err := sm.TryReadCtx(&cancelAfterCtx{context.Background(), 2}, 0, int(kvSize), commit); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the read to be cancelled, got %v", err)
+	}
+
+	b, found, err := sm.TryReadCtx(context.Background(), 0, int(kvSize), commit)
+	if err != nil || !found || !bytes.Equal(b, data) {
+		t.Fatalf("unexpected read: found %v, err %v", found, err)
+	}
+}
+
+func TestTryReadRange(t *testing.T) {
+	contract := common.HexToAddress("0x000000000000000000000000000000000333000a")
+	sm, files := createEthStorage(contract, []uint64{0, 1, 3}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		delete(ContractToShardManager, contract)
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	// kvs 14 ~ 17 span the boundary of shards 0 and 1
+	blobs := make([][]byte, 0)
+	commits := make([]common.Hash, 0)
+	for idx := uint64(14); idx < 18; idx++ {
+		blob, hash := createBlob(idx)
+		if _, err := sm.TryWrite(idx, blob, prepareCommit(hash)); err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, blob)
+		commits = append(commits, hash)
+	}
+	read, err := TryReadRange(contract, 14, 4, commits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range blobs {
+		if !bytes.Equal(read[i], blobs[i]) {
+			t.Fatalf("blob %d of the range does not match kv %d", i, 14+i)
+		}
+	}
+
+	// shard 2 in the middle of kvs 30 ~ 49 is not served
+	if _, err := TryReadRange(contract, 30, 20, make([]common.Hash, 20)); !errors.Is(err, ErrKvNotServed) {
+		t.Fatalf("expected ErrKvNotServed, got %v", err)
+	}
+	if _, err := TryReadRange(common.Address{1}, 0, 1, make([]common.Hash, 1)); !errors.Is(err, ErrKvNotServed) {
+		t.Fatalf("expected ErrKvNotServed for an unknown contract, got %v", err)
+	}
+}
+
+func TestShardManager_VariableKvSize(t *testing.T) {
+	const (
+		chunkSize = uint64(131072)
+		kvSize    = uint64(131072)
+	)
+	miner := common.HexToAddress("0x0000000000000000000000000000000000000a01")
+	sm, files := createEthStorageWithKvSizes(contractAddress, []uint64{0, 1}, map[uint64]uint64{1: 2 * kvSize},
+		chunkSize, kvSize, kvEntries, miner, defaultEncodeType)
+	if sm == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+
+	if sm.ShardKvSize(0) != kvSize || sm.ShardKvSize(1) != 2*kvSize || sm.ShardKvSize(2) != kvSize {
+		t.Fatalf("unexpected shard kv sizes %d, %d, %d", sm.ShardKvSize(0), sm.ShardKvSize(1), sm.ShardKvSize(2))
+	}
+
+	// a kv of shard 1 holds a blob followed by a second chunk of arbitrary data
+	for _, kvIdx := range []uint64{1, kvEntries + 1} {
+		blob, hash := createBlob(kvIdx)
+		size := sm.ShardKvSize(kvIdx / kvEntries)
+		data := make([]byte, size)
+		copy(data, blob)
+		rand.Read(data[len(blob):])
+		commit := prepareCommit(hash)
+		if _, err := sm.TryWrite(kvIdx, data, commit); err != nil {
+			t.Fatalf("write kv %d failed: %v", kvIdx, err)
+		}
+
+		read, _, err := sm.TryRead(kvIdx, int(size), commit)
+		if err != nil {
+			t.Fatalf("read kv %d failed: %v", kvIdx, err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Fatalf("kv %d read differs from the data written", kvIdx)
+		}
+		encoded, _, err := sm.TryReadEncoded(kvIdx, int(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _, err := sm.EncodeKV(kvIdx, data, commit, miner, defaultEncodeType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, expected) {
+			t.Fatalf("kv %d is not encoded with the kv size of its shard", kvIdx)
+		}
+		decoded, _, err := sm.DecodeKV(kvIdx, encoded, commit, miner, defaultEncodeType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("kv %d does not round-trip", kvIdx)
+		}
+	}
+
+	if _, err := sm.TryWrite(1, make([]byte, 2*kvSize), prepareCommit(common.Hash{})); err == nil {
+		t.Fatalf("expected writing a kv larger than the kv size of shard 0 to fail")
+	}
+}
+
+func TestShardManager_TryReadChunks(t *testing.T) {
+	const (
+		chunkSize = uint64(4096)
+		kvSize    = uint64(131072)
+	)
+	miner := common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D")
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330007")
+	sm, files := createEthStorage(contract, []uint64{0}, chunkSize, kvSize, kvEntries, miner, ENCODE_KECCAK_256)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	kvIdx := uint64(2)
+	blob, hash := createBlob(kvIdx)
+	if _, err := sm.TryWrite(kvIdx, blob, hash); err != nil {
+		t.Fatal(err)
+	}
+	// kv 3 is never written, and read as an empty blob
+	for _, kv := range []struct {
+		idx    uint64
+		commit common.Hash
+	}{{kvIdx, hash}, {kvIdx + 1, common.Hash{}}} {
+		full, _, err := sm.TryRead(kv.idx, int(kvSize), kv.commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkIdxs := []uint64{0, 5, 31, 5}
+		chunks, ok, err := sm.TryReadChunks(kv.idx, chunkIdxs, kv.commit)
+		if !ok || err != nil {
+			t.Fatalf("TryReadChunks of kv %d failed: %v", kv.idx, err)
+		}
+		if len(chunks) != 3 {
+			t.Fatalf("expected 3 chunks of kv %d, got %d", kv.idx, len(chunks))
+		}
+		for _, chunkIdx := range chunkIdxs {
+			if !bytes.Equal(chunks[chunkIdx], full[chunkIdx*chunkSize:(chunkIdx+1)*chunkSize]) {
+				t.Fatalf("chunk %d of kv %d differs from TryRead", chunkIdx, kv.idx)
+			}
+		}
+	}
+
+	if _, _, err := sm.TryReadChunks(kvIdx, []uint64{kvSize / chunkSize}, hash); err == nil {
+		t.Error("expected the error of a chunk out of the kv")
+	}
+	if _, ok, _ := sm.TryReadChunks(kvEntries, []uint64{0}, hash); ok {
+		t.Error("kv of another shard should not be found")
+	}
+}
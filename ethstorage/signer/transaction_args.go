@@ -28,6 +28,10 @@ type TransactionArgs struct {
 
 	AccessList *types.AccessList `json:"accessList,omitempty"`
 	ChainID    *hexutil.Big      `json:"chainId,omitempty"`
+
+	// For BlobTxType
+	BlobFeeCap *hexutil.Big  `json:"maxFeePerBlobGas,omitempty"`
+	BlobHashes []common.Hash `json:"blobVersionedHashes,omitempty"`
 }
 
 // NewTransactionArgsFromTransaction creates a TransactionArgs struct from an EIP-1559 transaction
@@ -48,6 +52,10 @@ func NewTransactionArgsFromTransaction(chainId *big.Int, from common.Address, tx
 		MaxPriorityFeePerGas: (*hexutil.Big)(tx.GasTipCap()),
 		AccessList:           &accesses,
 	}
+	if tx.Type() == types.BlobTxType {
+		args.BlobFeeCap = (*hexutil.Big)(tx.BlobGasFeeCap())
+		args.BlobHashes = tx.BlobHashes()
+	}
 	return args
 }
 
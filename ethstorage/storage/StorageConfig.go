@@ -3,7 +3,19 @@
 
 package storage
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DataFileName is the name of the data file of a shard created by es-node init.
+const DataFileName = "shard-%d.dat"
 
 type StorageConfig struct {
 	Filenames         []string
@@ -12,4 +24,96 @@ type StorageConfig struct {
 	KvEntriesPerShard uint64
 	L1Contract        common.Address
 	Miner             common.Address
+	ShardMiners       map[uint64]common.Address // miners of the shards encoded for another address than Miner
+	VerifyOnOpen      bool
+	Mmap              bool // serve the reads of the data files from memory mappings
+}
+
+// Check verifies that the storage layout read from the contract is supported. The shard
+// and chunk index math (e.g. kvIdx >> kvEntriesBits) requires all the sizes to be powers of two.
+func (c *StorageConfig) Check() error {
+	if c.KvSize == 0 || c.ChunkSize == 0 || c.KvEntriesPerShard == 0 {
+		return fmt.Errorf("kvSize (%d), chunkSize (%d) and kvEntriesPerShard (%d) must be positive",
+			c.KvSize, c.ChunkSize, c.KvEntriesPerShard)
+	}
+	if !isPow2(c.KvSize) {
+		return fmt.Errorf("kvSize %d is not a power of two", c.KvSize)
+	}
+	if !isPow2(c.ChunkSize) {
+		return fmt.Errorf("chunkSize %d is not a power of two", c.ChunkSize)
+	}
+	if !isPow2(c.KvEntriesPerShard) {
+		return fmt.Errorf("kvEntriesPerShard %d is not a power of two", c.KvEntriesPerShard)
+	}
+	if c.ChunkSize > c.KvSize || c.KvSize%c.ChunkSize != 0 {
+		return fmt.Errorf("kvSize %d must be a multiple of chunkSize %d", c.KvSize, c.ChunkSize)
+	}
+	return nil
+}
+
+// MinerOf returns the miner address the shard is encoded for and receives the mining rewards.
+func (c *StorageConfig) MinerOf(shardIdx uint64) common.Address {
+	if miner, ok := c.ShardMiners[shardIdx]; ok {
+		return miner
+	}
+	return c.Miner
+}
+
+// ParseShardMiners parses the miners of the shards in the form of "shardIdx:address".
+func ParseShardMiners(values []string) (map[uint64]common.Address, error) {
+	miners := make(map[uint64]common.Address, len(values))
+	for _, v := range values {
+		idx, addr, ok := strings.Cut(v, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid shard miner %q, expected shardIdx:address", v)
+		}
+		shardIdx, err := strconv.ParseUint(strings.TrimSpace(idx), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard index in %q: %w", v, err)
+		}
+		addr = strings.TrimSpace(addr)
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("invalid miner address in %q", v)
+		}
+		if _, ok := miners[shardIdx]; ok {
+			return nil, fmt.Errorf("duplicate miner of shard %d", shardIdx)
+		}
+		miners[shardIdx] = common.HexToAddress(addr)
+	}
+	return miners, nil
+}
+
+// DiskMap maps the shards to the directories their data files are placed in, so the shards of a large
+// deployment can be spread across the disks. The data files of the shards not in the map stay in the datadir.
+type DiskMap map[uint64]string
+
+// LoadDiskMap reads the disk map from a JSON file of shard indexes to directories, e.g. {"0": "/mnt/disk0"}.
+func LoadDiskMap(file string) (DiskMap, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := make(DiskMap)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid disk map %s: %w", file, err)
+	}
+	for shardIdx, dir := range m {
+		if strings.TrimSpace(dir) == "" {
+			return nil, fmt.Errorf("empty directory of shard %d in disk map %s", shardIdx, file)
+		}
+	}
+	return m, nil
+}
+
+// DataFile returns the path of the data file of the shard.
+func (m DiskMap) DataFile(datadir string, shardIdx uint64) string {
+	dir, ok := m[shardIdx]
+	if !ok {
+		dir = datadir
+	}
+	return filepath.Join(dir, fmt.Sprintf(DataFileName, shardIdx))
+}
+
+func isPow2(v uint64) bool {
+	return v != 0 && v&(v-1) == 0
 }
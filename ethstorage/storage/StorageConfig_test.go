@@ -0,0 +1,60 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestStorageConfig_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     StorageConfig
+		wantErr bool
+	}{
+		{"valid", StorageConfig{KvSize: 1 << 17, ChunkSize: 1 << 17, KvEntriesPerShard: 1 << 13}, false},
+		{"multiple chunks", StorageConfig{KvSize: 1 << 17, ChunkSize: 1 << 12, KvEntriesPerShard: 16}, false},
+		{"zero entries", StorageConfig{KvSize: 1 << 17, ChunkSize: 1 << 17, KvEntriesPerShard: 0}, true},
+		{"entries not pow2", StorageConfig{KvSize: 1 << 17, ChunkSize: 1 << 17, KvEntriesPerShard: 3000}, true},
+		{"kv size not pow2", StorageConfig{KvSize: 131000, ChunkSize: 131000, KvEntriesPerShard: 16}, true},
+		{"chunk larger than kv", StorageConfig{KvSize: 1 << 12, ChunkSize: 1 << 17, KvEntriesPerShard: 16}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseShardMiners(t *testing.T) {
+	miners, err := ParseShardMiners([]string{"1:0x0000000000000000000000000000000000000b01", " 3 : 0x0000000000000000000000000000000000000b03"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := StorageConfig{Miner: common.HexToAddress("0x04580493117292ba13361D8e9e28609ec112264D"), ShardMiners: miners}
+	for shardIdx, want := range map[uint64]common.Address{
+		0: cfg.Miner,
+		1: common.HexToAddress("0x0000000000000000000000000000000000000b01"),
+		3: common.HexToAddress("0x0000000000000000000000000000000000000b03"),
+	} {
+		if got := cfg.MinerOf(shardIdx); got != want {
+			t.Errorf("MinerOf(%d) = %s, want %s", shardIdx, got, want)
+		}
+	}
+
+	for _, invalid := range [][]string{
+		{"0x0000000000000000000000000000000000000b01"},
+		{"a:0x0000000000000000000000000000000000000b01"},
+		{"1:0xb01"},
+		{"1:0x0000000000000000000000000000000000000b01", "1:0x0000000000000000000000000000000000000b02"},
+	} {
+		if _, err := ParseShardMiners(invalid); err == nil {
+			t.Errorf("ParseShardMiners(%q) should fail", invalid)
+		}
+	}
+}
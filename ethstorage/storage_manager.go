@@ -119,6 +119,9 @@ func (s *StorageManager) DownloadFinished(newL1 int64, kvIndices []uint64, blobs
 	if err != nil {
 		return err
 	}
+	if c, ok := s.l1Source.(metaInvalidator); ok {
+		c.InvalidateMetas(kvIndices, s.localL1, newL1)
+	}
 	s.lastKvIdx = lastKvIdx
 	s.localL1 = newL1
 
@@ -154,25 +157,15 @@ func (s *StorageManager) Reset(newL1 int64) error {
 }
 
 // CommitBlobs This function will be called when p2p sync received blobs. It will commit the blobs
-// that match local L1 view and return the unmatched ones.
-// Note that the caller must make sure the blobs data and the corresponding commit are matched.
-func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
+// that match local L1 view, and return the indexes of the blobs committed and of the ones failed.
+// Note that the caller must make sure the blobs data and the corresponding commit are matched, and that
+// the commits match the contract, so the blobs failed are the ones failing for local reasons, e.g. the
+// local L1 view changed or a write failed, which are to be retried.
+// The blobs to write are written with TryWriteBatch, so a contiguous range of kvs costs a few writes
+// per data file instead of a few per chunk.
+func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, []uint64, error) {
 	if len(kvIndices) != len(blobs) || len(blobs) != len(commits) {
-		return nil, errors.New("invalid params lens")
-	}
-	var (
-		l            = len(kvIndices)
-		encodedBlobs = make([][]byte, l)
-		encoded      = make([]bool, l)
-	)
-	for i := 0; i < len(kvIndices); i++ {
-		encodedBlob, success, err := s.shardManager.TryEncodeKV(kvIndices[i], blobs[i], commits[i])
-		if !success || err != nil {
-			log.Warn("Blob encode failed", "index", kvIndices[i], "err", err.Error())
-			continue
-		}
-		encodedBlobs[i] = encodedBlob
-		encoded[i] = true
+		return nil, nil, errors.New("invalid params lens")
 	}
 
 	s.mu.Lock()
@@ -180,22 +173,33 @@ func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits
 
 	metas, err := s.getKvMetas(kvIndices)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	inserted := []uint64{}
+	inserted, failed := []uint64{}, []uint64{}
+	entries := make([]WriteEntry, 0, len(kvIndices))
 	for i, contractMeta := range metas {
-		if !encoded[i] {
-			continue
-		}
-		err := s.commitEncodedBlob(kvIndices[i], encodedBlobs[i], commits[i], contractMeta)
+		write, err := s.checkCommit(kvIndices[i], commits[i], contractMeta)
 		if err != nil {
 			log.Warn("Commit blobs fail", "kvIndex", kvIndices[i], "err", err.Error())
+			failed = append(failed, kvIndices[i])
 			continue
 		}
-		inserted = append(inserted, kvIndices[i])
+		if !write {
+			inserted = append(inserted, kvIndices[i])
+			continue
+		}
+		entries = append(entries, WriteEntry{KvIdx: kvIndices[i], Data: blobs[i], Commit: prepareCommit(commits[i])})
 	}
-	return inserted, nil
+	for i, res := range s.shardManager.TryWriteBatch(entries) {
+		if !res.Managed || res.Err != nil {
+			log.Warn("Commit blobs fail", "kvIndex", entries[i].KvIdx, "managed", res.Managed, "err", res.Err)
+			failed = append(failed, entries[i].KvIdx)
+			continue
+		}
+		inserted = append(inserted, entries[i].KvIdx)
+	}
+	return inserted, failed, nil
 }
 
 // CommitEmptyBlobs use to commit batch empty blobs, return inserted blobs count, next index to fill
@@ -266,20 +270,22 @@ func (s *StorageManager) CommitBlob(kvIndex uint64, blob []byte, commit common.H
 	return s.commitEncodedBlob(kvIndex, encodedBlob, commit, contractMeta)
 }
 
-func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, commit common.Hash, contractMeta [32]byte) error {
+// checkCommit checks the commit of the kv against its meta in the contract, and returns whether the blob
+// needs to be written, which is false if the local storage already has it.
+func (s *StorageManager) checkCommit(kvIndex uint64, commit common.Hash, contractMeta [32]byte) (bool, error) {
 	// the commit is different with what we got from the contract, so should not commit
 	if !bytes.Equal(contractMeta[32-HashSizeInContract:32], commit[0:HashSizeInContract]) {
-		return errCommitMismatch
+		return false, errCommitMismatch
 	}
 
 	m, success, err := s.shardManager.TryReadMeta(kvIndex)
 	if !success || err != nil {
-		return errors.New("metadata read failed")
+		return false, errors.New("metadata read failed")
 	}
 
 	contractKvIdx := new(big.Int).SetBytes(contractMeta[0:5]).Uint64()
 	if contractKvIdx != kvIndex {
-		return errors.New("kvIdx from contract and input is not matched")
+		return false, errors.New("kvIdx from contract and input is not matched")
 	}
 
 	localMeta := common.Hash{}
@@ -288,18 +294,99 @@ func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, c
 	// the local already have the data and we do not need to commit
 	// empty filled case: if both of the hash is 0, but local meta shows this encodedBlob hasn't been filled yet, we should also commit
 	if bytes.Equal(localMeta[0:HashSizeInContract], commit[0:HashSizeInContract]) && (localMeta[HashSizeInContract]&blobFillingMask) != 0 {
-		return nil
+		return false, nil
+	}
+	// the kvs punched by Compact already read as empty, and filling them would take their space again
+	if commit == (common.Hash{}) && localMeta == (common.Hash{}) && s.shardManager.isPunched(kvIndex) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, commit common.Hash, contractMeta [32]byte) error {
+	write, err := s.checkCommit(kvIndex, commit, contractMeta)
+	if err != nil || !write {
+		return err
 	}
 
 	c := prepareCommit(commit)
 
-	success, err = s.shardManager.TryWriteEncoded(kvIndex, encodedBlob, c)
+	success, err := s.shardManager.TryWriteEncoded(kvIndex, encodedBlob, c)
 	if !success || err != nil {
 		return errors.New("encodedBlob write failed")
 	}
 	return nil
 }
 
+// Compact reclaims the space of the kvs beyond the last kv index at the tail of the data file, which is
+// left allocated when the shard is dropped or the last kv index of the contract shrinks. Only the kvs
+// filled with empty are punched, so the compaction stops at the last kv with data or not synced yet. The
+// punched kvs are skipped by CommitEmptyBlobs afterwards. Only holes are punched, so the file keeps its
+// size and the shard is still complete, while the blocks are freed on the file systems supporting it.
+func (s *StorageManager) Compact(df *DataFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ds *DataShard
+	for _, shard := range s.shardManager.shardMap {
+		if shard.Contains(df.KvIdxStart()) {
+			ds = shard
+			break
+		}
+	}
+	if ds == nil {
+		return fmt.Errorf("data file of kv %d is not managed", df.KvIdxStart())
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	end := df.KvIdxEnd()
+	for end > max(s.lastKvIdx, df.KvIdxStart()) {
+		meta, err := df.ReadMeta(end - 1)
+		if err != nil {
+			return err
+		}
+		if !isEmptyFilled(meta) {
+			break
+		}
+		end--
+	}
+	if end == df.KvIdxEnd() {
+		return nil
+	}
+	log.Info("Compact data file", "file", df.backend.Name(), "punchFrom", end, "punchTo", df.KvIdxEnd())
+	return df.punch(end, df.KvIdxEnd())
+}
+
+// InvalidateKv clears the filling mask of the local meta of the kv, e.g. of a kv with a corrupt chunk, so
+// the kv is not synced and the blob of the same commit is written again by the next commit.
+func (s *StorageManager) InvalidateKv(kvIdx uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.shardManager.shardMap[kvIdx/s.shardManager.kvEntries]
+	if !ok {
+		return fmt.Errorf("kv %d is not managed", kvIdx)
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	meta, err := ds.ReadMeta(kvIdx)
+	if err != nil {
+		return err
+	}
+	meta[HashSizeInContract] &^= blobFillingMask
+	return ds.WriteMeta(kvIdx, meta)
+}
+
+// isEmptyFilled reports whether the local meta is of a kv filled with empty: without commit, but filled.
+func isEmptyFilled(meta []byte) bool {
+	if len(meta) <= HashSizeInContract || meta[HashSizeInContract]&blobFillingMask == 0 {
+		return false
+	}
+	return bytes.Equal(meta[0:HashSizeInContract], make([]byte, HashSizeInContract))
+}
+
 func (s *StorageManager) syncCheck(kvIdx uint64) error {
 	meta, success, err := s.shardManager.TryReadMeta(kvIdx)
 	if !success || err != nil {
@@ -451,6 +538,90 @@ func (s *StorageManager) downloadMetaInRange(ctx context.Context, from, to, batc
 	return nil
 }
 
+// RefreshMetas re-reads the last kv index and the metas of the local kv entries at blockNumber, which should be
+// a block the caller does not expect to be reorged, and returns the kv indices whose metas changed since they were
+// downloaded, including the kvs dropped by a shrunk last kv index. Nothing is refreshed if the local L1 view is
+// already at or beyond blockNumber, as the metas are then updated by DownloadFinished.
+func (s *StorageManager) RefreshMetas(ctx context.Context, blockNumber int64, batchSize uint64) ([]uint64, error) {
+	s.mu.Lock()
+	localL1, oldLastKvIdx := s.localL1, s.lastKvIdx
+	s.mu.Unlock()
+	if blockNumber <= localL1 {
+		return nil, nil
+	}
+
+	lastKvIdx, err := s.l1Source.GetStorageLastBlobIdx(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]uint64, 0)
+	// the metas cached by the l1Source for the kvs may have been read before the reorg
+	defer func() {
+		if p, ok := s.l1Source.(metaPurger); ok && len(changed) > 0 {
+			p.PurgeMetas(changed)
+		}
+	}()
+	for _, sid := range s.Shards() {
+		from, limit := s.KvEntries()*sid, min(s.KvEntries()*(sid+1), oldLastKvIdx)
+		// kvs in [keep, limit) have been removed from the contract
+		keep := max(from, min(limit, lastKvIdx))
+		for from < keep {
+			batchLimit := min(from+batchSize, keep)
+			kvIndices := make([]uint64, 0, batchLimit-from)
+			for i := from; i < batchLimit; i++ {
+				kvIndices = append(kvIndices, i)
+			}
+			metas, err := s.l1Source.GetKvMetas(kvIndices, blockNumber)
+			if err != nil {
+				return nil, err
+			}
+			if len(metas) != len(kvIndices) {
+				return nil, fmt.Errorf("expected %d metas, got %d", len(kvIndices), len(metas))
+			}
+
+			s.mu.Lock()
+			if s.localL1 != localL1 {
+				s.mu.Unlock()
+				return changed, nil
+			}
+			for i, meta := range metas {
+				if old, ok := s.blobMetas[kvIndices[i]]; ok && old != meta {
+					s.blobMetas[kvIndices[i]] = meta
+					changed = append(changed, kvIndices[i])
+				}
+			}
+			s.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return changed, nil
+			default:
+			}
+			from = batchLimit
+		}
+
+		s.mu.Lock()
+		if s.localL1 != localL1 {
+			s.mu.Unlock()
+			return changed, nil
+		}
+		for i := keep; i < limit; i++ {
+			delete(s.blobMetas, i)
+			changed = append(changed, i)
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localL1 == localL1 && lastKvIdx < s.lastKvIdx {
+		log.Info("Last kv index shrunk", "from", s.lastKvIdx, "to", lastKvIdx, "blockNumber", blockNumber)
+		s.lastKvIdx = lastKvIdx
+	}
+	return changed, nil
+}
+
 // This function is only called by DownloadFinished which already uses s.mu to protect the s.blobMetas, so
 // we don't need to lock in this function
 func (s *StorageManager) updateLocalMetas(kvIndices []uint64, commits []common.Hash) {
@@ -490,6 +661,11 @@ func (s *StorageManager) getKvMetas(kvIndices []uint64) ([][32]byte, error) {
 // TryReadEncoded This function will read the encoded data from the local storage file. It also check whether the blob is empty or not synced,
 // if they are these two cases, it will return err.
 func (s *StorageManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
+	return s.TryReadEncodedCtx(context.Background(), kvIdx, readLen)
+}
+
+// TryReadEncodedCtx is TryReadEncoded with a context, which stops the read once it is done.
+func (s *StorageManager) TryReadEncodedCtx(ctx context.Context, kvIdx uint64, readLen int) ([]byte, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -498,14 +674,27 @@ func (s *StorageManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool
 		return nil, false, err
 	}
 
-	return s.shardManager.TryReadEncoded(kvIdx, readLen)
+	return s.shardManager.TryReadEncodedCtx(ctx, kvIdx, readLen)
 }
 
 func (s *StorageManager) TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
+	return s.TryReadCtx(context.Background(), kvIdx, readLen, commit)
+}
+
+// TryReadCtx is TryRead with a context, which stops the read once it is done.
+func (s *StorageManager) TryReadCtx(ctx context.Context, kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shardManager.TryReadCtx(ctx, kvIdx, readLen, commit)
+}
+
+// TryReadChunks reads and decodes only the chunks at chunkIdxs of the kv, see ShardManager.TryReadChunks.
+func (s *StorageManager) TryReadChunks(kvIdx uint64, chunkIdxs []uint64, commit common.Hash) (map[uint64][]byte, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.shardManager.TryRead(kvIdx, readLen, commit)
+	return s.shardManager.TryReadChunks(kvIdx, chunkIdxs, commit)
 }
 
 func (s *StorageManager) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
@@ -514,6 +703,14 @@ func (s *StorageManager) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
 	return s.shardManager.TryReadMeta(kvIdx)
 }
 
+// GetKvMetas returns the metas of the kvs from the contract. The metas need to be downloaded by
+// DownloadAllMetas before, except for the kvs beyond the last kv index, which are empty.
+func (s *StorageManager) GetKvMetas(kvIndices []uint64) ([][32]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getKvMetas(kvIndices)
+}
+
 func (s *StorageManager) LastKvIndex() uint64 {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -555,10 +752,23 @@ func (s *StorageManager) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
 	return s.shardManager.GetShardEncodeType(shardIdx)
 }
 
+func (s *StorageManager) IsShardComplete(shardIdx uint64) (bool, bool) {
+	return s.shardManager.IsShardComplete(shardIdx)
+}
+
 func (s *StorageManager) MaxKvSize() uint64 {
 	return s.shardManager.kvSize
 }
 
+// ShardKvSize returns the kv size of the shard, which may differ from the default kv size of the contract.
+func (s *StorageManager) ShardKvSize(shardIdx uint64) uint64 {
+	return s.shardManager.ShardKvSize(shardIdx)
+}
+
+func (s *StorageManager) ChunkSize() uint64 {
+	return s.shardManager.chunkSize
+}
+
 func (s *StorageManager) MaxKvSizeBits() uint64 {
 	return s.shardManager.kvSizeBits
 }
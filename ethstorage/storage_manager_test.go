@@ -4,11 +4,13 @@
 package ethstorage
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/detailyang/go-fallocate"
@@ -91,17 +93,28 @@ func newMockL1Source(lastBlobIndex uint64, metafile string) Il1Source {
 
 func createEthStorage(contract common.Address, shardIdxList []uint64, chunkSize, kvSize, kvEntries uint64,
 	miner common.Address, encodeType uint64) (*ShardManager, []string) {
+	return createEthStorageWithKvSizes(contract, shardIdxList, nil, chunkSize, kvSize, kvEntries, miner, encodeType)
+}
+
+// createEthStorageWithKvSizes creates the shards like createEthStorage, the kv size of a shard in
+// shardKvSizes overrides the default kvSize.
+func createEthStorageWithKvSizes(contract common.Address, shardIdxList []uint64, shardKvSizes map[uint64]uint64,
+	chunkSize, kvSize, kvEntries uint64, miner common.Address, encodeType uint64) (*ShardManager, []string) {
 	sm := NewShardManager(contract, kvSize, kvEntries, chunkSize)
 	ContractToShardManager[contract] = sm
-	chunkPerKv := kvSize / chunkSize
 
 	files := make([]string, 0)
 	for _, shardIdx := range shardIdxList {
-		sm.AddDataShard(shardIdx)
+		shardKvSize := kvSize
+		if size, ok := shardKvSizes[shardIdx]; ok {
+			shardKvSize = size
+		}
+		chunkPerKv := shardKvSize / chunkSize
+		sm.AddDataShardWithKvSize(shardIdx, shardKvSize)
 		fileName := fmt.Sprintf(".\\ss%d.dat", shardIdx)
 		files = append(files, fileName)
 		startChunkId := shardIdx * chunkPerKv * kvEntries
-		_, err := Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, kvSize, encodeType, miner, sm.ChunkSize())
+		_, err := Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, shardKvSize, encodeType, miner, sm.ChunkSize())
 		if err != nil {
 			log.Crit("open failed", "error", err)
 		}
@@ -213,7 +226,7 @@ func TestStorageManager_CommitBlobs(t *testing.T) {
 
 	kvIndex := uint64(2)
 	b, h := createBlob(kvIndex)
-	successCommitted, err := storageManager.CommitBlobs([]uint64{kvIndex}, [][]byte{b}, []common.Hash{h})
+	successCommitted, _, err := storageManager.CommitBlobs([]uint64{kvIndex}, [][]byte{b}, []common.Hash{h})
 	if err != nil {
 		t.Fatal("failed to commit blob", err)
 	}
@@ -234,6 +247,54 @@ func TestStorageManager_CommitBlobs(t *testing.T) {
 	}
 }
 
+func benchmarkCommitBlobs(b *testing.B, batch bool) {
+	contract := common.HexToAddress("0x0000000000000000000000000000000003330009")
+	sm, files := createEthStorage(contract, []uint64{0}, 4096, 131072, kvEntries, common.Address{}, NO_ENCODE)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, nil)
+	kvIndices := make([]uint64, kvEntries)
+	blobs := make([][]byte, kvEntries)
+	commits := make([]common.Hash, kvEntries)
+	for i := range kvIndices {
+		kvIndices[i] = uint64(i)
+		blobs[i] = bytes.Repeat([]byte{byte(i)}, 131072)
+		commits[i] = common.Hash{byte(i + 1)}
+	}
+	s.lastKvIdx = kvEntries
+	s.updateLocalMetas(kvIndices, commits)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// clear the metas so the blobs are written again
+		b.StopTimer()
+		for _, kvIdx := range kvIndices {
+			if err := sm.ShardMap()[0].WriteMeta(kvIdx, make([]byte, 32)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		if batch {
+			if inserted, _, err := s.CommitBlobs(kvIndices, blobs, commits); err != nil || len(inserted) != len(kvIndices) {
+				b.Fatalf("commit blobs failed: inserted %d, err %v", len(inserted), err)
+			}
+			continue
+		}
+		for i, kvIdx := range kvIndices {
+			if err := s.CommitBlob(kvIdx, blobs[i], commits[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStorageManager_CommitBlob(b *testing.B)  { benchmarkCommitBlobs(b, false) }
+func BenchmarkStorageManager_CommitBlobs(b *testing.B) { benchmarkCommitBlobs(b, true) }
+
 func TestStorageManager_DownloadAllMeta(t *testing.T) {
 	setup(t)
 	err := storageManager.DownloadAllMetas(context.Background(), 4)
@@ -254,3 +315,119 @@ func TestStorageManager_DownloadAllMeta(t *testing.T) {
 		t.Fatal("failed to compare meta", err)
 	}
 }
+
+func TestStorageManager_Compact(t *testing.T) {
+	metafile, err := createMetaFile(metafileName, int64(kvEntries))
+	if err != nil {
+		t.Fatal("Create metafileName fail", err.Error())
+	}
+	defer func(file *os.File) {
+		file.Close()
+		os.Remove(file.Name())
+	}(metafile)
+	l1 := newMockL1Source(lastKvIndex, metafileName).(*mockL1Source)
+
+	shardManager, files := createEthStorage(contractAddress, []uint64{0},
+		131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	if shardManager == nil {
+		t.Fatalf("createEthStorage failed")
+	}
+	defer func(files []string) {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}(files)
+	sm := NewStorageManager(shardManager, l1)
+	sm.Reset(0)
+	df := shardManager.ShardMap()[0].dataFiles[0]
+	diskUsage := func() (int64, int64) {
+		info, err := os.Stat(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size(), info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	// the file is full
+	size, used := diskUsage()
+	if err := sm.Compact(df); err != nil {
+		t.Fatal(err)
+	}
+	if s, u := diskUsage(); s != size || u != used {
+		t.Fatalf("compact should be a no-op when the file is full")
+	}
+
+	// the last kv index shrinks to 4: kvs 0 ~ 3 and 10 have data, the others are filled with empty
+	l1.lastBlobIndex = 4
+	sm.Reset(1)
+	if _, _, err := sm.CommitEmptyBlobs(4, kvEntries-1); err != nil {
+		t.Fatal(err)
+	}
+	blobs := make(map[uint64][]byte)
+	for _, idx := range []uint64{0, 1, 2, 3, 10} {
+		blob, hash := createBlob(idx)
+		if _, err := shardManager.TryWrite(idx, blob, prepareCommit(hash)); err != nil {
+			t.Fatal(err)
+		}
+		blobs[idx] = blob
+	}
+
+	_, used = diskUsage()
+	if err := sm.Compact(df); err != nil {
+		t.Fatal(err)
+	}
+	s, u := diskUsage()
+	if s != size || df.KvIdxEnd() != kvEntries || !shardManager.ShardMap()[0].IsComplete() {
+		t.Fatalf("compact should keep the layout of the file, size %d, kvIdxEnd %d", s, df.KvIdxEnd())
+	}
+	if used-u < int64((kvEntries-11)*131072) {
+		t.Fatalf("disk usage %d should shrink from %d", u, used)
+	}
+	for idx := uint64(11); idx < kvEntries; idx++ {
+		if meta, _ := df.ReadMeta(idx); !bytes.Equal(meta, make([]byte, 32)) {
+			t.Fatalf("punched kv %d should not be filled, meta %x", idx, meta)
+		}
+	}
+
+	// the empty fill skips the punched kvs, which are kept in the header of the file
+	if inserted, next, err := sm.CommitEmptyBlobs(11, kvEntries-1); err != nil || inserted != kvEntries-11 || next != kvEntries {
+		t.Fatalf("failed to fill empty: inserted %d, next %d, err %v", inserted, next, err)
+	}
+	if _, u := diskUsage(); u > used-int64((kvEntries-11)*131072) {
+		t.Fatalf("empty fill should not take the punched space again, disk usage %d", u)
+	}
+	for idx := uint64(11); idx < kvEntries; idx++ {
+		if meta, _ := df.ReadMeta(idx); !bytes.Equal(meta, make([]byte, 32)) {
+			t.Fatalf("punched kv %d should not be filled, meta %x", idx, meta)
+		}
+	}
+	reopened, err := OpenDataFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.isPunched(11) || reopened.isPunched(10) {
+		t.Fatalf("punched tail should start at kv 11")
+	}
+	reopened.Close()
+
+	// the last kv index grows, so a punched kv is written again
+	blob, hash := createBlob(12)
+	if _, err := shardManager.TryWrite(12, blob, prepareCommit(hash)); err != nil {
+		t.Fatal(err)
+	}
+	blobs[12] = blob
+	for idx, blob := range blobs {
+		_, hash := createBlob(idx)
+		read, found, err := sm.TryRead(idx, len(blob), prepareCommit(hash))
+		if err != nil || !found {
+			t.Fatalf("failed to read blob %d: %v", idx, err)
+		}
+		if !bytes.Equal(read, blob) {
+			t.Fatalf("blob %d mismatch after compaction", idx)
+		}
+	}
+	meta, _, err := sm.TryReadMeta(5)
+	if err != nil || !isEmptyFilled(meta) {
+		t.Fatalf("kv 5 should stay filled with empty, meta %x, err %v", meta, err)
+	}
+}
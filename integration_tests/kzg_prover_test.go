@@ -88,11 +88,11 @@ func uploadBlob(t *testing.T, data []byte) common.Hash {
 	storageCost := new(big.Int).SetBytes(bs)
 	lg.Info("Get storage cost done", "storageCost", storageCost)
 
-	key, err := crypto.HexToECDSA(privateKey)
+	txSigner, err := utils.NewKeySigner(privateKey)
 	if err != nil {
 		t.Fatalf("Invalid private key: %s, err: %v", privateKey, err)
 	}
-	signer := crypto.PubkeyToAddress(key.PublicKey)
+	signer := txSigner.Address()
 	lg.Info("Get signer address", "signer", signer.Hex())
 	n, err := client.NonceAt(context.Background(), signer, big.NewInt(rpc.LatestBlockNumber.Int64()))
 	if err != nil {
@@ -129,10 +129,10 @@ func uploadBlob(t *testing.T, data []byte) common.Hash {
 	}
 	lg.Info("Estimated gas done", "gas", estimatedGas)
 
-	tx := utils.SendBlobTx(
+	tx, err := utils.SendBlobTx(
 		l1Endpoint,
 		kzgContract,
-		privateKey,
+		txSigner,
 		data,
 		true,
 		int64(n),
@@ -144,6 +144,9 @@ func uploadBlob(t *testing.T, data []byte) common.Hash {
 		chainID.String(),
 		"0x"+common.Bytes2Hex(calldata),
 	)
+	if err != nil {
+		lg.Crit("Send blob transaction failed", "error", err)
+	}
 	lg.Info("Blob transaction submitted", "hash", tx.Hash())
 	receipt, err := bind.WaitMined(context.Background(), client, tx)
 	if err != nil {
@@ -74,7 +74,7 @@ func TestMining(t *testing.T) {
 	feed := new(event.Feed)
 
 	l1api := miner.NewL1MiningAPI(pClient, lg)
-	pvr := prover.NewKZGPoseidonProver(miningConfig.ZKWorkingDir, miningConfig.ZKeyFileName, 2, lg)
+	pvr := prover.NewKZGPoseidonProver(miningConfig.ZKWorkingDir, miningConfig.ZKeyFileName, 2, prover.NewKZGProver(lg), lg)
 	mnr := miner.New(miningConfig, storageManager, l1api, &pvr, feed, lg)
 	lg.Info("Initialized miner")
 
@@ -261,6 +261,10 @@ func prepareData(t *testing.T, l1Client *eth.PollingClient, storageMgr *ethstora
 	if err != nil {
 		t.Fatalf("Get chain id failed %v", err)
 	}
+	txSigner, err := utils.NewKeySigner(privateKey)
+	if err != nil {
+		t.Fatalf("Invalid private key %v", err)
+	}
 	for i := 0; i < txs; i++ {
 		max := maxBlobsPerTx
 		if i == txs-1 {
@@ -274,7 +278,7 @@ func prepareData(t *testing.T, l1Client *eth.PollingClient, storageMgr *ethstora
 		if len(blobData) == 0 {
 			break
 		}
-		kvIdxes, dataHashes, err := utils.UploadBlobs(l1Client, l1Endpoint, privateKey, chainID.String(), storageMgr.ContractAddress(), blobData, false, value)
+		kvIdxes, dataHashes, err := utils.UploadBlobs(l1Client, l1Endpoint, txSigner, chainID.String(), storageMgr.ContractAddress(), blobData, false, value, 5000000, "300000000", nil)
 		if err != nil {
 			t.Fatalf("Upload blobs failed %v", err)
 		}